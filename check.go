@@ -0,0 +1,146 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrentzip
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/uwedeportivo/torrentzip/czip"
+)
+
+// IsTorrentzipped reports whether the zip file in r of the given size is a
+// valid torrentzip: its comment has to hold the CRC32 of its central
+// directory, and its entries have to carry the torrentzip header values and
+// be in torrentzip order. The compressed data itself is not checked.
+func IsTorrentzipped(r io.ReaderAt, size int64) (bool, error) {
+	return TorrentZip.Check(r, size)
+}
+
+// DetectProfile returns the profile the zip file in r of the given size
+// is valid for, nil if there is none.
+func DetectProfile(r io.ReaderAt, size int64) (*Profile, error) {
+	for _, p := range Profiles {
+		ok, err := p.Check(r, size)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// Check reports whether the zip file in r of the given size is valid for
+// p, the way IsTorrentzipped does for torrentzips.
+func (p *Profile) Check(r io.ReaderAt, size int64) (bool, error) {
+	zr, err := czip.NewReader(r, size)
+	if err != nil {
+		return false, err
+	}
+	if len(zr.Comment) != p.commentLen() || !strings.HasPrefix(zr.Comment, p.CommentPrefix) {
+		return false, nil
+	}
+	want, err := hex.DecodeString(zr.Comment[len(p.CommentPrefix):])
+	if err != nil || strings.ToUpper(zr.Comment) != zr.Comment {
+		return false, nil
+	}
+
+	offset, dirSize, err := centralDirectory(r, size, p.commentLen())
+	if err != nil {
+		return false, err
+	}
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, io.NewSectionReader(r, offset, dirSize)); err != nil {
+		return false, err
+	}
+	if binary.BigEndian.Uint32(want) != crc.Sum32() {
+		return false, nil
+	}
+
+	for i, fh := range zr.File {
+		if fh.Method != p.Method || fh.Flags != p.Flags || fh.ModifiedTime != p.ModifiedTime ||
+			fh.ModifiedDate != p.ModifiedDate || fh.CreatorVersion != creatorFAT ||
+			fh.ExternalAttrs != 0 || fh.Comment != "" || fh.Name != torrentCanonicalName(fh.Name) {
+			return false, nil
+		}
+		if i > 0 && strings.ToLower(zr.File[i-1].Name) > strings.ToLower(fh.Name) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// centralDirectory returns offset and size of the central directory of a
+// zip file ending in a comment of the given length.
+func centralDirectory(r io.ReaderAt, size int64, commentLen int) (int64, int64, error) {
+	endOffset := size - directoryEndLen - int64(commentLen)
+	if endOffset < 0 {
+		return 0, 0, czip.ErrFormat
+	}
+	var buf [directory64EndLen]byte
+	if _, err := r.ReadAt(buf[:directoryEndLen], endOffset); err != nil {
+		return 0, 0, err
+	}
+	if binary.LittleEndian.Uint32(buf[:4]) != directoryEndSignature {
+		return 0, 0, czip.ErrFormat
+	}
+	dirSize := int64(binary.LittleEndian.Uint32(buf[12:16]))
+	offset := int64(binary.LittleEndian.Uint32(buf[16:20]))
+	if dirSize != uint32max && offset != uint32max {
+		return offset, dirSize, nil
+	}
+
+	locOffset := endOffset - directory64LocLen
+	if locOffset < 0 {
+		return 0, 0, czip.ErrFormat
+	}
+	if _, err := r.ReadAt(buf[:directory64LocLen], locOffset); err != nil {
+		return 0, 0, err
+	}
+	if binary.LittleEndian.Uint32(buf[:4]) != directory64LocSignature {
+		return 0, 0, czip.ErrFormat
+	}
+	end64Offset := int64(binary.LittleEndian.Uint64(buf[8:16]))
+	if _, err := r.ReadAt(buf[:directory64EndLen], end64Offset); err != nil {
+		return 0, 0, err
+	}
+	if binary.LittleEndian.Uint32(buf[:4]) != directory64EndSignature {
+		return 0, 0, czip.ErrFormat
+	}
+	dirSize = int64(binary.LittleEndian.Uint64(buf[40:48]))
+	offset = int64(binary.LittleEndian.Uint64(buf[48:56]))
+	return offset, dirSize, nil
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrentzip
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip/czip"
+)
+
+func TestIsTorrentzipped(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*"+zipext))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := IsTorrentzipped(f, fi.Size())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Errorf("torrentzip %s was not reported as one", path)
+		}
+
+		zr, err := czip.NewReader(f, fi.Size())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var plain bytes.Buffer
+		zw := czip.NewWriter(&plain)
+		for _, fh := range zr.File {
+			cw, err := zw.Create(fh.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cr, err := fh.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = io.Copy(cw, cr)
+			cr.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		ok, err = IsTorrentzipped(bytes.NewReader(plain.Bytes()), int64(plain.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Errorf("plain zip of %s was reported as a torrentzip", path)
+		}
+
+		var buf bytes.Buffer
+		err = Rezip(&buf, zr, 0)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tz := buf.Bytes()
+		ok, err = IsTorrentzipped(bytes.NewReader(tz), int64(len(tz)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Errorf("torrentzip of %s was not reported as one", path)
+		}
+
+		// flip a bit in the name of the last entry in the central directory
+		tz[len(tz)-directoryEndLen-TorrentZip.commentLen()-1] ^= 1
+		ok, err = IsTorrentzipped(bytes.NewReader(tz), int64(len(tz)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Errorf("corrupted torrentzip of %s was reported as valid", path)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/uwedeportivo/torrentzip/dat"
+	"github.com/uwedeportivo/torrentzip/detector"
+	"github.com/uwedeportivo/torrentzip/scanner"
+)
+
+const (
+	versionStr = "1.0"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
+	fmt.Fprintf(os.Stderr, "\tUsage: %s <command> <args>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	fmt.Fprintf(os.Stderr, "\tverify [-json] [-hash] [-all] [-cache <file>] [-detector <file>] <datfile> <dir 1> ..... <dir n>\n")
+	fmt.Fprintf(os.Stderr, "\tdir2dat [-hash] [-out <datfile>] [-name <name>] [-description <text>] ... <dir>\n")
+	fmt.Fprintf(os.Stderr, "\tfixdat [-full] [-hash] [-cache <file>] [-detector <file>] [-out <datfile>] <datfile> <dir 1> ..... <dir n>\n")
+	fmt.Fprintf(os.Stderr, "\tconvert -to <xml, cmp or rc> [-out <datfile>] <datfile>\n")
+	fmt.Fprintf(os.Stderr, "\nFlag defaults:\n")
+	flag.PrintDefaults()
+}
+
+func readDat(path string) (*dat.Dat, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d, _, err := dat.Parse(f)
+	return d, err
+}
+
+func readDetector(path string) (*detector.Detector, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return detector.Parse(f)
+}
+
+// verifyDirs verifies the archives in dirs against the dat file at
+// datPath, loading and saving the scan cache at cachePath if set.
+func verifyDirs(datPath string, dirs []string, hash bool, cachePath, detPath string) (*dat.Dat, *dat.Report, error) {
+	d, err := readDat(datPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	det, err := readDetector(detPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading detector %s failed: %v", detPath, err)
+	}
+
+	s := &scanner.Scanner{HashEntries: hash, Detector: det}
+	if cachePath != "" {
+		s.Cache, err = scanner.LoadCache(cachePath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("loading cache %s failed: %v", cachePath, err)
+		}
+	}
+
+	report, err := dat.VerifyDir(d, s, dirs...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cachePath != "" {
+		if err := s.Cache.Save(cachePath); err != nil {
+			return nil, nil, fmt.Errorf("saving cache %s failed: %v", cachePath, err)
+		}
+	}
+	return d, report, nil
+}
+
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "write the report as json")
+	hash := fs.Bool("hash", false, "decompress entries to compare their md5 and sha1")
+	all := fs.Bool("all", false, "list complete sets too")
+	cachePath := fs.String("cache", "", "scan cache file")
+	detPath := fs.String("detector", "", "header detector file for roms with copier headers")
+	fs.Parse(args)
+
+	if fs.NArg() < 2 {
+		return fmt.Errorf("verify needs a dat file and at least one dir")
+	}
+
+	_, report, err := verifyDirs(fs.Arg(0), fs.Args()[1:], *hash, *cachePath, *detPath)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(os.Stdout)
+	if *jsonOut {
+		enc := json.NewEncoder(bw)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = writeReport(bw, report, *all)
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func fixdat(args []string) error {
+	fs := flag.NewFlagSet("fixdat", flag.ExitOnError)
+	full := fs.Bool("full", false, "list partially complete sets with all their roms")
+	hash := fs.Bool("hash", false, "decompress entries to compare their md5 and sha1")
+	cachePath := fs.String("cache", "", "scan cache file")
+	detPath := fs.String("detector", "", "header detector file for roms with copier headers")
+	out := fs.String("out", "", "fixdat file to write, defaults to stdout")
+	fs.Parse(args)
+
+	if fs.NArg() < 2 {
+		return fmt.Errorf("fixdat needs a dat file and at least one dir")
+	}
+
+	d, report, err := verifyDirs(fs.Arg(0), fs.Args()[1:], *hash, *cachePath, *detPath)
+	if err != nil {
+		return err
+	}
+	fd := dat.Fixdat(d, report, *full)
+
+	if *out == "" {
+		return dat.WriteXML(os.Stdout, fd)
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := dat.WriteXML(file, fd); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "wrote %d incomplete sets to %s\n", len(fd.Games), *out)
+	return file.Close()
+}
+
+func writeRom(w io.Writer, rom *dat.Rom) {
+	fmt.Fprintf(w, "size=%d", rom.Size)
+	if rom.CRC != nil {
+		fmt.Fprintf(w, " crc=%s", rom.CRC)
+	}
+	if rom.MD5 != nil {
+		fmt.Fprintf(w, " md5=%s", rom.MD5)
+	}
+	if rom.SHA1 != nil {
+		fmt.Fprintf(w, " sha1=%s", rom.SHA1)
+	}
+}
+
+func writeReport(w io.Writer, report *dat.Report, all bool) error {
+	for _, s := range report.Sets {
+		problem := s.Status != dat.SetComplete || len(s.Unneeded) > 0 || !s.Torrentzipped
+		if !problem && !all {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s: %s", s.Name, s.Status)
+		if s.Archive != "" {
+			if s.Torrentzipped {
+				fmt.Fprintf(w, ", torrentzipped")
+			} else {
+				fmt.Fprintf(w, ", not torrentzipped")
+			}
+			fmt.Fprintf(w, " (%s)", s.Archive)
+		}
+		fmt.Fprintf(w, "\n")
+
+		if s.Archive == "" {
+			continue
+		}
+		for _, rom := range s.Missing {
+			fmt.Fprintf(w, "\tmissing %s\n", rom.Name)
+		}
+		for _, m := range s.WrongHash {
+			fmt.Fprintf(w, "\twrong hash %s: want ", m.Rom.Name)
+			writeRom(w, m.Rom)
+			fmt.Fprintf(w, ", found ")
+			writeRom(w, m.Found)
+			fmt.Fprintf(w, "\n")
+		}
+		for _, rom := range s.Unneeded {
+			fmt.Fprintf(w, "\tunneeded %s\n", rom.Name)
+		}
+	}
+
+	for _, path := range report.Unknown {
+		fmt.Fprintf(w, "unknown archive %s\n", path)
+	}
+	failed := make([]string, 0, len(report.Failed))
+	for path := range report.Failed {
+		failed = append(failed, path)
+	}
+	sort.Strings(failed)
+	for _, path := range failed {
+		fmt.Fprintf(w, "failed to read %s: %s\n", path, report.Failed[path])
+	}
+
+	complete, partial, missing := report.Count()
+	_, err := fmt.Fprintf(w, "%d sets: %d complete, %d partial, %d missing, %d unknown archives\n",
+		len(report.Sets), complete, partial, missing, len(report.Unknown))
+	return err
+}
+
+func dir2dat(args []string) error {
+	fs := flag.NewFlagSet("dir2dat", flag.ExitOnError)
+	hash := fs.Bool("hash", false, "decompress entries to compute their md5 and sha1")
+	out := fs.String("out", "", "dat file to write, defaults to stdout")
+
+	var h dat.Header
+	fs.StringVar(&h.Name, "name", "", "header name")
+	fs.StringVar(&h.Description, "description", "", "header description")
+	fs.StringVar(&h.Category, "category", "", "header category")
+	fs.StringVar(&h.Version, "version", "", "header version")
+	fs.StringVar(&h.Date, "date", "", "header date")
+	fs.StringVar(&h.Author, "author", "", "header author")
+	fs.StringVar(&h.Email, "email", "", "header email")
+	fs.StringVar(&h.Homepage, "homepage", "", "header homepage")
+	fs.StringVar(&h.URL, "url", "", "header url")
+	fs.StringVar(&h.Comment, "comment", "", "header comment")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("dir2dat needs exactly one dir")
+	}
+	if h.Name == "" {
+		h.Name = filepath.Base(fs.Arg(0))
+	}
+	if h.Description == "" {
+		h.Description = h.Name
+	}
+
+	d, err := dat.FromDir(fs.Arg(0), h, *hash)
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		return dat.WriteXML(os.Stdout, d)
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := dat.WriteXML(file, d); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "wrote %d games to %s\n", len(d.Games), *out)
+	return file.Close()
+}
+
+func convert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	to := fs.String("to", "", "format to convert to: xml (Logiqx), cmp (ClrMamePro) or rc (RomCenter)")
+	out := fs.String("out", "", "dat file to write, defaults to stdout")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("convert needs exactly one dat file")
+	}
+	f, err := dat.ParseFormat(*to)
+	if err != nil {
+		return err
+	}
+
+	d, err := readDat(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if f == dat.RomCenter {
+		for _, field := range dat.RomCenterLosses(d) {
+			fmt.Fprintf(os.Stderr, "warning: romcenter dats can't hold %s, dropping it\n", field)
+		}
+	}
+
+	if *out == "" {
+		return dat.Write(os.Stdout, d, f)
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := dat.Write(file, d, f); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func main() {
+	flag.Usage = usage
+
+	help := flag.Bool("help", false, "show this message")
+	version := flag.Bool("version", false, "show version")
+
+	flag.Parse()
+
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	if *version {
+		fmt.Fprintf(os.Stdout, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
+		os.Exit(0)
+	}
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	var err error
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "verify":
+		err = verify(args)
+	case "dir2dat":
+		err = dir2dat(args)
+	case "fixdat":
+		err = fixdat(args)
+	case "convert":
+		err = convert(args)
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
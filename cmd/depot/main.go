@@ -0,0 +1,339 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/uwedeportivo/torrentzip/depot"
+)
+
+const (
+	versionStr = "1.0"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
+	fmt.Fprintf(os.Stderr, "\tUsage: %s -root <dir>[=<maxsize>] ... <command> <args>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	fmt.Fprintf(os.Stderr, "\tingest <file, zip or dir 1> ..... <file, zip or dir n>\n")
+	fmt.Fprintf(os.Stderr, "\tlookup <sha1, md5 or crc 1> ..... <sha1, md5 or crc n>\n")
+	fmt.Fprintf(os.Stderr, "\tverify\n")
+	fmt.Fprintf(os.Stderr, "\texport <zipfile> <manifest with lines of sha1 and name>\n")
+	fmt.Fprintf(os.Stderr, "\nFlag defaults:\n")
+	flag.PrintDefaults()
+}
+
+type rootsFlag []*depot.Root
+
+func (rf *rootsFlag) String() string {
+	var ss []string
+	for _, r := range *rf {
+		ss = append(ss, r.Path)
+	}
+	return strings.Join(ss, ",")
+}
+
+func (rf *rootsFlag) Set(value string) error {
+	r := &depot.Root{Path: value}
+	if i := strings.LastIndex(value, "="); i != -1 {
+		size, err := parseSize(value[i+1:])
+		if err != nil {
+			return err
+		}
+		r.Path = value[:i]
+		r.MaxSize = size
+	}
+	*rf = append(*rf, r)
+	return nil
+}
+
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	case strings.HasSuffix(s, "T"):
+		mult = 1 << 40
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %s: %v", s, err)
+	}
+	return n * mult, nil
+}
+
+func isZip(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var buf [4]byte
+	if _, err := f.Read(buf[:]); err != nil {
+		return false, nil
+	}
+	return binary.LittleEndian.Uint32(buf[:]) == 0x04034b50, nil
+}
+
+type ingestVisitor struct {
+	d       *depot.Depot
+	added   int
+	skipped int
+}
+
+func (iv *ingestVisitor) visit(path string, f os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
+	if f.IsDir() {
+		return nil
+	}
+
+	zip, err := isZip(path)
+	if err != nil {
+		return err
+	}
+
+	if zip {
+		added, skipped, err := iv.d.IngestZip(path)
+		if err != nil {
+			return err
+		}
+		iv.added += added
+		iv.skipped += skipped
+		return nil
+	}
+
+	_, added, err := iv.d.IngestFile(path)
+	if err != nil {
+		return err
+	}
+	if added {
+		iv.added++
+	} else {
+		iv.skipped++
+	}
+	return nil
+}
+
+func ingest(d *depot.Depot, args []string) error {
+	iv := &ingestVisitor{d: d}
+	for _, name := range args {
+		err := filepath.Walk(name, iv.visit)
+		if err != nil {
+			return fmt.Errorf("ingesting %s failed: %v", name, err)
+		}
+	}
+	fmt.Fprintf(os.Stdout, "added %d files, skipped %d files already in the depot\n", iv.added, iv.skipped)
+	return nil
+}
+
+func lookup(d *depot.Depot, args []string) error {
+	for _, arg := range args {
+		h, err := hex.DecodeString(arg)
+		if err != nil {
+			return fmt.Errorf("invalid hash %s: %v", arg, err)
+		}
+
+		var es []*depot.Entry
+		switch len(h) {
+		case 20:
+			e, err := d.LookupSHA1(h)
+			if err != nil {
+				return err
+			}
+			if e != nil {
+				es = append(es, e)
+			}
+		case 16:
+			es, err = d.LookupMD5(h)
+		case 4:
+			es, err = d.LookupCRC(binary.BigEndian.Uint32(h))
+		default:
+			return fmt.Errorf("hash %s is neither a sha1, md5 nor crc", arg)
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(es) == 0 {
+			fmt.Fprintf(os.Stdout, "%s: not found\n", arg)
+		}
+		for _, e := range es {
+			fmt.Fprintf(os.Stdout, "%s: sha1=%x md5=%x crc=%08x size=%d path=%s\n",
+				arg, e.SHA1, e.MD5, e.CRC32, e.Size, e.Path)
+		}
+	}
+	return nil
+}
+
+func verify(d *depot.Depot) error {
+	var numFiles, numBad int
+	err := d.Verify(func(path string, problem error) error {
+		numFiles++
+		if problem != nil {
+			numBad++
+			fmt.Fprintf(os.Stdout, "%s: %v\n", path, problem)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "verified %d files, %d bad\n", numFiles, numBad)
+	return nil
+}
+
+func export(d *depot.Depot, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("export needs a zip file and a manifest")
+	}
+
+	mf, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer mf.Close()
+
+	var files []depot.ExportFile
+	scanner := bufio.NewScanner(mf)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid manifest line: %s", line)
+		}
+		h, err := hex.DecodeString(fields[0])
+		if err != nil || len(h) != 20 {
+			return fmt.Errorf("invalid sha1 in manifest line: %s", line)
+		}
+		files = append(files, depot.ExportFile{
+			Name: strings.TrimSpace(fields[1]),
+			SHA1: h,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	file, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+
+	bf := bufio.NewWriter(file)
+	err = d.Export(bf, files)
+	if err == nil {
+		err = bf.Flush()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(args[0])
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "finished creating zip file: %s\n", args[0])
+	return nil
+}
+
+func main() {
+	flag.Usage = usage
+
+	help := flag.Bool("help", false, "show this message")
+	version := flag.Bool("version", false, "show version")
+
+	var roots rootsFlag
+	flag.Var(&roots, "root", "depot root dir with optional size limit, e.g. /depot=500G (repeatable)")
+
+	flag.Parse()
+
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	if *version {
+		fmt.Fprintf(os.Stdout, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
+		os.Exit(0)
+	}
+
+	if len(roots) == 0 || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	d, err := depot.Open(roots...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "opening depot failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "ingest":
+		err = ingest(d, args)
+	case "lookup":
+		err = lookup(d, args)
+	case "verify":
+		err = verify(d)
+	case "export":
+		err = export(d, args)
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
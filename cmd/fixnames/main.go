@@ -0,0 +1,148 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/uwedeportivo/torrentzip/dat"
+	"github.com/uwedeportivo/torrentzip/fixnames"
+)
+
+const (
+	versionStr = "1.0"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
+	fmt.Fprintf(os.Stderr, "\tUsage: %s -dat <datfile> [-hash] [-drop] <zip or dir 1> ..... <zip or dir n>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\nFlag defaults:\n")
+	flag.PrintDefaults()
+}
+
+func report(r *fixnames.Result) {
+	switch {
+	case r.Game == "":
+		fmt.Fprintf(os.Stdout, "%s: no matching game\n", r.Path)
+		return
+	case r.Unchanged:
+		return
+	case r.NewPath != r.Path:
+		fmt.Fprintf(os.Stdout, "%s: renamed to %s\n", r.Path, r.NewPath)
+	default:
+		fmt.Fprintf(os.Stdout, "%s: rewritten\n", r.Path)
+	}
+	for _, rn := range r.Renamed {
+		fmt.Fprintf(os.Stdout, "\t%s -> %s\n", rn.From, rn.To)
+	}
+	for _, name := range r.Dropped {
+		fmt.Fprintf(os.Stdout, "\tdropped %s\n", name)
+	}
+	for _, rom := range r.Missing {
+		fmt.Fprintf(os.Stdout, "\tmissing %s\n", rom.Name)
+	}
+}
+
+func main() {
+	flag.Usage = usage
+
+	help := flag.Bool("help", false, "show this message")
+	version := flag.Bool("version", false, "show version")
+
+	datPath := flag.String("dat", "", "dat file describing the sets")
+	hash := flag.Bool("hash", false, "decompress entries to match them by sha1 and md5 too")
+	drop := flag.Bool("drop", false, "drop entries that match no rom")
+	tempDir := flag.String("temp", "", "dir for temporary files")
+
+	flag.Parse()
+
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	if *version {
+		fmt.Fprintf(os.Stdout, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
+		os.Exit(0)
+	}
+
+	if *datPath == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	df, err := os.Open(*datPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "opening dat %s failed: %v\n", *datPath, err)
+		os.Exit(1)
+	}
+	d, _, err := dat.Parse(df)
+	df.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reading dat %s failed: %v\n", *datPath, err)
+		os.Exit(1)
+	}
+
+	fx := &fixnames.Fixer{
+		Dat:          d,
+		HashEntries:  *hash,
+		DropUnneeded: *drop,
+		TempDir:      *tempDir,
+	}
+
+	for _, name := range flag.Args() {
+		fi, err := os.Stat(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+
+		var results []*fixnames.Result
+		if fi.IsDir() {
+			results, err = fx.FixDir(name)
+		} else {
+			var r *fixnames.Result
+			r, err = fx.Fix(name)
+			if r != nil {
+				results = append(results, r)
+			}
+		}
+		for _, r := range results {
+			report(r)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fixing names in %s failed: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/uwedeportivo/torrentzip/dat"
+	"github.com/uwedeportivo/torrentzip/layout"
+)
+
+const (
+	versionStr = "1.0"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
+	fmt.Fprintf(os.Stderr, "\tUsage: %s -dat <datfile> -mode <split, merged or nonmerged> [-out <dir>] [-backup <dir>] <dir>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\nFlag defaults:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+
+	help := flag.Bool("help", false, "show this message")
+	version := flag.Bool("version", false, "show version")
+
+	datPath := flag.String("dat", "", "dat file describing the sets")
+	modeStr := flag.String("mode", "", "layout to convert to: split, merged or nonmerged")
+	outDir := flag.String("out", "", "dir to write the sets to, defaults to converting in place")
+	tempDir := flag.String("temp", "", "dir for temporary files")
+	backupDir := flag.String("backup", "", "dir to move archives with entries matching no rom to (default <out>/backup)")
+
+	flag.Parse()
+
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	if *version {
+		fmt.Fprintf(os.Stdout, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
+		os.Exit(0)
+	}
+
+	if *datPath == "" || *modeStr == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	mode, err := layout.ParseMode(*modeStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	df, err := os.Open(*datPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "opening dat %s failed: %v\n", *datPath, err)
+		os.Exit(1)
+	}
+	d, _, err := dat.Parse(df)
+	df.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reading dat %s failed: %v\n", *datPath, err)
+		os.Exit(1)
+	}
+
+	inDir := flag.Arg(0)
+	if *outDir == "" {
+		*outDir = inDir
+	}
+
+	c := &layout.Converter{Dat: d, Mode: mode, TempDir: *tempDir, BackupDir: *backupDir}
+	report, err := c.Convert(inDir, *outDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "converting to %v failed: %v\n", mode, err)
+		os.Exit(1)
+	}
+
+	partial := 0
+	for _, s := range report.Sets {
+		if len(s.Missing) > 0 {
+			partial++
+			fmt.Fprintf(os.Stdout, "%s: %d roms missing\n", s.Name, len(s.Missing))
+		}
+		for _, name := range s.Kept {
+			fmt.Fprintf(os.Stdout, "%s: kept unknown entry %s\n", s.Name, name)
+		}
+		if s.Backup != "" {
+			fmt.Fprintf(os.Stdout, "%s: moved old archive to %s\n", s.Name, s.Backup)
+		}
+	}
+	for _, path := range report.Removed {
+		fmt.Fprintf(os.Stdout, "removed %s\n", path)
+	}
+	for _, path := range report.Backups {
+		fmt.Fprintf(os.Stdout, "moved removed archive to %s\n", path)
+	}
+	fmt.Fprintf(os.Stdout, "wrote %d %v sets, %d of them partial\n", len(report.Sets), mode, partial)
+}
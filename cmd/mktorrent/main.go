@@ -0,0 +1,140 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/uwedeportivo/torrentzip/torrent"
+)
+
+const (
+	versionStr = "1.0"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
+	fmt.Fprintf(os.Stderr, "\tUsage: %s [-v2 | -hybrid] [-piece <bytes>] [-tracker <url,...>] [-comment <text>] [-out <file>] <file or dir>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\nFlag defaults:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+
+	help := flag.Bool("help", false, "show this message")
+	version := flag.Bool("version", false, "show version")
+
+	outPath := flag.String("out", "", "torrent file to write, defaults to the name of the input with .torrent appended")
+	v2 := flag.Bool("v2", false, "create a v2 only torrent")
+	hybrid := flag.Bool("hybrid", false, "create a hybrid v1 and v2 torrent")
+	pieceLength := flag.Int64("piece", 0, "piece length in bytes, a power of two from 16384 to 268435456, 0 picks one from the total size")
+	trackers := flag.String("tracker", "", "comma separated list of tracker announce urls")
+	comment := flag.String("comment", "", "comment")
+	private := flag.Bool("private", false, "set the private flag")
+	date := flag.Bool("date", false, "include the creation date, which makes the output differ between runs")
+	workers := flag.Int("workers", 0, "number of goroutines hashing pieces, 0 uses all cpus")
+
+	flag.Parse()
+
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	if *version {
+		fmt.Fprintf(os.Stdout, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
+		os.Exit(0)
+	}
+
+	if flag.NArg() != 1 || (*v2 && *hybrid) {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	opts := &torrent.Options{
+		PieceLength: *pieceLength,
+		Comment:     *comment,
+		CreatedBy:   fmt.Sprintf("torrentzip mktorrent %s", versionStr),
+		Private:     *private,
+		Workers:     *workers,
+	}
+	switch {
+	case *v2:
+		opts.Version = torrent.V2
+	case *hybrid:
+		opts.Version = torrent.Hybrid
+	}
+	if *trackers != "" {
+		opts.Trackers = strings.Split(*trackers, ",")
+	}
+	if *date {
+		opts.CreationDate = time.Now().Unix()
+	}
+
+	in := flag.Arg(0)
+	t, err := torrent.Create(in, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "creating torrent for %s failed: %v\n", in, err)
+		os.Exit(1)
+	}
+
+	out := *outPath
+	if out == "" {
+		out = filepath.Base(filepath.Clean(in)) + ".torrent"
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "creating %s failed: %v\n", out, err)
+		os.Exit(1)
+	}
+	err = t.Write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "writing %s failed: %v\n", out, err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stdout, "wrote %s: %d files, piece length %d\n", out, len(t.Files), t.PieceLength)
+	if t.InfoHashV1 != nil {
+		fmt.Fprintf(os.Stdout, "info hash v1 %x\n", t.InfoHashV1)
+	}
+	if t.InfoHashV2 != nil {
+		fmt.Fprintf(os.Stdout, "info hash v2 %x\n", t.InfoHashV2)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/uwedeportivo/torrentzip/dat"
+	"github.com/uwedeportivo/torrentzip/detector"
+	"github.com/uwedeportivo/torrentzip/rebuild"
+)
+
+const (
+	versionStr = "1.0"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
+	fmt.Fprintf(os.Stderr, "\tUsage: %s -dat <datfile> -out <dir> [-move] [-backup <dir>] [-detector <file>] <file or dir 1> ..... <file or dir n>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\nFlag defaults:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+
+	help := flag.Bool("help", false, "show this message")
+	version := flag.Bool("version", false, "show version")
+
+	datPath := flag.String("dat", "", "dat file describing the sets")
+	outDir := flag.String("out", "", "dir to write the sets to")
+	move := flag.Bool("move", false, "remove sources once they are rebuilt")
+	tempDir := flag.String("temp", "", "dir for temporary files")
+	backupDir := flag.String("backup", "", "dir to move archives with unknown entries named like roms to (default <out>/backup)")
+	listUnused := flag.Bool("unused", false, "list unused sources")
+	detPath := flag.String("detector", "", "header detector file for roms with copier headers")
+
+	flag.Parse()
+
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	if *version {
+		fmt.Fprintf(os.Stdout, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
+		os.Exit(0)
+	}
+
+	if *datPath == "" || *outDir == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	df, err := os.Open(*datPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "opening dat %s failed: %v\n", *datPath, err)
+		os.Exit(1)
+	}
+	d, _, err := dat.Parse(df)
+	df.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reading dat %s failed: %v\n", *datPath, err)
+		os.Exit(1)
+	}
+
+	rb := &rebuild.Rebuilder{
+		Dat:       d,
+		OutDir:    *outDir,
+		Move:      *move,
+		TempDir:   *tempDir,
+		BackupDir: *backupDir,
+	}
+	if *detPath != "" {
+		f, err := os.Open(*detPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "opening detector %s failed: %v\n", *detPath, err)
+			os.Exit(1)
+		}
+		rb.Detector, err = detector.Parse(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading detector %s failed: %v\n", *detPath, err)
+			os.Exit(1)
+		}
+	}
+	report, err := rb.Rebuild(flag.Args()...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rebuild failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	var complete, partial, unchanged int
+	for _, s := range report.Sets {
+		switch {
+		case s.Unchanged:
+			unchanged++
+		case s.Status == dat.SetComplete:
+			complete++
+			fmt.Fprintf(os.Stdout, "%s: complete\n", s.Name)
+		default:
+			partial++
+			fmt.Fprintf(os.Stdout, "%s: partial, %d roms missing\n", s.Name, len(s.Missing))
+		}
+		if s.Unchanged {
+			continue
+		}
+		for _, name := range s.Kept {
+			fmt.Fprintf(os.Stdout, "%s: kept unknown entry %s\n", s.Name, name)
+		}
+		if s.Backup != "" {
+			fmt.Fprintf(os.Stdout, "%s: moved old archive to %s\n", s.Name, s.Backup)
+		}
+	}
+	if *listUnused {
+		for _, s := range report.Unused {
+			fmt.Fprintf(os.Stdout, "unused %s\n", s)
+		}
+	}
+	for _, path := range report.Removed {
+		fmt.Fprintf(os.Stdout, "removed %s\n", path)
+	}
+	fmt.Fprintf(os.Stdout, "rebuilt %d complete and %d partial sets, %d sets unchanged, %d sources unused\n",
+		complete, partial, unchanged, len(report.Unused))
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/uwedeportivo/torrentzip/dat"
+	"github.com/uwedeportivo/torrentzip/torrent"
+)
+
+const (
+	versionStr = "1.0"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
+	fmt.Fprintf(os.Stderr, "\tUsage: %s [-repair [-dat <datfile>] [-sources <dir,...>]] <torrent file> <dir>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\nFlag defaults:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+
+	help := flag.Bool("help", false, "show this message")
+	version := flag.Bool("version", false, "show version")
+
+	repair := flag.Bool("repair", false, "torrentzip or rebuild failing archives and check them again")
+	datPath := flag.String("dat", "", "dat file used to rebuild sets that rezipping doesn't fix")
+	sources := flag.String("sources", "", "comma separated list of files and dirs to rebuild sets from")
+	depth := flag.Int("depth", 0, "torrentzip nested zip archives up to this depth when rezipping")
+	tempDir := flag.String("temp", "", "dir for temporary files")
+	workers := flag.Int("workers", runtime.GOMAXPROCS(0), "number of goroutines hashing pieces")
+
+	flag.Parse()
+
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	if *version {
+		fmt.Fprintf(os.Stdout, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
+		os.Exit(0)
+	}
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	tpath, dir := flag.Arg(0), flag.Arg(1)
+	f, err := os.Open(tpath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "opening torrent %s failed: %v\n", tpath, err)
+		os.Exit(1)
+	}
+	t, err := torrent.Load(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reading torrent %s failed: %v\n", tpath, err)
+		os.Exit(1)
+	}
+
+	report, err := t.Verify(dir, *workers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "checking %s failed: %v\n", dir, err)
+		os.Exit(1)
+	}
+	for _, fr := range report.Files {
+		switch {
+		case fr.Missing:
+			fmt.Fprintf(os.Stdout, "%s: missing\n", fr.Path)
+		case fr.Size != fr.File.Length:
+			fmt.Fprintf(os.Stdout, "%s: size %d, want %d, %d failing pieces\n", fr.Path, fr.Size, fr.File.Length, len(fr.Bad))
+		default:
+			fmt.Fprintf(os.Stdout, "%s: %d failing pieces\n", fr.Path, len(fr.Bad))
+		}
+	}
+	fmt.Fprintf(os.Stdout, "%d of %d pieces failed, %d files affected\n", len(report.Bad), report.Pieces, len(report.Files))
+
+	if !*repair || len(report.Files) == 0 {
+		if len(report.Files) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	rp := &torrent.Repairer{
+		Torrent:     t,
+		Dir:         dir,
+		NestedDepth: *depth,
+		TempDir:     *tempDir,
+		Workers:     *workers,
+	}
+	if *datPath != "" {
+		df, err := os.Open(*datPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "opening dat %s failed: %v\n", *datPath, err)
+			os.Exit(1)
+		}
+		rp.Dat, _, err = dat.Parse(df)
+		df.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading dat %s failed: %v\n", *datPath, err)
+			os.Exit(1)
+		}
+	}
+	if *sources != "" {
+		rp.Sources = strings.Split(*sources, ",")
+	}
+
+	fixed := 0
+	for _, res := range rp.Repair(report) {
+		switch {
+		case res.Fixed:
+			fixed++
+			fmt.Fprintf(os.Stdout, "%s: fixed by %s\n", res.Path, res.Method)
+		case res.Err != nil:
+			fmt.Fprintf(os.Stdout, "%s: not fixed: %v\n", res.Path, res.Err)
+		default:
+			fmt.Fprintf(os.Stdout, "%s: not fixed\n", res.Path)
+		}
+	}
+	fmt.Fprintf(os.Stdout, "fixed %d of %d files\n", fixed, len(report.Files))
+	if fixed < len(report.Files) {
+		os.Exit(1)
+	}
+}
@@ -31,11 +31,16 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
+	"github.com/uwedeportivo/torrentzip"
 	"github.com/uwedeportivo/torrentzip/czip"
 )
 
@@ -46,7 +51,7 @@ const (
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
-	fmt.Fprintf(os.Stderr, "\tUsage: %s <zipfile>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\tUsage: %s [-gz <dir>] <zipfile>\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "\nFlag defaults:\n")
 	flag.PrintDefaults()
 }
@@ -91,12 +96,89 @@ func unzip(path string) error {
 	return nil
 }
 
+// unzipGzip writes every entry of the zip file zippath into dir as a gzip
+// file, copying the deflate streams without recompressing them.
+func unzipGzip(zippath string, dir string, storeName bool) error {
+	r, err := czip.OpenReader(zippath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, fh := range r.File {
+		name, err := entryPath(dir, fh.Name)
+		if err != nil {
+			return err
+		}
+
+		if strings.HasSuffix(fh.Name, "/") {
+			err = os.MkdirAll(name, 0777)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = os.MkdirAll(filepath.Dir(name), 0777)
+		if err != nil {
+			return err
+		}
+
+		h := &torrentzip.GzipHeader{
+			XFL: 2,
+			OS:  255,
+		}
+		if storeName {
+			h.Name = path.Base(fh.Name)
+		}
+
+		err = writeGzip(name+".gz", fh, h)
+		if err != nil {
+			fmt.Printf("error writing gzip for %s: %v\n", fh.Name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func writeGzip(name string, fh *czip.File, h *torrentzip.GzipHeader) error {
+	w, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	bw := bufio.NewWriter(w)
+	err = torrentzip.ExtractGzip(bw, fh, h)
+	if err != nil {
+		return err
+	}
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// entryPath returns the path in dir for the zip entry name, refusing
+// names that would end up outside of dir.
+func entryPath(dir string, name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return "", fmt.Errorf("invalid entry name %q", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean[1:])), nil
+}
+
 func main() {
 	flag.Usage = usage
 
 	help := flag.Bool("help", false, "show this message")
 	version := flag.Bool("version", false, "show version")
 
+	gzdir := flag.String("gz", "", "dir into which entries are written as gzip files")
+	gzname := flag.Bool("gzname", false, "store the entry name in the gzip header")
+
 	flag.Parse()
 
 	if *help {
@@ -111,7 +193,12 @@ func main() {
 
 	path := flag.Arg(0)
 
-	err := unzip(path)
+	var err error
+	if *gzdir != "" {
+		err = unzipGzip(path, *gzdir, *gzname)
+	} else {
+		err = unzip(path)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to unzip %s: %v\n", path, err)
 		os.Exit(1)
@@ -31,8 +31,10 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package main
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
+	"compress/bzip2"
 	"crypto/sha1"
 	"encoding/hex"
 	"flag"
@@ -40,10 +42,13 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
 	"github.com/uwedeportivo/torrentzip"
+	"github.com/uwedeportivo/torrentzip/cgzip"
+	"github.com/uwedeportivo/torrentzip/sevenzip"
 )
 
 const (
@@ -52,7 +57,8 @@ const (
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
-	fmt.Fprintf(os.Stderr, "\tUsage: %s -out <zipfile> <file or dir 1> <file or dir 2> ..... <file or dir n>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\tUsage: %s [-format torrentzip|rvzstd] [-unpack [-skipspecial]] -out <zipfile> <file or dir 1> <file or dir 2> ..... <file or dir n>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\t       %s -check <zipfile 1> ..... <zipfile n>\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "\nFlag defaults:\n")
 	flag.PrintDefaults()
 }
@@ -135,6 +141,312 @@ func (av *adderVisitor) visit(path string, f os.FileInfo, err error) error {
 	return nil
 }
 
+// unpacker adds the files of archives to a zip file. Empty directories
+// are added the same way as those on disk, once all archives are read.
+type unpacker struct {
+	zw          *torrentzip.Writer
+	skipSpecial bool
+
+	// dirs holds the directories of the archives, parents every
+	// directory some name added lies in.
+	dirs    map[string]bool
+	parents map[string]bool
+}
+
+var tarExts = []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tbz"}
+
+// isArchive reports whether name is an archive the unpacker reads, "-"
+// stands for a tar stream on stdin.
+func isArchive(name string) bool {
+	return name == "-" || hasExt(name, ".7z") || hasExt(name, ".gz") || tarExt(name)
+}
+
+func hasExt(name, ext string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ext)
+}
+
+func tarExt(name string) bool {
+	for _, ext := range tarExts {
+		if hasExt(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *unpacker) add(name string) error {
+	switch {
+	case name == "-":
+		return u.addTar(os.Stdin)
+	case hasExt(name, ".7z"):
+		return u.add7z(name)
+	case tarExt(name):
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return u.addTar(f)
+	default:
+		return u.addGzip(name)
+	}
+}
+
+func (u *unpacker) addFile(name string, r io.Reader) error {
+	name, err := entryName(name)
+	if err != nil || name == "" {
+		return err
+	}
+	u.addParents(name)
+
+	fh, err := u.zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fh, r)
+	if err != nil {
+		return fmt.Errorf("extracting %s failed: %v", name, err)
+	}
+	return nil
+}
+
+func (u *unpacker) addDir(name string) error {
+	name, err := entryName(name)
+	if err != nil || name == "" {
+		return err
+	}
+	u.addParents(name)
+	if u.dirs == nil {
+		u.dirs = make(map[string]bool)
+	}
+	u.dirs[name] = true
+	return nil
+}
+
+func (u *unpacker) addParents(name string) {
+	if u.parents == nil {
+		u.parents = make(map[string]bool)
+	}
+	for dir := path.Dir(name); dir != "." && !u.parents[dir]; dir = path.Dir(dir) {
+		u.parents[dir] = true
+	}
+}
+
+// close adds the dirs no other name lies in.
+func (u *unpacker) close() error {
+	for dir := range u.dirs {
+		if u.parents[dir] {
+			continue
+		}
+		if _, err := u.zw.Create(dir + "/"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *unpacker) add7z(path string) error {
+	zr, err := sevenzip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if f.IsDir() {
+			err = u.addDir(f.Name)
+		} else {
+			var cf io.ReadCloser
+			cf, err = f.Open()
+			if err != nil {
+				return err
+			}
+			err = u.addFile(f.Name, cf)
+			cf.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTar adds the regular files and directories of the tar stream in r,
+// which may be compressed with gzip or bzip2. As when extracting with
+// tar, a file replaces an earlier one of the same name and a hard link
+// gets the content its target has at that point. Symbolic links, device
+// files and fifos have no place in a zip file, they are an error unless
+// skipSpecial is set.
+func (u *unpacker) addTar(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(3)
+
+	var tr io.Reader = br
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gr, err := cgzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		tr = gr
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		tr = bzip2.NewReader(br)
+	}
+
+	// files are only added once the whole stream is read, until then
+	// their content is kept in dir
+	dir, err := ioutil.TempDir("", "torrentzip-unpack")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	files := make(map[string]string)
+
+	t := tar.NewReader(tr)
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeCont, tar.TypeGNUSparse:
+			err = spoolTarFile(files, dir, hdr.Name, t)
+		case tar.TypeLink:
+			err = linkTarFile(files, hdr.Name, hdr.Linkname)
+		case tar.TypeDir:
+			err = u.addDir(hdr.Name)
+		case tar.TypeXGlobalHeader:
+		default:
+			if !u.skipSpecial {
+				return fmt.Errorf("%s is a link or special file", hdr.Name)
+			}
+			fmt.Fprintf(os.Stderr, "skipping link or special file %s\n", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, p := range files {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		err = u.addFile(name, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spoolTarFile copies the content of the tar entry name from r to a new
+// file in dir, which replaces what files had for name.
+func spoolTarFile(files map[string]string, dir, name string, r io.Reader) error {
+	name, err := entryName(name)
+	if err != nil || name == "" {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "entry")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("extracting %s failed: %v", name, err)
+	}
+	files[name] = f.Name()
+	return nil
+}
+
+// linkTarFile makes name share the content target has in files.
+func linkTarFile(files map[string]string, name, target string) error {
+	name, err := entryName(name)
+	if err != nil || name == "" {
+		return err
+	}
+	target, err = entryName(target)
+	if err != nil {
+		return err
+	}
+	p, ok := files[target]
+	if !ok {
+		return fmt.Errorf("hard link %s to %s, which is not a file earlier in the archive", name, target)
+	}
+	files[name] = p
+	return nil
+}
+
+// addGzip adds the contents of the gzip file at path, named like gunzip
+// names it.
+func (u *unpacker) addGzip(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := cgzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	base := filepath.Base(path)
+	return u.addFile(base[:len(base)-len(".gz")], gr)
+}
+
+// entryName turns the name of a file in an archive into a zip entry
+// name, refusing names that would leave the directory it is unpacked in.
+// The root of the archive gives an empty name.
+func entryName(name string) (string, error) {
+	name = strings.Replace(name, "\\", "/", -1)
+	name = strings.TrimSuffix(name, "/")
+	for strings.HasPrefix(name, "./") {
+		name = name[2:]
+	}
+	if name == "." || name == "" {
+		return "", nil
+	}
+	if path.Clean(name) != name || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("invalid name %s in archive", name)
+	}
+	return name, nil
+}
+
+func checkZips(paths []string) error {
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		p, err := torrentzip.DetectProfile(f, fi.Size())
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("checking %s failed: %v", path, err)
+		}
+		if p == nil {
+			fmt.Fprintf(os.Stdout, "%s: not canonical\n", path)
+		} else {
+			fmt.Fprintf(os.Stdout, "%s: %s\n", path, p.Name)
+		}
+	}
+	return nil
+}
+
 func dirEmpty(dirname string) (bool, error) {
 	fs, err := ioutil.ReadDir(dirname)
 	if err != nil {
@@ -150,6 +462,11 @@ func main() {
 	version := flag.Bool("version", false, "show version")
 
 	outpath := flag.String("out", "", "zip file")
+	nested := flag.Int("nested", 0, "torrentzip added zip files up to this nesting depth")
+	format := flag.String("format", torrentzip.TorrentZip.Name, "format of the zip file, torrentzip or rvzstd")
+	check := flag.Bool("check", false, "report the format each zip file is valid for")
+	unpack := flag.Bool("unpack", false, "add the contents of .7z, tar, tar.gz, tar.bz2 and .gz files instead of the files, - reads a tar from stdin")
+	skipSpecial := flag.Bool("skipspecial", false, "skip links, device files and fifos in tar files instead of failing")
 
 	flag.Parse()
 
@@ -163,11 +480,25 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *check {
+		if err := checkZips(flag.Args()); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if *outpath == "" {
 		flag.Usage()
 		os.Exit(0)
 	}
 
+	profile := torrentzip.ProfileByName(*format)
+	if profile == nil {
+		fmt.Fprintf(os.Stderr, "unknown format %s\n", *format)
+		os.Exit(1)
+	}
+
 	file, err := os.Create(*outpath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "creating zip file %s failed: %v\n", *outpath, err)
@@ -180,11 +511,12 @@ func main() {
 
 	hh := sha1.New()
 
-	zw, err := torrentzip.NewWriter(io.MultiWriter(bf, hh))
+	zw, err := torrentzip.NewWriterWithProfile(io.MultiWriter(bf, hh), "", profile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "creating zip file writer %s failed: %v\n", *outpath, err)
 		os.Exit(1)
 	}
+	zw.SetNestedDepth(*nested)
 
 	pwdName, err := os.Getwd()
 	if err != nil {
@@ -196,8 +528,21 @@ func main() {
 		zw:      zw,
 		pwdName: pwdName,
 	}
+	u := &unpacker{
+		zw:          zw,
+		skipSpecial: *skipSpecial,
+	}
 
 	for _, name := range flag.Args() {
+		if *unpack && isArchive(name) {
+			err = u.add(name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "adding files from %s failed: %v\n", name, err)
+				os.Exit(1)
+			}
+			continue
+		}
+
 		if filepath.IsAbs(name) {
 			fmt.Fprintf(os.Stderr, "cannot add absolute paths to a zip file:  %s\n", name)
 			os.Exit(1)
@@ -213,6 +558,12 @@ func main() {
 
 	}
 
+	err = u.close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "adding empty directories failed: %v\n", err)
+		os.Exit(1)
+	}
+
 	err = zw.Close()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to close zip file %s: %v\n", *outpath, err)
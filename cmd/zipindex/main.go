@@ -0,0 +1,175 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/uwedeportivo/torrentzip/index"
+)
+
+const (
+	versionStr = "1.0"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
+	fmt.Fprintf(os.Stderr, "\tUsage: %s -index <indexfile> build [-hash] <dir 1> ..... <dir n>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\t       %s -index <indexfile> query [-crc <crc> -size <size>] [-md5 <md5>] [-sha1 <sha1>] [-name <name>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\t       %s -index <indexfile> compact\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\nFlag defaults:\n")
+	flag.PrintDefaults()
+}
+
+func build(ix *index.Index, args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	fullHash := fs.Bool("hash", false, "decompress entries to compute their md5 and sha1")
+	fs.Parse(args)
+
+	for _, dir := range fs.Args() {
+		fmt.Fprintf(os.Stdout, "indexing %s\n", dir)
+
+		stats, err := ix.UpdateDir(dir, *fullHash)
+		if err != nil {
+			return err
+		}
+		for path, err := range stats.Failed {
+			fmt.Fprintf(os.Stderr, "failed to index %s: %v\n", path, err)
+		}
+		fmt.Fprintf(os.Stdout, "%d archives added or changed, %d removed, %d failed\n",
+			stats.Changed, stats.Removed, len(stats.Failed))
+	}
+	return nil
+}
+
+func query(ix *index.Index, args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	crc := fs.String("crc", "", "crc32 of the entry in hex")
+	size := fs.Uint64("size", 0, "size of the entry, used with -crc")
+	md5 := fs.String("md5", "", "md5 of the entry in hex")
+	sha1 := fs.String("sha1", "", "sha1 of the entry in hex")
+	name := fs.String("name", "", "name of the entry")
+	fs.Parse(args)
+
+	var locs []index.Location
+	switch {
+	case *crc != "":
+		v, err := strconv.ParseUint(*crc, 16, 32)
+		if err != nil {
+			return fmt.Errorf("invalid crc %s: %v", *crc, err)
+		}
+		locs = ix.LookupCRC(uint32(v), *size)
+	case *md5 != "":
+		h, err := hex.DecodeString(*md5)
+		if err != nil {
+			return fmt.Errorf("invalid md5 %s: %v", *md5, err)
+		}
+		locs = ix.LookupMD5(h)
+	case *sha1 != "":
+		h, err := hex.DecodeString(*sha1)
+		if err != nil {
+			return fmt.Errorf("invalid sha1 %s: %v", *sha1, err)
+		}
+		locs = ix.LookupSHA1(h)
+	case *name != "":
+		locs = ix.LookupName(*name)
+	default:
+		return fmt.Errorf("query needs one of -crc, -md5, -sha1 or -name")
+	}
+
+	for _, loc := range locs {
+		fmt.Fprintf(os.Stdout, "%s\t%s\tsize=%d crc=%08x", loc.Archive, loc.Name, loc.Size, loc.CRC32)
+		if len(loc.MD5) > 0 {
+			fmt.Fprintf(os.Stdout, " md5=%x sha1=%x", loc.MD5, loc.SHA1)
+		}
+		fmt.Fprintf(os.Stdout, "\n")
+	}
+	fmt.Fprintf(os.Stdout, "found %d entries\n", len(locs))
+	return nil
+}
+
+func main() {
+	flag.Usage = usage
+
+	help := flag.Bool("help", false, "show this message")
+	version := flag.Bool("version", false, "show version")
+
+	ixpath := flag.String("index", "", "index file")
+
+	flag.Parse()
+
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	if *version {
+		fmt.Fprintf(os.Stdout, "%s version %s, Copyright (c) 2013 Uwe Hoffmann. All rights reserved.\n", os.Args[0], versionStr)
+		os.Exit(0)
+	}
+
+	if *ixpath == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	ix, err := index.Open(*ixpath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "opening index %s failed: %v\n", *ixpath, err)
+		os.Exit(1)
+	}
+
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "build":
+		err = build(ix, args)
+	case "query":
+		err = query(ix, args)
+	case "compact":
+		err = ix.Compact()
+	default:
+		ix.Close()
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if cerr := ix.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
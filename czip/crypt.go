@@ -0,0 +1,288 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package czip
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// aesMethod is the method of WinZip AES encrypted files, the method
+	// the data is compressed with is in the AES extra field.
+	aesMethod = 99
+
+	aesIterations = 1000
+	aesPVLen      = 2  // password verification value
+	aesMACLen     = 10 // truncated HMAC-SHA1 of the encrypted data
+
+	zipCryptoHeaderLen = 12
+)
+
+// aesExtra holds the WinZip AES extra field of a file.
+type aesExtra struct {
+	version  uint16 // 1 for AE-1, 2 for AE-2 which has no CRC32
+	strength byte   // 1, 2 or 3 for 128, 192 or 256 bit keys
+	method   uint16 // compression method
+}
+
+// decrypter returns a reader decrypting the contents r of f and the
+// method the decrypted data is compressed with.
+func (f *File) decrypter(r *io.SectionReader) (io.Reader, uint16, error) {
+	if f.Flags&0x40 != 0 {
+		// PKWARE strong encryption
+		return nil, 0, ErrAlgorithm
+	}
+	password := f.password
+	if password == nil {
+		password = f.zip.password
+	}
+	if password == nil {
+		return nil, 0, ErrEncrypted
+	}
+	if f.Method == aesMethod {
+		return f.aesReader(r, []byte(*password))
+	}
+	zr, err := f.zipCryptoReader(r, []byte(*password))
+	return zr, f.Method, err
+}
+
+// zipCrypto holds the keys of traditional PKWARE encryption.
+type zipCrypto struct {
+	k0, k1, k2 uint32
+}
+
+func newZipCrypto(password []byte) *zipCrypto {
+	z := &zipCrypto{0x12345678, 0x23456789, 0x34567890}
+	for _, b := range password {
+		z.update(b)
+	}
+	return z
+}
+
+func (z *zipCrypto) update(b byte) {
+	z.k0 = crc32.IEEETable[byte(z.k0)^b] ^ z.k0>>8
+	z.k1 = (z.k1+z.k0&0xff)*134775813 + 1
+	z.k2 = crc32.IEEETable[byte(z.k2)^byte(z.k1>>24)] ^ z.k2>>8
+}
+
+func (z *zipCrypto) decrypt(p []byte) {
+	for i, c := range p {
+		t := z.k2 | 2
+		p[i] = c ^ byte(t*(t^1)>>8)
+		z.update(p[i])
+	}
+}
+
+type zipCryptoReader struct {
+	r io.Reader
+	z *zipCrypto
+}
+
+func (r *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.z.decrypt(p[:n])
+	return n, err
+}
+
+// zipCryptoReader reads the encryption header in front of the data of
+// f. Its last byte is the high byte of the CRC32, or of the modification
+// time for files with a data descriptor, which tells a wrong password
+// with a probability of 255/256. The CRC32 catches the rest.
+func (f *File) zipCryptoReader(r io.Reader, password []byte) (io.Reader, error) {
+	z := newZipCrypto(password)
+	var header [zipCryptoHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	z.decrypt(header[:])
+	check := byte(f.CRC32 >> 24)
+	if f.hasDataDescriptor() {
+		check = byte(f.ModifiedTime >> 8)
+	}
+	if header[zipCryptoHeaderLen-1] != check {
+		return nil, ErrPassword
+	}
+	return &zipCryptoReader{r, z}, nil
+}
+
+// aesReader returns a reader decrypting the WinZip AES encrypted data r
+// of f. The data starts with a salt and the password verification value
+// and ends with the authentication code of the encrypted data, which is
+// checked as the data is read, so the data only needs to be read once.
+func (f *File) aesReader(r *io.SectionReader, password []byte) (io.Reader, uint16, error) {
+	if f.aes.strength < 1 || f.aes.strength > 3 {
+		return nil, 0, ErrAlgorithm
+	}
+	keyLen := 8 + 8*int(f.aes.strength)
+	saltLen := keyLen / 2
+	dataLen := r.Size() - int64(saltLen+aesPVLen+aesMACLen)
+	if dataLen < 0 {
+		return nil, 0, ErrFormat
+	}
+
+	header := make([]byte, saltLen+aesPVLen)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, 0, err
+	}
+	keys := pbkdf2(password, header[:saltLen], aesIterations, 2*keyLen+aesPVLen)
+	if subtle.ConstantTimeCompare(keys[2*keyLen:], header[saltLen:]) != 1 {
+		return nil, 0, ErrPassword
+	}
+
+	block, err := aes.NewCipher(keys[:keyLen])
+	if err != nil {
+		return nil, 0, err
+	}
+	ar := &aesCTRReader{
+		r:         io.NewSectionReader(r, int64(len(header)), dataLen),
+		code:      io.NewSectionReader(r, int64(len(header))+dataLen, aesMACLen),
+		mac:       hmac.New(sha1.New, keys[keyLen:2*keyLen]),
+		remaining: dataLen,
+		block:     block,
+		pos:       aes.BlockSize,
+	}
+	if dataLen == 0 {
+		// nothing may ever be read to check the code
+		if err := ar.authenticate(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return ar, f.aes.method, nil
+}
+
+// aesCTRReader decrypts AES in counter mode with the little endian
+// counter starting at 1 WinZip uses, which crypto/cipher's CTR doesn't
+// implement. It checks the authentication code once it has read all of
+// the encrypted data: the read reaching the end returns ErrAuthentication
+// instead of its bytes if the code doesn't match, so a decompressor can't
+// finish a stream with unauthenticated data at its end. Errors in the
+// data before that are likely found by the decompressor or the CRC32
+// first.
+type aesCTRReader struct {
+	r         io.Reader
+	code      io.Reader
+	mac       hash.Hash
+	remaining int64
+	err       error
+
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	pos     int // next byte of stream to use
+}
+
+func (c *aesCTRReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.mac.Write(p[:n])
+	c.remaining -= int64(n)
+	if c.remaining == 0 {
+		if aerr := c.authenticate(); aerr != nil {
+			c.err = aerr
+			return 0, aerr
+		}
+	} else if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	for i := range p[:n] {
+		if c.pos == aes.BlockSize {
+			for j := range c.counter {
+				c.counter[j]++
+				if c.counter[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.stream[:], c.counter[:])
+			c.pos = 0
+		}
+		p[i] ^= c.stream[c.pos]
+		c.pos++
+	}
+	return n, err
+}
+
+// authenticate compares the code of the data read with the stored one.
+func (c *aesCTRReader) authenticate() error {
+	var code [aesMACLen]byte
+	if _, err := io.ReadFull(c.code, code[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if !hmac.Equal(c.mac.Sum(nil)[:aesMACLen], code[:]) {
+		return ErrAuthentication
+	}
+	return nil
+}
+
+// pbkdf2 derives a key of keyLen bytes from password as described in
+// RFC 2898 using HMAC-SHA1.
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	var key []byte
+	for i := uint32(1); len(key) < keyLen; i++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
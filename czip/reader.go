@@ -13,20 +13,24 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-
-	"github.com/uwedeportivo/torrentzip/zlib"
 )
 
 var (
 	ErrFormat    = errors.New("zip: not a valid zip file")
 	ErrAlgorithm = errors.New("zip: unsupported compression algorithm")
 	ErrChecksum  = errors.New("zip: checksum error")
+
+	ErrEncrypted      = errors.New("zip: encrypted file and no password given")
+	ErrPassword       = errors.New("zip: wrong password")
+	ErrAuthentication = errors.New("zip: authentication failed")
 )
 
 type Reader struct {
-	r       io.ReaderAt
-	File    []*File
-	Comment string
+	r             io.ReaderAt
+	File          []*File
+	Comment       string
+	decompressors map[uint16]Decompressor
+	password      *string
 }
 
 type ReadCloser struct {
@@ -36,15 +40,36 @@ type ReadCloser struct {
 
 type File struct {
 	FileHeader
+	zip          *Reader
 	zipr         io.ReaderAt
 	zipsize      int64
 	headerOffset int64
+	password     *string
+	aes          aesExtra
 }
 
 func (f *File) hasDataDescriptor() bool {
 	return f.Flags&0x8 != 0
 }
 
+// hasCRC32 reports whether f has a CRC32 of its contents. AE-2 encrypted
+// files have none, their authentication code takes its place.
+func (f *File) hasCRC32() bool {
+	return f.Method != aesMethod || f.aes.version != 2
+}
+
+// IsEncrypted reports whether the contents of f are encrypted, in which
+// case a password has to be set to open it.
+func (f *File) IsEncrypted() bool {
+	return f.Flags&0x1 != 0
+}
+
+// SetPassword sets the password to decrypt f with, overriding the one
+// of its Reader.
+func (f *File) SetPassword(password string) {
+	f.password = &password
+}
+
 // OpenReader will open the Zip file specified by name and return a ReadCloser.
 func OpenReader(name string) (*ReadCloser, error) {
 	f, err := os.Open(name)
@@ -94,7 +119,7 @@ func (z *Reader) init(r io.ReaderAt, size int64) error {
 	// a bad one, and then only report a ErrFormat or UnexpectedEOF if
 	// the file count modulo 65536 is incorrect.
 	for {
-		f := &File{zipr: r, zipsize: size}
+		f := &File{zip: z, zipr: r, zipsize: size}
 		err = readDirectoryHeader(f, buf)
 		if err == ErrFormat || err == io.ErrUnexpectedEOF {
 			break
@@ -112,6 +137,31 @@ func (z *Reader) init(r io.ReaderAt, size int64) error {
 	return nil
 }
 
+// RegisterDecompressor registers or overrides a custom decompressor for a
+// specific method ID. If a decompressor for a given method is not found,
+// Reader will default to looking up the decompressor at the package level.
+func (z *Reader) RegisterDecompressor(method uint16, dcomp Decompressor) {
+	if z.decompressors == nil {
+		z.decompressors = make(map[uint16]Decompressor)
+	}
+	z.decompressors[method] = dcomp
+}
+
+func (z *Reader) decompressor(method uint16) Decompressor {
+	dcomp := z.decompressors[method]
+	if dcomp == nil {
+		dcomp = decompressor(method)
+	}
+	return dcomp
+}
+
+// SetPassword sets the password to decrypt the encrypted files of the
+// archive with. Both traditional PKWARE encryption and WinZip AES are
+// supported.
+func (z *Reader) SetPassword(password string) {
+	z.password = &password
+}
+
 // Close closes the Zip file, rendering it unusable for I/O.
 func (rc *ReadCloser) Close() error {
 	return rc.f.Close()
@@ -131,7 +181,8 @@ func (f *File) DataOffset() (offset int64, err error) {
 }
 
 // Open returns a ReadCloser that provides access to the File's contents.
-// Multiple files may be read concurrently.
+// Multiple files may be read concurrently. Encrypted files are decrypted
+// with the password set for the file or its Reader.
 func (f *File) Open() (rc io.ReadCloser, err error) {
 	bodyOffset, err := f.findBodyOffset()
 	if err != nil {
@@ -139,18 +190,26 @@ func (f *File) Open() (rc io.ReadCloser, err error) {
 	}
 	size := int64(f.CompressedSize64)
 	r := io.NewSectionReader(f.zipr, f.headerOffset+bodyOffset, size)
-	switch f.Method {
-	case Store: // (no compression)
-		rc = ioutil.NopCloser(r)
-	case Deflate:
-		rc, err = zlib.NewReader(r)
+	var dr io.Reader = r
+	method := f.Method
+	if f.IsEncrypted() {
+		dr, method, err = f.decrypter(r)
 		if err != nil {
 			return
 		}
-	default:
+	}
+	dcomp := f.zip.decompressor(method)
+	if dcomp == nil {
 		err = ErrAlgorithm
 		return
 	}
+	rc, err = dcomp(dr)
+	if err != nil {
+		return
+	}
+	// LZMA entries need not have an end marker, the decompressor has
+	// to be stopped at the uncompressed size.
+	rc = &limitedReadCloser{io.LimitReader(rc, int64(f.UncompressedSize64)), rc}
 	var desr io.Reader
 	if f.hasDataDescriptor() {
 		desr = io.NewSectionReader(f.zipr, f.headerOffset+bodyOffset+size, dataDescriptorLen)
@@ -192,14 +251,14 @@ func (r *checksumReader) Read(b []byte) (n int, err error) {
 		if r.desr != nil {
 			if err1 := readDataDescriptor(r.desr, r.f); err1 != nil {
 				err = err1
-			} else if r.hash.Sum32() != r.f.CRC32 {
+			} else if r.f.hasCRC32() && r.hash.Sum32() != r.f.CRC32 {
 				err = ErrChecksum
 			}
 		} else {
 			// If there's not a data descriptor, we still compare
 			// the CRC32 of what we've read against the file header
 			// or TOC's CRC32, if it seems like it was set.
-			if r.f.CRC32 != 0 && r.hash.Sum32() != r.f.CRC32 {
+			if r.f.hasCRC32() && r.f.CRC32 != 0 && r.hash.Sum32() != r.f.CRC32 {
 				err = ErrChecksum
 			}
 		}
@@ -210,6 +269,11 @@ func (r *checksumReader) Read(b []byte) (n int, err error) {
 
 func (r *checksumReader) Close() error { return r.rc.Close() }
 
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
 // findBodyOffset does the minimum work to verify the file has a header
 // and returns the file body offset.
 func (f *File) findBodyOffset() (int64, error) {
@@ -285,6 +349,14 @@ func readDirectoryHeader(f *File, r io.Reader) error {
 					f.headerOffset = int64(eb.uint64())
 				}
 			}
+			if tag == aesExtraId && size >= 7 {
+				eb := readBuf(b[:size])
+				f.aes.version = eb.uint16()
+				eb = eb[2:] // vendor id "AE"
+				f.aes.strength = eb[0]
+				eb = eb[1:]
+				f.aes.method = eb.uint16()
+			}
 			b = b[size:]
 		}
 		// Should have consumed the whole header.
@@ -0,0 +1,123 @@
+// Copyright 2010 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package czip
+
+import (
+	"compress/bzip2"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/uwedeportivo/torrentzip/deflate64"
+	"github.com/uwedeportivo/torrentzip/lzma"
+	"github.com/uwedeportivo/torrentzip/zlib"
+)
+
+// A Compressor returns a new compressing writer, writing to w.
+// The WriteCloser's Close method must be used to flush pending data to w.
+// The Compressor itself must be safe to invoke from multiple goroutines
+// simultaneously, but each returned writer will be used only by
+// one goroutine at a time.
+type Compressor func(w io.Writer) (io.WriteCloser, error)
+
+// A Decompressor returns a new decompressing reader, reading from r.
+// The ReadCloser's Close method must be used to release associated resources.
+// The Decompressor itself must be safe to invoke from multiple goroutines
+// simultaneously, but each returned reader will be used only by
+// one goroutine at a time.
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+var (
+	compressors   sync.Map // map[uint16]Compressor
+	decompressors sync.Map // map[uint16]Decompressor
+)
+
+func init() {
+	compressors.Store(Store, Compressor(func(w io.Writer) (io.WriteCloser, error) {
+		return nopCloser{w}, nil
+	}))
+	compressors.Store(Deflate, Compressor(func(w io.Writer) (io.WriteCloser, error) {
+		return zlib.NewWriterLevel(w, 9)
+	}))
+	compressors.Store(Zstd, Compressor(newZstdWriter))
+
+	decompressors.Store(Store, Decompressor(func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(r), nil
+	}))
+	decompressors.Store(Deflate, Decompressor(func(r io.Reader) (io.ReadCloser, error) {
+		return zlib.NewReader(r)
+	}))
+	decompressors.Store(Deflate64, Decompressor(func(r io.Reader) (io.ReadCloser, error) {
+		return deflate64.NewReader(r), nil
+	}))
+	decompressors.Store(Zstd, Decompressor(newZstdReader))
+	decompressors.Store(Bzip2, Decompressor(func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	}))
+	decompressors.Store(LZMA, Decompressor(func(r io.Reader) (io.ReadCloser, error) {
+		lr, err := lzma.NewZipReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(lr), nil
+	}))
+	decompressors.Store(XZ, Decompressor(func(r io.Reader) (io.ReadCloser, error) {
+		xr, err := lzma.NewXZReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	}))
+}
+
+// newZstdWriter compresses in a single goroutine, which keeps the output
+// independent of the number of cpus.
+func newZstdWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w,
+		zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+		zstd.WithEncoderConcurrency(1))
+}
+
+func newZstdReader(r io.Reader) (io.ReadCloser, error) {
+	zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return zr.IOReadCloser(), nil
+}
+
+// RegisterDecompressor allows custom decompressors for a specified method ID.
+// The methods Store, Deflate, Deflate64, Bzip2, LZMA, Zstd and XZ are
+// built in.
+func RegisterDecompressor(method uint16, dcomp Decompressor) {
+	if _, dup := decompressors.LoadOrStore(method, dcomp); dup {
+		panic("decompressor already registered")
+	}
+}
+
+// RegisterCompressor registers custom compressors for a specified method ID.
+// The methods Store, Deflate and Zstd are built in.
+func RegisterCompressor(method uint16, comp Compressor) {
+	if _, dup := compressors.LoadOrStore(method, comp); dup {
+		panic("compressor already registered")
+	}
+}
+
+func compressor(method uint16) Compressor {
+	ci, ok := compressors.Load(method)
+	if !ok {
+		return nil
+	}
+	return ci.(Compressor)
+}
+
+func decompressor(method uint16) Decompressor {
+	di, ok := decompressors.Load(method)
+	if !ok {
+		return nil
+	}
+	return di.(Decompressor)
+}
@@ -26,8 +26,13 @@ import (
 
 // Compression methods.
 const (
-	Store   uint16 = 0
-	Deflate uint16 = 8
+	Store     uint16 = 0
+	Deflate   uint16 = 8
+	Deflate64 uint16 = 9
+	Bzip2     uint16 = 12
+	LZMA      uint16 = 14
+	Zstd      uint16 = 93
+	XZ        uint16 = 95
 )
 
 const (
@@ -62,6 +67,7 @@ const (
 
 	// extra header id's
 	zip64ExtraId = 0x0001 // zip64 Extended Information Extra Field
+	aesExtraId   = 0x9901 // WinZip AES Extra Field
 )
 
 // FileHeader describes a file within a zip file.
@@ -11,8 +11,6 @@ import (
 	"hash"
 	"hash/crc32"
 	"io"
-
-	"github.com/uwedeportivo/torrentzip/zlib"
 )
 
 // TODO(adg): support zip file comments
@@ -20,10 +18,11 @@ import (
 
 // Writer implements a zip file writer.
 type Writer struct {
-	cw     *countWriter
-	dir    []*header
-	last   *fileWriter
-	closed bool
+	cw          *countWriter
+	dir         []*header
+	last        *fileWriter
+	closed      bool
+	compressors map[uint16]Compressor
 }
 
 type header struct {
@@ -168,7 +167,7 @@ func (w *Writer) Close() error {
 // letter (e.g. C:) or leading slash, and only forward slashes are
 // allowed.
 // The file's contents must be written to the io.Writer before the next
-// call to Create, CreateHeader, or Close.
+// call to Create, CreateHeader, CreateRaw, or Close.
 func (w *Writer) Create(name string) (io.Writer, error) {
 	header := &FileHeader{
 		Name:   name,
@@ -181,8 +180,23 @@ func (w *Writer) Create(name string) (io.Writer, error) {
 // for the file metadata.
 // It returns a Writer to which the file contents should be written.
 // The file's contents must be written to the io.Writer before the next
-// call to Create, CreateHeader, or Close.
+// call to Create, CreateHeader, CreateRaw, or Close.
 func (w *Writer) CreateHeader(fh *FileHeader) (io.Writer, error) {
+	return w.createHeader(fh, false)
+}
+
+// CreateRaw adds a file to the zip file using the provided FileHeader
+// and returns a Writer to which the already compressed file contents
+// should be written. The CRC32 and UncompressedSize64 fields of fh must
+// be set by the caller, the compressed size is taken from the number of
+// bytes written.
+// The file's contents must be written to the io.Writer before the next
+// call to Create, CreateHeader, CreateRaw, or Close.
+func (w *Writer) CreateRaw(fh *FileHeader) (io.Writer, error) {
+	return w.createHeader(fh, true)
+}
+
+func (w *Writer) createHeader(fh *FileHeader, raw bool) (io.Writer, error) {
 	if w.last != nil && !w.last.closed {
 		if err := w.last.close(); err != nil {
 			return nil, err
@@ -198,18 +212,20 @@ func (w *Writer) CreateHeader(fh *FileHeader) (io.Writer, error) {
 		zipw:      w.cw,
 		compCount: &countWriter{w: w.cw},
 		crc32:     crc32.NewIEEE(),
+		raw:       raw,
 	}
-	switch fh.Method {
-	case Store:
+	if raw {
 		fw.comp = nopCloser{fw.compCount}
-	case Deflate:
+	} else {
+		comp := w.compressor(fh.Method)
+		if comp == nil {
+			return nil, ErrAlgorithm
+		}
 		var err error
-		fw.comp, err = zlib.NewWriterLevel(fw.compCount, 9)
+		fw.comp, err = comp(fw.compCount)
 		if err != nil {
 			return nil, err
 		}
-	default:
-		return nil, ErrAlgorithm
 	}
 	fw.rawCount = &countWriter{w: fw.comp}
 
@@ -228,6 +244,24 @@ func (w *Writer) CreateHeader(fh *FileHeader) (io.Writer, error) {
 	return fw, nil
 }
 
+// RegisterCompressor registers or overrides a custom compressor for a
+// specific method ID. If a compressor for a given method is not found,
+// Writer will default to looking up the compressor at the package level.
+func (w *Writer) RegisterCompressor(method uint16, comp Compressor) {
+	if w.compressors == nil {
+		w.compressors = make(map[uint16]Compressor)
+	}
+	w.compressors[method] = comp
+}
+
+func (w *Writer) compressor(method uint16) Compressor {
+	comp := w.compressors[method]
+	if comp == nil {
+		comp = compressor(method)
+	}
+	return comp
+}
+
 func writeHeader(w io.Writer, h *FileHeader) error {
 	var buf [fileHeaderLen]byte
 	b := writeBuf(buf[:])
@@ -259,6 +293,7 @@ type fileWriter struct {
 	comp      io.WriteCloser
 	compCount *countWriter
 	crc32     hash.Hash32
+	raw       bool
 	closed    bool
 }
 
@@ -266,6 +301,9 @@ func (w *fileWriter) Write(p []byte) (int, error) {
 	if w.closed {
 		return 0, errors.New("zip: write to closed file")
 	}
+	if w.raw {
+		return w.compCount.Write(p)
+	}
 	w.crc32.Write(p)
 	return w.rawCount.Write(p)
 }
@@ -281,9 +319,11 @@ func (w *fileWriter) close() error {
 
 	// update FileHeader
 	fh := w.header.FileHeader
-	fh.CRC32 = w.crc32.Sum32()
+	if !w.raw {
+		fh.CRC32 = w.crc32.Sum32()
+		fh.UncompressedSize64 = uint64(w.rawCount.count)
+	}
 	fh.CompressedSize64 = uint64(w.compCount.count)
-	fh.UncompressedSize64 = uint64(w.rawCount.count)
 
 	if fh.isZip64() {
 		fh.CompressedSize = uint32max
@@ -0,0 +1,402 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package dat
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type cmpPair struct {
+	key   string
+	value string
+	block []*cmpPair
+}
+
+type cmpLexer struct {
+	s    string
+	pos  int
+	line int
+}
+
+const cmpEOF = ""
+
+// next returns the next token, which is a parenthesis, a word or the
+// content of a quoted string.
+func (l *cmpLexer) next() (string, bool, error) {
+	for l.pos < len(l.s) {
+		c := l.s[l.pos]
+		if c == '\n' {
+			l.line++
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			break
+		}
+		l.pos++
+	}
+	if l.pos == len(l.s) {
+		return cmpEOF, false, nil
+	}
+
+	start := l.pos
+	switch l.s[l.pos] {
+	case '(', ')':
+		l.pos++
+		return l.s[start:l.pos], false, nil
+	case '"':
+		end := strings.IndexByte(l.s[start+1:], '"')
+		if end == -1 {
+			return "", false, fmt.Errorf("line %d: unterminated string", l.line+1)
+		}
+		l.pos = start + 1 + end + 1
+		return l.s[start+1 : start+1+end], true, nil
+	}
+	for l.pos < len(l.s) && !strings.ContainsRune(" \t\r\n()\"", rune(l.s[l.pos])) {
+		l.pos++
+	}
+	return l.s[start:l.pos], false, nil
+}
+
+// block parses key value pairs up to the closing parenthesis of a block
+// whose opening parenthesis has already been read.
+func (l *cmpLexer) block() ([]*cmpPair, error) {
+	var pairs []*cmpPair
+	for {
+		key, quoted, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		if key == cmpEOF && !quoted {
+			return nil, fmt.Errorf("line %d: unexpected end of file", l.line+1)
+		}
+		if key == ")" && !quoted {
+			return pairs, nil
+		}
+
+		value, vquoted, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		if value == ")" && !vquoted {
+			return nil, fmt.Errorf("line %d: missing value for %s", l.line+1, key)
+		}
+
+		p := &cmpPair{key: strings.ToLower(key)}
+		if value == "(" && !vquoted {
+			p.block, err = l.block()
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			p.value = value
+		}
+		pairs = append(pairs, p)
+	}
+}
+
+// decodeText returns data as a string. DAT files that aren't valid UTF-8
+// are decoded as Latin-1.
+func decodeText(data []byte) string {
+	if utf8.Valid(data) {
+		return strings.TrimPrefix(string(data), "\ufeff")
+	}
+	rs := make([]rune, len(data))
+	for i, b := range data {
+		rs[i] = rune(b)
+	}
+	return string(rs)
+}
+
+// ParseClrMamePro parses a DAT in the ClrMamePro text format. Bios sets
+// stored as resource blocks are parsed as games with IsBios set.
+func ParseClrMamePro(r io.Reader) (*Dat, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	l := &cmpLexer{s: decodeText(data)}
+
+	d := new(Dat)
+	for {
+		kw, _, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		if kw == cmpEOF {
+			break
+		}
+		open, _, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		if open != "(" {
+			return nil, fmt.Errorf("line %d: expected ( after %s", l.line+1, kw)
+		}
+		pairs, err := l.block()
+		if err != nil {
+			return nil, err
+		}
+
+		switch strings.ToLower(kw) {
+		case "clrmamepro":
+			cmpHeader(&d.Header, pairs)
+		case "game", "machine", "resource":
+			g, err := cmpGame(pairs)
+			if err != nil {
+				return nil, err
+			}
+			if strings.ToLower(kw) == "resource" {
+				g.IsBios = true
+			}
+			d.Games = append(d.Games, g)
+		}
+	}
+	return d, nil
+}
+
+func cmpHeader(h *Header, pairs []*cmpPair) {
+	for _, p := range pairs {
+		switch p.key {
+		case "name":
+			h.Name = p.value
+		case "description":
+			h.Description = p.value
+		case "category":
+			h.Category = p.value
+		case "version":
+			h.Version = p.value
+		case "date":
+			h.Date = p.value
+		case "author":
+			h.Author = p.value
+		case "email":
+			h.Email = p.value
+		case "homepage":
+			h.Homepage = p.value
+		case "url":
+			h.URL = p.value
+		case "comment":
+			h.Comment = p.value
+		case "forcemerging":
+			h.ForceMerging = p.value
+		case "forcenodump":
+			h.ForceNoDump = p.value
+		case "forcepacking":
+			h.ForcePacking = p.value
+		case "header":
+			h.Skipper = p.value
+		}
+	}
+}
+
+func cmpGame(pairs []*cmpPair) (*Game, error) {
+	g := new(Game)
+	for _, p := range pairs {
+		switch p.key {
+		case "name":
+			g.Name = p.value
+		case "description":
+			g.Description = p.value
+		case "year":
+			g.Year = p.value
+		case "manufacturer":
+			g.Manufacturer = p.value
+		case "cloneof":
+			g.CloneOf = p.value
+		case "romof":
+			g.RomOf = p.value
+		case "sampleof":
+			g.SampleOf = p.value
+		case "isbios":
+			g.IsBios = p.value == "yes"
+		case "rom":
+			rom, err := cmpRom(p.block)
+			if err != nil {
+				return nil, fmt.Errorf("game %s: %v", g.Name, err)
+			}
+			g.Roms = append(g.Roms, rom)
+		}
+	}
+	return g, nil
+}
+
+func cmpRom(pairs []*cmpPair) (*Rom, error) {
+	rom := new(Rom)
+	var size, crc, md5, sha1 string
+	for _, p := range pairs {
+		switch p.key {
+		case "name":
+			rom.Name = p.value
+		case "size":
+			size = p.value
+		case "crc":
+			crc = p.value
+		case "md5":
+			md5 = p.value
+		case "sha1":
+			sha1 = p.value
+		case "merge":
+			rom.Merge = p.value
+		case "status", "flags":
+			rom.Status = p.value
+		}
+	}
+
+	// the name may come after the other fields, so they are parsed last
+	// for errors to name the rom
+	var err error
+	if size != "" {
+		rom.Size, err = strconv.ParseUint(size, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("rom %s: invalid size %q", rom.Name, size)
+		}
+	}
+	if rom.CRC, err = ParseCRC(crc); err != nil {
+		return nil, fmt.Errorf("rom %s: %v", rom.Name, err)
+	}
+	if rom.MD5, err = ParseMD5(md5); err != nil {
+		return nil, fmt.Errorf("rom %s: %v", rom.Name, err)
+	}
+	if rom.SHA1, err = ParseSHA1(sha1); err != nil {
+		return nil, fmt.Errorf("rom %s: %v", rom.Name, err)
+	}
+	return rom, nil
+}
+
+// WriteClrMamePro writes d in the ClrMamePro text format. Bios sets are
+// written as games with an isbios field. The format has no way to escape
+// double quotes in quoted strings, backslashes being path separators in
+// rom names, so WriteClrMamePro fails without writing anything if a
+// string of d has one.
+func WriteClrMamePro(w io.Writer, d *Dat) error {
+	if err := cmpCheck(d); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+
+	h := d.Header
+	bw.WriteString("clrmamepro (\n")
+	for _, f := range []struct{ key, value string }{
+		{"name", h.Name},
+		{"description", h.Description},
+		{"category", h.Category},
+		{"version", h.Version},
+		{"date", h.Date},
+		{"author", h.Author},
+		{"email", h.Email},
+		{"homepage", h.Homepage},
+		{"url", h.URL},
+		{"comment", h.Comment},
+		{"header", h.Skipper},
+		{"forcemerging", h.ForceMerging},
+		{"forcenodump", h.ForceNoDump},
+		{"forcepacking", h.ForcePacking},
+	} {
+		writeCmpField(bw, f.key, f.value)
+	}
+	bw.WriteString(")\n")
+
+	for _, g := range d.Games {
+		bw.WriteString("\ngame (\n")
+		writeCmpField(bw, "name", g.Name)
+		writeCmpField(bw, "description", g.Description)
+		writeCmpField(bw, "year", g.Year)
+		writeCmpField(bw, "manufacturer", g.Manufacturer)
+		writeCmpField(bw, "cloneof", g.CloneOf)
+		writeCmpField(bw, "romof", g.RomOf)
+		writeCmpField(bw, "sampleof", g.SampleOf)
+		if g.IsBios {
+			writeCmpField(bw, "isbios", "yes")
+		}
+		for _, rom := range g.Roms {
+			fmt.Fprintf(bw, "\trom ( name %s size %d", cmpQuote(rom.Name), rom.Size)
+			if rom.CRC != nil {
+				fmt.Fprintf(bw, " crc %s", rom.CRC)
+			}
+			if rom.MD5 != nil {
+				fmt.Fprintf(bw, " md5 %s", rom.MD5)
+			}
+			if rom.SHA1 != nil {
+				fmt.Fprintf(bw, " sha1 %s", rom.SHA1)
+			}
+			if rom.Merge != "" {
+				fmt.Fprintf(bw, " merge %s", cmpQuote(rom.Merge))
+			}
+			if rom.Status != "" {
+				fmt.Fprintf(bw, " status %s", rom.Status)
+			}
+			bw.WriteString(" )\n")
+		}
+		bw.WriteString(")\n")
+	}
+	return bw.Flush()
+}
+
+// cmpCheck returns an error if a string WriteClrMamePro quotes has a
+// double quote.
+func cmpCheck(d *Dat) error {
+	h := d.Header
+	values := []string{h.Name, h.Description, h.Category, h.Version, h.Date, h.Author,
+		h.Email, h.Homepage, h.URL, h.Comment, h.Skipper, h.ForceMerging, h.ForceNoDump, h.ForcePacking}
+	for _, v := range values {
+		if strings.Contains(v, "\"") {
+			return fmt.Errorf("clrmamepro: header value %q has a double quote", v)
+		}
+	}
+	for _, g := range d.Games {
+		values := []string{g.Name, g.Description, g.Year, g.Manufacturer, g.CloneOf, g.RomOf, g.SampleOf}
+		for _, rom := range g.Roms {
+			values = append(values, rom.Name, rom.Merge)
+		}
+		for _, v := range values {
+			if strings.Contains(v, "\"") {
+				return fmt.Errorf("clrmamepro: game %s: value %q has a double quote", g.Name, v)
+			}
+		}
+	}
+	return nil
+}
+
+func cmpQuote(s string) string {
+	return "\"" + s + "\""
+}
+
+func writeCmpField(bw *bufio.Writer, key, value string) {
+	if value == "" {
+		return
+	}
+	fmt.Fprintf(bw, "\t%s %s\n", key, cmpQuote(value))
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package dat
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testCMP = `clrmamepro (
+	name "Test"
+	description "Test DAT"
+	version 20130101
+	forcemerging split
+	header "No-Intro_NES.xml"
+)
+
+resource (
+	name bios
+	description "Bios (v1)"
+	rom ( name bios.bin size 8 crc 01020304 )
+)
+
+game (
+	name parent
+	description "Parent Game"
+	year 1985
+	manufacturer "Acme"
+	romof bios
+	rom ( name "a file.bin" size 1024 crc deadbeef sha1 da39a3ee5e6b4b0d3255bfef95601890afd80709 )
+	rom ( name c.bin size 16 flags nodump )
+	disk ( name hd sha1 da39a3ee5e6b4b0d3255bfef95601890afd80709 )
+)
+
+game (
+	name clone
+	description "Clone Game"
+	cloneof parent
+	romof parent
+	rom ( name "a file.bin" merge "a file.bin" size 1024 crc deadbeef )
+)
+`
+
+func TestParseClrMamePro(t *testing.T) {
+	d, err := ParseClrMamePro(strings.NewReader(testCMP))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Header.Name != "Test" || d.Header.Version != "20130101" ||
+		d.Header.ForceMerging != "split" || d.Header.Skipper != "No-Intro_NES.xml" {
+		t.Errorf("unexpected header %+v", d.Header)
+	}
+	if len(d.Games) != 3 {
+		t.Fatalf("got %d games, want 3", len(d.Games))
+	}
+
+	b := d.Games[0]
+	if b.Name != "bios" || !b.IsBios || b.Description != "Bios (v1)" || len(b.Roms) != 1 {
+		t.Errorf("unexpected bios %+v", b)
+	}
+
+	p := d.Game("parent")
+	if p.Year != "1985" || p.Manufacturer != "Acme" || p.RomOf != "bios" || len(p.Roms) != 2 {
+		t.Fatalf("unexpected parent %+v", p)
+	}
+	if p.Roms[0].Name != "a file.bin" || p.Roms[0].CRC.String() != "deadbeef" || len(p.Roms[0].SHA1) != 20 {
+		t.Errorf("unexpected rom %+v", p.Roms[0])
+	}
+	if p.Roms[1].Status != StatusNoDump {
+		t.Errorf("flags not parsed as status: %+v", p.Roms[1])
+	}
+
+	c := d.Game("clone")
+	if c.CloneOf != "parent" || c.Roms[0].Merge != "a file.bin" {
+		t.Errorf("unexpected clone %+v", c)
+	}
+}
+
+func TestParseClrMameProErrors(t *testing.T) {
+	for _, s := range []string{
+		`game ( name "unterminated )`,
+		`game ( name x`,
+		`game name x )`,
+		`game ( name x rom ( name y size big ) )`,
+	} {
+		if _, err := ParseClrMamePro(strings.NewReader(s)); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
+
+func TestClrMameProRoundTrip(t *testing.T) {
+	d, err := ParseXML(strings.NewReader(testXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Header.ForcePacking = "zip"
+
+	var buf bytes.Buffer
+	if err := WriteClrMamePro(&buf, d); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseClrMamePro(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, d) {
+		t.Errorf("round trip changed dat:\n%s", buf.String())
+	}
+}
+
+func TestClrMameProQuotes(t *testing.T) {
+	d := &Dat{
+		Header: Header{Name: `C:\dats\`, Description: "it's \\ fine"},
+		Games: []*Game{{
+			Name:        `game\`,
+			Description: `Game (Disk 1\2)`,
+			Roms:        []*Rom{{Name: `disk1\track 01.bin`, Size: 1, Merge: `\`}},
+		}},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteClrMamePro(&buf, d); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseClrMamePro(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, d) {
+		t.Errorf("round trip with backslashes changed dat:\n%s", buf.String())
+	}
+
+	d.Games[0].Roms[0].Name = `track "1".bin`
+	buf.Reset()
+	if err := WriteClrMamePro(&buf, d); err == nil {
+		t.Errorf("WriteClrMamePro of rom name with double quotes succeeded:\n%s", buf.String())
+	}
+	if buf.Len() != 0 {
+		t.Errorf("WriteClrMamePro wrote %d bytes before failing", buf.Len())
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package dat reads ROM management DAT files and verifies collections of
+torrentzipped sets against them.
+
+A DAT describes a collection as a list of games (sets), each of which is
+a list of roms with name, size and hashes. Every set is stored in a zip
+file named after the set.
+*/
+package dat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Format is a DAT file format.
+type Format int
+
+// Supported DAT formats.
+const (
+	Logiqx Format = iota
+	ClrMamePro
+	RomCenter
+)
+
+var formatNames = []string{"xml", "cmp", "rc"}
+
+func (f Format) String() string {
+	if int(f) < len(formatNames) {
+		return formatNames[f]
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ParseFormat returns the format named by s, which is one of "xml", "cmp"
+// and "rc".
+func ParseFormat(s string) (Format, error) {
+	for i, name := range formatNames {
+		if strings.EqualFold(s, name) {
+			return Format(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown dat format %s", s)
+}
+
+// Parse detects the format of a DAT and parses it.
+func Parse(r io.Reader) (*Dat, Format, error) {
+	br := bufio.NewReader(r)
+	f := ClrMamePro
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return new(Dat), f, nil
+		}
+		if err != nil {
+			return nil, f, err
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' || c >= 0x80 {
+			// skip white space and byte order marks
+			continue
+		}
+		switch c {
+		case '<':
+			f = Logiqx
+		case '[':
+			f = RomCenter
+		}
+		br.UnreadByte()
+		break
+	}
+
+	var d *Dat
+	var err error
+	switch f {
+	case Logiqx:
+		d, err = ParseXML(br)
+	case RomCenter:
+		d, err = ParseRomCenter(br)
+	default:
+		d, err = ParseClrMamePro(br)
+	}
+	return d, f, err
+}
+
+// Write writes d in format f.
+func Write(w io.Writer, d *Dat, f Format) error {
+	switch f {
+	case Logiqx:
+		return WriteXML(w, d)
+	case ClrMamePro:
+		return WriteClrMamePro(w, d)
+	case RomCenter:
+		return WriteRomCenter(w, d)
+	}
+	return fmt.Errorf("unknown dat format %v", f)
+}
+
+// Rom status values. Roms with status StatusNoDump have no known dump
+// and are ignored when verifying.
+const (
+	StatusGood     = "good"
+	StatusBadDump  = "baddump"
+	StatusNoDump   = "nodump"
+	StatusVerified = "verified"
+)
+
+// Hash is a CRC32, MD5 or SHA1 in big-endian byte order. A nil Hash means
+// the hash is not known. Hashes are printed and JSON encoded as lowercase
+// hex.
+type Hash []byte
+
+// Sizes of the hashes in bytes.
+const (
+	CRCSize  = 4
+	MD5Size  = 16
+	SHA1Size = 20
+)
+
+// ParseHash decodes a hex encoded CRC32, MD5 or SHA1. An empty string
+// results in a nil Hash.
+func ParseHash(s string) (Hash, error) {
+	h, err := parseHash(s)
+	if err != nil || h == nil {
+		return h, err
+	}
+	if len(h) != CRCSize && len(h) != MD5Size && len(h) != SHA1Size {
+		return nil, fmt.Errorf("invalid hash %q: wrong length", s)
+	}
+	return h, nil
+}
+
+// ParseCRC decodes a hex encoded CRC32. Some DATs drop leading zeros, so
+// shorter strings are padded with zeros. An empty string results in a nil
+// Hash.
+func ParseCRC(s string) (Hash, error) {
+	s = strings.TrimSpace(s)
+	if s != "" && s != "-" && len(s) < 2*CRCSize {
+		s = strings.Repeat("0", 2*CRCSize-len(s)) + s
+	}
+	return parseSized(s, "crc", CRCSize)
+}
+
+// ParseMD5 decodes a hex encoded MD5. An empty string results in a nil
+// Hash.
+func ParseMD5(s string) (Hash, error) {
+	return parseSized(s, "md5", MD5Size)
+}
+
+// ParseSHA1 decodes a hex encoded SHA1. An empty string results in a nil
+// Hash.
+func ParseSHA1(s string) (Hash, error) {
+	return parseSized(s, "sha1", SHA1Size)
+}
+
+func parseSized(s, kind string, size int) (Hash, error) {
+	h, err := parseHash(s)
+	if err != nil || h == nil {
+		return h, err
+	}
+	if len(h) != size {
+		return nil, fmt.Errorf("invalid %s %q: want %d hex digits", kind, s, 2*size)
+	}
+	return h, nil
+}
+
+func parseHash(s string) (Hash, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "-" {
+		return nil, nil
+	}
+	h, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hash %q: %v", s, err)
+	}
+	return Hash(h), nil
+}
+
+// CRC returns the Hash of a CRC32 value.
+func CRC(crc uint32) Hash {
+	return Hash{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)}
+}
+
+func (h Hash) String() string {
+	return hex.EncodeToString(h)
+}
+
+// Equal reports whether h and o are the same hash.
+func (h Hash) Equal(o Hash) bool {
+	return bytes.Equal(h, o)
+}
+
+// MarshalJSON encodes h as a hex string.
+func (h Hash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.String())
+}
+
+// UnmarshalJSON decodes h from a hex string.
+func (h *Hash) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := ParseHash(s)
+	if err != nil {
+		return err
+	}
+	*h = v
+	return nil
+}
+
+// Dat is a parsed DAT file.
+type Dat struct {
+	Header Header  `json:"header"`
+	Games  []*Game `json:"games"`
+}
+
+// Header describes the DAT itself.
+type Header struct {
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Category    string `json:"category,omitempty"`
+	Version     string `json:"version,omitempty"`
+	Date        string `json:"date,omitempty"`
+	Author      string `json:"author,omitempty"`
+	Email       string `json:"email,omitempty"`
+	Homepage    string `json:"homepage,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+
+	// ClrMamePro settings. ForceMerging is one of "none", "split" and
+	// "full". Skipper names the header detector for the roms.
+	ForceMerging string `json:"forcemerging,omitempty"`
+	ForceNoDump  string `json:"forcenodump,omitempty"`
+	ForcePacking string `json:"forcepacking,omitempty"`
+	Skipper      string `json:"skipper,omitempty"`
+}
+
+// Game is a set of roms stored in one archive. Games are called machines
+// in newer MAME DATs.
+//
+// A clone names its parent in CloneOf. RomOf names the set the game takes
+// shared roms from, which is either the parent or a bios set. Roms with a
+// Merge name are shared and stored under that name in the set named by
+// RomOf when sets are split or merged.
+type Game struct {
+	Name         string `json:"name"`
+	Description  string `json:"description,omitempty"`
+	Year         string `json:"year,omitempty"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	CloneOf      string `json:"cloneof,omitempty"`
+	RomOf        string `json:"romof,omitempty"`
+	SampleOf     string `json:"sampleof,omitempty"`
+	IsBios       bool   `json:"isbios,omitempty"`
+	Roms         []*Rom `json:"roms"`
+}
+
+// Rom is a file of a game.
+type Rom struct {
+	Name   string `json:"name"`
+	Size   uint64 `json:"size"`
+	CRC    Hash   `json:"crc,omitempty"`
+	MD5    Hash   `json:"md5,omitempty"`
+	SHA1   Hash   `json:"sha1,omitempty"`
+	Merge  string `json:"merge,omitempty"`
+	Status string `json:"status,omitempty"`
+}
+
+// Game returns the game with the given name, or nil. It looks at every
+// game, so callers looking up many games should use GamesByName.
+func (d *Dat) Game(name string) *Game {
+	for _, g := range d.Games {
+		if g.Name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// GamesByName returns a map from game names to the games of d. If several
+// games have the same name, the first one is in the map, as with Game.
+func (d *Dat) GamesByName() map[string]*Game {
+	m := make(map[string]*Game, len(d.Games))
+	for _, g := range d.Games {
+		if _, ok := m[g.Name]; !ok {
+			m[g.Name] = g
+		}
+	}
+	return m
+}
+
+// romName converts the path separators of DAT rom names to the forward
+// slashes used in zip files.
+func romName(name string) string {
+	return strings.Replace(name, "\\", "/", -1)
+}
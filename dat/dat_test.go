@@ -0,0 +1,139 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package dat
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  Format
+	}{
+		{testXML, Logiqx},
+		{"\ufeff" + testXML, Logiqx},
+		{testCMP, ClrMamePro},
+		{testRC, RomCenter},
+	} {
+		d, f, err := Parse(strings.NewReader(tc.input))
+		if err != nil {
+			t.Fatalf("%v: %v", tc.want, err)
+		}
+		if f != tc.want {
+			t.Errorf("detected %v, want %v", f, tc.want)
+		}
+		if len(d.Games) != 3 {
+			t.Errorf("%v: got %d games, want 3", f, len(d.Games))
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	d, err := ParseClrMamePro(strings.NewReader(testCMP))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// xml -> cmp -> xml keeps everything
+	for _, f := range []Format{Logiqx, ClrMamePro, Logiqx} {
+		var buf bytes.Buffer
+		if err := Write(&buf, d, f); err != nil {
+			t.Fatal(err)
+		}
+		parsed, pf, err := Parse(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pf != f {
+			t.Errorf("wrote %v, detected %v", f, pf)
+		}
+		if !reflect.DeepEqual(parsed, d) {
+			t.Errorf("converting to %v changed dat:\n%s", f, buf.String())
+		}
+		d = parsed
+	}
+
+	for _, s := range []string{"xml", "CMP", "rc"} {
+		f, err := ParseFormat(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.EqualFold(f.String(), s) {
+			t.Errorf("format %s parsed as %v", s, f)
+		}
+	}
+}
+
+func TestGamesByName(t *testing.T) {
+	d, err := ParseClrMamePro(strings.NewReader(testCMP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	games := d.GamesByName()
+	if len(games) != len(d.Games) {
+		t.Errorf("GamesByName has %d games, want %d", len(games), len(d.Games))
+	}
+	for _, g := range d.Games {
+		if games[g.Name] != g || d.Game(g.Name) != g {
+			t.Errorf("game %s not found by name", g.Name)
+		}
+	}
+}
+
+func TestParseHashes(t *testing.T) {
+	crc, err := ParseCRC("abcdef1")
+	if err != nil || !crc.Equal(CRC(0x0abcdef1)) {
+		t.Errorf("got %v, %v for a 7 digit crc", crc, err)
+	}
+	for _, tc := range []struct {
+		parse func(string) (Hash, error)
+		input string
+	}{
+		{ParseCRC, "123456789a"},
+		{ParseMD5, "0123456789abcdef"},
+		{ParseSHA1, "0123456789abcdef0123456789abcdef"},
+		{ParseHash, "0123456789"},
+	} {
+		if h, err := tc.parse(tc.input); err == nil {
+			t.Errorf("got %v for %q, want an error", h, tc.input)
+		}
+	}
+
+	input := `game ( name g rom ( crc 12345678 sha1 0123 name bad.bin ) )`
+	_, err = ParseClrMamePro(strings.NewReader(input))
+	if err == nil || !strings.Contains(err.Error(), "bad.bin") {
+		t.Errorf("got error %v, want one naming the rom", err)
+	}
+}
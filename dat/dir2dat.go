@@ -0,0 +1,128 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package dat
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/uwedeportivo/torrentzip/czip"
+	"github.com/uwedeportivo/torrentzip/scanner"
+)
+
+// FromDir creates a DAT with header h from the zip files below dir. Every
+// archive becomes a game named like the archive without its extension and
+// every entry becomes a rom. Entry names that aren't valid UTF-8 are
+// decoded as code page 437. Directory entries, which the torrentzip
+// Writer stores for empty directories, become zero length roms whose name
+// ends in a slash. If hashEntries is set, entries are decompressed to
+// compute their MD5 and SHA1. Games are sorted by name so that the same
+// archives always result in the same DAT.
+func FromDir(dir string, h Header, hashEntries bool) (*Dat, error) {
+	d := &Dat{Header: h}
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		zip, err := scanner.IsZip(path)
+		if err != nil || !zip {
+			return err
+		}
+		g, err := ArchiveGame(path, hashEntries)
+		if err != nil {
+			return err
+		}
+		d.Games = append(d.Games, g)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(d.Games, func(i, j int) bool {
+		return d.Games[i].Name < d.Games[j].Name
+	})
+	return d, nil
+}
+
+// ArchiveGame reads the zip file at path and returns a game describing it.
+func ArchiveGame(path string, hashEntries bool) (*Game, error) {
+	zr, err := czip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	name := SetName(path)
+	g := &Game{Name: name, Description: name}
+	for _, fh := range zr.File {
+		rom := &Rom{
+			Name: zipName(fh.Name),
+			Size: fh.UncompressedSize64,
+			CRC:  CRC(fh.CRC32),
+		}
+		if hashEntries {
+			if err := hashRom(fh, rom); err != nil {
+				return nil, err
+			}
+		}
+		g.Roms = append(g.Roms, rom)
+	}
+	return g, nil
+}
+
+func hashRom(fh *czip.File, rom *Rom) error {
+	md5h := md5.New()
+	sha1h := sha1.New()
+	if !strings.HasSuffix(fh.Name, "/") {
+		fr, err := fh.Open()
+		if err != nil {
+			return err
+		}
+		defer fr.Close()
+
+		if _, err := io.Copy(io.MultiWriter(md5h, sha1h), fr); err != nil {
+			return err
+		}
+	}
+	rom.MD5 = md5h.Sum(nil)
+	rom.SHA1 = sha1h.Sum(nil)
+	return nil
+}
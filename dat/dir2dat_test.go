@@ -0,0 +1,139 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package dat
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/uwedeportivo/torrentzip/scanner"
+)
+
+func TestFromDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names, err := filepath.Glob(filepath.Join("..", "testdata", "*.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := filepath.Join(dir, strings.ToLower(filepath.Base(name)))
+		if err := ioutil.WriteFile(dst, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := Header{Name: "testdata", Description: "torrentzip testdata", Version: "1"}
+	d, err := FromDir(dir, h, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Games) != len(names) {
+		t.Fatalf("got %d games, want %d", len(d.Games), len(names))
+	}
+	for i := 1; i < len(d.Games); i++ {
+		if d.Games[i-1].Name >= d.Games[i].Name {
+			t.Errorf("games not sorted: %s >= %s", d.Games[i-1].Name, d.Games[i].Name)
+		}
+	}
+
+	var dirRom *Rom
+	for _, g := range d.Games {
+		for _, rom := range g.Roms {
+			if !utf8.ValidString(rom.Name) {
+				t.Errorf("rom name %q is not valid utf-8", rom.Name)
+			}
+			if len(rom.MD5) != 16 || len(rom.SHA1) != 20 {
+				t.Errorf("rom %s not hashed", rom.Name)
+			}
+			if strings.HasSuffix(rom.Name, "/") {
+				dirRom = rom
+			}
+		}
+	}
+	if dirRom == nil || dirRom.Size != 0 || dirRom.CRC.String() != "00000000" ||
+		dirRom.SHA1.String() != "da39a3ee5e6b4b0d3255bfef95601890afd80709" {
+		t.Errorf("unexpected directory rom %+v", dirRom)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteXML(&buf, d); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := FromDir(dir, h, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf2 bytes.Buffer
+	if err := WriteXML(&buf2, again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), buf2.Bytes()) {
+		t.Error("dat output is not deterministic")
+	}
+
+	parsed, err := ParseXML(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, d) {
+		t.Error("parsed dat differs from written dat")
+	}
+
+	r, err := VerifyDir(parsed, &scanner.Scanner{HashEntries: true}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete, _, _ := r.Count()
+	if complete != len(names) {
+		t.Errorf("got %d complete sets, want %d", complete, len(names))
+	}
+	for _, s := range r.Sets {
+		if len(s.Unneeded) > 0 {
+			t.Errorf("%s: unneeded %v", s.Name, s.Unneeded)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package dat
+
+// Fixdat returns a DAT listing the roms that r reports missing or with a
+// wrong hash. Complete sets are left out. If full is set, sets with
+// missing roms are listed with all their roms, otherwise only with the
+// roms that are missing. Roms with status StatusNoDump are never listed.
+func Fixdat(d *Dat, r *Report, full bool) *Dat {
+	fd := &Dat{Header: d.Header}
+	fd.Header.Name = "fix_" + d.Header.Name
+	if d.Header.Description != "" {
+		fd.Header.Description = "fix_" + d.Header.Description
+	}
+
+	games := d.GamesByName()
+	for _, s := range r.Sets {
+		if s.Status == SetComplete {
+			continue
+		}
+		g := games[s.Name]
+		if g == nil {
+			continue
+		}
+
+		missing := make(map[*Rom]bool)
+		for _, rom := range s.Missing {
+			missing[rom] = true
+		}
+		for _, m := range s.WrongHash {
+			missing[m.Rom] = true
+		}
+
+		fg := *g
+		fg.Roms = nil
+		for _, rom := range g.Roms {
+			if rom.Status == StatusNoDump {
+				continue
+			}
+			if full || missing[rom] {
+				fg.Roms = append(fg.Roms, rom)
+			}
+		}
+		fd.Games = append(fd.Games, &fg)
+	}
+	return fd
+}
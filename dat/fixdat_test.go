@@ -0,0 +1,85 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package dat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip/scanner"
+)
+
+func TestFixdat(t *testing.T) {
+	d, err := ParseXML(strings.NewReader(testXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := []*scanner.Result{
+		{
+			Path: "/roms/parent.zip",
+			Entries: []*scanner.Entry{
+				{Name: "a.bin", Size: 1024, CRC32: 0xdeadbeef},
+				{Name: "sub/b.bin", Size: 16, CRC32: 0x12345678},
+			},
+		},
+		{
+			Path:    "/roms/clone.zip",
+			Entries: []*scanner.Entry{{Name: "a.bin", Size: 1024, CRC32: 0xdeadbeef}},
+		},
+	}
+	r := Verify(d, results)
+
+	fd := Fixdat(d, r, false)
+	if fd.Header.Name != "fix_Test" {
+		t.Errorf("got header name %s", fd.Header.Name)
+	}
+	if len(fd.Games) != 2 {
+		t.Fatalf("got %d games, want 2", len(fd.Games))
+	}
+	p := fd.Games[0]
+	if p.Name != "parent" || p.Description != "Parent Game" || len(p.Roms) != 1 || p.Roms[0].Name != "sub\\b.bin" {
+		t.Errorf("unexpected partial set %+v", p)
+	}
+	b := fd.Games[1]
+	if b.Name != "bios" || !b.IsBios || len(b.Roms) != 1 {
+		t.Errorf("unexpected missing set %+v", b)
+	}
+
+	fd = Fixdat(d, r, true)
+	if p := fd.Games[0]; len(p.Roms) != 2 {
+		t.Errorf("full partial set has %d roms, want 2 without the nodump rom", len(p.Roms))
+	}
+
+	if len(d.Game("parent").Roms) != 3 {
+		t.Error("fixdat modified the original dat")
+	}
+}
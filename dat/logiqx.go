@@ -0,0 +1,305 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package dat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type xmlDatafile struct {
+	Header   xmlHeader  `xml:"header"`
+	Games    []*xmlGame `xml:"game"`
+	Machines []*xmlGame `xml:"machine"`
+}
+
+type xmlHeader struct {
+	Name        string `xml:"name"`
+	Description string `xml:"description"`
+	Category    string `xml:"category"`
+	Version     string `xml:"version"`
+	Date        string `xml:"date"`
+	Author      string `xml:"author"`
+	Email       string `xml:"email"`
+	Homepage    string `xml:"homepage"`
+	URL         string `xml:"url"`
+	Comment     string `xml:"comment"`
+
+	ClrMamePro *xmlClrMamePro `xml:"clrmamepro"`
+}
+
+type xmlClrMamePro struct {
+	Header       string `xml:"header,attr"`
+	ForceMerging string `xml:"forcemerging,attr"`
+	ForceNoDump  string `xml:"forcenodump,attr"`
+	ForcePacking string `xml:"forcepacking,attr"`
+}
+
+type xmlGame struct {
+	Name         string    `xml:"name,attr"`
+	CloneOf      string    `xml:"cloneof,attr,omitempty"`
+	RomOf        string    `xml:"romof,attr,omitempty"`
+	SampleOf     string    `xml:"sampleof,attr,omitempty"`
+	IsBios       string    `xml:"isbios,attr,omitempty"`
+	Description  string    `xml:"description"`
+	Year         string    `xml:"year,omitempty"`
+	Manufacturer string    `xml:"manufacturer,omitempty"`
+	Roms         []*xmlRom `xml:"rom"`
+}
+
+type xmlRom struct {
+	Name   string `xml:"name,attr"`
+	Size   string `xml:"size,attr"`
+	CRC    string `xml:"crc,attr,omitempty"`
+	MD5    string `xml:"md5,attr,omitempty"`
+	SHA1   string `xml:"sha1,attr,omitempty"`
+	Merge  string `xml:"merge,attr,omitempty"`
+	Status string `xml:"status,attr,omitempty"`
+}
+
+// ParseXML parses a Logiqx XML DAT. MAME style DATs with machine elements
+// instead of game elements are accepted as well.
+func ParseXML(r io.Reader) (*Dat, error) {
+	dec := xml.NewDecoder(bufio.NewReader(r))
+	dec.CharsetReader = charsetReader
+	dec.Strict = false
+
+	var df xmlDatafile
+	if err := dec.Decode(&df); err != nil {
+		return nil, fmt.Errorf("parsing xml dat failed: %v", err)
+	}
+
+	d := &Dat{
+		Header: Header{
+			Name:        df.Header.Name,
+			Description: df.Header.Description,
+			Category:    df.Header.Category,
+			Version:     df.Header.Version,
+			Date:        df.Header.Date,
+			Author:      df.Header.Author,
+			Email:       df.Header.Email,
+			Homepage:    df.Header.Homepage,
+			URL:         df.Header.URL,
+			Comment:     df.Header.Comment,
+		},
+	}
+	if cmp := df.Header.ClrMamePro; cmp != nil {
+		d.Header.ForceMerging = cmp.ForceMerging
+		d.Header.ForceNoDump = cmp.ForceNoDump
+		d.Header.ForcePacking = cmp.ForcePacking
+		d.Header.Skipper = cmp.Header
+	}
+
+	for _, xg := range append(df.Games, df.Machines...) {
+		g := &Game{
+			Name:         xg.Name,
+			Description:  xg.Description,
+			Year:         xg.Year,
+			Manufacturer: xg.Manufacturer,
+			CloneOf:      xg.CloneOf,
+			RomOf:        xg.RomOf,
+			SampleOf:     xg.SampleOf,
+			IsBios:       xg.IsBios == "yes",
+		}
+		for _, xr := range xg.Roms {
+			rom, err := xr.rom()
+			if err != nil {
+				return nil, fmt.Errorf("game %s: %v", xg.Name, err)
+			}
+			g.Roms = append(g.Roms, rom)
+		}
+		d.Games = append(d.Games, g)
+	}
+	return d, nil
+}
+
+func (xr *xmlRom) rom() (*Rom, error) {
+	rom := &Rom{
+		Name:   xr.Name,
+		Merge:  xr.Merge,
+		Status: xr.Status,
+	}
+
+	var err error
+	if xr.Size != "" {
+		rom.Size, err = strconv.ParseUint(strings.TrimSpace(xr.Size), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("rom %s: invalid size %q", xr.Name, xr.Size)
+		}
+	}
+	if rom.CRC, err = ParseCRC(xr.CRC); err != nil {
+		return nil, fmt.Errorf("rom %s: %v", xr.Name, err)
+	}
+	if rom.MD5, err = ParseMD5(xr.MD5); err != nil {
+		return nil, fmt.Errorf("rom %s: %v", xr.Name, err)
+	}
+	if rom.SHA1, err = ParseSHA1(xr.SHA1); err != nil {
+		return nil, fmt.Errorf("rom %s: %v", xr.Name, err)
+	}
+	return rom, nil
+}
+
+const xmlPreamble = `<?xml version="1.0"?>
+<!DOCTYPE datafile PUBLIC "-//Logiqx//DTD ROM Management Datafile//EN" "http://www.logiqx.com/Dats/datafile.dtd">
+`
+
+// WriteXML writes d as a Logiqx XML DAT. Empty header fields and
+// attributes are left out.
+func WriteXML(w io.Writer, d *Dat) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(xmlPreamble)
+	bw.WriteString("<datafile>\n")
+
+	h := d.Header
+	bw.WriteString("\t<header>\n")
+	for _, f := range []struct{ tag, value string }{
+		{"name", h.Name},
+		{"description", h.Description},
+		{"category", h.Category},
+		{"version", h.Version},
+		{"date", h.Date},
+		{"author", h.Author},
+		{"email", h.Email},
+		{"homepage", h.Homepage},
+		{"url", h.URL},
+		{"comment", h.Comment},
+	} {
+		writeElement(bw, "\t\t", f.tag, f.value)
+	}
+	if h.ForceMerging != "" || h.ForceNoDump != "" || h.ForcePacking != "" || h.Skipper != "" {
+		bw.WriteString("\t\t<clrmamepro")
+		writeAttr(bw, "header", h.Skipper)
+		writeAttr(bw, "forcemerging", h.ForceMerging)
+		writeAttr(bw, "forcenodump", h.ForceNoDump)
+		writeAttr(bw, "forcepacking", h.ForcePacking)
+		bw.WriteString("/>\n")
+	}
+	bw.WriteString("\t</header>\n")
+
+	for _, g := range d.Games {
+		bw.WriteString("\t<game")
+		writeAttr(bw, "name", g.Name)
+		writeAttr(bw, "cloneof", g.CloneOf)
+		writeAttr(bw, "romof", g.RomOf)
+		writeAttr(bw, "sampleof", g.SampleOf)
+		if g.IsBios {
+			writeAttr(bw, "isbios", "yes")
+		}
+		bw.WriteString(">\n")
+		writeElement(bw, "\t\t", "description", g.Description)
+		writeElement(bw, "\t\t", "year", g.Year)
+		writeElement(bw, "\t\t", "manufacturer", g.Manufacturer)
+		for _, rom := range g.Roms {
+			bw.WriteString("\t\t<rom")
+			writeAttr(bw, "name", rom.Name)
+			writeAttr(bw, "size", strconv.FormatUint(rom.Size, 10))
+			writeAttr(bw, "crc", rom.CRC.String())
+			writeAttr(bw, "md5", rom.MD5.String())
+			writeAttr(bw, "sha1", rom.SHA1.String())
+			writeAttr(bw, "merge", rom.Merge)
+			writeAttr(bw, "status", rom.Status)
+			bw.WriteString("/>\n")
+		}
+		bw.WriteString("\t</game>\n")
+	}
+
+	bw.WriteString("</datafile>\n")
+	return bw.Flush()
+}
+
+func escape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func writeElement(bw *bufio.Writer, indent, tag, value string) {
+	if value == "" {
+		return
+	}
+	fmt.Fprintf(bw, "%s<%s>%s</%s>\n", indent, tag, escape(value), tag)
+}
+
+func writeAttr(bw *bufio.Writer, name, value string) {
+	if value == "" {
+		return
+	}
+	fmt.Fprintf(bw, " %s=\"%s\"", name, escape(value))
+}
+
+// charsetReader handles the single byte encodings some DAT tools declare,
+// treating them as Latin-1.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "latin-1", "windows-1252", "cp1252", "us-ascii", "ascii":
+		return &latin1Reader{r: bufio.NewReader(input)}, nil
+	}
+	return nil, fmt.Errorf("unsupported charset %s", charset)
+}
+
+type latin1Reader struct {
+	r   io.ByteReader
+	buf []byte
+}
+
+func (lr *latin1Reader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(lr.buf) > 0 {
+			c := copy(p[n:], lr.buf)
+			lr.buf = lr.buf[c:]
+			n += c
+			continue
+		}
+		b, err := lr.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if b < utf8.RuneSelf {
+			p[n] = b
+			n++
+			continue
+		}
+		var enc [2]byte
+		utf8.EncodeRune(enc[:], rune(b))
+		lr.buf = append(lr.buf[:0], enc[:]...)
+	}
+	return n, nil
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package dat
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testXML = `<?xml version="1.0"?>
+<!DOCTYPE datafile PUBLIC "-//Logiqx//DTD ROM Management Datafile//EN" "http://www.logiqx.com/Dats/datafile.dtd">
+<datafile>
+	<header>
+		<name>Test</name>
+		<description>Test DAT</description>
+		<version>20130101</version>
+		<author>uwe</author>
+	</header>
+	<game name="parent">
+		<description>Parent Game</description>
+		<year>1985</year>
+		<manufacturer>Acme</manufacturer>
+		<rom name="a.bin" size="1024" crc="DEADBEEF" md5="d41d8cd98f00b204e9800998ecf8427e" sha1="da39a3ee5e6b4b0d3255bfef95601890afd80709"/>
+		<rom name="sub\b.bin" size="16" crc="0badf00d"/>
+		<rom name="c.bin" size="16" status="nodump"/>
+	</game>
+	<game name="clone" cloneof="parent" romof="parent">
+		<description>Clone Game</description>
+		<rom name="a.bin" merge="a.bin" size="1024" crc="deadbeef"/>
+	</game>
+	<machine name="bios" isbios="yes">
+		<description>Bios</description>
+		<rom name="bios.bin" size="8" crc="01020304"/>
+	</machine>
+</datafile>
+`
+
+func TestParseXML(t *testing.T) {
+	d, err := ParseXML(strings.NewReader(testXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Header.Name != "Test" || d.Header.Description != "Test DAT" ||
+		d.Header.Version != "20130101" || d.Header.Author != "uwe" {
+		t.Errorf("unexpected header %+v", d.Header)
+	}
+	if len(d.Games) != 3 {
+		t.Fatalf("got %d games, want 3", len(d.Games))
+	}
+
+	p := d.Game("parent")
+	if p == nil || p.Year != "1985" || p.Manufacturer != "Acme" || len(p.Roms) != 3 {
+		t.Fatalf("unexpected parent %+v", p)
+	}
+	a := p.Roms[0]
+	if a.Size != 1024 || a.CRC.String() != "deadbeef" || len(a.MD5) != 16 || len(a.SHA1) != 20 {
+		t.Errorf("unexpected rom %+v", a)
+	}
+	if p.Roms[2].Status != StatusNoDump || p.Roms[2].CRC != nil {
+		t.Errorf("unexpected nodump rom %+v", p.Roms[2])
+	}
+
+	c := d.Game("clone")
+	if c.CloneOf != "parent" || c.RomOf != "parent" || c.Roms[0].Merge != "a.bin" {
+		t.Errorf("unexpected clone %+v", c)
+	}
+	if b := d.Game("bios"); b == nil || !b.IsBios {
+		t.Errorf("machine element not parsed as bios game: %+v", b)
+	}
+}
+
+func TestParseXMLLatin1(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="ISO-8859-1"?><datafile><game name="Fu`)
+	buf.WriteByte(0xdf)
+	buf.WriteString(`ball"><rom name="x" size="1" crc="00000000"/></game></datafile>`)
+
+	d, err := ParseXML(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Games[0].Name != "Fußball" {
+		t.Errorf("got name %q, want %q", d.Games[0].Name, "Fußball")
+	}
+}
+
+func TestParseXMLInvalidHash(t *testing.T) {
+	_, err := ParseXML(strings.NewReader(`<datafile><game name="g"><rom name="x" size="1" crc="xyz"/></game></datafile>`))
+	if err == nil {
+		t.Fatal("expected error for invalid crc")
+	}
+}
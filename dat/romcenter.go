@@ -0,0 +1,299 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package dat
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const rcSep = "¬"
+
+// ParseRomCenter parses a DAT in the RomCenter 2 INI style format.
+//
+// RomCenter DATs don't mark bios sets. A game that other games name in
+// RomOf but that isn't the parent of any game is taken to be a bios set.
+func ParseRomCenter(r io.Reader) (*Dat, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(Dat)
+	games := make(map[string]*Game)
+	section := ""
+	for i, line := range strings.Split(decodeText(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToUpper(line[1 : len(line)-1])
+			continue
+		}
+
+		if section == "GAMES" {
+			if err := rcGameLine(d, games, line); err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		rcHeader(&d.Header, section, strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1]))
+	}
+
+	cloned := make(map[string]bool)
+	for _, g := range d.Games {
+		cloned[g.CloneOf] = true
+	}
+	for _, g := range d.Games {
+		if g.RomOf != "" && !cloned[g.RomOf] {
+			if bios := games[g.RomOf]; bios != nil {
+				bios.IsBios = true
+			}
+		}
+	}
+	return d, nil
+}
+
+func rcHeader(h *Header, section, key, value string) {
+	switch section {
+	case "CREDITS":
+		switch key {
+		case "author":
+			h.Author = value
+		case "version":
+			h.Version = value
+		case "email":
+			h.Email = value
+		case "homepage":
+			h.Homepage = value
+		case "url":
+			h.URL = value
+		case "date":
+			h.Date = value
+		case "comment":
+			h.Comment = value
+		case "category":
+			h.Category = value
+		}
+	case "DAT":
+		switch key {
+		case "split":
+			if value == "1" && h.ForceMerging == "" {
+				h.ForceMerging = "split"
+			}
+		case "merge":
+			if value == "1" {
+				h.ForceMerging = "full"
+			} else if h.ForceMerging == "" {
+				h.ForceMerging = "none"
+			}
+		case "forcenodump":
+			h.ForceNoDump = value
+		case "forcepacking":
+			h.ForcePacking = value
+		case "header":
+			h.Skipper = value
+		}
+	case "EMULATOR":
+		switch key {
+		case "refname":
+			h.Name = value
+		case "version":
+			h.Description = value
+		}
+	}
+}
+
+// rcGameLine parses a line of the form
+// ¬parent¬parent description¬game¬game description¬rom¬crc¬size¬romof¬merge¬
+func rcGameLine(d *Dat, games map[string]*Game, line string) error {
+	fields := strings.Split(strings.TrimSuffix(strings.TrimPrefix(line, rcSep), rcSep), rcSep)
+	if len(fields) < 9 {
+		return fmt.Errorf("expected 9 fields, got %d", len(fields))
+	}
+
+	g := games[fields[2]]
+	if g == nil {
+		g = &Game{
+			Name:        fields[2],
+			Description: fields[3],
+			RomOf:       fields[7],
+		}
+		if fields[0] != fields[2] {
+			g.CloneOf = fields[0]
+		}
+		games[g.Name] = g
+		d.Games = append(d.Games, g)
+	}
+
+	if fields[4] == "" {
+		return nil
+	}
+	rom := &Rom{
+		Name:  fields[4],
+		Merge: fields[8],
+	}
+	var err error
+	if rom.CRC, err = ParseCRC(fields[5]); err != nil {
+		return fmt.Errorf("rom %s: %v", rom.Name, err)
+	}
+	if fields[6] != "" {
+		rom.Size, err = strconv.ParseUint(fields[6], 10, 64)
+		if err != nil {
+			return fmt.Errorf("rom %s: invalid size %q", rom.Name, fields[6])
+		}
+	}
+	g.Roms = append(g.Roms, rom)
+	return nil
+}
+
+// WriteRomCenter writes d in the RomCenter 2 format. The category, forced
+// nodump and packing settings and the header skipper are written as extra
+// keys that RomCenter ignores. Games without roms are written as a line
+// with an empty rom name.
+//
+// RomCenter DATs have no place for year, manufacturer, sampleof, rom MD5,
+// SHA1 and status; RomCenterLosses lists which of them d uses.
+func WriteRomCenter(w io.Writer, d *Dat) error {
+	var sb strings.Builder
+	h := d.Header
+
+	sb.WriteString("[CREDITS]\r\n")
+	writeRcField(&sb, "author", h.Author)
+	writeRcField(&sb, "version", h.Version)
+	writeRcField(&sb, "email", h.Email)
+	writeRcField(&sb, "homepage", h.Homepage)
+	writeRcField(&sb, "url", h.URL)
+	writeRcField(&sb, "date", h.Date)
+	writeRcField(&sb, "comment", h.Comment)
+	writeRcField(&sb, "category", h.Category)
+
+	sb.WriteString("[DAT]\r\n")
+	sb.WriteString("version=2.50\r\n")
+	sb.WriteString("plugin=arcade.dll\r\n")
+	switch h.ForceMerging {
+	case "none":
+		sb.WriteString("split=0\r\nmerge=0\r\n")
+	case "split":
+		sb.WriteString("split=1\r\nmerge=0\r\n")
+	case "full":
+		sb.WriteString("split=1\r\nmerge=1\r\n")
+	}
+	writeRcField(&sb, "forcenodump", h.ForceNoDump)
+	writeRcField(&sb, "forcepacking", h.ForcePacking)
+	writeRcField(&sb, "header", h.Skipper)
+
+	sb.WriteString("[EMULATOR]\r\n")
+	sb.WriteString("refname=" + h.Name + "\r\n")
+	sb.WriteString("version=" + h.Description + "\r\n")
+
+	sb.WriteString("[GAMES]\r\n")
+	games := d.GamesByName()
+	for _, g := range d.Games {
+		parent, parentDesc := g.Name, g.Description
+		if g.CloneOf != "" {
+			parent, parentDesc = g.CloneOf, ""
+			if p := games[g.CloneOf]; p != nil {
+				parentDesc = p.Description
+			}
+		}
+		prefix := rcSep + parent + rcSep + parentDesc + rcSep + g.Name + rcSep + g.Description + rcSep
+		if len(g.Roms) == 0 {
+			sb.WriteString(prefix + rcSep + rcSep + rcSep + g.RomOf + rcSep + rcSep + "\r\n")
+		}
+		for _, rom := range g.Roms {
+			sb.WriteString(prefix + rom.Name + rcSep + rom.CRC.String() + rcSep +
+				strconv.FormatUint(rom.Size, 10) + rcSep + g.RomOf + rcSep + rom.Merge + rcSep + "\r\n")
+		}
+	}
+
+	_, err := io.WriteString(w, encodeLatin1(sb.String()))
+	return err
+}
+
+func writeRcField(sb *strings.Builder, key, value string) {
+	if value != "" {
+		sb.WriteString(key + "=" + value + "\r\n")
+	}
+}
+
+// encodeLatin1 encodes s as Latin-1 if possible, which is what RomCenter
+// expects. Otherwise s is left as UTF-8, which ParseRomCenter detects.
+func encodeLatin1(s string) string {
+	bs := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff {
+			return s
+		}
+		bs = append(bs, byte(r))
+	}
+	return string(bs)
+}
+
+// RomCenterLosses returns the names of the fields used in d that a
+// RomCenter DAT can't hold.
+func RomCenterLosses(d *Dat) []string {
+	lost := make(map[string]bool)
+	cloned := make(map[string]bool)
+	romOf := make(map[string]bool)
+	for _, g := range d.Games {
+		cloned[g.CloneOf] = true
+		romOf[g.RomOf] = true
+	}
+	for _, g := range d.Games {
+		lost["year"] = lost["year"] || g.Year != ""
+		lost["manufacturer"] = lost["manufacturer"] || g.Manufacturer != ""
+		lost["sampleof"] = lost["sampleof"] || g.SampleOf != ""
+		lost["isbios"] = lost["isbios"] || g.IsBios != (romOf[g.Name] && !cloned[g.Name])
+		for _, rom := range g.Roms {
+			lost["md5"] = lost["md5"] || rom.MD5 != nil
+			lost["sha1"] = lost["sha1"] || rom.SHA1 != nil
+			lost["status"] = lost["status"] || rom.Status != ""
+		}
+	}
+
+	var names []string
+	for _, name := range []string{"year", "manufacturer", "sampleof", "isbios", "md5", "sha1", "status"} {
+		if lost[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
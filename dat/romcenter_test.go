@@ -0,0 +1,133 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package dat
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testRC = "[CREDITS]\r\n" +
+	"author=uwe\r\n" +
+	"version=20130101\r\n" +
+	"[DAT]\r\n" +
+	"version=2.50\r\n" +
+	"plugin=arcade.dll\r\n" +
+	"split=1\r\n" +
+	"merge=0\r\n" +
+	"[EMULATOR]\r\n" +
+	"refname=Test\r\n" +
+	"version=Test DAT\r\n" +
+	"[GAMES]\r\n" +
+	"\xacbios\xacBios\xacbios\xacBios\xacbios.bin\xac01020304\xac8\xac\xac\xac\r\n" +
+	"\xacparent\xacParent Game\xacparent\xacParent Game\xaca.bin\xacdeadbeef\xac1024\xacbios\xac\xac\r\n" +
+	"\xacparent\xacParent Game\xacclone\xacClone Game\xaca.bin\xacdeadbeef\xac1024\xacparent\xaca.bin\xac\r\n" +
+	"\xacparent\xacParent Game\xacclone\xacClone Game\xacFu\xdfball.bin\xac0badf00d\xac16\xacparent\xac\xac\r\n"
+
+func TestParseRomCenter(t *testing.T) {
+	d, err := ParseRomCenter(strings.NewReader(testRC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Header{
+		Name:         "Test",
+		Description:  "Test DAT",
+		Version:      "20130101",
+		Author:       "uwe",
+		ForceMerging: "split",
+	}
+	if d.Header != want {
+		t.Errorf("got header %+v, want %+v", d.Header, want)
+	}
+	if len(d.Games) != 3 {
+		t.Fatalf("got %d games, want 3", len(d.Games))
+	}
+	if b := d.Game("bios"); !b.IsBios || b.CloneOf != "" {
+		t.Errorf("unexpected bios %+v", b)
+	}
+	if p := d.Game("parent"); p.IsBios || p.CloneOf != "" || p.RomOf != "bios" {
+		t.Errorf("unexpected parent %+v", p)
+	}
+	c := d.Game("clone")
+	if c.CloneOf != "parent" || c.RomOf != "parent" || len(c.Roms) != 2 {
+		t.Fatalf("unexpected clone %+v", c)
+	}
+	if c.Roms[0].Merge != "a.bin" || c.Roms[0].Size != 1024 || c.Roms[0].CRC.String() != "deadbeef" {
+		t.Errorf("unexpected rom %+v", c.Roms[0])
+	}
+	if c.Roms[1].Name != "Fußball.bin" {
+		t.Errorf("latin-1 name decoded as %q", c.Roms[1].Name)
+	}
+}
+
+func TestRomCenterRoundTrip(t *testing.T) {
+	d, err := ParseRomCenter(strings.NewReader(testRC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Header.Category = "Arcade"
+	d.Header.Skipper = "header.xml"
+	d.Games = append(d.Games, &Game{Name: "empty", Description: "No Roms"})
+
+	if losses := RomCenterLosses(d); len(losses) != 0 {
+		t.Fatalf("unexpected losses %v", losses)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteRomCenter(&buf, d); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\xacFu\xdfball.bin\xac") {
+		t.Errorf("names not written as latin-1:\n%s", buf.String())
+	}
+	parsed, err := ParseRomCenter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, d) {
+		t.Errorf("round trip changed dat:\n%s", buf.String())
+	}
+}
+
+func TestRomCenterLosses(t *testing.T) {
+	d, err := ParseXML(strings.NewReader(testXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := RomCenterLosses(d)
+	want := []string{"year", "manufacturer", "isbios", "md5", "sha1", "status"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got losses %v, want %v", got, want)
+	}
+}
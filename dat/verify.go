@@ -0,0 +1,254 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package dat
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/uwedeportivo/torrentzip/scanner"
+)
+
+// Set status values.
+const (
+	SetComplete = "complete"
+	SetPartial  = "partial"
+	SetMissing  = "missing"
+)
+
+// Report is the result of verifying a collection against a DAT.
+type Report struct {
+	Sets []*SetReport `json:"sets"`
+
+	// Unknown lists archives that don't belong to any set of the DAT.
+	Unknown []string `json:"unknown,omitempty"`
+
+	// Failed maps archives that could not be read to the error message.
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// SetReport is the result of verifying one set.
+type SetReport struct {
+	Name          string      `json:"name"`
+	Status        string      `json:"status"`
+	Archive       string      `json:"archive,omitempty"`
+	Torrentzipped bool        `json:"torrentzipped"`
+	Have          []*Rom      `json:"have,omitempty"`
+	Missing       []*Rom      `json:"missing,omitempty"`
+	WrongHash     []*Mismatch `json:"wronghash,omitempty"`
+	Unneeded      []*Rom      `json:"unneeded,omitempty"`
+
+	// Merged lists roms the archive doesn't have which are shared with
+	// the parent or bios of the set. Split sets leave them to the parent,
+	// so they don't make the set incomplete.
+	Merged []*Rom `json:"merged,omitempty"`
+}
+
+// Mismatch is an archive entry whose name matches a rom but whose size or
+// hashes don't.
+type Mismatch struct {
+	Rom   *Rom `json:"rom"`
+	Found *Rom `json:"found"`
+}
+
+// Count returns the number of complete, partial and missing sets.
+func (r *Report) Count() (complete, partial, missing int) {
+	for _, s := range r.Sets {
+		switch s.Status {
+		case SetComplete:
+			complete++
+		case SetPartial:
+			partial++
+		case SetMissing:
+			missing++
+		}
+	}
+	return
+}
+
+// VerifyDir scans the given directories with s and verifies the archives
+// found against d.
+func VerifyDir(d *Dat, s *scanner.Scanner, dirs ...string) (*Report, error) {
+	sr, err := s.Scan(dirs...)
+	if err != nil {
+		return nil, err
+	}
+	r := Verify(d, sr.Results)
+	for path, err := range sr.Failed {
+		if r.Failed == nil {
+			r.Failed = make(map[string]string)
+		}
+		r.Failed[path] = err.Error()
+	}
+	return r, nil
+}
+
+// Verify matches scanned archives against the sets of d. An archive
+// belongs to the set named like the archive without its extension. If
+// several archives map to the same set, the first one by path is used
+// and the others are reported as unknown.
+func Verify(d *Dat, results []*scanner.Result) *Report {
+	sorted := make([]*scanner.Result, len(results))
+	copy(sorted, results)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Path < sorted[j].Path
+	})
+
+	r := &Report{}
+	games := d.GamesByName()
+	archives := make(map[string]*scanner.Result)
+	for _, res := range sorted {
+		name := SetName(res.Path)
+		if games[name] == nil || archives[name] != nil {
+			r.Unknown = append(r.Unknown, res.Path)
+			continue
+		}
+		archives[name] = res
+	}
+
+	for _, g := range d.Games {
+		r.Sets = append(r.Sets, VerifySet(g, archives[g.Name]))
+	}
+	return r
+}
+
+// SetName returns the name of the set stored in the archive at path.
+func SetName(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// SetPath returns the path of the archive of set g in dir. It fails if the
+// name of g is absolute or leads out of dir, as in a crafted DAT.
+func SetPath(dir string, g *Game) (string, error) {
+	name := filepath.Clean(g.Name)
+	if g.Name == "" || filepath.IsAbs(g.Name) || filepath.VolumeName(g.Name) != "" ||
+		name == "." || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid set name %q", g.Name)
+	}
+	return filepath.Join(dir, name+".zip"), nil
+}
+
+// VerifySet matches the entries of an archive against the roms of g. Entry
+// names that aren't valid UTF-8 are decoded as code page 437. A nil
+// archive reports all roms as missing. Roms with status StatusNoDump are
+// ignored. Roms with a merge attribute are only required if g has no
+// parent, so both split and non-merged sets verify.
+func VerifySet(g *Game, archive *scanner.Result) *SetReport {
+	sr := &SetReport{Name: g.Name}
+
+	entries := make(map[string]*scanner.Entry)
+	if archive != nil {
+		sr.Archive = archive.Path
+		sr.Torrentzipped = archive.Torrentzipped
+		for _, e := range archive.Entries {
+			entries[zipName(e.Name)] = e
+		}
+	}
+
+	used := make(map[string]bool)
+	for _, rom := range g.Roms {
+		if rom.Status == StatusNoDump {
+			continue
+		}
+		name := romName(rom.Name)
+		e := entries[name]
+		switch {
+		case e == nil && rom.Merge != "" && (g.RomOf != "" || g.CloneOf != ""):
+			sr.Merged = append(sr.Merged, rom)
+		case e == nil:
+			sr.Missing = append(sr.Missing, rom)
+		case rom.Matches(e):
+			sr.Have = append(sr.Have, rom)
+		default:
+			sr.WrongHash = append(sr.WrongHash, &Mismatch{Rom: rom, Found: EntryRom(e)})
+		}
+		used[name] = true
+	}
+
+	if archive != nil {
+		for _, e := range archive.Entries {
+			if !used[zipName(e.Name)] {
+				sr.Unneeded = append(sr.Unneeded, EntryRom(e))
+			}
+		}
+	}
+
+	switch {
+	case len(sr.Missing) == 0 && len(sr.WrongHash) == 0:
+		sr.Status = SetComplete
+	case len(sr.Have) > 0:
+		sr.Status = SetPartial
+	default:
+		sr.Status = SetMissing
+	}
+	return sr
+}
+
+// Matches reports whether the archive entry e, or its headerless content
+// if it has a copier header, has the size and hashes of rom. MD5 and SHA1
+// are only compared if both are known.
+func (rom *Rom) Matches(e *scanner.Entry) bool {
+	if rom.matches(e.Size, e.CRC32, e.MD5, e.SHA1) {
+		return true
+	}
+	h := e.Headerless
+	return h != nil && rom.matches(h.Size, h.CRC32, h.MD5, h.SHA1)
+}
+
+func (rom *Rom) matches(size uint64, crc uint32, md5, sha1 []byte) bool {
+	if rom.Size != size {
+		return false
+	}
+	if rom.CRC != nil && !rom.CRC.Equal(CRC(crc)) {
+		return false
+	}
+	if rom.MD5 != nil && md5 != nil && !rom.MD5.Equal(md5) {
+		return false
+	}
+	if rom.SHA1 != nil && sha1 != nil && !rom.SHA1.Equal(sha1) {
+		return false
+	}
+	return true
+}
+
+// EntryRom returns a Rom describing the archive entry e.
+func EntryRom(e *scanner.Entry) *Rom {
+	return &Rom{
+		Name: zipName(e.Name),
+		Size: e.Size,
+		CRC:  CRC(e.CRC32),
+		MD5:  Hash(e.MD5),
+		SHA1: Hash(e.SHA1),
+	}
+}
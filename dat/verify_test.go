@@ -0,0 +1,215 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package dat
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip/detector"
+	"github.com/uwedeportivo/torrentzip/scanner"
+)
+
+func TestVerify(t *testing.T) {
+	d, err := ParseXML(strings.NewReader(testXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := []*scanner.Result{
+		{
+			Path:          "/roms/parent.zip",
+			Torrentzipped: true,
+			Entries: []*scanner.Entry{
+				{Name: "a.bin", Size: 1024, CRC32: 0xdeadbeef},
+				{Name: "sub/b.bin", Size: 16, CRC32: 0x12345678},
+				{Name: "readme.txt", Size: 3, CRC32: 0x1},
+			},
+		},
+		{
+			Path:    "/roms/clone.zip",
+			Entries: []*scanner.Entry{{Name: "a.bin", Size: 1024, CRC32: 0xdeadbeef}},
+		},
+		{Path: "/roms/other/clone.zip"},
+		{Path: "/roms/unrelated.zip"},
+	}
+
+	r := Verify(d, results)
+	if len(r.Sets) != 3 {
+		t.Fatalf("got %d sets, want 3", len(r.Sets))
+	}
+
+	p := r.Sets[0]
+	if p.Name != "parent" || p.Status != SetPartial || !p.Torrentzipped {
+		t.Errorf("unexpected parent report %+v", p)
+	}
+	if len(p.Have) != 1 || p.Have[0].Name != "a.bin" {
+		t.Errorf("unexpected have %v", p.Have)
+	}
+	if len(p.WrongHash) != 1 || p.WrongHash[0].Found.CRC.String() != "12345678" {
+		t.Errorf("unexpected wrong hash %v", p.WrongHash)
+	}
+	if len(p.Missing) != 0 {
+		t.Errorf("nodump rom reported missing: %v", p.Missing)
+	}
+	if len(p.Unneeded) != 1 || p.Unneeded[0].Name != "readme.txt" {
+		t.Errorf("unexpected unneeded %v", p.Unneeded)
+	}
+
+	c := r.Sets[1]
+	if c.Status != SetComplete || c.Archive != "/roms/clone.zip" || c.Torrentzipped {
+		t.Errorf("unexpected clone report %+v", c)
+	}
+
+	b := r.Sets[2]
+	if b.Status != SetMissing || b.Archive != "" || len(b.Missing) != 1 {
+		t.Errorf("unexpected bios report %+v", b)
+	}
+
+	if len(r.Unknown) != 2 || r.Unknown[0] != "/roms/other/clone.zip" || r.Unknown[1] != "/roms/unrelated.zip" {
+		t.Errorf("unexpected unknown %v", r.Unknown)
+	}
+
+	complete, partial, missing := r.Count()
+	if complete != 1 || partial != 1 || missing != 1 {
+		t.Errorf("got counts %d %d %d, want 1 1 1", complete, partial, missing)
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"crc":"deadbeef"`) {
+		t.Errorf("hashes not hex encoded in json: %s", data)
+	}
+}
+
+func TestVerifyDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, err := ioutil.ReadFile(filepath.Join("..", "testdata", "E22A0E0EF7AC6E2B80048990FEEB8C8BD46D3333.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "filegen.zip"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Dat{
+		Games: []*Game{{
+			Name: "filegen",
+			Roms: []*Rom{
+				{Name: "FileGen 1084623739.bin", Size: 146432, CRC: CRC(0xd2784314)},
+				{Name: "FileGen 122332430.bin", Size: 146432, CRC: CRC(0x84d8475d)},
+				{Name: "FileGen 25784252.bin", Size: 146432, CRC: CRC(0x3c7bea47)},
+				{Name: "FileGen 331380692.bin", Size: 146432, CRC: CRC(0xc5fc814d)},
+			},
+		}},
+	}
+
+	r, err := VerifyDir(d, &scanner.Scanner{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := r.Sets[0]
+	if s.Status != SetComplete || !s.Torrentzipped || len(s.Have) != 4 {
+		t.Errorf("unexpected set report %+v", s)
+	}
+}
+
+func TestMatchesHeaderless(t *testing.T) {
+	rom := &Rom{Name: "game.nes", Size: 16, CRC: CRC(0x12345678)}
+	e := &scanner.Entry{Name: "game.nes", Size: 32, CRC32: 0x87654321}
+	if rom.Matches(e) {
+		t.Fatal("headered entry matched without headerless hashes")
+	}
+	e.Headerless = &detector.Hashes{Size: 16, CRC32: 0x12345678}
+	if !rom.Matches(e) {
+		t.Error("headerless hashes not matched")
+	}
+}
+
+func TestSetPath(t *testing.T) {
+	dir := filepath.Join("out", "sets")
+	for name, want := range map[string]string{
+		"game":        filepath.Join(dir, "game.zip"),
+		"sub/game":    filepath.Join(dir, "sub", "game.zip"),
+		"sub/../game": filepath.Join(dir, "game.zip"),
+		"..game":      filepath.Join(dir, "..game.zip"),
+	} {
+		path, err := SetPath(dir, &Game{Name: name})
+		if err != nil || path != want {
+			t.Errorf("got %s, %v for %q, want %s", path, err, name, want)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "../game", "sub/../../game", "/game"} {
+		if path, err := SetPath(dir, &Game{Name: name}); err == nil {
+			t.Errorf("got %s for %q, want an error", path, name)
+		}
+	}
+}
+
+func TestVerifySetMerged(t *testing.T) {
+	g := &Game{
+		Name:    "clone",
+		CloneOf: "parent",
+		RomOf:   "parent",
+		Roms: []*Rom{
+			{Name: "shared.bin", Size: 16, CRC: CRC(0x12345678), Merge: "shared.bin"},
+			{Name: "own.bin", Size: 16, CRC: CRC(0x87654321)},
+		},
+	}
+	own := &scanner.Entry{Name: "own.bin", Size: 16, CRC32: 0x87654321}
+	shared := &scanner.Entry{Name: "shared.bin", Size: 16, CRC32: 0x12345678}
+
+	split := VerifySet(g, &scanner.Result{Entries: []*scanner.Entry{own}})
+	if split.Status != SetComplete || len(split.Merged) != 1 || len(split.Missing) != 0 {
+		t.Errorf("unexpected split report %+v", split)
+	}
+	nonMerged := VerifySet(g, &scanner.Result{Entries: []*scanner.Entry{own, shared}})
+	if nonMerged.Status != SetComplete || len(nonMerged.Have) != 2 || len(nonMerged.Merged) != 0 {
+		t.Errorf("unexpected non-merged report %+v", nonMerged)
+	}
+
+	// without a parent, the merge attribute doesn't matter
+	g.CloneOf, g.RomOf = "", ""
+	if s := VerifySet(g, &scanner.Result{Entries: []*scanner.Entry{own}}); s.Status != SetPartial {
+		t.Errorf("unexpected report %+v without a parent", s)
+	}
+}
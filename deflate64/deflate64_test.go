@@ -0,0 +1,99 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package deflate64
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+)
+
+// big.d64 holds stored, fixed and dynamic blocks with matches longer
+// than 258 bytes and distances of up to 65536. Info-ZIP unzip decodes
+// it to the same data.
+const (
+	bigSize = 188086
+	bigSHA1 = "c4e989965b28b17c3609f410fe6249b2984d33e8"
+)
+
+func readBig(t *testing.T) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "big.d64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestReader(t *testing.T) {
+	data := readBig(t)
+	for _, r := range []io.Reader{
+		bytes.NewReader(data),
+		iotest.OneByteReader(bytes.NewReader(data)),
+	} {
+		zr := NewReader(r)
+		out, err := ioutil.ReadAll(iotest.HalfReader(zr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := zr.Close(); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha1.Sum(out)
+		if len(out) != bigSize || hex.EncodeToString(sum[:]) != bigSHA1 {
+			t.Errorf("got %d bytes with sha1 %x", len(out), sum)
+		}
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	data := readBig(t)
+	_, err := ioutil.ReadAll(NewReader(bytes.NewReader(data[:len(data)/2])))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated stream gave %v", err)
+	}
+
+	// block type 3 does not exist
+	_, err = ioutil.ReadAll(NewReader(bytes.NewReader([]byte{0x07, 0x00})))
+	if err != ErrCorrupt {
+		t.Errorf("invalid block type gave %v", err)
+	}
+
+	// a fixed block starting with a match has nothing to copy from
+	_, err = ioutil.ReadAll(NewReader(bytes.NewReader([]byte{0x03, 0x02, 0x00, 0x00})))
+	if err != ErrCorrupt {
+		t.Errorf("match before the start of the data gave %v", err)
+	}
+}
@@ -0,0 +1,496 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Package deflate64 implements decompression of Deflate64, the enhanced
+// deflate of PKWARE used by zip method 9.
+//
+// Deflate64 differs from deflate in three points: the window is 64K,
+// length code 285 has 16 extra bits giving lengths of 3 to 65538, and
+// distance codes 30 and 31 reach back up to 65536 bytes.
+package deflate64
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+var ErrCorrupt = errors.New("deflate64: corrupt input")
+
+const (
+	windowSize = 1 << 16
+	maxBits    = 15 // longest code
+
+	numLitLen = 288
+	numDist   = 32
+
+	// codes up to fastBits long are decoded with a single table lookup
+	fastBits = 9
+)
+
+var (
+	lenBase = [29]uint32{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31,
+		35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 3}
+	lenExtra = [29]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2,
+		3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 16}
+	distBase = [32]uint32{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193,
+		257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577, 32769, 49153}
+	distExtra = [32]uint{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6,
+		7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13, 14, 14}
+
+	// order of the code length code lengths
+	codeOrder = [19]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+// huffman is a canonical Huffman code. Codes of up to fastBits bits are
+// found in fast, indexed by the next fastBits input bits, longer ones are
+// decoded bit by bit using count and symbol.
+type huffman struct {
+	fast   [1 << fastBits]uint16 // symbol<<4 | length, 0 if longer
+	count  [maxBits + 1]uint16   // number of codes of each length
+	symbol []uint16              // symbols ordered by code
+}
+
+func (h *huffman) init(lengths []uint8) error {
+	h.count = [maxBits + 1]uint16{}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	h.count[0] = 0
+
+	left := 1
+	for l := 1; l <= maxBits; l++ {
+		left <<= 1
+		left -= int(h.count[l])
+		if left < 0 {
+			return ErrCorrupt
+		}
+	}
+
+	var offs [maxBits + 2]uint16
+	for l := 1; l <= maxBits; l++ {
+		offs[l+1] = offs[l] + h.count[l]
+	}
+	h.symbol = make([]uint16, offs[maxBits+1])
+	for s, l := range lengths {
+		if l != 0 {
+			h.symbol[offs[l]] = uint16(s)
+			offs[l]++
+		}
+	}
+
+	h.fast = [1 << fastBits]uint16{}
+	code, index := 0, 0
+	for l := 1; l <= fastBits; l++ {
+		for n := 0; n < int(h.count[l]); n++ {
+			entry := h.symbol[index]<<4 | uint16(l)
+			rev := reverse(code, l)
+			for i := rev; i < len(h.fast); i += 1 << uint(l) {
+				h.fast[i] = entry
+			}
+			code++
+			index++
+		}
+		code <<= 1
+	}
+	return nil
+}
+
+// reverse returns the n low bits of code in reverse order, the order in
+// which they are stored.
+func reverse(code, n int) int {
+	r := 0
+	for i := 0; i < n; i++ {
+		r = r<<1 | code&1
+		code >>= 1
+	}
+	return r
+}
+
+var fixedLitLen, fixedDist huffman
+
+func init() {
+	var lengths [numLitLen]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	fixedLitLen.init(lengths[:])
+	var dist [numDist]uint8
+	for i := range dist {
+		dist[i] = 5
+	}
+	fixedDist.init(dist[:])
+}
+
+type state int
+
+const (
+	stateHeader state = iota
+	stateStored
+	stateHuffman
+	stateDone
+)
+
+type decompressor struct {
+	r     io.ByteReader
+	bits  uint32
+	nbits uint
+
+	// win holds the last 64K of output, win[rpos:wpos] has not been
+	// read yet.
+	win        [windowSize]byte
+	wpos, rpos int
+	full       bool
+
+	state    state
+	final    bool
+	stored   int // bytes left in a stored block
+	copyLen  int // bytes left of a match
+	copyDist int
+	litLen   *huffman
+	dist     *huffman
+	dynLit   huffman
+	dynDist  huffman
+
+	err error
+}
+
+// NewReader returns a ReadCloser decompressing the Deflate64 stream in r.
+// Data following the final block is not read if r is an io.ByteReader.
+func NewReader(r io.Reader) io.ReadCloser {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &decompressor{r: br}
+}
+
+func (d *decompressor) Read(p []byte) (int, error) {
+	for {
+		if d.rpos < d.wpos {
+			n := copy(p, d.win[d.rpos:d.wpos])
+			d.rpos += n
+			return n, nil
+		}
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.wpos == len(d.win) {
+			d.wpos, d.rpos, d.full = 0, 0, true
+		}
+		d.err = d.step()
+	}
+}
+
+func (d *decompressor) Close() error {
+	if d.err == io.EOF {
+		return nil
+	}
+	return d.err
+}
+
+// step decodes until the window is full or the current block ends.
+func (d *decompressor) step() error {
+	switch d.state {
+	case stateHeader:
+		return d.header()
+	case stateStored:
+		for d.stored > 0 && d.wpos < len(d.win) {
+			b, err := d.getBits(8)
+			if err != nil {
+				return err
+			}
+			d.win[d.wpos] = byte(b)
+			d.wpos++
+			d.stored--
+		}
+		if d.stored == 0 {
+			d.endBlock()
+		}
+		return nil
+	case stateHuffman:
+		return d.huffmanBlock()
+	}
+	return io.EOF
+}
+
+func (d *decompressor) endBlock() {
+	if d.final {
+		d.state = stateDone
+	} else {
+		d.state = stateHeader
+	}
+}
+
+func (d *decompressor) header() error {
+	h, err := d.getBits(3)
+	if err != nil {
+		return err
+	}
+	d.final = h&1 != 0
+	switch h >> 1 {
+	case 0:
+		// stored blocks start at a byte boundary
+		d.bits >>= d.nbits % 8
+		d.nbits -= d.nbits % 8
+		n, err := d.getBits(16)
+		if err != nil {
+			return err
+		}
+		nn, err := d.getBits(16)
+		if err != nil {
+			return err
+		}
+		if n != ^nn&0xffff {
+			return ErrCorrupt
+		}
+		d.stored = int(n)
+		d.state = stateStored
+	case 1:
+		d.litLen, d.dist = &fixedLitLen, &fixedDist
+		d.state = stateHuffman
+	case 2:
+		if err := d.readCodes(); err != nil {
+			return err
+		}
+		d.litLen, d.dist = &d.dynLit, &d.dynDist
+		d.state = stateHuffman
+	default:
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// readCodes reads the code lengths of a dynamic block.
+func (d *decompressor) readCodes() error {
+	h, err := d.getBits(14)
+	if err != nil {
+		return err
+	}
+	nlen := int(h&0x1f) + 257
+	ndist := int(h>>5&0x1f) + 1
+	ncode := int(h>>10) + 4
+	if nlen > 286 {
+		return ErrCorrupt
+	}
+
+	var lengths [numLitLen + numDist]uint8
+	for i := 0; i < ncode; i++ {
+		l, err := d.getBits(3)
+		if err != nil {
+			return err
+		}
+		lengths[codeOrder[i]] = uint8(l)
+	}
+	var lencode huffman
+	if err := lencode.init(lengths[:19]); err != nil {
+		return err
+	}
+
+	lengths = [numLitLen + numDist]uint8{}
+	for i := 0; i < nlen+ndist; {
+		sym, err := d.decode(&lencode)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+		var prev uint8
+		var rep uint32
+		switch sym {
+		case 16:
+			if i == 0 {
+				return ErrCorrupt
+			}
+			prev = lengths[i-1]
+			rep, err = d.getBits(2)
+			rep += 3
+		case 17:
+			rep, err = d.getBits(3)
+			rep += 3
+		default:
+			rep, err = d.getBits(7)
+			rep += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+int(rep) > nlen+ndist {
+			return ErrCorrupt
+		}
+		for ; rep > 0; rep-- {
+			lengths[i] = prev
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		// no end of block code
+		return ErrCorrupt
+	}
+
+	if err := d.dynLit.init(lengths[:nlen]); err != nil {
+		return err
+	}
+	return d.dynDist.init(lengths[nlen : nlen+ndist])
+}
+
+func (d *decompressor) huffmanBlock() error {
+	for d.wpos < len(d.win) {
+		if d.copyLen > 0 {
+			d.copyMatch()
+			continue
+		}
+
+		sym, err := d.decode(d.litLen)
+		if err != nil {
+			return err
+		}
+		switch {
+		case sym < 256:
+			d.win[d.wpos] = byte(sym)
+			d.wpos++
+			continue
+		case sym == 256:
+			d.endBlock()
+			return nil
+		case sym > 285:
+			return ErrCorrupt
+		}
+
+		sym -= 257
+		extra, err := d.getBits(lenExtra[sym])
+		if err != nil {
+			return err
+		}
+		length := lenBase[sym] + extra
+
+		sym, err = d.decode(d.dist)
+		if err != nil {
+			return err
+		}
+		if sym >= numDist {
+			return ErrCorrupt
+		}
+		extra, err = d.getBits(distExtra[sym])
+		if err != nil {
+			return err
+		}
+		dist := int(distBase[sym] + extra)
+		if !d.full && dist > d.wpos {
+			return ErrCorrupt
+		}
+		d.copyLen, d.copyDist = int(length), dist
+	}
+	return nil
+}
+
+// copyMatch copies the current match up to the end of the window.
+func (d *decompressor) copyMatch() {
+	src := (d.wpos - d.copyDist) & (windowSize - 1)
+	for d.copyLen > 0 && d.wpos < len(d.win) {
+		d.win[d.wpos] = d.win[src]
+		d.wpos++
+		src = (src + 1) & (windowSize - 1)
+		d.copyLen--
+	}
+}
+
+// more adds a byte of input to the bit buffer.
+func (d *decompressor) more() error {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	d.bits |= uint32(b) << d.nbits
+	d.nbits += 8
+	return nil
+}
+
+func (d *decompressor) getBits(n uint) (uint32, error) {
+	for d.nbits < n {
+		if err := d.more(); err != nil {
+			return 0, err
+		}
+	}
+	v := d.bits & (1<<n - 1)
+	d.bits >>= n
+	d.nbits -= n
+	return v, nil
+}
+
+func (d *decompressor) decode(h *huffman) (int, error) {
+	for d.nbits < fastBits {
+		if d.more() != nil {
+			// near the end of the input, decode bit by bit
+			break
+		}
+	}
+	if d.nbits >= fastBits {
+		if e := h.fast[d.bits&(1<<fastBits-1)]; e != 0 {
+			l := uint(e & 0xf)
+			d.bits >>= l
+			d.nbits -= l
+			return int(e >> 4), nil
+		}
+	}
+
+	code, first, index := 0, 0, 0
+	for l := 1; l <= maxBits; l++ {
+		b, err := d.getBits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(b)
+		count := int(h.count[l])
+		if code-first < count {
+			return int(h.symbol[index+code-first]), nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, ErrCorrupt
+}
@@ -0,0 +1,585 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package depot implements a content addressed store of TorrentGZ files,
+laid out the way romba and RomVault lay out their depots.
+
+Every file is stored once, compressed as a TorrentGZ file and named after
+the SHA1 of its content:
+
+	<root>/aa/bb/cc/dd/aabbccdd....gz
+
+A depot can span several root directories, each with an optional size
+limit. New files go into the first root that still has room.
+*/
+package depot
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/uwedeportivo/torrentzip"
+	"github.com/uwedeportivo/torrentzip/czip"
+	"github.com/uwedeportivo/torrentzip/torrentgz"
+)
+
+const gzext = ".gz"
+
+var ErrFull = errors.New("depot: all roots are full")
+
+// Root is a directory of a depot.
+type Root struct {
+	Path string
+
+	// MaxSize limits the number of bytes stored in the root.
+	// 0 means no limit.
+	MaxSize int64
+
+	size int64
+}
+
+// Size returns the number of bytes currently stored in the root.
+func (r *Root) Size() int64 {
+	return r.size
+}
+
+func (r *Root) fits(n int64) bool {
+	return r.MaxSize == 0 || r.size+n <= r.MaxSize
+}
+
+// Depot is a content addressed store of TorrentGZ files.
+type Depot struct {
+	mu    sync.Mutex
+	roots []*Root
+
+	// byMD5 and byCRC map the MD5 and CRC32 of the files in the depot to
+	// their SHA1s. They are built by the first lookup needing them and
+	// kept up to date by Ingest.
+	byMD5 map[string][][]byte
+	byCRC map[uint32][][]byte
+}
+
+// Entry is a file in the depot.
+type Entry struct {
+	Path string
+	SHA1 []byte
+	*torrentgz.Info
+}
+
+// Open opens the depot made of the given roots, creating root directories
+// that do not exist yet.
+func Open(roots ...*Root) (*Depot, error) {
+	if len(roots) == 0 {
+		return nil, errors.New("depot: no roots")
+	}
+	for _, r := range roots {
+		if err := os.MkdirAll(r.Path, 0777); err != nil {
+			return nil, err
+		}
+		r.size = 0
+		err := filepath.Walk(r.Path, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				r.size += fi.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Depot{roots: roots}, nil
+}
+
+// Roots returns the roots of the depot.
+func (d *Depot) Roots() []*Root {
+	return d.roots
+}
+
+func relPath(sha1 []byte) string {
+	h := hex.EncodeToString(sha1)
+	return filepath.Join(h[0:2], h[2:4], h[4:6], h[6:8], h+gzext)
+}
+
+// Path returns the path of the file with the given SHA1 and whether it is
+// in the depot.
+func (d *Depot) Path(sha1 []byte) (string, bool) {
+	rel := relPath(sha1)
+	for _, r := range d.roots {
+		p := filepath.Join(r.Path, rel)
+		if _, err := os.Stat(p); err == nil {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// Has returns whether the file with the given SHA1 is in the depot.
+func (d *Depot) Has(sha1 []byte) bool {
+	_, ok := d.Path(sha1)
+	return ok
+}
+
+// Ingest adds the content read from r to the depot. It returns the
+// metadata of the content and whether it was added, which is false if the
+// depot already had it.
+func (d *Depot) Ingest(r io.Reader) (*torrentgz.Info, bool, error) {
+	// the file most likely ends up in the first root with room left, so
+	// it is staged there to be renamed into place
+	d.mu.Lock()
+	tempDir := d.roots[len(d.roots)-1].Path
+	for _, r := range d.roots {
+		if r.fits(0) {
+			tempDir = r.Path
+			break
+		}
+	}
+	d.mu.Unlock()
+
+	tf, err := ioutil.TempFile(tempDir, "depot")
+	if err != nil {
+		return nil, false, err
+	}
+	defer os.Remove(tf.Name())
+	defer tf.Close()
+
+	info, err := torrentgz.Write(tf, r, tempDir)
+	if err != nil {
+		return nil, false, err
+	}
+	fi, err := tf.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := tf.Close(); err != nil {
+		return nil, false, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.Has(info.SHA1) {
+		return info, false, nil
+	}
+
+	var root *Root
+	for _, r := range d.roots {
+		if r.fits(fi.Size()) {
+			root = r
+			break
+		}
+	}
+	if root == nil {
+		return nil, false, ErrFull
+	}
+
+	dst := filepath.Join(root.Path, relPath(info.SHA1))
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return nil, false, err
+	}
+	if err := moveFile(tf.Name(), dst); err != nil {
+		return nil, false, err
+	}
+	root.size += fi.Size()
+	if d.byMD5 != nil {
+		d.addHashes(info.SHA1, info)
+	}
+	return info, true, nil
+}
+
+// IngestFile adds the file at path to the depot unless the depot already
+// has it. It returns the SHA1 of the file and whether it was added.
+func (d *Depot) IngestFile(path string) ([]byte, bool, error) {
+	sha1sum, err := hashFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if d.Has(sha1sum) {
+		return sha1sum, false, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	_, added, err := d.Ingest(f)
+	return sha1sum, added, err
+}
+
+// IngestZip adds every file inside the zip file at path to the depot,
+// skipping files the depot already has. It returns the number of files
+// added and skipped.
+func (d *Depot) IngestZip(path string) (added int, skipped int, err error) {
+	zr, err := czip.OpenReader(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer zr.Close()
+
+	for _, fh := range zr.File {
+		if strings.HasSuffix(fh.Name, "/") {
+			continue
+		}
+
+		sha1sum, err := hashZipFile(fh)
+		if err != nil {
+			return added, skipped, fmt.Errorf("hashing %s in %s failed: %v", fh.Name, path, err)
+		}
+		if d.Has(sha1sum) {
+			skipped++
+			continue
+		}
+
+		fr, err := fh.Open()
+		if err != nil {
+			return added, skipped, err
+		}
+		_, ok, err := d.Ingest(fr)
+		fr.Close()
+		if err != nil {
+			return added, skipped, fmt.Errorf("ingesting %s in %s failed: %v", fh.Name, path, err)
+		}
+		if ok {
+			added++
+		} else {
+			skipped++
+		}
+	}
+	return added, skipped, nil
+}
+
+// Walk calls fn for every file in the depot, with the metadata read from
+// its header.
+func (d *Depot) Walk(fn func(e *Entry) error) error {
+	for _, r := range d.roots {
+		err := filepath.Walk(r.Path, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() || filepath.Ext(path) != gzext {
+				return nil
+			}
+			sha1sum, err := hex.DecodeString(strings.TrimSuffix(fi.Name(), gzext))
+			if err != nil || len(sha1sum) != sha1.Size {
+				return nil
+			}
+
+			info, err := readInfo(path)
+			if err != nil {
+				return fmt.Errorf("reading header of %s failed: %v", path, err)
+			}
+			return fn(&Entry{
+				Path: path,
+				SHA1: sha1sum,
+				Info: info,
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errFound = errors.New("depot: found")
+
+// LookupSHA1 returns the file with the given SHA1 or nil if the depot does
+// not have it.
+func (d *Depot) LookupSHA1(sha1sum []byte) (*Entry, error) {
+	path, ok := d.Path(sha1sum)
+	if !ok {
+		return nil, nil
+	}
+	info, err := readInfo(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{
+		Path: path,
+		SHA1: sha1sum,
+		Info: info,
+	}, nil
+}
+
+// LookupMD5 returns the files with the given MD5. The first lookup by MD5
+// or CRC32 reads the header of every file in the depot.
+func (d *Depot) LookupMD5(md5sum []byte) ([]*Entry, error) {
+	d.mu.Lock()
+	err := d.loadHashes()
+	sums := d.byMD5[string(md5sum)]
+	d.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return d.lookupSHA1s(sums)
+}
+
+// LookupCRC returns the files with the given CRC32. The first lookup by
+// MD5 or CRC32 reads the header of every file in the depot.
+func (d *Depot) LookupCRC(crc uint32) ([]*Entry, error) {
+	d.mu.Lock()
+	err := d.loadHashes()
+	sums := d.byCRC[crc]
+	d.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return d.lookupSHA1s(sums)
+}
+
+func (d *Depot) lookupSHA1s(sums [][]byte) ([]*Entry, error) {
+	var es []*Entry
+	for _, sum := range sums {
+		e, err := d.LookupSHA1(sum)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			es = append(es, e)
+		}
+	}
+	return es, nil
+}
+
+// loadHashes builds byMD5 and byCRC unless they are built already. d.mu
+// has to be held.
+func (d *Depot) loadHashes() error {
+	if d.byMD5 != nil {
+		return nil
+	}
+	d.byMD5 = make(map[string][][]byte)
+	d.byCRC = make(map[uint32][][]byte)
+	err := d.Walk(func(e *Entry) error {
+		d.addHashes(e.SHA1, e.Info)
+		return nil
+	})
+	if err != nil {
+		d.byMD5, d.byCRC = nil, nil
+	}
+	return err
+}
+
+func (d *Depot) addHashes(sha1sum []byte, info *torrentgz.Info) {
+	d.byMD5[string(info.MD5)] = append(d.byMD5[string(info.MD5)], sha1sum)
+	d.byCRC[info.CRC32] = append(d.byCRC[info.CRC32], sha1sum)
+}
+
+// Verify decompresses every file in the depot and checks it against its
+// header and its name. It calls fn with the path of every file and the
+// problem found with it, or nil if there is none. Verify stops and returns
+// the error if fn returns one.
+func (d *Depot) Verify(fn func(path string, problem error) error) error {
+	for _, r := range d.roots {
+		err := filepath.Walk(r.Path, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() || filepath.Ext(path) != gzext {
+				return nil
+			}
+			return fn(path, verifyFile(path, strings.TrimSuffix(fi.Name(), gzext)))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyFile(path string, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := torrentgz.Verify(f)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(info.SHA1) != strings.ToLower(name) {
+		return fmt.Errorf("depot: sha1 of content is %x", info.SHA1)
+	}
+	return nil
+}
+
+// ExportFile names a file of the depot to be exported into a set.
+type ExportFile struct {
+	Name string
+	SHA1 []byte
+}
+
+// Export writes the given files as a torrentzip to w. The deflate streams
+// of the depot files are copied without recompressing them if they were
+// compressed with torrentzip parameters, as they are by Ingest, romba and
+// RomVault. Files compressed otherwise are recompressed. If a file can't
+// be exported, nothing is written to w.
+func (d *Depot) Export(w io.Writer, files []ExportFile) error {
+	zw, err := torrentzip.NewWriter(w)
+	if err != nil {
+		return err
+	}
+
+	for _, ef := range files {
+		err := d.export(zw, ef)
+		if err != nil {
+			zw.Abort()
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func (d *Depot) export(zw *torrentzip.Writer, ef ExportFile) error {
+	path, ok := d.Path(ef.SHA1)
+	if !ok {
+		return fmt.Errorf("depot: missing %x for %s", ef.SHA1, ef.Name)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if _, err := torrentgz.ReadInfo(f); err != nil {
+		return err
+	}
+
+	err = zw.CreateFromGzip(ef.Name, f, fi.Size(), true)
+	if err != torrentzip.ErrGzipParams {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	zr, _, err := torrentgz.Open(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	cw, err := zw.Create(ef.Name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(cw, zr)
+	return err
+}
+
+func readInfo(path string) (*torrentgz.Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return torrentgz.ReadInfo(f)
+}
+
+func hashFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hh := sha1.New()
+	if _, err := io.Copy(hh, f); err != nil {
+		return nil, err
+	}
+	return hh.Sum(nil), nil
+}
+
+func hashZipFile(fh *czip.File) ([]byte, error) {
+	fr, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer fr.Close()
+
+	hh := sha1.New()
+	if _, err := io.Copy(hh, fr); err != nil {
+		return nil, err
+	}
+	return hh.Sum(nil), nil
+}
+
+// moveFile renames src to dst, falling back to copying if they are on
+// different file systems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	sf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+
+	tmp := dst + ".tmp"
+	df, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(df, sf); err != nil {
+		df.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := df.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,291 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package depot
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip"
+	"github.com/uwedeportivo/torrentzip/torrentgz"
+)
+
+func TestDepot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	small := &Root{Path: filepath.Join(dir, "small"), MaxSize: 100}
+	big := &Root{Path: filepath.Join(dir, "big")}
+
+	d, err := Open(small, big)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := [][]byte{
+		[]byte("a"),
+		bytes.Repeat([]byte("torrentzip "), 1000),
+		[]byte("organic green tea"),
+	}
+
+	for _, c := range contents {
+		info, added, err := d.Ingest(bytes.NewReader(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !added {
+			t.Fatalf("content %q was not added", c[:1])
+		}
+		sum := sha1.Sum(c)
+		if !bytes.Equal(info.SHA1, sum[:]) {
+			t.Fatalf("ingest returned wrong sha1")
+		}
+	}
+
+	_, added, err := d.Ingest(bytes.NewReader(contents[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added {
+		t.Errorf("content was added twice")
+	}
+
+	if small.Size() > small.MaxSize {
+		t.Errorf("root %s holds %d bytes, more than its limit", small.Path, small.Size())
+	}
+	if big.Size() == 0 {
+		t.Errorf("root %s is empty, expected overflow from full root", big.Path)
+	}
+
+	sum := sha1.Sum(contents[2])
+	e, err := d.LookupSHA1(sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || e.Size != uint64(len(contents[2])) {
+		t.Fatalf("LookupSHA1 failed")
+	}
+
+	md5sum := md5.Sum(contents[1])
+	es, err := d.LookupMD5(md5sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 1 {
+		t.Errorf("LookupMD5 found %d entries, want 1", len(es))
+	}
+
+	es, err = d.LookupCRC(crc32.ChecksumIEEE(contents[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 1 {
+		t.Errorf("LookupCRC found %d entries, want 1", len(es))
+	}
+
+	late := []byte("ingested after the first lookup")
+	if _, _, err := d.Ingest(bytes.NewReader(late)); err != nil {
+		t.Fatal(err)
+	}
+	md5sum = md5.Sum(late)
+	es, err = d.LookupMD5(md5sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 1 {
+		t.Errorf("LookupMD5 found %d entries for late file, want 1", len(es))
+	}
+
+	err = d.Verify(func(path string, problem error) error {
+		if problem != nil {
+			t.Errorf("verify of %s failed: %v", path, problem)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var golden bytes.Buffer
+	zw, err := torrentzip.NewWriter(&golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []ExportFile
+	for i, c := range contents {
+		name := string('a'+rune(i)) + ".rom"
+		cw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cw.Write(c); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha1.Sum(c)
+		files = append(files, ExportFile{Name: name, SHA1: sum[:]})
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var exported bytes.Buffer
+	if err := d.Export(&exported, files); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(exported.Bytes(), golden.Bytes()) {
+		t.Errorf("exported torrentzip differs from golden")
+	}
+}
+
+func TestExportRecompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := Open(&Root{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a depot file compressed with level 1, as other tools might leave
+	content := bytes.Repeat([]byte("organic green tea "), 1000)
+	md5sum := md5.Sum(content)
+	sum := sha1.Sum(content)
+	info := &torrentgz.Info{MD5: md5sum[:], CRC32: crc32.ChecksumIEEE(content), Size: uint64(len(content))}
+	extra := make([]byte, 28)
+	copy(extra, info.MD5)
+	binary.BigEndian.PutUint32(extra[16:], info.CRC32)
+	binary.LittleEndian.PutUint64(extra[20:], info.Size)
+
+	var gz bytes.Buffer
+	if err := torrentzip.WriteGzipHeader(&gz, &torrentzip.GzipHeader{OS: 0xff, Extra: extra}); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := flate.NewWriter(&gz, flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(content)
+	fw.Close()
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], info.CRC32)
+	binary.LittleEndian.PutUint32(trailer[4:], uint32(info.Size))
+	gz.Write(trailer[:])
+
+	path := filepath.Join(dir, relPath(sum[:]))
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, gz.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	var golden bytes.Buffer
+	zw, err := torrentzip.NewWriter(&golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw, err := zw.Create("tea.rom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw.Write(content)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var exported bytes.Buffer
+	if err := d.Export(&exported, []ExportFile{{Name: "tea.rom", SHA1: sum[:]}}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(exported.Bytes(), golden.Bytes()) {
+		t.Errorf("export of level 1 depot file differs from golden")
+	}
+}
+
+// TestExportMissing checks that a failed export writes nothing and leaves
+// no temp files behind.
+func TestExportMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpDir := filepath.Join(dir, "tmp")
+	if err := os.Mkdir(tmpDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmpDir)
+
+	d, err := Open(&Root{Path: filepath.Join(dir, "depot")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _, err := d.Ingest(bytes.NewReader([]byte("organic green tea")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := sha1.Sum([]byte("missing"))
+
+	var exported bytes.Buffer
+	err = d.Export(&exported, []ExportFile{
+		{Name: "tea.rom", SHA1: info.SHA1},
+		{Name: "missing.rom", SHA1: missing[:]},
+	})
+	if err == nil {
+		t.Fatal("export of a missing file succeeded")
+	}
+	if exported.Len() != 0 {
+		t.Errorf("failed export wrote %d bytes", exported.Len())
+	}
+	names, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("%d temp files left behind", len(names))
+	}
+}
@@ -0,0 +1,441 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package detector reads clrmamepro header skipper files and strips copier
+headers from roms.
+
+A detector file lists rules. Each rule has tests that look at the data of
+a file. The first rule whose tests all have the expected result applies:
+the data between its start and end offsets, transformed by its
+operation, is the headerless content that DATs hash.
+
+	<detector>
+		<name>iNES header skipper</name>
+		<rule start_offset="10" end_offset="EOF" operation="none">
+			<data offset="0" value="4E45531A" result="true"/>
+		</rule>
+	</detector>
+
+Offsets and values are hex. Tests at negative offsets, which some tools
+use to look at the end of a file, are not supported.
+*/
+package detector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Operations applied to the headerless data.
+const (
+	OpNone         = "none"
+	OpBitSwap      = "bitswap"
+	OpByteSwap     = "byteswap"
+	OpWordSwap     = "wordswap"
+	OpWordByteSwap = "wordbyteswap"
+)
+
+// Test kinds.
+const (
+	TestData = "data"
+	TestOr   = "or"
+	TestXor  = "xor"
+	TestAnd  = "and"
+	TestFile = "file"
+)
+
+// EOF as end offset means the end of the file.
+const EOF = -1
+
+// ErrFormat is returned for detector files that can't be parsed.
+var ErrFormat = errors.New("detector: invalid detector file")
+
+// Detector is a parsed header skipper file.
+type Detector struct {
+	Name    string
+	Author  string
+	Version string
+	Rules   []*Rule
+}
+
+// Rule describes a header and how to strip it.
+type Rule struct {
+	StartOffset int64
+
+	// EndOffset is EOF or the offset the headerless data ends at.
+	EndOffset int64
+
+	Operation string
+	Tests     []*Test
+}
+
+// Test checks a property of a file.
+//
+// Data tests compare the bytes at Offset with Value. Or, and and xor tests
+// first combine the bytes with Mask. File tests compare the file size
+// with Size using Operator, which is one of "equal", "less" and
+// "greater"; if PowerOfTwo is set they check the size is a power of two
+// instead.
+type Test struct {
+	Kind       string
+	Offset     int64
+	Value      []byte
+	Mask       []byte
+	Size       int64
+	PowerOfTwo bool
+	Operator   string
+
+	// Result is the result the test must have for its rule to match.
+	Result bool
+}
+
+type xmlDetector struct {
+	Name    string     `xml:"name"`
+	Author  string     `xml:"author"`
+	Version string     `xml:"version"`
+	Rules   []*xmlRule `xml:"rule"`
+}
+
+type xmlRule struct {
+	StartOffset string     `xml:"start_offset,attr"`
+	EndOffset   string     `xml:"end_offset,attr"`
+	Operation   string     `xml:"operation,attr"`
+	Tests       []*xmlTest `xml:",any"`
+}
+
+type xmlTest struct {
+	XMLName  xml.Name
+	Offset   string `xml:"offset,attr"`
+	Value    string `xml:"value,attr"`
+	Mask     string `xml:"mask,attr"`
+	Size     string `xml:"size,attr"`
+	Operator string `xml:"operator,attr"`
+	Result   string `xml:"result,attr"`
+}
+
+// Parse reads a detector file.
+func Parse(r io.Reader) (*Detector, error) {
+	var xd xmlDetector
+	dec := xml.NewDecoder(bufio.NewReader(r))
+	dec.Strict = false
+	if err := dec.Decode(&xd); err != nil {
+		return nil, fmt.Errorf("%v: %v", ErrFormat, err)
+	}
+
+	d := &Detector{
+		Name:    strings.TrimSpace(xd.Name),
+		Author:  strings.TrimSpace(xd.Author),
+		Version: strings.TrimSpace(xd.Version),
+	}
+	for i, xr := range xd.Rules {
+		rule, err := xr.rule()
+		if err != nil {
+			return nil, fmt.Errorf("%v: rule %d: %v", ErrFormat, i+1, err)
+		}
+		d.Rules = append(d.Rules, rule)
+	}
+	return d, nil
+}
+
+func parseOffset(s string, def int64) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return def, nil
+	}
+	if strings.EqualFold(s, "EOF") {
+		return EOF, nil
+	}
+	v, err := strconv.ParseInt(s, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid offset %s", s)
+	}
+	if v < 0 {
+		return 0, fmt.Errorf("negative offset %s not supported", s)
+	}
+	return v, nil
+}
+
+func (xr *xmlRule) rule() (*Rule, error) {
+	start, err := parseOffset(xr.StartOffset, 0)
+	if err != nil {
+		return nil, err
+	}
+	if start == EOF {
+		return nil, fmt.Errorf("start offset can't be EOF")
+	}
+	end, err := parseOffset(xr.EndOffset, EOF)
+	if err != nil {
+		return nil, err
+	}
+
+	rule := &Rule{
+		StartOffset: start,
+		EndOffset:   end,
+		Operation:   strings.ToLower(strings.TrimSpace(xr.Operation)),
+	}
+	switch rule.Operation {
+	case "":
+		rule.Operation = OpNone
+	case OpNone, OpBitSwap, OpByteSwap, OpWordSwap, OpWordByteSwap:
+	default:
+		return nil, fmt.Errorf("unknown operation %s", xr.Operation)
+	}
+
+	for _, xt := range xr.Tests {
+		t, err := xt.test()
+		if err != nil {
+			return nil, err
+		}
+		rule.Tests = append(rule.Tests, t)
+	}
+	return rule, nil
+}
+
+func (xt *xmlTest) test() (*Test, error) {
+	t := &Test{
+		Kind:   strings.ToLower(xt.XMLName.Local),
+		Result: !strings.EqualFold(strings.TrimSpace(xt.Result), "false"),
+	}
+
+	var err error
+	switch t.Kind {
+	case TestData, TestOr, TestXor, TestAnd:
+		if t.Offset, err = parseOffset(xt.Offset, 0); err != nil {
+			return nil, err
+		}
+		if t.Offset == EOF {
+			return nil, fmt.Errorf("test offset can't be EOF")
+		}
+		if t.Value, err = hex.DecodeString(strings.TrimSpace(xt.Value)); err != nil || len(t.Value) == 0 {
+			return nil, fmt.Errorf("invalid value %s", xt.Value)
+		}
+		if t.Kind != TestData {
+			t.Mask, err = hex.DecodeString(strings.TrimSpace(xt.Mask))
+			if err != nil || len(t.Mask) != len(t.Value) {
+				return nil, fmt.Errorf("invalid mask %s", xt.Mask)
+			}
+		}
+	case TestFile:
+		size := strings.TrimSpace(xt.Size)
+		if strings.EqualFold(size, "PO2") {
+			t.PowerOfTwo = true
+		} else if t.Size, err = strconv.ParseInt(size, 16, 64); err != nil {
+			return nil, fmt.Errorf("invalid size %s", xt.Size)
+		}
+		t.Operator = strings.ToLower(strings.TrimSpace(xt.Operator))
+		switch t.Operator {
+		case "":
+			t.Operator = "equal"
+		case "equal", "less", "greater":
+		default:
+			return nil, fmt.Errorf("unknown operator %s", xt.Operator)
+		}
+	default:
+		return nil, fmt.Errorf("unknown test %s", t.Kind)
+	}
+	return t, nil
+}
+
+// prefixLen returns the number of bytes at the start of a file the tests
+// of d look at.
+func (d *Detector) prefixLen() int64 {
+	var n int64
+	for _, rule := range d.Rules {
+		for _, t := range rule.Tests {
+			if end := t.Offset + int64(len(t.Value)); end > n {
+				n = end
+			}
+		}
+	}
+	return n
+}
+
+// eval returns the result of t for a file of the given size starting with
+// prefix.
+func (t *Test) eval(prefix []byte, size int64) bool {
+	if t.Kind == TestFile {
+		if t.PowerOfTwo {
+			return size > 0 && size&(size-1) == 0
+		}
+		switch t.Operator {
+		case "less":
+			return size < t.Size
+		case "greater":
+			return size > t.Size
+		}
+		return size == t.Size
+	}
+
+	end := t.Offset + int64(len(t.Value))
+	if end > int64(len(prefix)) || end > size {
+		return false
+	}
+	data := prefix[t.Offset:end]
+	for i, v := range t.Value {
+		b := data[i]
+		switch t.Kind {
+		case TestOr:
+			b |= t.Mask[i]
+		case TestXor:
+			b ^= t.Mask[i]
+		case TestAnd:
+			b &= t.Mask[i]
+		}
+		if b != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Match returns the first rule that applies to a file of the given size
+// starting with prefix, or nil. The prefix needs to hold at least the
+// bytes the tests look at.
+func (d *Detector) Match(prefix []byte, size int64) *Rule {
+	for _, rule := range d.Rules {
+		ok := true
+		for _, t := range rule.Tests {
+			if t.eval(prefix, size) != t.Result {
+				ok = false
+				break
+			}
+		}
+		if ok && rule.StartOffset <= size && (rule.EndOffset == EOF || rule.EndOffset <= size) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// NewReader returns a reader of the headerless content of the file of the
+// given size read from r, and the size of that content. If no rule
+// applies, rule is nil and the returned reader yields the file unchanged.
+func (d *Detector) NewReader(r io.Reader, size int64) (hr io.Reader, hsize int64, rule *Rule, err error) {
+	prefix := make([]byte, d.prefixLen())
+	n, err := io.ReadFull(r, prefix)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, 0, nil, err
+	}
+	prefix = prefix[:n]
+	all := io.MultiReader(bytes.NewReader(prefix), r)
+
+	rule = d.Match(prefix, size)
+	if rule == nil {
+		return all, size, nil, nil
+	}
+
+	end := size
+	if rule.EndOffset != EOF {
+		end = rule.EndOffset
+	}
+	if end < rule.StartOffset {
+		end = rule.StartOffset
+	}
+	if _, err := io.CopyN(ioutil.Discard, all, rule.StartOffset); err != nil {
+		return nil, 0, nil, err
+	}
+	hsize = end - rule.StartOffset
+	hr = io.LimitReader(all, hsize)
+	if rule.Operation != OpNone {
+		hr = &swapReader{r: hr, op: rule.Operation}
+	}
+	return hr, hsize, rule, nil
+}
+
+// swapReader applies a bit or byte swapping operation. Trailing bytes that
+// don't fill a whole word are passed through unchanged.
+type swapReader struct {
+	r   io.Reader
+	op  string
+	buf []byte
+	out []byte
+	eof bool
+}
+
+func (sr *swapReader) unit() int {
+	switch sr.op {
+	case OpByteSwap:
+		return 2
+	case OpWordSwap, OpWordByteSwap:
+		return 4
+	}
+	return 1
+}
+
+func (sr *swapReader) Read(p []byte) (int, error) {
+	for len(sr.out) == 0 {
+		if sr.eof {
+			return 0, io.EOF
+		}
+		if sr.buf == nil {
+			sr.buf = make([]byte, 32*1024)
+		}
+		n, err := io.ReadFull(sr.r, sr.buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			sr.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+		sr.out = sr.buf[:n]
+		sr.swap(sr.out)
+	}
+	n := copy(p, sr.out)
+	sr.out = sr.out[n:]
+	return n, nil
+}
+
+func (sr *swapReader) swap(b []byte) {
+	u := sr.unit()
+	for i := 0; i+u <= len(b); i += u {
+		switch sr.op {
+		case OpBitSwap:
+			v := b[i]
+			v = v>>4 | v<<4
+			v = (v&0xcc)>>2 | (v&0x33)<<2
+			v = (v&0xaa)>>1 | (v&0x55)<<1
+			b[i] = v
+		case OpByteSwap:
+			b[i], b[i+1] = b[i+1], b[i]
+		case OpWordSwap:
+			b[i], b[i+1], b[i+2], b[i+3] = b[i+2], b[i+3], b[i], b[i+1]
+		case OpWordByteSwap:
+			b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+		}
+	}
+}
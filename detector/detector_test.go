@@ -0,0 +1,201 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package detector
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"hash/crc32"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const nesXML = `<?xml version="1.0"?>
+<detector>
+	<name>No-Intro NES header skipper</name>
+	<author>Yakushi~Kabuto</author>
+	<version>20070321</version>
+	<rule start_offset="10" end_offset="EOF" operation="none">
+		<data offset="0" value="4E45531A" result="true"/>
+	</rule>
+</detector>
+`
+
+const swapXML = `<detector>
+	<name>swap</name>
+	<rule start_offset="4" operation="byteswap">
+		<and offset="0" mask="F0" value="A0"/>
+		<file size="PO2" result="false"/>
+	</rule>
+	<rule start_offset="0" end_offset="8" operation="wordswap">
+		<xor offset="1" mask="FF" value="00"/>
+	</rule>
+	<rule operation="bitswap">
+		<or offset="0" mask="0F" value="1F"/>
+		<file size="10" operator="less"/>
+	</rule>
+	<rule operation="wordbyteswap">
+		<file size="4" operator="greater"/>
+	</rule>
+</detector>
+`
+
+func TestParse(t *testing.T) {
+	d, err := Parse(strings.NewReader(nesXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "No-Intro NES header skipper" || d.Author != "Yakushi~Kabuto" || d.Version != "20070321" {
+		t.Errorf("unexpected detector %+v", d)
+	}
+	if len(d.Rules) != 1 {
+		t.Fatalf("got %d rules, want 1", len(d.Rules))
+	}
+	r := d.Rules[0]
+	if r.StartOffset != 0x10 || r.EndOffset != EOF || r.Operation != OpNone || len(r.Tests) != 1 {
+		t.Errorf("unexpected rule %+v", r)
+	}
+	if tt := r.Tests[0]; tt.Kind != TestData || tt.Offset != 0 || !bytes.Equal(tt.Value, []byte("NES\x1a")) || !tt.Result {
+		t.Errorf("unexpected test %+v", tt)
+	}
+
+	d, err = Parse(strings.NewReader(swapXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Rules) != 4 || d.Rules[0].Tests[1].Result || !d.Rules[0].Tests[1].PowerOfTwo {
+		t.Errorf("unexpected swap rules %+v", d.Rules)
+	}
+
+	for _, s := range []string{
+		`<detector><rule operation="shuffle"/></detector>`,
+		`<detector><rule><data offset="zz" value="00"/></rule></detector>`,
+		`<detector><rule><or offset="0" value="00"/></rule></detector>`,
+		`<detector><rule><crc offset="0" value="00"/></rule></detector>`,
+		`<detector><rule start_offset="-10"/></detector>`,
+	} {
+		if _, err := Parse(strings.NewReader(s)); err == nil {
+			t.Errorf("expected error parsing %s", s)
+		}
+	}
+}
+
+func strip(t *testing.T, d *Detector, data []byte) ([]byte, *Rule) {
+	hr, hsize, rule, err := d.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(hr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(out)) != hsize {
+		t.Errorf("read %d bytes, reported size %d", len(out), hsize)
+	}
+	return out, rule
+}
+
+func TestNewReader(t *testing.T) {
+	nes, err := Parse(strings.NewReader(nesXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rom := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 5000)
+	headered := append([]byte("NES\x1a\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), rom...)
+
+	out, rule := strip(t, nes, headered)
+	if rule == nil || !bytes.Equal(out, rom) {
+		t.Error("nes header not stripped")
+	}
+	out, rule = strip(t, nes, rom)
+	if rule != nil || !bytes.Equal(out, rom) {
+		t.Error("headerless rom changed")
+	}
+
+	d, err := Parse(strings.NewReader(swapXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		in, want []byte
+	}{
+		// byteswap after 4 bytes, size not a power of two
+		{[]byte{0xa5, 0, 0, 0, 1, 2, 3, 4, 5}, []byte{2, 1, 4, 3, 5}},
+		// size 8 is a power of two, so the second rule: wordswap up to 8
+		{[]byte{0xa5, 0xff, 2, 3, 4, 5, 6, 7}, []byte{2, 3, 0xa5, 0xff, 6, 7, 4, 5}},
+		// bitswap
+		{[]byte{0x10, 0x01, 0x80}, []byte{0x08, 0x80, 0x01}},
+		// wordbyteswap, trailing bytes unchanged
+		{[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}, []byte{3, 2, 1, 0, 7, 6, 5, 4, 11, 10, 9, 8, 15, 14, 13, 12, 16}},
+	} {
+		out, rule := strip(t, d, tc.in)
+		if rule == nil || !bytes.Equal(out, tc.want) {
+			t.Errorf("%x: got %x, want %x", tc.in, out, tc.want)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	nes, err := Parse(strings.NewReader(nesXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rom := bytes.Repeat([]byte("rom data"), 20000)
+	headered := append([]byte("NES\x1a\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), rom...)
+
+	raw, headerless, err := Hash(bytes.NewReader(headered), int64(len(headered)), nes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawSHA1 := sha1.Sum(headered)
+	romSHA1 := sha1.Sum(rom)
+	if raw.Size != uint64(len(headered)) || raw.CRC32 != crc32.ChecksumIEEE(headered) || !bytes.Equal(raw.SHA1, rawSHA1[:]) {
+		t.Errorf("unexpected raw hashes %+v", raw)
+	}
+	if headerless == nil || headerless.Size != uint64(len(rom)) || headerless.CRC32 != crc32.ChecksumIEEE(rom) ||
+		!bytes.Equal(headerless.SHA1, romSHA1[:]) {
+		t.Errorf("unexpected headerless hashes %+v", headerless)
+	}
+
+	raw, headerless, err = Hash(bytes.NewReader(rom), int64(len(rom)), nes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headerless != nil || !bytes.Equal(raw.SHA1, romSHA1[:]) {
+		t.Errorf("unexpected hashes for rom without header %+v %+v", raw, headerless)
+	}
+
+	raw, _, err = Hash(bytes.NewReader(headered), int64(len(headered)), nil)
+	if err != nil || !bytes.Equal(raw.SHA1, rawSHA1[:]) {
+		t.Errorf("unexpected hashes without detector %+v %v", raw, err)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package detector
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// Hashes holds the size and hashes of some content.
+type Hashes struct {
+	Size  uint64
+	CRC32 uint32
+	MD5   []byte
+	SHA1  []byte
+}
+
+type hasher struct {
+	n    uint64
+	crc  hash.Hash32
+	md5  hash.Hash
+	sha1 hash.Hash
+	w    io.Writer
+}
+
+func newHasher() *hasher {
+	h := &hasher{
+		crc:  crc32.NewIEEE(),
+		md5:  md5.New(),
+		sha1: sha1.New(),
+	}
+	h.w = io.MultiWriter(h.crc, h.md5, h.sha1)
+	return h
+}
+
+func (h *hasher) Write(p []byte) (int, error) {
+	h.n += uint64(len(p))
+	return h.w.Write(p)
+}
+
+func (h *hasher) hashes() *Hashes {
+	return &Hashes{
+		Size:  h.n,
+		CRC32: h.crc.Sum32(),
+		MD5:   h.md5.Sum(nil),
+		SHA1:  h.sha1.Sum(nil),
+	}
+}
+
+// Hash reads the file of the given size from r and returns the hashes of
+// its content and, if d is not nil and one of its rules applies, of its
+// headerless content. The file is read only once.
+func Hash(r io.Reader, size int64, d *Detector) (raw *Hashes, headerless *Hashes, err error) {
+	rh := newHasher()
+	tr := io.TeeReader(r, rh)
+
+	if d != nil {
+		hr, _, rule, err := d.NewReader(tr, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		if rule != nil {
+			hh := newHasher()
+			if _, err := io.Copy(hh, hr); err != nil {
+				return nil, nil, err
+			}
+			headerless = hh.hashes()
+		}
+	}
+
+	// whatever the detector didn't read still needs to be hashed
+	if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+		return nil, nil, err
+	}
+	return rh.hashes(), headerless, nil
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrentzip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip/czip"
+)
+
+// the zips in czip/testdata/encrypted are encrypted with testPassword and
+// named after the sha1 of the torrentzip of their decrypted contents.
+// ZipCrypto and AES-128 and AES-256 were written by bsdtar, the second
+// ZipCrypto one by Info-ZIP zip and the mixed one, with AES-192 AE-1 and
+// AE-2, ZipCrypto without data descriptor and an unencrypted entry, by a
+// script and checked with bsdtar.
+const (
+	testPassword = "secret"
+
+	zipCryptoZip = "C2B2FD23DCA19ED39448E25023B96E9B0D882957.zip"
+	infoZipZip   = "54AB0089953C4D9E32D69AA6707F2D0C4961A738.zip"
+	aes128Zip    = "5266914872A7F2B8FD8DF516DA3275A543B8BD87.zip"
+	aes256Zip    = "59DE8C2EAACAD19E356B871E590B9FAC235D36A0.zip"
+	mixedZip     = "ED01DA101070012EF08FCAA5E666F0856880F142.zip"
+)
+
+func openEncrypted(t *testing.T, name string) (*czip.Reader, []byte) {
+	data, err := ioutil.ReadFile(filepath.Join("czip", "testdata", "encrypted", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := czip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zr, data
+}
+
+func TestEncrypted(t *testing.T) {
+	for _, name := range []string{zipCryptoZip, infoZipZip, aes128Zip, aes256Zip, mixedZip} {
+		zr, _ := openEncrypted(t, name)
+		for _, f := range zr.File {
+			if !f.IsEncrypted() {
+				continue
+			}
+			if _, err := f.Open(); err != czip.ErrEncrypted {
+				t.Errorf("%s: opening %s without password gave %v", name, f.Name, err)
+			}
+		}
+
+		zr.SetPassword("wrong")
+		for _, f := range zr.File {
+			if !f.IsEncrypted() {
+				continue
+			}
+			if _, err := f.Open(); err != czip.ErrPassword {
+				t.Errorf("%s: opening %s with wrong password gave %v", name, f.Name, err)
+			}
+		}
+
+		// a password set for a file overrides the one of the reader
+		for _, f := range zr.File {
+			f.SetPassword(testPassword)
+		}
+		var buf bytes.Buffer
+		if err := Rezip(&buf, zr, 0); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		want := torrentzipOf(t, zr, readEntries(t, zr))
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("torrentzip of %s differs from torrentzip of its contents", name)
+		}
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	zr, data := openEncrypted(t, mixedZip)
+	f := zr.File[1]
+	off, err := f.DataOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a tampered authentication code is found once all data is read, a
+	// tampered byte of data at the latest then
+	for _, tc := range []struct {
+		pos  int64
+		want error // nil for any error
+	}{
+		{off + int64(f.CompressedSize64) - 1, czip.ErrAuthentication},
+		{off + 100, nil},
+	} {
+		bad := append([]byte(nil), data...)
+		bad[tc.pos] ^= 1
+		zr, err = czip.NewReader(bytes.NewReader(bad), int64(len(bad)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr.SetPassword(testPassword)
+		rc, err := zr.File[1].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err == nil || tc.want != nil && err != tc.want {
+			t.Errorf("tampered AES entry at offset %d gave %v, want %v", tc.pos-off, err, tc.want)
+		}
+	}
+}
+
+func TestCopyRawEncrypted(t *testing.T) {
+	zr, _ := openEncrypted(t, zipCryptoZip)
+	zr.SetPassword(testPassword)
+
+	var buf bytes.Buffer
+	zw, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if err := zw.CopyRaw(f.Name, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), torrentzipOf(t, zr, readEntries(t, zr))) {
+		t.Errorf("raw copy of encrypted entries differs from torrentzip of their contents")
+	}
+
+	if err := ExtractGzip(ioutil.Discard, zr.File[0], nil); err != czip.ErrAlgorithm {
+		t.Errorf("extracting encrypted entry as gzip gave %v", err)
+	}
+}
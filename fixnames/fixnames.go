@@ -0,0 +1,413 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package fixnames renames the entries of archives, and the archives
+themselves, to the names a DAT gives their content.
+
+Entries are matched against the roms of the DAT by size and CRC32, and
+by SHA1 too if entries are hashed. The archive is assigned to the game
+with the most matching roms and rewritten as a torrentzip with entries
+named after the roms. Entries of valid torrentzips are copied without
+recompressing them, so fixing only names doesn't decompress anything.
+*/
+package fixnames
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uwedeportivo/torrentzip"
+	"github.com/uwedeportivo/torrentzip/czip"
+	"github.com/uwedeportivo/torrentzip/dat"
+	"github.com/uwedeportivo/torrentzip/scanner"
+)
+
+// Rename is a renamed entry.
+type Rename struct {
+	From string
+	To   string
+}
+
+// Result describes a fixed archive.
+type Result struct {
+	Path string
+
+	// NewPath is where the archive is now. It is empty if the archive
+	// didn't match any game.
+	NewPath string
+	Game    string
+
+	// Unchanged is set if the archive had the right names and was
+	// torrentzipped already.
+	Unchanged bool
+
+	Renamed []Rename
+
+	// Missing lists the roms of the game none of the entries match.
+	Missing []*dat.Rom
+
+	// Unneeded lists entries that match no rom of the game. They are
+	// kept, unless the Fixer drops them or their name is taken by a
+	// rom, and listed in Dropped too.
+	Unneeded []string
+	Dropped  []string
+}
+
+// Fixer fixes the names of archives according to a DAT.
+type Fixer struct {
+	Dat *dat.Dat
+
+	// HashEntries makes the Fixer decompress entries to match them by
+	// SHA1 and MD5 too.
+	HashEntries bool
+
+	// DropUnneeded drops entries that match no rom of the game.
+	DropUnneeded bool
+
+	// TempDir is used for temporary files. If empty, the default
+	// directory for temporary files is used.
+	TempDir string
+
+	byCRC  map[crcKey][]*dat.Game
+	bySize map[uint64][]*dat.Game
+	order  map[*dat.Game]int
+}
+
+type crcKey struct {
+	crc  string
+	size uint64
+}
+
+// FixDir fixes all zip files below dir.
+func (fx *Fixer) FixDir(dir string) ([]*Result, error) {
+	var paths []string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		zip, err := scanner.IsZip(path)
+		if err == nil && zip {
+			paths = append(paths, path)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*Result
+	for _, path := range paths {
+		r, err := fx.Fix(path)
+		if err != nil {
+			return results, fmt.Errorf("fixing %s failed: %v", path, err)
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+type assignment struct {
+	name  string
+	entry string
+}
+
+// Fix fixes the zip file at path. The fixed archive stays in the same
+// directory. Fix fails if an archive with the new name already exists.
+func (fx *Fixer) Fix(path string) (*Result, error) {
+	res, err := scanner.ScanArchive(path, fx.HashEntries, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Result{Path: path}
+	g := fx.bestGame(res)
+	if g == nil {
+		return r, nil
+	}
+	r.Game = g.Name
+	r.NewPath, err = dat.SetPath(filepath.Dir(path), g)
+	if err != nil {
+		return nil, err
+	}
+	same, err := samePath(path, r.NewPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var as []assignment
+	used := make(map[string]bool)
+	taken := make(map[string]bool)
+	for _, rom := range g.Roms {
+		if rom.Status == dat.StatusNoDump {
+			continue
+		}
+		name := strings.Replace(rom.Name, "\\", "/", -1)
+		if taken[name] {
+			continue
+		}
+		e := matchEntry(rom, name, res.Entries)
+		if e == nil {
+			r.Missing = append(r.Missing, rom)
+			continue
+		}
+		taken[name] = true
+		used[e.Name] = true
+		as = append(as, assignment{name: name, entry: e.Name})
+		if e.Name != name {
+			r.Renamed = append(r.Renamed, Rename{From: e.Name, To: name})
+		}
+	}
+
+	for _, e := range res.Entries {
+		if used[e.Name] {
+			continue
+		}
+		r.Unneeded = append(r.Unneeded, e.Name)
+		if fx.DropUnneeded || taken[e.Name] {
+			r.Dropped = append(r.Dropped, e.Name)
+			continue
+		}
+		taken[e.Name] = true
+		as = append(as, assignment{name: e.Name, entry: e.Name})
+	}
+
+	if len(r.Renamed) == 0 && len(r.Dropped) == 0 && len(as) == len(res.Entries) &&
+		res.Torrentzipped && same {
+		r.Unchanged = true
+		return r, nil
+	}
+
+	if !same {
+		if _, err := os.Stat(r.NewPath); err == nil {
+			return nil, fmt.Errorf("%s already exists", r.NewPath)
+		}
+	}
+
+	if err := fx.write(path, r.NewPath, as, res.Torrentzipped); err != nil {
+		return nil, err
+	}
+	if !same {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// samePath reports whether path and newPath name the same file. newPath
+// must be clean.
+func samePath(path, newPath string) (bool, error) {
+	if filepath.Clean(path) == newPath {
+		return true, nil
+	}
+	nfi, err := os.Stat(newPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(fi, nfi), nil
+}
+
+// bestGame returns the game with the most roms matching entries of res.
+// On ties the game named like the archive wins, then the first one.
+func (fx *Fixer) bestGame(res *scanner.Result) *dat.Game {
+	if fx.order == nil {
+		fx.index()
+	}
+
+	counts := make(map[*dat.Game]int)
+	for _, e := range res.Entries {
+		seen := make(map[*dat.Game]bool)
+		for _, g := range fx.candidates(e) {
+			if seen[g] {
+				continue
+			}
+			seen[g] = true
+			for _, rom := range g.Roms {
+				if rom.Status != dat.StatusNoDump && rom.Matches(e) {
+					counts[g]++
+					break
+				}
+			}
+		}
+	}
+
+	var best *dat.Game
+	bestCount := 0
+	current := dat.SetName(res.Path)
+	for g, count := range counts {
+		// counts is unordered, so ties are broken by the position in the DAT
+		switch {
+		case count > bestCount:
+		case count < bestCount:
+			continue
+		case best.Name == current:
+			continue
+		case g.Name != current && fx.order[g] > fx.order[best]:
+			continue
+		}
+		best, bestCount = g, count
+	}
+	return best
+}
+
+// index maps the CRC32 and size of every rom to the games holding it, so
+// an archive is only compared with the games sharing some of its roms.
+// Roms without a CRC32 are mapped by size alone.
+func (fx *Fixer) index() {
+	fx.byCRC = make(map[crcKey][]*dat.Game)
+	fx.bySize = make(map[uint64][]*dat.Game)
+	fx.order = make(map[*dat.Game]int)
+	for i, g := range fx.Dat.Games {
+		fx.order[g] = i
+		for _, rom := range g.Roms {
+			if rom.Status == dat.StatusNoDump {
+				continue
+			}
+			if rom.CRC == nil {
+				fx.bySize[rom.Size] = appendGame(fx.bySize[rom.Size], g)
+				continue
+			}
+			key := crcKey{string(rom.CRC), rom.Size}
+			fx.byCRC[key] = appendGame(fx.byCRC[key], g)
+		}
+	}
+}
+
+func appendGame(gs []*dat.Game, g *dat.Game) []*dat.Game {
+	if len(gs) > 0 && gs[len(gs)-1] == g {
+		return gs
+	}
+	return append(gs, g)
+}
+
+// candidates returns the games with a rom that may match e, possibly
+// more than once.
+func (fx *Fixer) candidates(e *scanner.Entry) []*dat.Game {
+	var gs []*dat.Game
+	gs = append(gs, fx.byCRC[crcKey{string(dat.CRC(e.CRC32)), e.Size}]...)
+	gs = append(gs, fx.bySize[e.Size]...)
+	if h := e.Headerless; h != nil {
+		gs = append(gs, fx.byCRC[crcKey{string(dat.CRC(h.CRC32)), h.Size}]...)
+		gs = append(gs, fx.bySize[h.Size]...)
+	}
+	return gs
+}
+
+// matchEntry returns an entry matching rom, preferring one that already
+// has the right name.
+func matchEntry(rom *dat.Rom, name string, entries []*scanner.Entry) *scanner.Entry {
+	var match *scanner.Entry
+	for _, e := range entries {
+		if !rom.Matches(e) {
+			continue
+		}
+		if e.Name == name {
+			return e
+		}
+		if match == nil {
+			match = e
+		}
+	}
+	return match
+}
+
+func (fx *Fixer) write(path, newPath string, as []assignment, torrentzipped bool) error {
+	zr, err := czip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	files := make(map[string]*czip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	tf, err := ioutil.TempFile(filepath.Dir(newPath), "fixnames")
+	if err != nil {
+		return err
+	}
+
+	zw, err := torrentzip.NewWriterWithTemp(tf, fx.TempDir)
+	if err == nil {
+		for _, a := range as {
+			if err = copyEntry(zw, a.name, files[a.entry], torrentzipped); err != nil {
+				break
+			}
+		}
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := tf.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tf.Name(), newPath)
+	}
+	if err != nil {
+		os.Remove(tf.Name())
+	}
+	return err
+}
+
+func copyEntry(zw *torrentzip.Writer, name string, f *czip.File, raw bool) error {
+	if raw {
+		return zw.CopyRaw(name, f)
+	}
+
+	fr, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+
+	cw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(cw, fr)
+	return err
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package fixnames
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip"
+	"github.com/uwedeportivo/torrentzip/dat"
+)
+
+type testFile struct {
+	name    string
+	content []byte
+}
+
+func writeTorrentzip(t *testing.T, path string, files []testFile) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zw, err := torrentzip.NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tf := range files {
+		w, err := zw.Create(tf.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(tf.content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testRom(name string, content []byte) *dat.Rom {
+	return &dat.Rom{
+		Name: name,
+		Size: uint64(len(content)),
+		CRC:  dat.CRC(crc32.ChecksumIEEE(content)),
+	}
+}
+
+func TestFix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixnames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := bytes.Repeat([]byte("content a"), 1000)
+	b := bytes.Repeat([]byte("content b"), 1000)
+	extra := []byte("extra")
+
+	d := &dat.Dat{
+		Games: []*dat.Game{
+			{Name: "other", Roms: []*dat.Rom{testRom("a.bin", a)}},
+			{Name: "right", Roms: []*dat.Rom{
+				testRom("a.bin", a),
+				testRom("sub\\b.bin", b),
+				testRom("c.bin", []byte("missing")),
+			}},
+		},
+	}
+
+	wrong := filepath.Join(dir, "wrong.zip")
+	writeTorrentzip(t, wrong, []testFile{{"x.bin", a}, {"y.bin", b}, {"extra.txt", extra}})
+	unknown := filepath.Join(dir, "unknown.zip")
+	writeTorrentzip(t, unknown, []testFile{{"z.bin", extra}})
+
+	fx := &Fixer{Dat: d}
+	results, err := fx.FixDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+
+	u := results[0]
+	if u.Path != unknown || u.NewPath != "" || u.Game != "" {
+		t.Errorf("unexpected result for unknown archive %+v", u)
+	}
+
+	r := results[1]
+	want := filepath.Join(dir, "right.zip")
+	if r.Game != "right" || r.NewPath != want || r.Unchanged {
+		t.Errorf("unexpected result %+v", r)
+	}
+	if len(r.Renamed) != 2 || len(r.Missing) != 1 || len(r.Unneeded) != 1 || len(r.Dropped) != 0 {
+		t.Errorf("unexpected result %+v", r)
+	}
+	if _, err := os.Stat(wrong); !os.IsNotExist(err) {
+		t.Error("old archive still exists")
+	}
+
+	expected := filepath.Join(dir, "expected")
+	writeTorrentzip(t, expected, []testFile{{"a.bin", a}, {"sub/b.bin", b}, {"extra.txt", extra}})
+	got, err := ioutil.ReadFile(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := ioutil.ReadFile(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(expected)
+	if !bytes.Equal(got, exp) {
+		t.Error("fixed archive differs from a fresh torrentzip")
+	}
+
+	r, err = fx.Fix(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Unchanged {
+		t.Errorf("fixed archive was rewritten: %+v", r)
+	}
+
+	// a path that isn't clean still names the fixed archive
+	r, err = fx.Fix(dir + string(filepath.Separator) + "." + string(filepath.Separator) + "right.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Unchanged {
+		t.Errorf("fixed archive was rewritten: %+v", r)
+	}
+
+	fx.DropUnneeded = true
+	r, err = fx.Fix(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Unchanged || len(r.Dropped) != 1 || r.Dropped[0] != "extra.txt" {
+		t.Errorf("unexpected result %+v", r)
+	}
+
+	// the new name must not be taken
+	writeTorrentzip(t, wrong, []testFile{{"x.bin", a}, {"y.bin", b}})
+	if _, err := fx.Fix(wrong); err == nil {
+		t.Error("expected error when the new archive name is taken")
+	}
+}
+
+func TestFixBadName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixnames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := []byte("content a")
+	sets := filepath.Join(dir, "sets")
+	if err := os.Mkdir(sets, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(sets, "a.zip")
+	writeTorrentzip(t, path, []testFile{{"a.bin", a}})
+
+	fx := &Fixer{Dat: &dat.Dat{Games: []*dat.Game{
+		{Name: "../evil", Roms: []*dat.Rom{testRom("a.bin", a)}},
+	}}}
+	if _, err := fx.Fix(path); err == nil {
+		t.Error("fixing to a set name leading out of the dir succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil.zip")); !os.IsNotExist(err) {
+		t.Error("archive was written outside its dir")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/uwedeportivo/torrentzip
 
-go 1.12
+go 1.22
+
+require github.com/klauspost/compress v1.18.0
@@ -0,0 +1,400 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrentzip
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/uwedeportivo/torrentzip/czip"
+	"github.com/uwedeportivo/torrentzip/zlib"
+)
+
+const (
+	gzipID1     = 0x1f
+	gzipID2     = 0x8b
+	gzipDeflate = 8
+
+	gzipFlagText    = 1 << 0
+	gzipFlagHdrCrc  = 1 << 1
+	gzipFlagExtra   = 1 << 2
+	gzipFlagName    = 1 << 3
+	gzipFlagComment = 1 << 4
+
+	gzipHeaderLen  = 10
+	gzipTrailerLen = 8
+)
+
+var (
+	ErrGzipFormat   = errors.New("torrentzip: not a valid gzip file")
+	ErrGzipChecksum = errors.New("torrentzip: gzip checksum error")
+	ErrGzipParams   = errors.New("torrentzip: gzip file not compressed with torrentzip parameters")
+)
+
+// GzipHeader holds the header fields of a gzip member.
+// See RFC 1952 for details.
+type GzipHeader struct {
+	Name    string // FNAME, without the terminating zero byte
+	Comment string // FCOMMENT, without the terminating zero byte
+	MTime   uint32 // modification time in seconds since the epoch, 0 if unset
+	XFL     byte   // extra flags, 2 signals maximum compression
+	OS      byte   // operating system, 255 if unknown
+	Extra   []byte // FEXTRA, nil if unset
+}
+
+type gzipHeaderReader struct {
+	br *bufio.Reader
+	n  int64
+}
+
+func (r *gzipHeaderReader) readFull(buf []byte) error {
+	n, err := io.ReadFull(r.br, buf)
+	r.n += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (r *gzipHeaderReader) readString() (string, error) {
+	s, err := r.br.ReadString(0)
+	r.n += int64(len(s))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	return s[:len(s)-1], nil
+}
+
+// ReadGzipHeader reads the header of the gzip member at the start of r.
+// It returns the header and its length in bytes.
+func ReadGzipHeader(r io.Reader) (*GzipHeader, int64, error) {
+	hr := &gzipHeaderReader{br: bufio.NewReader(r)}
+
+	var buf [gzipHeaderLen]byte
+	if err := hr.readFull(buf[:]); err != nil {
+		return nil, 0, err
+	}
+	if buf[0] != gzipID1 || buf[1] != gzipID2 || buf[2] != gzipDeflate {
+		return nil, 0, ErrGzipFormat
+	}
+	flg := buf[3]
+	if flg&0xe0 != 0 {
+		return nil, 0, ErrGzipFormat
+	}
+
+	h := &GzipHeader{
+		MTime: binary.LittleEndian.Uint32(buf[4:8]),
+		XFL:   buf[8],
+		OS:    buf[9],
+	}
+
+	if flg&gzipFlagExtra != 0 {
+		if err := hr.readFull(buf[:2]); err != nil {
+			return nil, 0, err
+		}
+		h.Extra = make([]byte, binary.LittleEndian.Uint16(buf[:2]))
+		if err := hr.readFull(h.Extra); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var err error
+	if flg&gzipFlagName != 0 {
+		if h.Name, err = hr.readString(); err != nil {
+			return nil, 0, err
+		}
+	}
+	if flg&gzipFlagComment != 0 {
+		if h.Comment, err = hr.readString(); err != nil {
+			return nil, 0, err
+		}
+	}
+	if flg&gzipFlagHdrCrc != 0 {
+		if err := hr.readFull(buf[:2]); err != nil {
+			return nil, 0, err
+		}
+	}
+	return h, hr.n, nil
+}
+
+// CreateFromGzip adds a file named name to the zip file whose contents
+// are the decompressed contents of the single member gzip file in r of
+// the given size. The deflate stream of the gzip file is copied into the
+// zip file without recompressing it. This only results in a valid
+// torrentzip if the stream was made by zlib with level 9, windowBits 15
+// and memLevel 8, like the stream of every torrentzip entry.
+//
+// If verify is true the stream is recompressed to make sure that is the
+// case and ErrGzipParams is returned if it is not. Otherwise the
+// compression parameters are trusted. Either way the stream is
+// decompressed, to check the CRC32, to get the uncompressed size, which
+// the gzip trailer only holds modulo 4GB, and to reject files with more
+// than one member with ErrGzipFormat.
+func (w *Writer) CreateFromGzip(name string, r io.ReaderAt, size int64, verify bool) error {
+	if w.profile.Method != czip.Deflate {
+		return czip.ErrAlgorithm
+	}
+	if err := w.flushSpool(); err != nil {
+		return err
+	}
+
+	_, hlen, err := ReadGzipHeader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return err
+	}
+	if size < hlen+gzipTrailerLen {
+		return ErrGzipFormat
+	}
+
+	var buf [gzipTrailerLen]byte
+	if _, err := r.ReadAt(buf[:], size-gzipTrailerLen); err != nil {
+		return err
+	}
+	crc := binary.LittleEndian.Uint32(buf[:4])
+	isize := binary.LittleEndian.Uint32(buf[4:])
+
+	blen := size - hlen - gzipTrailerLen
+	usize, err := checkDeflate(io.NewSectionReader(r, hlen, blen), crc, isize, verify)
+	if err != nil {
+		return err
+	}
+
+	cw, err := w.uw.CreateRaw(&czip.FileHeader{
+		Name:               name,
+		Method:             czip.Deflate,
+		CRC32:              crc,
+		UncompressedSize64: usize,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(cw, io.NewSectionReader(r, hlen, blen))
+	return err
+}
+
+// checkDeflate decompresses the raw deflate stream in r, which has to end
+// where r ends, and checks its content against the CRC32 and the size
+// modulo 4GB of the gzip trailer. If verify is true it also checks that
+// the stream is what zlib produces with torrentzip compression
+// parameters. It returns the uncompressed size.
+func checkDeflate(r *io.SectionReader, crc, isize uint32, verify bool) (uint64, error) {
+	var cmp *compareWriter
+	var zw *zlib.Writer
+	var dst io.Writer = ioutil.Discard
+	if verify {
+		cmp = &compareWriter{r: io.NewSectionReader(r, 0, r.Size())}
+		var err error
+		zw, err = zlib.NewWriterLevel(cmp, 9)
+		if err != nil {
+			return 0, err
+		}
+		dst = zw
+	}
+
+	br := &countReader{br: bufio.NewReader(io.NewSectionReader(r, 0, r.Size()))}
+	fr := flate.NewReader(br)
+	hh := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(hh, dst), fr)
+	fr.Close()
+	if zw != nil {
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if br.n != r.Size() || uint32(n) != isize {
+		// a stream ending early means the file has more than one member
+		return 0, ErrGzipFormat
+	}
+	if hh.Sum32() != crc {
+		return 0, ErrGzipChecksum
+	}
+	if verify && !cmp.equal() {
+		return 0, ErrGzipParams
+	}
+	return uint64(n), nil
+}
+
+// countReader counts the bytes a decompressor takes from br, which tells
+// where its stream ends.
+type countReader struct {
+	br *bufio.Reader
+	n  int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.br.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countReader) ReadByte() (byte, error) {
+	b, err := c.br.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// compareWriter compares the bytes written to it with the bytes read
+// from r.
+type compareWriter struct {
+	r        io.Reader
+	buf      []byte
+	mismatch bool
+}
+
+func (c *compareWriter) Write(p []byte) (int, error) {
+	if c.mismatch {
+		return len(p), nil
+	}
+	if cap(c.buf) < len(p) {
+		c.buf = make([]byte, len(p))
+	}
+	b := c.buf[:len(p)]
+	n, _ := io.ReadFull(c.r, b)
+	if n != len(p) || !bytes.Equal(b, p) {
+		c.mismatch = true
+	}
+	return len(p), nil
+}
+
+// equal reports whether everything written matched and all of r was
+// consumed.
+func (c *compareWriter) equal() bool {
+	if c.mismatch {
+		return false
+	}
+	var b [1]byte
+	n, _ := c.r.Read(b[:])
+	return n == 0
+}
+
+// WriteGzipHeader writes h to w as the header of a gzip member compressed
+// with deflate.
+func WriteGzipHeader(w io.Writer, h *GzipHeader) error {
+	var buf [gzipHeaderLen]byte
+	buf[0] = gzipID1
+	buf[1] = gzipID2
+	buf[2] = gzipDeflate
+	if h.Extra != nil {
+		buf[3] |= gzipFlagExtra
+	}
+	if h.Name != "" {
+		buf[3] |= gzipFlagName
+	}
+	if h.Comment != "" {
+		buf[3] |= gzipFlagComment
+	}
+	binary.LittleEndian.PutUint32(buf[4:8], h.MTime)
+	buf[8] = h.XFL
+	buf[9] = h.OS
+	if _, err := w.Write(buf[:]); err != nil {
+		return err
+	}
+
+	if h.Extra != nil {
+		if len(h.Extra) > uint16max {
+			return errors.New("torrentzip: gzip extra field too long")
+		}
+		binary.LittleEndian.PutUint16(buf[:2], uint16(len(h.Extra)))
+		if _, err := w.Write(buf[:2]); err != nil {
+			return err
+		}
+		if _, err := w.Write(h.Extra); err != nil {
+			return err
+		}
+	}
+	for _, s := range []string{h.Name, h.Comment} {
+		if s == "" {
+			continue
+		}
+		if strings.IndexByte(s, 0) != -1 {
+			return errors.New("torrentzip: gzip name or comment contains a zero byte")
+		}
+		if _, err := io.WriteString(w, s); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtractGzip writes the contents of the deflated file f to w as a single
+// member gzip file with header h. The deflate stream of f is copied
+// without recompressing it, so f must not be encrypted. A nil h writes a
+// header without a name, modification time or extra field.
+func ExtractGzip(w io.Writer, f *czip.File, h *GzipHeader) error {
+	if f.Method != czip.Deflate || f.IsEncrypted() {
+		return czip.ErrAlgorithm
+	}
+	if h == nil {
+		h = &GzipHeader{
+			XFL: 2,
+			OS:  255,
+		}
+	}
+
+	if err := WriteGzipHeader(w, h); err != nil {
+		return err
+	}
+
+	fr, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+
+	if _, err := io.Copy(w, fr); err != nil {
+		return err
+	}
+
+	var buf [gzipTrailerLen]byte
+	binary.LittleEndian.PutUint32(buf[:4], f.CRC32)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(f.UncompressedSize64))
+	_, err = w.Write(buf[:])
+	return err
+}
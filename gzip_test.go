@@ -0,0 +1,254 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrentzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip/cgzip"
+	"github.com/uwedeportivo/torrentzip/czip"
+)
+
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	where := 0
+	for where < size {
+		toFill := rand.Intn(16)
+		filler := 0x61 + rand.Intn(24)
+		for i := 0; i < toFill && where < size; i++ {
+			content[where] = byte(filler)
+			where++
+		}
+	}
+	return content
+}
+
+func TestCreateFromGzip(t *testing.T) {
+	content := testContent(1024 * 1024)
+
+	var golden bytes.Buffer
+	zw, err := NewWriter(&golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw, err := zw.Create("content.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var gz bytes.Buffer
+	cgz, err := cgzip.NewWriterLevel(&gz, cgzip.Z_BEST_COMPRESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cgz.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := cgz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, verify := range []bool{false, true} {
+		var out bytes.Buffer
+		zw, err := NewWriter(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = zw.CreateFromGzip("content.bin", bytes.NewReader(gz.Bytes()), int64(gz.Len()), verify)
+		if err != nil {
+			t.Fatalf("CreateFromGzip with verify %v failed: %v", verify, err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), golden.Bytes()) {
+			t.Errorf("torrentzip from gzip with verify %v differs from golden", verify)
+		}
+	}
+}
+
+func TestCreateFromGzipParams(t *testing.T) {
+	var gz bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&gz, gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw.Name = "content.bin"
+	if _, err := gw.Write(testContent(64 * 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, _, err := ReadGzipHeader(bytes.NewReader(gz.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Name != "content.bin" {
+		t.Errorf("gzip header name = %q, want %q", h.Name, "content.bin")
+	}
+
+	zw, err := NewWriter(ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zw.abort()
+
+	err = zw.CreateFromGzip("content.bin", bytes.NewReader(gz.Bytes()), int64(gz.Len()), true)
+	if err != ErrGzipParams {
+		t.Errorf("CreateFromGzip of level 1 gzip returned %v, want %v", err, ErrGzipParams)
+	}
+}
+
+func TestCreateFromGzipMembers(t *testing.T) {
+	var single bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&single, gzip.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gw.Write(testContent(16 * 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	double := append(append([]byte(nil), single.Bytes()...), single.Bytes()...)
+	// a single member whose trailer has the wrong size
+	wrongSize := append([]byte(nil), single.Bytes()...)
+	wrongSize[len(wrongSize)-1] ^= 1
+
+	for _, verify := range []bool{false, true} {
+		zw, err := NewWriter(ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = zw.CreateFromGzip("content.bin", bytes.NewReader(double), int64(len(double)), verify)
+		if err != ErrGzipFormat {
+			t.Errorf("CreateFromGzip of two member gzip with verify %v returned %v, want %v",
+				verify, err, ErrGzipFormat)
+		}
+		err = zw.CreateFromGzip("content.bin", bytes.NewReader(wrongSize), int64(len(wrongSize)), verify)
+		if err != ErrGzipFormat {
+			t.Errorf("CreateFromGzip of gzip with wrong size with verify %v returned %v, want %v",
+				verify, err, ErrGzipFormat)
+		}
+		zw.abort()
+	}
+}
+
+func TestExtractGzip(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*"+zipext))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range paths {
+		zr, err := czip.OpenReader(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var golden bytes.Buffer
+		err = Rezip(&golden, &zr.Reader, 0)
+		zr.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tr, err := czip.NewReader(bytes.NewReader(golden.Bytes()), int64(golden.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		zw, err := NewWriter(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, fh := range tr.File {
+			h := &GzipHeader{
+				Name:  fh.Name,
+				XFL:   2,
+				OS:    255,
+				Extra: []byte("XY\x02\x00ok"),
+			}
+
+			var gz bytes.Buffer
+			if err := ExtractGzip(&gz, fh, h); err != nil {
+				t.Fatal(err)
+			}
+
+			gr, err := gzip.NewReader(bytes.NewReader(gz.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := ioutil.ReadAll(gr)
+			if err != nil {
+				t.Fatalf("reading extracted gzip of %s in %s failed: %v", fh.Name, path, err)
+			}
+			rh, _, err := ReadGzipHeader(bytes.NewReader(gz.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rh.Name != fh.Name || !bytes.Equal(rh.Extra, h.Extra) {
+				t.Errorf("extracted gzip header of %s in %s differs", fh.Name, path)
+			}
+			if uint64(len(content)) != fh.UncompressedSize64 {
+				t.Errorf("extracted gzip of %s in %s has wrong size", fh.Name, path)
+			}
+
+			err = zw.CreateFromGzip(fh.Name, bytes.NewReader(gz.Bytes()), int64(gz.Len()), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), golden.Bytes()) {
+			t.Errorf("torrentzip rebuilt from extracted gzips of %s differs", path)
+		}
+	}
+}
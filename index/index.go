@@ -0,0 +1,693 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package index keeps a searchable catalogue of the entries of a collection
+of zip files.
+
+The catalogue is filled from the central directories of the zip files and
+optionally from hashing their content, and answers lookups by CRC32 and
+size, MD5, SHA1 and entry name.
+
+The index is stored in a single local file, an append only log of records:
+
+	length   uint32, little endian
+	crc32    uint32, little endian, of the payload
+	payload  gob encoded record
+
+A record either puts an archive with all its entries into the index or
+removes one. Records are only ever appended, and synced before Put,
+Remove and Update return, or once at the end of UpdateDir for all records
+it writes. So a crash can at most lose the records of an unfinished
+UpdateDir and leave a torn record at the end of the log, which is detected by its
+length or CRC32 and cut off when the index is opened again. A bad record
+followed by more records can't be explained by a crash, Open fails with
+ErrCorrupt rather than throw away the records after it. Compact
+rewrites the log into a temp file holding only live archives and renames
+it over the old log.
+*/
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/uwedeportivo/torrentzip/czip"
+	"github.com/uwedeportivo/torrentzip/scanner"
+)
+
+const (
+	recordHeaderLen = 8
+	maxRecordLen    = 1 << 30
+
+	opPut    = "put"
+	opRemove = "remove"
+)
+
+var ErrCorrupt = errors.New("index: corrupt record")
+
+// Entry is a file inside an indexed archive. MD5 and SHA1 are only set if
+// the archive was indexed with full hashing.
+type Entry struct {
+	Name  string
+	Size  uint64
+	CRC32 uint32
+	MD5   []byte
+	SHA1  []byte
+}
+
+// Archive is an indexed zip file.
+type Archive struct {
+	Path    string
+	Size    int64
+	ModTime int64
+	Hashed  bool
+	Entries []*Entry
+}
+
+// Location is the result of a lookup: an entry and the archive holding it.
+type Location struct {
+	Archive string
+	*Entry
+}
+
+type record struct {
+	Op      string
+	Path    string
+	Archive *Archive
+}
+
+type crcSize struct {
+	crc  uint32
+	size uint64
+}
+
+// Index is a catalogue of the entries of a collection of zip files.
+// It is safe for concurrent use.
+type Index struct {
+	mu       sync.RWMutex
+	path     string
+	f        *os.File
+	bw       *bufio.Writer
+	garbage  int
+	archives map[string]*Archive
+
+	byCRCSize map[crcSize][]Location
+	byMD5     map[string][]Location
+	bySHA1    map[string][]Location
+	byName    map[string][]Location
+}
+
+// Open opens the index stored in the file at path, creating it if it does
+// not exist yet.
+func Open(path string) (*Index, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	ix := &Index{
+		path:      path,
+		f:         f,
+		archives:  make(map[string]*Archive),
+		byCRCSize: make(map[crcSize][]Location),
+		byMD5:     make(map[string][]Location),
+		bySHA1:    make(map[string][]Location),
+		byName:    make(map[string][]Location),
+	}
+
+	end, err := ix.replay()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// cut off a torn record left behind by a crash
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	ix.bw = bufio.NewWriter(f)
+	return ix, nil
+}
+
+// replay applies all intact records of the log and returns the offset
+// after the last one. A bad record is only tolerated as the last one.
+func (ix *Index) replay() (int64, error) {
+	fi, err := ix.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	br := bufio.NewReader(ix.f)
+	var end int64
+	for {
+		rec, n, err := readRecord(br)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return end, nil
+		}
+		if err == ErrCorrupt && end+n >= fi.Size() {
+			return end, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		ix.apply(rec)
+		end += n
+	}
+}
+
+// readRecord reads the next record. The returned length is that of the
+// record even if it is corrupt, to tell whether more records follow.
+func readRecord(r io.Reader) (*record, int64, error) {
+	var hdr [recordHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, 0, err
+	}
+	l := binary.LittleEndian.Uint32(hdr[:4])
+	n := int64(recordHeaderLen) + int64(l)
+	if l > maxRecordLen {
+		return nil, n, ErrCorrupt
+	}
+	payload := make([]byte, l)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, n, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(hdr[4:]) {
+		return nil, n, ErrCorrupt
+	}
+	rec := new(record)
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(rec); err != nil {
+		return nil, n, ErrCorrupt
+	}
+	return rec, n, nil
+}
+
+func writeRecord(w io.Writer, rec *record) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return err
+	}
+	payload := buf.Bytes()
+	var hdr [recordHeaderLen]byte
+	binary.LittleEndian.PutUint32(hdr[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(hdr[4:], crc32.ChecksumIEEE(payload))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func (ix *Index) apply(rec *record) {
+	switch rec.Op {
+	case opPut:
+		if rec.Archive != nil {
+			ix.put(rec.Archive)
+		}
+	case opRemove:
+		ix.remove(rec.Path)
+	}
+}
+
+func (ix *Index) put(a *Archive) {
+	ix.remove(a.Path)
+	ix.archives[a.Path] = a
+	for _, e := range a.Entries {
+		loc := Location{Archive: a.Path, Entry: e}
+		k := crcSize{crc: e.CRC32, size: e.Size}
+		ix.byCRCSize[k] = append(ix.byCRCSize[k], loc)
+		if len(e.MD5) > 0 {
+			ix.byMD5[string(e.MD5)] = append(ix.byMD5[string(e.MD5)], loc)
+		}
+		if len(e.SHA1) > 0 {
+			ix.bySHA1[string(e.SHA1)] = append(ix.bySHA1[string(e.SHA1)], loc)
+		}
+		n := nameKey(e.Name)
+		ix.byName[n] = append(ix.byName[n], loc)
+	}
+}
+
+func (ix *Index) remove(path string) {
+	a, ok := ix.archives[path]
+	if !ok {
+		return
+	}
+	delete(ix.archives, path)
+	ix.garbage++
+
+	for _, e := range a.Entries {
+		k := crcSize{crc: e.CRC32, size: e.Size}
+		ix.byCRCSize[k] = removeLocations(ix.byCRCSize[k], path)
+		if len(ix.byCRCSize[k]) == 0 {
+			delete(ix.byCRCSize, k)
+		}
+		if len(e.MD5) > 0 {
+			removeKey(ix.byMD5, string(e.MD5), path)
+		}
+		if len(e.SHA1) > 0 {
+			removeKey(ix.bySHA1, string(e.SHA1), path)
+		}
+		removeKey(ix.byName, nameKey(e.Name), path)
+	}
+}
+
+func removeKey(m map[string][]Location, k string, path string) {
+	locs := removeLocations(m[k], path)
+	if len(locs) == 0 {
+		delete(m, k)
+	} else {
+		m[k] = locs
+	}
+}
+
+func removeLocations(locs []Location, path string) []Location {
+	kept := locs[:0]
+	for _, loc := range locs {
+		if loc.Archive != path {
+			kept = append(kept, loc)
+		}
+	}
+	return kept
+}
+
+func nameKey(name string) string {
+	return strings.ToLower(name)
+}
+
+func (ix *Index) append(rec *record) error {
+	if err := writeRecord(ix.bw, rec); err != nil {
+		return err
+	}
+	ix.apply(rec)
+	return nil
+}
+
+// Sync flushes and syncs all records written so far to disk.
+func (ix *Index) Sync() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return ix.sync()
+}
+
+func (ix *Index) sync() error {
+	if err := ix.bw.Flush(); err != nil {
+		return err
+	}
+	return ix.f.Sync()
+}
+
+// Close syncs the index and closes its file. If more than half of the log
+// is made of records that no longer matter, it is compacted first.
+func (ix *Index) Close() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if err := ix.sync(); err != nil {
+		ix.f.Close()
+		return err
+	}
+	if ix.garbage > len(ix.archives) {
+		if err := ix.compact(); err != nil {
+			ix.f.Close()
+			return err
+		}
+	}
+	return ix.f.Close()
+}
+
+// Compact rewrites the log so that it only holds the archives currently
+// in the index.
+func (ix *Index) Compact() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if err := ix.sync(); err != nil {
+		return err
+	}
+	return ix.compact()
+}
+
+func (ix *Index) compact() error {
+	tmp := ix.path + ".tmp"
+	tf, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(tf)
+	for _, a := range ix.sortedArchives() {
+		if err := writeRecord(bw, &record{Op: opPut, Archive: a}); err != nil {
+			tf.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		tf.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := tf.Sync(); err != nil {
+		tf.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// some platforms cannot rename over an open file
+	ix.f.Close()
+	rerr := os.Rename(tmp, ix.path)
+	if rerr != nil {
+		os.Remove(tmp)
+	} else {
+		syncDir(filepath.Dir(ix.path))
+	}
+
+	f, err := os.OpenFile(ix.path, os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	ix.f = f
+	ix.bw = bufio.NewWriter(f)
+	if rerr != nil {
+		return rerr
+	}
+	ix.garbage = 0
+	return nil
+}
+
+// syncDir makes a rename in dir durable. Not all platforms support
+// syncing directories, so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+func (ix *Index) sortedArchives() []*Archive {
+	as := make([]*Archive, 0, len(ix.archives))
+	for _, a := range ix.archives {
+		as = append(as, a)
+	}
+	sort.Slice(as, func(i, j int) bool { return as[i].Path < as[j].Path })
+	return as
+}
+
+// Archives returns all indexed archives sorted by path.
+func (ix *Index) Archives() []*Archive {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.sortedArchives()
+}
+
+// Archive returns the indexed archive at path or nil if it is not indexed.
+func (ix *Index) Archive(path string) *Archive {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.archives[path]
+}
+
+// Put adds a to the index, replacing an archive with the same path.
+func (ix *Index) Put(a *Archive) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if err := ix.append(&record{Op: opPut, Archive: a}); err != nil {
+		return err
+	}
+	return ix.sync()
+}
+
+// Remove removes the archive at path from the index.
+func (ix *Index) Remove(path string) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if _, ok := ix.archives[path]; !ok {
+		return nil
+	}
+	if err := ix.append(&record{Op: opRemove, Path: path}); err != nil {
+		return err
+	}
+	return ix.sync()
+}
+
+// write appends rec without syncing it, for batches synced at their end.
+func (ix *Index) write(rec *record) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return ix.append(rec)
+}
+
+// Update indexes the zip file at path unless the index already has it
+// with the same size and modification time. If fullHash is true the
+// content of every entry is hashed to fill in MD5 and SHA1, and an archive
+// indexed without hashing is reindexed. Update returns whether the index
+// changed.
+func (ix *Index) Update(path string, fullHash bool) (bool, error) {
+	changed, err := ix.update(path, fullHash)
+	if err != nil || !changed {
+		return changed, err
+	}
+	return true, ix.Sync()
+}
+
+// update is Update without syncing the index.
+func (ix *Index) update(path string, fullHash bool) (bool, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	if a := ix.Archive(path); a != nil {
+		if a.Size == fi.Size() && a.ModTime == fi.ModTime().UnixNano() && (a.Hashed || !fullHash) {
+			return false, nil
+		}
+	}
+
+	a, err := ReadArchive(path, fullHash)
+	if err != nil {
+		return false, err
+	}
+	a.Size = fi.Size()
+	a.ModTime = fi.ModTime().UnixNano()
+	return true, ix.write(&record{Op: opPut, Archive: a})
+}
+
+// Stats counts what UpdateDir did.
+type Stats struct {
+	Changed int
+	Removed int
+
+	// Failed maps the paths that could not be read to the error reading
+	// them. Archives that can't be read are removed from the index, while
+	// those below a directory that can't be read are kept, as they may
+	// still be there.
+	Failed map[string]error
+}
+
+// UpdateDir indexes all zip files below dir with Update and removes
+// archives below dir that no longer exist. Zip files are recognized by
+// their content, whatever their extension. Paths that can't be read are
+// reported in Stats.Failed and the walk goes on. The index is synced once
+// at the end.
+func (ix *Index) UpdateDir(dir string, fullHash bool) (*Stats, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{Failed: make(map[string]error)}
+	seen := make(map[string]bool)
+	walkFailed := make(map[string]bool)
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			stats.Failed[path] = err
+			walkFailed[path] = true
+			return nil
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		isZip, err := scanner.IsZip(path)
+		if err != nil {
+			stats.Failed[path] = err
+			return nil
+		}
+		if !isZip {
+			return nil
+		}
+		changed, err := ix.update(path, fullHash)
+		if err != nil {
+			stats.Failed[path] = err
+			return nil
+		}
+		seen[path] = true
+		if changed {
+			stats.Changed++
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	prefix := dir + string(filepath.Separator)
+	for _, a := range ix.Archives() {
+		if strings.HasPrefix(a.Path, prefix) && !seen[a.Path] && !below(a.Path, walkFailed) {
+			if err := ix.write(&record{Op: opRemove, Path: a.Path}); err != nil {
+				return stats, err
+			}
+			if _, failed := stats.Failed[a.Path]; !failed {
+				stats.Removed++
+			}
+		}
+	}
+	return stats, ix.Sync()
+}
+
+// below reports whether path or a directory above it is in dirs.
+func below(path string, dirs map[string]bool) bool {
+	for p := path; ; p = filepath.Dir(p) {
+		if dirs[p] {
+			return true
+		}
+		if filepath.Dir(p) == p {
+			return false
+		}
+	}
+}
+
+// ReadArchive reads the entries of the zip file at path from its central
+// directory. If fullHash is true the entries are decompressed to compute
+// their MD5 and SHA1, which also verifies their CRC32. Size and ModTime
+// of the returned archive are not set.
+func ReadArchive(path string, fullHash bool) (*Archive, error) {
+	zr, err := czip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	a := &Archive{
+		Path:   path,
+		Hashed: fullHash,
+	}
+	for _, fh := range zr.File {
+		e := &Entry{
+			Name:  fh.Name,
+			Size:  fh.UncompressedSize64,
+			CRC32: fh.CRC32,
+		}
+		if fullHash {
+			if err := hashEntry(fh, e); err != nil {
+				return nil, err
+			}
+		}
+		a.Entries = append(a.Entries, e)
+	}
+	return a, nil
+}
+
+func hashEntry(fh *czip.File, e *Entry) error {
+	fr, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+
+	md5h := md5.New()
+	sha1h := sha1.New()
+	if _, err := io.Copy(io.MultiWriter(md5h, sha1h), fr); err != nil {
+		return err
+	}
+	e.MD5 = md5h.Sum(nil)
+	e.SHA1 = sha1h.Sum(nil)
+	return nil
+}
+
+func copyLocations(locs []Location) []Location {
+	return append([]Location(nil), locs...)
+}
+
+// LookupCRC returns the entries with the given CRC32 and size.
+func (ix *Index) LookupCRC(crc uint32, size uint64) []Location {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return copyLocations(ix.byCRCSize[crcSize{crc: crc, size: size}])
+}
+
+// LookupMD5 returns the entries with the given MD5.
+func (ix *Index) LookupMD5(md5sum []byte) []Location {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return copyLocations(ix.byMD5[string(md5sum)])
+}
+
+// LookupSHA1 returns the entries with the given SHA1.
+func (ix *Index) LookupSHA1(sha1sum []byte) []Location {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return copyLocations(ix.bySHA1[string(sha1sum)])
+}
+
+// LookupName returns the entries with the given name, compared without
+// regard to case.
+func (ix *Index) LookupName(name string) []Location {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return copyLocations(ix.byName[nameKey(name)])
+}
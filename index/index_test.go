@@ -0,0 +1,284 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip/czip"
+)
+
+func copyTestdata(t *testing.T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join("..", "testdata", "*.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copies []string
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := filepath.Join(dir, filepath.Base(path))
+		if err := ioutil.WriteFile(dst, b, 0666); err != nil {
+			t.Fatal(err)
+		}
+		copies = append(copies, dst)
+	}
+	return copies
+}
+
+func checkLookups(t *testing.T, ix *Index, paths []string) {
+	for _, path := range paths {
+		zr, err := czip.OpenReader(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fh := range zr.File {
+			found := false
+			for _, loc := range ix.LookupCRC(fh.CRC32, fh.UncompressedSize64) {
+				if loc.Archive == path && loc.Name == fh.Name {
+					found = true
+					if len(loc.SHA1) == 0 {
+						t.Errorf("entry %s in %s has no sha1", fh.Name, path)
+					} else if len(ix.LookupSHA1(loc.SHA1)) == 0 {
+						t.Errorf("LookupSHA1 did not find %s in %s", fh.Name, path)
+					}
+				}
+			}
+			if !found {
+				t.Errorf("LookupCRC did not find %s in %s", fh.Name, path)
+			}
+			if len(ix.LookupName(fh.Name)) == 0 {
+				t.Errorf("LookupName did not find %s in %s", fh.Name, path)
+			}
+		}
+		zr.Close()
+	}
+}
+
+func TestIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zipDir := filepath.Join(dir, "zips")
+	if err := os.Mkdir(zipDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	paths := copyTestdata(t, zipDir)
+	// zip files are found by their content, not their extension
+	renamed := strings.TrimSuffix(paths[len(paths)-1], ".zip") + ".rom"
+	if err := os.Rename(paths[len(paths)-1], renamed); err != nil {
+		t.Fatal(err)
+	}
+	paths[len(paths)-1] = renamed
+	ixPath := filepath.Join(dir, "index.log")
+
+	ix, err := Open(ixPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := ix.UpdateDir(zipDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Changed != len(paths) || len(stats.Failed) != 0 {
+		t.Fatalf("UpdateDir changed %d archives and failed %d, want %d and 0",
+			stats.Changed, len(stats.Failed), len(paths))
+	}
+	checkLookups(t, ix, paths)
+
+	stats, err = ix.UpdateDir(zipDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Changed != 0 {
+		t.Errorf("UpdateDir of unchanged dir changed %d archives", stats.Changed)
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash in the middle of writing a record
+	f, err := os.OpenFile(ixPath, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0xff, 0x00, 0x00, 0x00, 0x12, 0x34}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	ix, err = Open(ixPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLookups(t, ix, paths)
+
+	if err := os.Remove(paths[0]); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = ix.UpdateDir(zipDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != 1 {
+		t.Errorf("UpdateDir removed %d archives, want 1", stats.Removed)
+	}
+	if ix.Archive(paths[0]) != nil {
+		t.Errorf("removed archive %s is still indexed", paths[0])
+	}
+	if err := ix.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ix, err = Open(ixPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	if len(ix.Archives()) != len(paths)-1 {
+		t.Errorf("compacted index has %d archives, want %d", len(ix.Archives()), len(paths)-1)
+	}
+	checkLookups(t, ix, paths[1:])
+}
+
+func TestCorruptRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ixPath := filepath.Join(dir, "index.log")
+	ix, err := Open(ixPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/a.zip", "/b.zip"} {
+		if err := ix.Put(&Archive{Path: p, Entries: []*Entry{{Name: "a.rom"}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(ixPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// damage the payload of the first record
+	b[recordHeaderLen+1] ^= 0xff
+	if err := ioutil.WriteFile(ixPath, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(ixPath); err != ErrCorrupt {
+		t.Errorf("Open of index with corrupt first record returned %v, want %v", err, ErrCorrupt)
+	}
+	fi, err := os.Stat(ixPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(b)) {
+		t.Errorf("Open truncated index with corrupt first record to %d bytes", fi.Size())
+	}
+}
+
+func TestUpdateDirUnreadable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zipDir := filepath.Join(dir, "zips")
+	locked := filepath.Join(zipDir, "locked")
+	if err := os.MkdirAll(locked, 0777); err != nil {
+		t.Fatal(err)
+	}
+	paths := copyTestdata(t, zipDir)
+	lockedPaths := copyTestdata(t, locked)
+
+	ixPath := filepath.Join(dir, "index.log")
+	ix, err := Open(ixPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	// Put syncs its record right away
+	if err := ix.Put(&Archive{Path: filepath.Join(dir, "put.zip")}); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(ixPath); err != nil || fi.Size() == 0 {
+		t.Errorf("record of Put not written to the log: %v", err)
+	}
+
+	if _, err := ix.UpdateDir(zipDir, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(ix.Archives()); n != 1+len(paths)+len(lockedPaths) {
+		t.Fatalf("got %d archives, want %d", n, 1+len(paths)+len(lockedPaths))
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can read dirs without read permission")
+	}
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(locked, 0777)
+
+	stats, err := ix.UpdateDir(zipDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Failed[locked] == nil || stats.Removed != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	for _, path := range append(paths, lockedPaths...) {
+		if ix.Archive(path) == nil {
+			t.Errorf("%s was removed from the index", path)
+		}
+	}
+}
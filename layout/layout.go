@@ -0,0 +1,684 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package layout converts collections of torrentzipped sets between the
+split, merged and non-merged layouts of MAME style DATs.
+
+The DAT has to list every rom a set needs, with shared roms carrying a
+merge attribute that names them in the set given by romof, the way MAME's
+-listxml output does. In the three layouts
+
+	non-merged  every set holds all of its roms
+	split       every set holds only the roms it doesn't share with its
+	            parent or bios
+	merged      parents hold their own roms and those of all their clones,
+	            clones have no archive of their own
+
+Bios sets always stand alone. In merged sets a clone rom whose name clashes
+with a different rom of the parent is stored in a directory named after
+the clone.
+*/
+package layout
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uwedeportivo/torrentzip"
+	"github.com/uwedeportivo/torrentzip/czip"
+	"github.com/uwedeportivo/torrentzip/dat"
+	"github.com/uwedeportivo/torrentzip/scanner"
+)
+
+// Mode is a set layout.
+type Mode int
+
+// Set layouts.
+const (
+	NonMerged Mode = iota
+	Split
+	Merged
+)
+
+var modeNames = []string{"nonmerged", "split", "merged"}
+
+func (m Mode) String() string {
+	if int(m) < len(modeNames) {
+		return modeNames[m]
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// ParseMode returns the layout named by s, which is one of "nonmerged",
+// "split" and "merged".
+func ParseMode(s string) (Mode, error) {
+	for i, name := range modeNames {
+		if strings.EqualFold(s, name) {
+			return Mode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown set layout %s", s)
+}
+
+// Set is an archive of a layout.
+type Set struct {
+	Name string
+	Roms []*dat.Rom
+}
+
+// Sets returns the archives of d in layout m. Rom names in the result use
+// forward slashes. Roms with status dat.StatusNoDump are left out.
+func Sets(d *dat.Dat, m Mode) []*Set {
+	var sets []*Set
+	games := d.GamesByName()
+	clones := make(map[string][]*dat.Game)
+	for _, g := range d.Games {
+		if g.CloneOf != "" && games[g.CloneOf] != nil {
+			clones[g.CloneOf] = append(clones[g.CloneOf], g)
+		}
+	}
+
+	for _, g := range d.Games {
+		switch m {
+		case NonMerged:
+			sets = append(sets, &Set{Name: g.Name, Roms: roms(g, false)})
+		case Split:
+			sets = append(sets, &Set{Name: g.Name, Roms: roms(g, true)})
+		case Merged:
+			if g.CloneOf != "" && games[g.CloneOf] != nil {
+				continue
+			}
+			s := &Set{Name: g.Name, Roms: roms(g, true)}
+			byName := make(map[string]*dat.Rom)
+			for _, rom := range s.Roms {
+				byName[rom.Name] = rom
+			}
+			for _, c := range clones[g.Name] {
+				for _, rom := range roms(c, true) {
+					if prev := byName[rom.Name]; prev != nil {
+						if same(prev, rom) {
+							continue
+						}
+						r := *rom
+						r.Name = c.Name + "/" + rom.Name
+						rom = &r
+					}
+					byName[rom.Name] = rom
+					s.Roms = append(s.Roms, rom)
+				}
+			}
+			sets = append(sets, s)
+		}
+	}
+	return sets
+}
+
+// roms returns the roms of g with forward slashes in their names, leaving
+// out shared roms if split is set.
+func roms(g *dat.Game, split bool) []*dat.Rom {
+	var rs []*dat.Rom
+	seen := make(map[string]bool)
+	for _, rom := range g.Roms {
+		if rom.Status == dat.StatusNoDump || (split && rom.Merge != "" && g.RomOf != "") {
+			continue
+		}
+		r := *rom
+		r.Name = strings.Replace(rom.Name, "\\", "/", -1)
+		if seen[r.Name] {
+			continue
+		}
+		seen[r.Name] = true
+		rs = append(rs, &r)
+	}
+	return rs
+}
+
+func same(a, b *dat.Rom) bool {
+	if a.Size != b.Size {
+		return false
+	}
+	if a.SHA1 != nil && b.SHA1 != nil {
+		return a.SHA1.Equal(b.SHA1)
+	}
+	return a.CRC.Equal(b.CRC)
+}
+
+// SetResult describes a converted set.
+type SetResult struct {
+	Name    string
+	Path    string
+	Missing []*dat.Rom
+
+	// Kept lists the entries of the archive that was at Path already
+	// which match no rom written to any set and were kept.
+	Kept []string
+
+	// Backup is where the archive that was at Path already was moved, if
+	// some of its entries match no rom written to any set and have the
+	// name of a rom of the set. It is empty if the archive wasn't moved.
+	Backup string
+}
+
+// Report is the result of a conversion.
+type Report struct {
+	Sets []*SetResult
+
+	// Removed lists archives of the input dir that have no place in the
+	// new layout. They are only removed when converting in place, and
+	// are moved to the backup dir instead if they hold entries that match
+	// no rom written to any set.
+	Removed []string
+
+	// Backups lists where the archives of Removed that were moved ended
+	// up.
+	Backups []string
+}
+
+// Converter rewrites the sets of a DAT into a layout.
+type Converter struct {
+	Dat  *dat.Dat
+	Mode Mode
+
+	// TempDir is used for temporary files. If empty, the default
+	// directory for temporary files is used.
+	TempDir string
+
+	// BackupDir is where archives are moved to that hold entries the
+	// conversion would otherwise lose. If empty, a dir named backup in
+	// the output dir is used.
+	BackupDir string
+}
+
+type source struct {
+	path          string
+	name          string
+	torrentzipped bool
+	key           crcKey
+	sha1, md5     []byte
+}
+
+type crcKey struct {
+	crc  uint32
+	size uint64
+}
+
+// index holds the entries of the archives in a dir by their hashes.
+type index struct {
+	byCRC  map[crcKey]*source
+	bySHA1 map[string]*source
+	byMD5  map[string]*source
+}
+
+func (idx *index) add(src *source) {
+	// prefer entries of torrentzips, which are copied without
+	// recompressing them
+	if prev := idx.byCRC[src.key]; prev == nil || (!prev.torrentzipped && src.torrentzipped) {
+		idx.byCRC[src.key] = src
+	}
+	if src.sha1 == nil {
+		return
+	}
+	if prev := idx.bySHA1[string(src.sha1)]; prev == nil || (!prev.torrentzipped && src.torrentzipped) {
+		idx.bySHA1[string(src.sha1)] = src
+	}
+	if prev := idx.byMD5[string(src.md5)]; prev == nil || (!prev.torrentzipped && src.torrentzipped) {
+		idx.byMD5[string(src.md5)] = src
+	}
+}
+
+// lookup returns an entry matching rom, by CRC32 and size or, for roms
+// without a CRC32, by SHA1 or MD5.
+func (idx *index) lookup(rom *dat.Rom) *source {
+	switch {
+	case len(rom.CRC) == 4:
+		crc := uint32(rom.CRC[0])<<24 | uint32(rom.CRC[1])<<16 | uint32(rom.CRC[2])<<8 | uint32(rom.CRC[3])
+		return idx.byCRC[crcKey{crc, rom.Size}]
+	case rom.SHA1 != nil:
+		if src := idx.bySHA1[string(rom.SHA1)]; src != nil && src.key.size == rom.Size {
+			return src
+		}
+	case rom.MD5 != nil:
+		if src := idx.byMD5[string(rom.MD5)]; src != nil && src.key.size == rom.Size {
+			return src
+		}
+	}
+	return nil
+}
+
+type entry struct {
+	name string
+	src  *source
+}
+
+// plan is a set to be written.
+type plan struct {
+	sr      *SetResult
+	entries []entry
+	backup  bool
+}
+
+// Convert reads the archives in inDir and writes the sets of the layout
+// to outDir, which may be the same as inDir. Roms are found by CRC32 and
+// size, or by SHA1 or MD5 if they have no CRC32, and copied without
+// recompressing them if their archive is a valid torrentzip. Sets without
+// any of their roms are not written. Entries of the archives replaced or
+// removed that match no rom written to any set are kept or moved to the
+// backup dir.
+func (c *Converter) Convert(inDir, outDir string) (*Report, error) {
+	// archives are named after the games, so check all names before any
+	// archive is written or removed
+	for _, g := range c.Dat.Games {
+		if _, err := dat.SetPath(outDir, g); err != nil {
+			return nil, err
+		}
+	}
+
+	idx, err := indexDir(inDir, needsHashes(c.Dat))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+
+	report := new(Report)
+	inLayout := make(map[string]bool)
+	written := make(map[crcKey]bool)
+	var plans []*plan
+	for _, s := range Sets(c.Dat, c.Mode) {
+		inLayout[s.Name] = true
+		p := planSet(idx, outDir, s)
+		if p == nil {
+			continue
+		}
+		plans = append(plans, p)
+		report.Sets = append(report.Sets, p.sr)
+		for _, e := range p.entries {
+			if e.src != nil {
+				written[e.src.key] = true
+			}
+		}
+	}
+
+	// all sets are written to temp files first, since in place the
+	// archives being replaced are still needed as sources
+	pending := make(map[string]*plan)
+	defer func() {
+		for tmp := range pending {
+			os.Remove(tmp)
+		}
+	}()
+	for _, p := range plans {
+		if err := keepUnknown(p, written); err != nil {
+			return nil, fmt.Errorf("converting %s failed: %v", p.sr.Name, err)
+		}
+		tmp, err := c.writeSet(p)
+		if err != nil {
+			return nil, fmt.Errorf("converting %s failed: %v", p.sr.Name, err)
+		}
+		pending[tmp] = p
+	}
+
+	for tmp, p := range pending {
+		if p.backup {
+			p.sr.Backup, err = c.backup(outDir, p.sr.Path)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := os.Rename(tmp, p.sr.Path); err != nil {
+			return nil, err
+		}
+		delete(pending, tmp)
+	}
+
+	same, err := sameDir(inDir, outDir)
+	if err != nil || !same {
+		return report, err
+	}
+	for _, g := range c.Dat.Games {
+		if inLayout[g.Name] {
+			continue
+		}
+		path, err := dat.SetPath(outDir, g)
+		if err != nil {
+			return report, err
+		}
+		old, err := oldEntries(path)
+		if err != nil {
+			return report, err
+		}
+		if old == nil {
+			continue
+		}
+		lost := false
+		for _, src := range old {
+			lost = lost || !written[src.key]
+		}
+		if lost {
+			backup, err := c.backup(outDir, path)
+			if err != nil {
+				return report, err
+			}
+			report.Backups = append(report.Backups, backup)
+		} else if err := os.Remove(path); err != nil {
+			return report, err
+		}
+		report.Removed = append(report.Removed, path)
+	}
+	return report, nil
+}
+
+func sameDir(a, b string) (bool, error) {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(fa, fb), nil
+}
+
+// needsHashes reports whether d has roms without a CRC32, which are
+// matched by SHA1 or MD5.
+func needsHashes(d *dat.Dat) bool {
+	for _, g := range d.Games {
+		for _, rom := range g.Roms {
+			if rom.CRC == nil && (rom.SHA1 != nil || rom.MD5 != nil) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// indexDir indexes the entries of the zip files below dir. Entries are
+// decompressed to hash them only if hashed is set.
+func indexDir(dir string, hashed bool) (*index, error) {
+	idx := &index{
+		byCRC:  make(map[crcKey]*source),
+		bySHA1: make(map[string]*source),
+		byMD5:  make(map[string]*source),
+	}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		zip, err := scanner.IsZip(path)
+		if err != nil || !zip {
+			return err
+		}
+
+		srcs, err := archiveEntries(path, hashed)
+		if err != nil {
+			return err
+		}
+		for _, src := range srcs {
+			idx.add(src)
+		}
+		return nil
+	})
+	return idx, err
+}
+
+// archiveEntries returns a source for each file in the zip file at path.
+// If hashed is set, the files are decompressed to get their SHA1 and MD5.
+func archiveEntries(path string, hashed bool) ([]*source, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	tz, err := torrentzip.IsTorrentzipped(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	zr, err := czip.NewReader(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	var srcs []*source
+	for _, fh := range zr.File {
+		if strings.HasSuffix(fh.Name, "/") {
+			continue
+		}
+		src := &source{
+			path:          path,
+			name:          fh.Name,
+			torrentzipped: tz,
+			key:           crcKey{fh.CRC32, fh.UncompressedSize64},
+		}
+		if hashed {
+			src.sha1, src.md5, err = hashEntry(fh)
+			if err != nil {
+				return nil, fmt.Errorf("reading %s in %s failed: %v", fh.Name, path, err)
+			}
+		}
+		srcs = append(srcs, src)
+	}
+	return srcs, nil
+}
+
+func hashEntry(fh *czip.File) ([]byte, []byte, error) {
+	fr, err := fh.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fr.Close()
+
+	sh := sha1.New()
+	mh := md5.New()
+	if _, err := io.Copy(io.MultiWriter(sh, mh), fr); err != nil {
+		return nil, nil, err
+	}
+	return sh.Sum(nil), mh.Sum(nil), nil
+}
+
+// oldEntries returns the entries of the archive at path, which is about
+// to be replaced or removed, or nil if there is none.
+func oldEntries(path string) ([]*source, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return archiveEntries(path, false)
+}
+
+// planSet finds the roms of s. It returns nil if none are found.
+func planSet(idx *index, outDir string, s *Set) *plan {
+	p := &plan{sr: &SetResult{
+		Name: s.Name,
+		Path: filepath.Join(outDir, s.Name+".zip"),
+	}}
+	found := 0
+	for _, rom := range s.Roms {
+		if rom.Size == 0 && strings.HasSuffix(rom.Name, "/") {
+			p.entries = append(p.entries, entry{name: rom.Name})
+			continue
+		}
+		src := idx.lookup(rom)
+		if src == nil {
+			p.sr.Missing = append(p.sr.Missing, rom)
+			continue
+		}
+		p.entries = append(p.entries, entry{name: rom.Name, src: src})
+		found++
+	}
+	if found == 0 {
+		return nil
+	}
+	return p
+}
+
+// keepUnknown adds the entries of the archive being replaced by p that
+// match no rom written to any set to p. If one of them has the name of a
+// rom of the set, the archive is marked for a backup instead.
+func keepUnknown(p *plan, written map[crcKey]bool) error {
+	old, err := oldEntries(p.sr.Path)
+	if err != nil {
+		return err
+	}
+	taken := make(map[string]bool)
+	for _, e := range p.entries {
+		taken[e.name] = true
+	}
+	for _, src := range old {
+		if written[src.key] {
+			continue
+		}
+		if taken[src.name] {
+			p.backup = true
+			continue
+		}
+		taken[src.name] = true
+		p.entries = append(p.entries, entry{name: src.name, src: src})
+		p.sr.Kept = append(p.sr.Kept, src.name)
+	}
+	return nil
+}
+
+// writeSet writes p to a temp file next to its archive and returns the
+// temp file's name.
+func (c *Converter) writeSet(p *plan) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(p.sr.Path), 0755); err != nil {
+		return "", err
+	}
+	tf, err := ioutil.TempFile(filepath.Dir(p.sr.Path), "layout")
+	if err != nil {
+		return "", err
+	}
+
+	readers := make(map[string]*czip.ReadCloser)
+	defer func() {
+		for _, zr := range readers {
+			zr.Close()
+		}
+	}()
+
+	zw, err := torrentzip.NewWriterWithTemp(tf, c.TempDir)
+	if err == nil {
+		for _, e := range p.entries {
+			if e.src == nil {
+				_, err = zw.Create(e.name)
+			} else {
+				err = copyEntry(zw, readers, e.name, e.src)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			zw.Abort()
+		} else {
+			err = zw.Close()
+		}
+	}
+	if cerr := tf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tf.Name())
+		return "", err
+	}
+	return tf.Name(), nil
+}
+
+// backup moves the archive at path to the backup dir and returns its new
+// path.
+func (c *Converter) backup(outDir, path string) (string, error) {
+	dir := c.BackupDir
+	if dir == "" {
+		dir = filepath.Join(outDir, "backup")
+	}
+	rel, err := filepath.Rel(outDir, path)
+	if err != nil {
+		return "", err
+	}
+	backup := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(backup), 0755); err != nil {
+		return "", err
+	}
+	for i := 1; ; i++ {
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			break
+		}
+		backup = filepath.Join(dir, strings.TrimSuffix(rel, ".zip")+fmt.Sprintf(".%d.zip", i))
+	}
+	return backup, os.Rename(path, backup)
+}
+
+func copyEntry(zw *torrentzip.Writer, readers map[string]*czip.ReadCloser, name string, src *source) error {
+	zr := readers[src.path]
+	if zr == nil {
+		var err error
+		zr, err = czip.OpenReader(src.path)
+		if err != nil {
+			return err
+		}
+		readers[src.path] = zr
+	}
+
+	for _, f := range zr.File {
+		if f.Name != src.name {
+			continue
+		}
+		if src.torrentzipped {
+			return zw.CopyRaw(name, f)
+		}
+		fr, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer fr.Close()
+		cw, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(cw, fr)
+		return err
+	}
+	return fmt.Errorf("%s not found in %s", src.name, src.path)
+}
@@ -0,0 +1,428 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package layout
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip"
+	"github.com/uwedeportivo/torrentzip/czip"
+	"github.com/uwedeportivo/torrentzip/dat"
+)
+
+var contents = map[string][]byte{
+	"bios":    bytes.Repeat([]byte("bios"), 1000),
+	"p1":      bytes.Repeat([]byte("parent rom"), 1000),
+	"shared1": []byte("parent version of shared"),
+	"shared2": []byte("clone version of shared"),
+	"c1":      bytes.Repeat([]byte("clone rom"), 1000),
+}
+
+func rom(name, content, merge string) *dat.Rom {
+	data := contents[content]
+	return &dat.Rom{
+		Name:  name,
+		Size:  uint64(len(data)),
+		CRC:   dat.CRC(crc32.ChecksumIEEE(data)),
+		Merge: merge,
+	}
+}
+
+func testDat() *dat.Dat {
+	return &dat.Dat{
+		Games: []*dat.Game{
+			{
+				Name:   "bios",
+				IsBios: true,
+				Roms:   []*dat.Rom{rom("bios.bin", "bios", "")},
+			},
+			{
+				Name:  "parent",
+				RomOf: "bios",
+				Roms: []*dat.Rom{
+					rom("bios.bin", "bios", "bios.bin"),
+					rom("p1.bin", "p1", ""),
+					rom("shared.bin", "shared1", ""),
+				},
+			},
+			{
+				Name:    "clone",
+				CloneOf: "parent",
+				RomOf:   "parent",
+				Roms: []*dat.Rom{
+					rom("bios.bin", "bios", "bios.bin"),
+					rom("p1.bin", "p1", "p1.bin"),
+					rom("shared.bin", "shared2", ""),
+					rom("sub\\c1.bin", "c1", ""),
+				},
+			},
+		},
+	}
+}
+
+func setNames(s *Set) []string {
+	var names []string
+	for _, r := range s.Roms {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+func TestSets(t *testing.T) {
+	d := testDat()
+
+	for _, tc := range []struct {
+		mode Mode
+		want map[string][]string
+	}{
+		{NonMerged, map[string][]string{
+			"bios":   {"bios.bin"},
+			"parent": {"bios.bin", "p1.bin", "shared.bin"},
+			"clone":  {"bios.bin", "p1.bin", "shared.bin", "sub/c1.bin"},
+		}},
+		{Split, map[string][]string{
+			"bios":   {"bios.bin"},
+			"parent": {"p1.bin", "shared.bin"},
+			"clone":  {"shared.bin", "sub/c1.bin"},
+		}},
+		{Merged, map[string][]string{
+			"bios":   {"bios.bin"},
+			"parent": {"p1.bin", "shared.bin", "clone/shared.bin", "sub/c1.bin"},
+		}},
+	} {
+		got := make(map[string][]string)
+		for _, s := range Sets(d, tc.mode) {
+			got[s.Name] = setNames(s)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: got %v, want %v", tc.mode, got, tc.want)
+		}
+	}
+}
+
+func writeSets(t *testing.T, dir string, d *dat.Dat) {
+	for _, s := range Sets(d, NonMerged) {
+		f, err := os.Create(filepath.Join(dir, s.Name+".zip"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw, err := torrentzip.NewWriter(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range s.Roms {
+			w, err := zw.Create(r.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, data := range contents {
+				if dat.CRC(crc32.ChecksumIEEE(data)).Equal(r.CRC) {
+					w.Write(data)
+					break
+				}
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+}
+
+func entryNames(t *testing.T, path string) []string {
+	zr, err := czip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, _ := f.Stat()
+	if ok, err := torrentzip.IsTorrentzipped(f, fi.Size()); err != nil || !ok {
+		t.Errorf("%s is not torrentzipped: %v", path, err)
+	}
+
+	var names []string
+	for _, fh := range zr.File {
+		names = append(names, fh.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestConvert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := testDat()
+	nonMerged := filepath.Join(dir, "nonmerged")
+	if err := os.MkdirAll(nonMerged, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeSets(t, nonMerged, d)
+
+	split := filepath.Join(dir, "split")
+	c := &Converter{Dat: d, Mode: Split}
+	report, err := c.Convert(nonMerged, split)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Sets) != 3 || len(report.Removed) != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if got := entryNames(t, filepath.Join(split, "clone.zip")); !reflect.DeepEqual(got, []string{"shared.bin", "sub/c1.bin"}) {
+		t.Errorf("split clone has entries %v", got)
+	}
+
+	// merge in place
+	c.Mode = Merged
+	report, err = c.Convert(split, split)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Removed) != 1 || filepath.Base(report.Removed[0]) != "clone.zip" {
+		t.Errorf("unexpected removed %v", report.Removed)
+	}
+	want := []string{"clone/shared.bin", "p1.bin", "shared.bin", "sub/c1.bin"}
+	if got := entryNames(t, filepath.Join(split, "parent.zip")); !reflect.DeepEqual(got, want) {
+		t.Errorf("merged parent has entries %v, want %v", got, want)
+	}
+
+	// and back to non-merged, which results in the original archives
+	back := filepath.Join(dir, "back")
+	c.Mode = NonMerged
+	report, err = c.Convert(split, back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range report.Sets {
+		if len(s.Missing) != 0 {
+			t.Errorf("%s: missing %v", s.Name, s.Missing)
+		}
+		orig, err := ioutil.ReadFile(filepath.Join(nonMerged, s.Name+".zip"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conv, err := ioutil.ReadFile(s.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(orig, conv) {
+			t.Errorf("%s differs after converting back", s.Name)
+		}
+	}
+
+	if _, err := ParseMode("Split"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConvertBadName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sets := filepath.Join(dir, "sets")
+	if err := os.MkdirAll(sets, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeSets(t, sets, testDat())
+	victim := filepath.Join(dir, "victim.zip")
+	if err := ioutil.WriteFile(victim, []byte("not to be removed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// in merged layout the clone victim is removed, unless its name is
+	// refused first
+	d := testDat()
+	d.Games = append(d.Games, &dat.Game{
+		Name:    "../victim",
+		CloneOf: "parent",
+		Roms:    []*dat.Rom{rom("p1.bin", "p1", "p1.bin")},
+	})
+	c := &Converter{Dat: d, Mode: Merged}
+	if _, err := c.Convert(sets, sets); err == nil {
+		t.Error("converting a DAT with a set name leading out of the dir succeeded")
+	}
+	if _, err := os.Stat(victim); err != nil {
+		t.Errorf("file outside the set dir was removed: %v", err)
+	}
+}
+
+func writeArchive(t *testing.T, path string, files map[string][]byte) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw, err := torrentzip.NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestConvertUnknown checks that converting in place keeps entries that
+// match no rom, or moves their archive to the backup dir.
+func TestConvertUnknown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := testDat()
+	sets := filepath.Join(dir, "sets")
+	if err := os.MkdirAll(sets, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeSets(t, sets, d)
+	readme := []byte("readme")
+	writeArchive(t, filepath.Join(sets, "bios.zip"), map[string][]byte{
+		"bios.bin":   contents["bios"],
+		"readme.txt": readme,
+	})
+	// a bad dump of p1.bin, which the clone has a good copy of
+	writeArchive(t, filepath.Join(sets, "parent.zip"), map[string][]byte{
+		"bios.bin":   contents["bios"],
+		"p1.bin":     []byte("bad dump"),
+		"shared.bin": contents["shared1"],
+	})
+	writeArchive(t, filepath.Join(sets, "clone.zip"), map[string][]byte{
+		"bios.bin":   contents["bios"],
+		"p1.bin":     contents["p1"],
+		"shared.bin": contents["shared2"],
+		"sub/c1.bin": contents["c1"],
+		"clone.nfo":  []byte("nfo"),
+	})
+
+	c := &Converter{Dat: d, Mode: Merged}
+	report, err := c.Convert(sets, sets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backups := filepath.Join(sets, "backup")
+	for _, s := range report.Sets {
+		switch s.Name {
+		case "bios":
+			if len(s.Kept) != 1 || s.Kept[0] != "readme.txt" || s.Backup != "" {
+				t.Errorf("unexpected bios result %+v", s)
+			}
+		case "parent":
+			if len(s.Kept) != 0 || s.Backup != filepath.Join(backups, "parent.zip") {
+				t.Errorf("unexpected parent result %+v", s)
+			}
+		}
+	}
+	if got := entryNames(t, filepath.Join(sets, "bios.zip")); !reflect.DeepEqual(got, []string{"bios.bin", "readme.txt"}) {
+		t.Errorf("bios has entries %v", got)
+	}
+	if len(report.Removed) != 1 || len(report.Backups) != 1 || report.Backups[0] != filepath.Join(backups, "clone.zip") {
+		t.Errorf("unexpected removed %v and backups %v", report.Removed, report.Backups)
+	}
+	for _, name := range []string{"parent.zip", "clone.zip"} {
+		if _, err := os.Stat(filepath.Join(backups, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// TestConvertSHA1 checks that roms without a CRC32 are found by SHA1.
+func TestConvertSHA1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	nonMerged := filepath.Join(dir, "nonmerged")
+	if err := os.MkdirAll(nonMerged, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeSets(t, nonMerged, testDat())
+
+	d := testDat()
+	for _, g := range d.Games {
+		for _, r := range g.Roms {
+			for _, data := range contents {
+				if dat.CRC(crc32.ChecksumIEEE(data)).Equal(r.CRC) {
+					h := sha1.Sum(data)
+					r.SHA1 = h[:]
+				}
+			}
+			r.CRC = nil
+		}
+	}
+
+	split := filepath.Join(dir, "split")
+	c := &Converter{Dat: d, Mode: Split}
+	report, err := c.Convert(nonMerged, split)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Sets) != 3 {
+		t.Fatalf("got %d sets, want 3", len(report.Sets))
+	}
+	for _, s := range report.Sets {
+		if len(s.Missing) != 0 {
+			t.Errorf("%s: missing %v", s.Name, s.Missing)
+		}
+	}
+	if got := entryNames(t, filepath.Join(split, "clone.zip")); !reflect.DeepEqual(got, []string{"shared.bin", "sub/c1.bin"}) {
+		t.Errorf("split clone has entries %v", got)
+	}
+}
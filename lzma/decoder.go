@@ -0,0 +1,393 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package lzma
+
+const (
+	numStates          = 12
+	numPosBitsMax      = 4
+	numLenToPosStates  = 4
+	numAlignBits       = 4
+	startPosModelIndex = 4
+	endPosModelIndex   = 14
+	numFullDistances   = 1 << (endPosModelIndex >> 1)
+	matchMinLen        = 2
+)
+
+// window is the dictionary of a decoder and holds the decoded bytes
+// until they are read.
+type window struct {
+	buf     []byte
+	size    int64 // dictionary size, buf grows up to it
+	pos     int   // next write position in buf
+	readPos int   // next read position in buf
+	full    bool  // buf has wrapped around at least once
+	total   int64 // bytes written since the last reset
+}
+
+// initialWindow is the size of buf in a new window. The dictionary size
+// comes from the header of a stream and can be up to 4 GB, so buf only
+// grows as data is decoded.
+const initialWindow = 1 << 16
+
+func newWindow(dictSize uint32) *window {
+	size := int64(dictSize)
+	if size < minDictSize {
+		size = minDictSize
+	}
+	n := size
+	if n > initialWindow {
+		n = initialWindow
+	}
+	return &window{buf: make([]byte, n), size: size}
+}
+
+// wrap makes room once buf is full and all of it has been read. Until
+// buf has the dictionary size it grows, after that writing starts at its
+// beginning again.
+func (w *window) wrap() {
+	if w.pos != len(w.buf) || w.readPos != w.pos {
+		return
+	}
+	if n := 2 * int64(len(w.buf)); int64(len(w.buf)) < w.size {
+		if n > w.size {
+			n = w.size
+		}
+		buf := make([]byte, n)
+		copy(buf, w.buf)
+		w.buf = buf
+		return
+	}
+	w.pos, w.readPos, w.full = 0, 0, true
+}
+
+func (w *window) reset() {
+	w.pos, w.readPos, w.full, w.total = 0, 0, false, 0
+}
+
+func (w *window) putByte(b byte) {
+	w.buf[w.pos] = b
+	w.pos++
+	w.total++
+}
+
+// getByte returns the byte dist+1 positions back.
+func (w *window) getByte(dist uint32) byte {
+	i := w.pos - int(dist) - 1
+	if i < 0 {
+		i += len(w.buf)
+	}
+	return w.buf[i]
+}
+
+// valid reports whether dist+1 bytes back is inside the dictionary.
+func (w *window) valid(dist uint32) bool {
+	if w.full {
+		return int64(dist) < int64(len(w.buf))
+	}
+	return int(dist) < w.pos
+}
+
+// copyMatch copies up to n bytes from dist+1 positions back, stopping at
+// the end of buf. It returns the number of bytes copied.
+func (w *window) copyMatch(dist uint32, n int) int {
+	if space := len(w.buf) - w.pos; n > space {
+		n = space
+	}
+	src := w.pos - int(dist) - 1
+	if src < 0 {
+		src += len(w.buf)
+	}
+	for i := 0; i < n; i++ {
+		w.buf[w.pos] = w.buf[src]
+		w.pos++
+		src++
+		if src == len(w.buf) {
+			src = 0
+		}
+	}
+	w.total += int64(n)
+	return n
+}
+
+type lenDecoder struct {
+	choice  prob
+	choice2 prob
+	low     [1 << numPosBitsMax][1 << 3]prob
+	mid     [1 << numPosBitsMax][1 << 3]prob
+	high    [1 << 8]prob
+}
+
+func (ld *lenDecoder) init() {
+	ld.choice = probInit
+	ld.choice2 = probInit
+	for i := range ld.low {
+		initProbs(ld.low[i][:])
+		initProbs(ld.mid[i][:])
+	}
+	initProbs(ld.high[:])
+}
+
+func (ld *lenDecoder) decode(rc *rangeDecoder, posState uint32) uint32 {
+	if rc.bit(&ld.choice) == 0 {
+		return rc.bitTree(ld.low[posState][:], 3)
+	}
+	if rc.bit(&ld.choice2) == 0 {
+		return 8 + rc.bitTree(ld.mid[posState][:], 3)
+	}
+	return 16 + rc.bitTree(ld.high[:], 8)
+}
+
+// decoder holds the state of an LZMA decoder.
+type decoder struct {
+	rc *rangeDecoder
+	w  *window
+
+	lc, lp, pb uint
+
+	literal     []prob
+	isMatch     [numStates << numPosBitsMax]prob
+	isRep       [numStates]prob
+	isRepG0     [numStates]prob
+	isRepG1     [numStates]prob
+	isRepG2     [numStates]prob
+	isRep0Long  [numStates << numPosBitsMax]prob
+	posSlot     [numLenToPosStates][1 << 6]prob
+	posDecoders [1 + numFullDistances - endPosModelIndex]prob
+	align       [1 << numAlignBits]prob
+	lenDec      lenDecoder
+	repLenDec   lenDecoder
+
+	state                  uint32
+	rep0, rep1, rep2, rep3 uint32
+
+	// remaining bytes of a match that didn't fit before the end of the
+	// window.
+	remain int
+}
+
+func newDecoder(p Properties, w *window) *decoder {
+	d := &decoder{w: w}
+	d.setProperties(p)
+	d.reset()
+	return d
+}
+
+func (d *decoder) setProperties(p Properties) {
+	d.lc, d.lp, d.pb = uint(p.LC), uint(p.LP), uint(p.PB)
+	n := 0x300 << (d.lc + d.lp)
+	if cap(d.literal) >= n {
+		d.literal = d.literal[:n]
+	} else {
+		d.literal = make([]prob, n)
+	}
+}
+
+// reset resets the probabilities and the state.
+func (d *decoder) reset() {
+	initProbs(d.literal)
+	initProbs(d.isMatch[:])
+	initProbs(d.isRep[:])
+	initProbs(d.isRepG0[:])
+	initProbs(d.isRepG1[:])
+	initProbs(d.isRepG2[:])
+	initProbs(d.isRep0Long[:])
+	for i := range d.posSlot {
+		initProbs(d.posSlot[i][:])
+	}
+	initProbs(d.posDecoders[:])
+	initProbs(d.align[:])
+	d.lenDec.init()
+	d.repLenDec.init()
+	d.state = 0
+	d.rep0, d.rep1, d.rep2, d.rep3 = 0, 0, 0, 0
+	d.remain = 0
+}
+
+// decode decodes until the window is full, limit bytes have been written
+// or the end marker is found, which is reported by returning true. A
+// negative limit means no limit.
+func (d *decoder) decode(limit int64) (bool, error) {
+	w := d.w
+	rc := d.rc
+	start := w.total
+	left := func() int64 {
+		if limit < 0 {
+			return int64(len(w.buf))
+		}
+		return limit - (w.total - start)
+	}
+
+	if d.remain > 0 {
+		n := d.remain
+		if l := left(); int64(n) > l {
+			n = int(l)
+		}
+		d.remain -= w.copyMatch(d.rep0, n)
+	}
+
+	pbMask := uint32(1)<<d.pb - 1
+	lpMask := uint32(1)<<d.lp - 1
+	for w.pos < len(w.buf) && left() > 0 {
+		if d.remain > 0 {
+			// a match was cut short by limit
+			break
+		}
+		posState := uint32(w.total) & pbMask
+
+		if rc.bit(&d.isMatch[d.state<<numPosBitsMax+posState]) == 0 {
+			var prev uint32
+			if w.total > 0 {
+				prev = uint32(w.getByte(0))
+			}
+			litState := (uint32(w.total)&lpMask)<<d.lc + prev>>(8-d.lc)
+			probs := d.literal[0x300*litState:]
+			sym := uint32(1)
+			if d.state >= 7 {
+				matchByte := uint32(w.getByte(d.rep0))
+				for sym < 0x100 {
+					matchBit := (matchByte >> 7) & 1
+					matchByte <<= 1
+					b := rc.bit(&probs[(1+matchBit)<<8+sym])
+					sym = sym<<1 | b
+					if matchBit != b {
+						break
+					}
+				}
+			}
+			for sym < 0x100 {
+				sym = sym<<1 | rc.bit(&probs[sym])
+			}
+			w.putByte(byte(sym))
+			switch {
+			case d.state < 4:
+				d.state = 0
+			case d.state < 10:
+				d.state -= 3
+			default:
+				d.state -= 6
+			}
+			if rc.err != nil {
+				return false, rc.err
+			}
+			continue
+		}
+
+		var length uint32
+		if rc.bit(&d.isRep[d.state]) == 0 {
+			d.rep3, d.rep2, d.rep1 = d.rep2, d.rep1, d.rep0
+			length = d.lenDec.decode(rc, posState)
+			if d.state < 7 {
+				d.state = 7
+			} else {
+				d.state = 10
+			}
+			d.rep0 = d.distance(length)
+			if rc.err != nil {
+				return false, rc.err
+			}
+			if d.rep0 == 0xFFFFFFFF {
+				return true, nil
+			}
+			if !w.valid(d.rep0) {
+				return false, ErrCorrupt
+			}
+		} else {
+			if w.total == 0 {
+				return false, ErrCorrupt
+			}
+			if rc.bit(&d.isRepG0[d.state]) == 0 {
+				if rc.bit(&d.isRep0Long[d.state<<numPosBitsMax+posState]) == 0 {
+					if d.state < 7 {
+						d.state = 9
+					} else {
+						d.state = 11
+					}
+					w.putByte(w.getByte(d.rep0))
+					if rc.err != nil {
+						return false, rc.err
+					}
+					continue
+				}
+			} else {
+				var dist uint32
+				if rc.bit(&d.isRepG1[d.state]) == 0 {
+					dist = d.rep1
+				} else {
+					if rc.bit(&d.isRepG2[d.state]) == 0 {
+						dist = d.rep2
+					} else {
+						dist = d.rep3
+						d.rep3 = d.rep2
+					}
+					d.rep2 = d.rep1
+				}
+				d.rep1 = d.rep0
+				d.rep0 = dist
+			}
+			length = d.repLenDec.decode(rc, posState)
+			if d.state < 7 {
+				d.state = 8
+			} else {
+				d.state = 11
+			}
+		}
+		if rc.err != nil {
+			return false, rc.err
+		}
+
+		n := int(length) + matchMinLen
+		if l := left(); int64(n) > l {
+			d.remain = n - int(l)
+			n = int(l)
+		}
+		copied := w.copyMatch(d.rep0, n)
+		d.remain += n - copied
+	}
+	return false, rc.err
+}
+
+func (d *decoder) distance(length uint32) uint32 {
+	lenState := length
+	if lenState > numLenToPosStates-1 {
+		lenState = numLenToPosStates - 1
+	}
+	posSlot := d.rc.bitTree(d.posSlot[lenState][:], 6)
+	if posSlot < startPosModelIndex {
+		return posSlot
+	}
+	numDirectBits := uint(posSlot>>1) - 1
+	dist := (2 | posSlot&1) << numDirectBits
+	if posSlot < endPosModelIndex {
+		return dist + d.rc.reverseBitTree(d.posDecoders[dist-posSlot:], numDirectBits)
+	}
+	dist += d.rc.direct(numDirectBits-numAlignBits) << numAlignBits
+	return dist + d.rc.reverseBitTree(d.align[:], numAlignBits)
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package lzma
+
+import (
+	"io"
+)
+
+// DictSize2 returns the dictionary size encoded in the properties byte of
+// an LZMA2 stream.
+func DictSize2(b byte) (uint32, error) {
+	if b > 40 {
+		return 0, ErrProperties
+	}
+	if b == 40 {
+		return 0xFFFFFFFF, nil
+	}
+	return (2 | uint32(b)&1) << (b/2 + 11), nil
+}
+
+// NewReader2 returns a reader decompressing the LZMA2 stream in r using
+// a dictionary of the given size. The dictionary is allocated as data is
+// decoded, so a large size read from a header only costs memory if the
+// stream is that long.
+func NewReader2(r io.Reader, dictSize uint32) io.Reader {
+	w := newWindow(dictSize)
+	d := &decoder{w: w}
+	return &reader2{
+		br:            byteReader(r),
+		d:             d,
+		needDictReset: true,
+		needProps:     true,
+	}
+}
+
+type reader2 struct {
+	br io.ByteReader
+	d  *decoder
+
+	// packed is the compressed input of the current LZMA chunk, copy is
+	// the number of bytes left in the current uncompressed chunk and
+	// unpacked those left in the current LZMA chunk.
+	packed   *limitedByteReader
+	copy     int
+	unpacked int64
+
+	needDictReset bool
+	needProps     bool
+	err           error
+}
+
+func (r *reader2) Read(p []byte) (int, error) {
+	w := r.d.w
+	for {
+		if w.readPos < w.pos {
+			n := copy(p, w.buf[w.readPos:w.pos])
+			w.readPos += n
+			return n, nil
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		w.wrap()
+
+		switch {
+		case r.copy > 0:
+			r.err = r.copyChunk()
+		case r.unpacked > 0:
+			r.err = r.decodeChunk()
+		default:
+			r.err = r.nextChunk()
+		}
+	}
+}
+
+func (r *reader2) copyChunk() error {
+	w := r.d.w
+	for r.copy > 0 && w.pos < len(w.buf) {
+		b, err := r.br.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+		w.putByte(b)
+		r.copy--
+	}
+	return nil
+}
+
+func (r *reader2) decodeChunk() error {
+	start := r.d.w.total
+	eos, err := r.d.decode(r.unpacked)
+	if err != nil {
+		return err
+	}
+	if eos {
+		return ErrCorrupt
+	}
+	r.unpacked -= r.d.w.total - start
+	if r.unpacked > 0 {
+		return r.d.rc.err
+	}
+	if r.d.remain > 0 {
+		return ErrCorrupt
+	}
+	for r.packed.n > 0 {
+		if _, err := r.packed.ReadByte(); err != nil {
+			return unexpected(err)
+		}
+	}
+	return r.d.rc.err
+}
+
+// nextChunk reads the header of the next chunk. It is only called once
+// all data of the previous chunk has been read, so the dictionary can
+// be reset.
+func (r *reader2) nextChunk() error {
+	control, err := r.br.ReadByte()
+	if err != nil {
+		return unexpected(err)
+	}
+	if control == 0 {
+		return io.EOF
+	}
+
+	var buf [5]byte
+	if control < 0x80 {
+		if control > 2 {
+			return ErrCorrupt
+		}
+		if _, err := readFull(r.br, buf[:2]); err != nil {
+			return err
+		}
+		if control == 1 {
+			r.d.w.reset()
+			r.needDictReset = false
+		} else if r.needDictReset {
+			return ErrCorrupt
+		}
+		r.copy = int(buf[0])<<8 | int(buf[1]) + 1
+		return nil
+	}
+
+	if _, err := readFull(r.br, buf[:4]); err != nil {
+		return err
+	}
+	r.unpacked = int64(control&0x1F)<<16 + int64(buf[0])<<8 + int64(buf[1]) + 1
+	packed := int64(buf[2])<<8 + int64(buf[3]) + 1
+
+	mode := (control >> 5) & 3
+	if mode == 3 {
+		r.d.w.reset()
+		r.needDictReset = false
+	} else if r.needDictReset {
+		return ErrCorrupt
+	}
+	if mode >= 2 {
+		pb, err := r.br.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+		p, err := DecodeProperties([]byte{pb, 0, 0, 0, 0})
+		if err != nil || p.LC+p.LP > 4 {
+			return ErrCorrupt
+		}
+		r.d.setProperties(p)
+		r.needProps = false
+	} else if r.needProps {
+		return ErrCorrupt
+	}
+	if mode >= 1 {
+		r.d.reset()
+	}
+
+	r.packed = &limitedByteReader{br: r.br, n: packed}
+	r.d.rc = newRangeDecoder(r.packed)
+	return r.d.rc.init()
+}
+
+type limitedByteReader struct {
+	br io.ByteReader
+	n  int64
+}
+
+func (l *limitedByteReader) ReadByte() (byte, error) {
+	if l.n <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	l.n--
+	return l.br.ReadByte()
+}
+
+func readFull(br io.ByteReader, buf []byte) (int, error) {
+	for i := range buf {
+		b, err := br.ReadByte()
+		if err != nil {
+			return i, unexpected(err)
+		}
+		buf[i] = b
+	}
+	return len(buf), nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,263 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package lzma
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// all test files hold the same data, compressed by liblzma with different
+// settings.
+const (
+	testSize = 102754
+	testSHA1 = "909d53d731edaff51d5e2144619aad3e9dbcc1e9"
+)
+
+func checkData(t *testing.T, name string, r io.Reader) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	sum := sha1.Sum(data)
+	if len(data) != testSize || hex.EncodeToString(sum[:]) != testSHA1 {
+		t.Errorf("%s: got %d bytes with sha1 %x", name, len(data), sum)
+	}
+}
+
+func TestReader(t *testing.T) {
+	for _, name := range []string{"text.lzma", "smalldict.lzma", "lc8.lzma"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkData(t, name, r)
+
+		// with a known size the end marker isn't needed
+		p, err := DecodeProperties(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err = NewRawReader(bytes.NewReader(data[HeaderLen:]), p, testSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkData(t, name+" sized", r)
+	}
+}
+
+func TestReader2(t *testing.T) {
+	for _, name := range []string{"text.lzma2", "smalldict.lzma2"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkData(t, name, NewReader2(bytes.NewReader(data), 1<<20))
+	}
+}
+
+func TestZipReader(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "text.ziplzma"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewZipReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkData(t, "text.ziplzma", r)
+
+	if _, err := NewZipReader(bytes.NewReader([]byte{9, 20, 4, 0, 93, 0, 0, 1})); err != ErrFormat {
+		t.Errorf("short properties: got error %v", err)
+	}
+}
+
+// TestZipReaderLargeDictionary reads zip LZMA data with a header
+// claiming a 4 GB dictionary and a 33 byte .lzma file claiming the same,
+// neither of which may allocate it.
+func TestZipReaderLargeDictionary(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "text.ziplzma"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append([]byte(nil), data...)
+	copy(data[5:9], []byte{0xFF, 0xFF, 0xFF, 0xFF})
+	r, err := NewZipReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkData(t, "text.ziplzma", r)
+	if n := len(r.(*reader).d.w.buf); n > 2*testSize {
+		t.Errorf("window of %d bytes for %d bytes of data", n, testSize)
+	}
+
+	small := make([]byte, HeaderLen+20)
+	small[0] = 93
+	for i := 1; i < HeaderLen; i++ {
+		small[i] = 0xFF
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	r, err = NewReader(bytes.NewReader(small))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Errorf("stream of zeros decoded without error")
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<24 {
+		t.Errorf("allocated %d bytes for a 33 byte file", n)
+	}
+}
+
+func TestXZReader(t *testing.T) {
+	// multi.xz has two streams with padding, a SHA-256 checked one and
+	// one of several CRC32 checked blocks.
+	for _, name := range []string{"text.xz", "multi.xz"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewXZReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkData(t, name, r)
+	}
+}
+
+func TestXZCorrupt(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "text.xz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewXZReader(bytes.NewReader(data[1:])); err != ErrFormat {
+		t.Errorf("bad magic: got error %v", err)
+	}
+
+	for _, n := range []int{len(data) / 2, len(data) - 20, len(data) - 1} {
+		r, err := NewXZReader(bytes.NewReader(data[:n]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+			t.Errorf("truncated to %d bytes: got error %v", n, err)
+		}
+	}
+
+	// the last bytes are the check of the block, the index and footer
+	for _, i := range []int{7, 13, len(data) - 40, len(data) - 20, len(data) - 10} {
+		bad := append([]byte(nil), data...)
+		bad[i] ^= 0x01
+		r, err := NewXZReader(bytes.NewReader(bad))
+		if err == nil {
+			_, err = ioutil.ReadAll(r)
+		}
+		if err == nil {
+			t.Errorf("corruption at %d went unnoticed", i)
+		}
+	}
+}
+
+// TestLargeDictionary checks that the dictionary size of a header
+// doesn't get allocated for a short stream.
+func TestLargeDictionary(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "text.lzma2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader2(bytes.NewReader(data), 0xFFFFFFFF)
+	checkData(t, "text.lzma2", r)
+	if n := len(r.(*reader2).d.w.buf); n > 2*testSize {
+		t.Errorf("window of %d bytes for %d bytes of data", n, testSize)
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "text.lzma"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(data[:len(data)/2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated stream: got error %v", err)
+	}
+
+	for i := HeaderLen + 10; i < len(data); i += 97 {
+		bad := append([]byte(nil), data...)
+		bad[i] ^= 0x55
+		r, err := NewReader(bytes.NewReader(bad))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err == nil && len(out) == testSize {
+			sum := sha1.Sum(out)
+			if hex.EncodeToString(sum[:]) == testSHA1 {
+				t.Errorf("corruption at %d went unnoticed", i)
+			}
+		}
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join("testdata", "text.lzma2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(NewReader2(bytes.NewReader(data[:len(data)-1]), 1<<20)); err != io.ErrUnexpectedEOF {
+		t.Errorf("lzma2 stream without end byte: got error %v", err)
+	}
+}
+
+func TestDictSize2(t *testing.T) {
+	for b, want := range map[byte]uint32{0: 4 << 10, 1: 6 << 10, 16: 1 << 20, 39: 3 << 30, 40: 0xFFFFFFFF} {
+		got, err := DictSize2(b)
+		if err != nil || got != want {
+			t.Errorf("DictSize2(%d) = %d, %v, want %d", b, got, err, want)
+		}
+	}
+	if _, err := DictSize2(41); err == nil {
+		t.Errorf("DictSize2(41) succeeded")
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package lzma
+
+import "io"
+
+const (
+	numBitModelTotalBits = 11
+	bitModelTotal        = 1 << numBitModelTotalBits
+	numMoveBits          = 5
+	topValue             = 1 << 24
+)
+
+type prob uint16
+
+const probInit = bitModelTotal / 2
+
+func initProbs(probs []prob) {
+	for i := range probs {
+		probs[i] = probInit
+	}
+}
+
+type rangeDecoder struct {
+	br   io.ByteReader
+	rng  uint32
+	code uint32
+	err  error
+}
+
+func newRangeDecoder(br io.ByteReader) *rangeDecoder {
+	return &rangeDecoder{br: br}
+}
+
+// init reads the five bytes that start a range coded stream.
+func (rc *rangeDecoder) init() error {
+	rc.rng = 0xFFFFFFFF
+	rc.code = 0
+	rc.err = nil
+	b := rc.readByte()
+	for i := 0; i < 4; i++ {
+		rc.code = rc.code<<8 | uint32(rc.readByte())
+	}
+	if rc.err != nil {
+		return rc.err
+	}
+	if b != 0 || rc.code == rc.rng {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+func (rc *rangeDecoder) readByte() byte {
+	b, err := rc.br.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if rc.err == nil {
+			rc.err = err
+		}
+		return 0
+	}
+	return b
+}
+
+func (rc *rangeDecoder) normalize() {
+	if rc.rng < topValue {
+		rc.rng <<= 8
+		rc.code = rc.code<<8 | uint32(rc.readByte())
+	}
+}
+
+func (rc *rangeDecoder) bit(p *prob) uint32 {
+	bound := (rc.rng >> numBitModelTotalBits) * uint32(*p)
+	var b uint32
+	if rc.code < bound {
+		rc.rng = bound
+		*p += (bitModelTotal - *p) >> numMoveBits
+	} else {
+		rc.rng -= bound
+		rc.code -= bound
+		*p -= *p >> numMoveBits
+		b = 1
+	}
+	rc.normalize()
+	return b
+}
+
+func (rc *rangeDecoder) direct(numBits uint) uint32 {
+	var res uint32
+	for ; numBits > 0; numBits-- {
+		rc.rng >>= 1
+		res <<= 1
+		if rc.code >= rc.rng {
+			rc.code -= rc.rng
+			res |= 1
+		}
+		rc.normalize()
+	}
+	return res
+}
+
+func (rc *rangeDecoder) bitTree(probs []prob, numBits uint) uint32 {
+	m := uint32(1)
+	for i := uint(0); i < numBits; i++ {
+		m = m<<1 | rc.bit(&probs[m])
+	}
+	return m - 1<<numBits
+}
+
+func (rc *rangeDecoder) reverseBitTree(probs []prob, numBits uint) uint32 {
+	m := uint32(1)
+	var sym uint32
+	for i := uint(0); i < numBits; i++ {
+		b := rc.bit(&probs[m])
+		m = m<<1 | b
+		sym |= b << i
+	}
+	return sym
+}
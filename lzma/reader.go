@@ -0,0 +1,213 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Package lzma implements decompression of LZMA and LZMA2 streams as
+// used by 7z, xz and zip archives.
+package lzma
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	ErrFormat      = errors.New("lzma: invalid header")
+	ErrCorrupt     = errors.New("lzma: corrupt data")
+	ErrProperties  = errors.New("lzma: invalid properties")
+	ErrChecksum    = errors.New("lzma: checksum error")
+	ErrUnsupported = errors.New("lzma: unsupported feature")
+)
+
+const (
+	minDictSize = 1 << 12
+
+	// HeaderLen is the length of the header of an .lzma file: the
+	// properties byte, the dictionary size and the uncompressed size.
+	HeaderLen = 13
+)
+
+// Properties holds the parameters of an LZMA stream.
+type Properties struct {
+	LC, LP, PB int
+	DictSize   uint32
+}
+
+// DecodeProperties decodes the properties byte and the little endian
+// dictionary size that start an LZMA stream in .lzma files, 7z and zip
+// archives.
+func DecodeProperties(b []byte) (Properties, error) {
+	if len(b) < 5 {
+		return Properties{}, ErrProperties
+	}
+	var p Properties
+	d := int(b[0])
+	if d >= 9*5*5 {
+		return p, ErrProperties
+	}
+	p.LC = d % 9
+	d /= 9
+	p.LP = d % 5
+	p.PB = d / 5
+	p.DictSize = binary.LittleEndian.Uint32(b[1:5])
+	return p, nil
+}
+
+// NewReader returns a reader decompressing the .lzma file in r.
+func NewReader(r io.Reader) (io.Reader, error) {
+	var buf [HeaderLen]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	p, err := DecodeProperties(buf[:5])
+	if err != nil {
+		return nil, ErrFormat
+	}
+	size := int64(binary.LittleEndian.Uint64(buf[5:]))
+	if size < -1 {
+		return nil, ErrFormat
+	}
+	return NewRawReader(r, p, size)
+}
+
+// NewZipReader returns a reader decompressing an entry of a zip archive
+// stored with method 14. Those start with the version of the LZMA SDK
+// and the size of the properties that follow. Entries don't need to end
+// with an end marker, so readers not stopping at the uncompressed size
+// recorded in the archive get garbage or an error after the data.
+func NewZipReader(r io.Reader) (io.Reader, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	n := int(binary.LittleEndian.Uint16(buf[2:]))
+	if n < 5 {
+		return nil, ErrFormat
+	}
+	props := make([]byte, n)
+	if _, err := io.ReadFull(r, props); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	p, err := DecodeProperties(props)
+	if err != nil {
+		return nil, err
+	}
+	return NewRawReader(r, p, -1)
+}
+
+// NewRawReader returns a reader decompressing the LZMA stream in r, which
+// has no header. size is the uncompressed size, -1 if unknown, in which
+// case the stream has to end with an end marker. If size is known an end
+// marker after the data is not required and not read, and the dictionary
+// is never made larger than size.
+func NewRawReader(r io.Reader, p Properties, size int64) (io.Reader, error) {
+	if p.LC > 8 || p.LP > 4 || p.PB > 4 {
+		return nil, ErrProperties
+	}
+	dictSize := p.DictSize
+	if size >= 0 && int64(dictSize) > size {
+		dictSize = uint32(size)
+	}
+	lr := &reader{
+		d:    newDecoder(p, newWindow(dictSize)),
+		size: size,
+	}
+	lr.d.rc = newRangeDecoder(byteReader(r))
+	return lr, nil
+}
+
+func byteReader(r io.Reader) io.ByteReader {
+	if br, ok := r.(io.ByteReader); ok {
+		return br
+	}
+	return bufio.NewReader(r)
+}
+
+type reader struct {
+	d       *decoder
+	size    int64
+	started bool
+	done    bool
+	err     error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	w := r.d.w
+	for {
+		if w.readPos < w.pos {
+			n := copy(p, w.buf[w.readPos:w.pos])
+			w.readPos += n
+			return n, nil
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			r.err = io.EOF
+			continue
+		}
+		if !r.started {
+			r.started = true
+			if err := r.d.rc.init(); err != nil {
+				r.err = err
+				continue
+			}
+		}
+
+		limit := int64(-1)
+		if r.size >= 0 {
+			limit = r.size - w.total
+		}
+		if limit == 0 {
+			r.done = true
+			continue
+		}
+		w.wrap()
+		eos, err := r.d.decode(limit)
+		switch {
+		case err != nil:
+			r.err = err
+		case eos && r.size >= 0 && w.total != r.size:
+			r.err = ErrCorrupt
+		case eos:
+			r.done = true
+		}
+	}
+}
@@ -0,0 +1,440 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package lzma
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+)
+
+// .xz files hold one or more streams, each made of blocks, an index
+// listing the sizes of the blocks and a footer. Only blocks compressed
+// with LZMA2 alone are supported, which is what xz and liblzma write
+// unless asked for other filters.
+
+const (
+	xzHeaderLen = 12
+	xzFooterLen = 12
+
+	xzFilterLZMA2 = 0x21
+
+	xzCheckNone   = 0
+	xzCheckCRC32  = 1
+	xzCheckCRC64  = 4
+	xzCheckSHA256 = 10
+)
+
+var (
+	xzMagic       = []byte{0xFD, '7', 'z', 'X', 'Z', 0}
+	xzFooterMagic = []byte{'Y', 'Z'}
+
+	crc64Table = crc64.MakeTable(crc64.ECMA)
+)
+
+// xzRecord is an entry of the index of a stream.
+type xzRecord struct {
+	unpadded     int64 // size of block header, compressed data and check
+	uncompressed int64
+}
+
+// countingReader counts the bytes read through it, so block padding and
+// the index can be checked.
+type countingReader struct {
+	br *bufio.Reader
+	n  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.br.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.br.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+type xzReader struct {
+	r     *countingReader
+	flags [2]byte
+	check hash.Hash
+
+	block        io.Reader // nil between blocks
+	blockStart   int64     // position of the compressed data of block
+	headerLen    int64
+	compressed   int64 // sizes given in the block header, -1 if not
+	uncompressed int64
+	written      int64 // bytes read from block so far
+
+	records []xzRecord
+	err     error
+}
+
+// NewXZReader returns a reader decompressing the .xz file in r. The
+// checks of the blocks, the index and the headers are verified, a
+// mismatch is reported as ErrChecksum. Concatenated streams are read
+// one after the other.
+func NewXZReader(r io.Reader) (io.Reader, error) {
+	z := &xzReader{r: &countingReader{br: bufio.NewReader(r)}}
+	var buf [xzHeaderLen]byte
+	if _, err := io.ReadFull(z.r, buf[:]); err != nil {
+		return nil, unexpected(err)
+	}
+	if err := z.streamHeader(buf[:]); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+func (z *xzReader) Read(p []byte) (int, error) {
+	for {
+		if z.err != nil {
+			return 0, z.err
+		}
+		if z.block == nil {
+			z.err = z.next()
+			continue
+		}
+		n, err := z.block.Read(p)
+		z.check.Write(p[:n])
+		z.written += int64(n)
+		if err == io.EOF {
+			err = z.endBlock()
+		}
+		z.err = err
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (z *xzReader) streamHeader(buf []byte) error {
+	if !bytes.Equal(buf[:len(xzMagic)], xzMagic) {
+		return ErrFormat
+	}
+	flags := buf[6:8]
+	if crc32.ChecksumIEEE(flags) != binary.LittleEndian.Uint32(buf[8:]) {
+		return ErrChecksum
+	}
+	if flags[0] != 0 || flags[1]&0xF0 != 0 {
+		return ErrUnsupported
+	}
+	switch flags[1] {
+	case xzCheckNone:
+		z.check = nopHash{}
+	case xzCheckCRC32:
+		z.check = crc32.NewIEEE()
+	case xzCheckCRC64:
+		z.check = crc64.New(crc64Table)
+	case xzCheckSHA256:
+		z.check = sha256.New()
+	default:
+		return ErrUnsupported
+	}
+	copy(z.flags[:], flags)
+	z.records = z.records[:0]
+	return nil
+}
+
+// next reads the header of the next block, or the index and footer
+// ending a stream, followed by the next stream if there is one.
+func (z *xzReader) next() error {
+	b, err := z.r.ReadByte()
+	if err != nil {
+		return unexpected(err)
+	}
+	if b == 0 {
+		if err := z.index(); err != nil {
+			return err
+		}
+		return z.nextStream()
+	}
+	return z.blockHeader(b)
+}
+
+func (z *xzReader) blockHeader(size byte) error {
+	z.headerLen = int64(size+1) * 4
+	buf := make([]byte, z.headerLen)
+	buf[0] = size
+	if _, err := io.ReadFull(z.r, buf[1:]); err != nil {
+		return unexpected(err)
+	}
+	n := len(buf) - 4
+	if crc32.ChecksumIEEE(buf[:n]) != binary.LittleEndian.Uint32(buf[n:]) {
+		return ErrChecksum
+	}
+	flags := buf[1]
+	if flags&0x3C != 0 {
+		return ErrUnsupported
+	}
+	h := bytes.NewReader(buf[2:n])
+
+	z.compressed, z.uncompressed = -1, -1
+	if flags&0x40 != 0 {
+		v, err := readUvarint(h)
+		if err != nil || v == 0 {
+			return ErrFormat
+		}
+		z.compressed = int64(v)
+	}
+	if flags&0x80 != 0 {
+		v, err := readUvarint(h)
+		if err != nil {
+			return ErrFormat
+		}
+		z.uncompressed = int64(v)
+	}
+
+	if flags&3 != 0 {
+		// more than one filter
+		return ErrUnsupported
+	}
+	id, err := readUvarint(h)
+	if err != nil {
+		return ErrFormat
+	}
+	if id != xzFilterLZMA2 {
+		return ErrUnsupported
+	}
+	propsLen, err := readUvarint(h)
+	if err != nil || propsLen != 1 {
+		return ErrFormat
+	}
+	props, err := h.ReadByte()
+	if err != nil {
+		return ErrFormat
+	}
+	dictSize, err := DictSize2(props)
+	if err != nil {
+		return err
+	}
+	for h.Len() > 0 {
+		if b, _ := h.ReadByte(); b != 0 {
+			return ErrFormat
+		}
+	}
+
+	if z.uncompressed >= 0 && int64(dictSize) > z.uncompressed {
+		dictSize = uint32(z.uncompressed)
+	}
+	z.check.Reset()
+	z.blockStart = z.r.n
+	z.written = 0
+	z.block = NewReader2(z.r, dictSize)
+	return nil
+}
+
+// endBlock checks the sizes of the block just read, skips its padding
+// and verifies its check.
+func (z *xzReader) endBlock() error {
+	z.block = nil
+	compressed := z.r.n - z.blockStart
+	if z.compressed >= 0 && compressed != z.compressed ||
+		z.uncompressed >= 0 && z.written != z.uncompressed {
+		return ErrCorrupt
+	}
+	if err := z.padding(compressed); err != nil {
+		return err
+	}
+
+	sum := z.check.Sum(nil)
+	switch z.check.(type) {
+	case hash.Hash32, hash.Hash64:
+		// CRC32 and CRC64 are stored little endian
+		for i, j := 0, len(sum)-1; i < j; i, j = i+1, j-1 {
+			sum[i], sum[j] = sum[j], sum[i]
+		}
+	}
+	stored := make([]byte, len(sum))
+	if _, err := io.ReadFull(z.r, stored); err != nil {
+		return unexpected(err)
+	}
+	if !bytes.Equal(sum, stored) {
+		return ErrChecksum
+	}
+
+	z.records = append(z.records, xzRecord{
+		unpadded:     z.headerLen + compressed + int64(len(sum)),
+		uncompressed: z.written,
+	})
+	return nil
+}
+
+// padding skips the zero bytes following n bytes up to a multiple of
+// four.
+func (z *xzReader) padding(n int64) error {
+	for ; n%4 != 0; n++ {
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+		if b != 0 {
+			return ErrCorrupt
+		}
+	}
+	return nil
+}
+
+// index reads the index of a stream, whose indicator byte has already
+// been read, and compares it with the blocks found, then reads the
+// footer.
+func (z *xzReader) index() error {
+	start := z.r.n - 1
+	crc := crc32.NewIEEE()
+	crc.Write([]byte{0})
+	ir := &hashByteReader{br: z.r, h: crc}
+
+	n, err := readUvarint(ir)
+	if err != nil {
+		return unexpected(err)
+	}
+	if n != uint64(len(z.records)) {
+		return ErrCorrupt
+	}
+	for _, rec := range z.records {
+		unpadded, err := readUvarint(ir)
+		if err != nil {
+			return unexpected(err)
+		}
+		uncompressed, err := readUvarint(ir)
+		if err != nil {
+			return unexpected(err)
+		}
+		if int64(unpadded) != rec.unpadded || int64(uncompressed) != rec.uncompressed {
+			return ErrCorrupt
+		}
+	}
+	for (z.r.n-start)%4 != 0 {
+		b, err := ir.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+		if b != 0 {
+			return ErrCorrupt
+		}
+	}
+	indexLen := z.r.n - start + 4 // including its CRC32
+
+	var buf [4 + xzFooterLen]byte
+	if _, err := io.ReadFull(z.r, buf[:]); err != nil {
+		return unexpected(err)
+	}
+	if crc.Sum32() != binary.LittleEndian.Uint32(buf[:4]) {
+		return ErrChecksum
+	}
+
+	footer := buf[4:]
+	if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer[:4]) {
+		return ErrChecksum
+	}
+	if !bytes.Equal(footer[10:], xzFooterMagic) {
+		return ErrFormat
+	}
+	backward := (int64(binary.LittleEndian.Uint32(footer[4:8])) + 1) * 4
+	if backward != indexLen || footer[8] != z.flags[0] || footer[9] != z.flags[1] {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// nextStream skips stream padding and reads the header of the next
+// stream, returning io.EOF at the end of the input.
+func (z *xzReader) nextStream() error {
+	var buf [xzHeaderLen]byte
+	for {
+		n, err := io.ReadFull(z.r, buf[:4])
+		if n == 0 && err == io.EOF {
+			return io.EOF
+		}
+		if err != nil {
+			return unexpected(err)
+		}
+		if !bytes.Equal(buf[:4], []byte{0, 0, 0, 0}) {
+			break
+		}
+	}
+	if _, err := io.ReadFull(z.r, buf[4:]); err != nil {
+		return unexpected(err)
+	}
+	return z.streamHeader(buf[:])
+}
+
+// readUvarint reads a variable length integer of at most 63 bits as
+// used by xz. Unlike encoding/binary it rejects needless zero bytes.
+func readUvarint(br io.ByteReader) (uint64, error) {
+	var v uint64
+	for i := uint(0); i < 9; i++ {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint64(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			if b == 0 && i > 0 {
+				return 0, ErrFormat
+			}
+			return v, nil
+		}
+	}
+	return 0, ErrFormat
+}
+
+type hashByteReader struct {
+	br io.ByteReader
+	h  hash.Hash
+}
+
+func (r *hashByteReader) ReadByte() (byte, error) {
+	b, err := r.br.ReadByte()
+	if err == nil {
+		r.h.Write([]byte{b})
+	}
+	return b, err
+}
+
+// nopHash is the check of streams without one.
+type nopHash struct{}
+
+func (nopHash) Write(p []byte) (int, error) { return len(p), nil }
+func (nopHash) Sum(b []byte) []byte         { return b }
+func (nopHash) Reset()                      {}
+func (nopHash) Size() int                   { return 0 }
+func (nopHash) BlockSize() int              { return 1 }
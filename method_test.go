@@ -0,0 +1,220 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrentzip
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip/czip"
+)
+
+// readEntries returns the contents of the entries of zr in order.
+func readEntries(t *testing.T, zr *czip.Reader) [][]byte {
+	var contents [][]byte
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("opening %s failed: %v", f.Name, err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("reading %s failed: %v", f.Name, err)
+		}
+		contents = append(contents, data)
+	}
+	return contents
+}
+
+// torrentzipOf writes the entries of zr with the given contents to a new
+// torrentzip.
+func torrentzipOf(t *testing.T, zr *czip.Reader, contents [][]byte) []byte {
+	var buf bytes.Buffer
+	zw, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range zr.File {
+		w, err := zw.Create(f.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(contents[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// the zips in testdata/methods use other compression methods and are
+// named after the sha1 of their torrentzip like the ones in testdata.
+const (
+	bzip2Zip     = "0494B716C310BB192F9B1C640FBD94802B2DF556.zip"
+	deflate64Zip = "C730036E1F299EF0AD883DC55EF6D2BCD1F8EB84.zip"
+	lzmaZip      = "26FCE83C585A6ACB365BE41505EC634D9562086F.zip"
+	xzZip        = "1C7C0B8CC436D6E35050F877B583042A2337071B.zip"
+)
+
+// testRezipMethod checks that the zip named name in testdata/methods has
+// entries compressed with method and that its torrentzip is the one of
+// its contents.
+func testRezipMethod(t *testing.T, name string, method uint16) {
+	zr, err := czip.OpenReader(filepath.Join("testdata", "methods", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.Method != method {
+			t.Fatalf("%s has method %d", f.Name, f.Method)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := Rezip(&buf, &zr.Reader, 0); err != nil {
+		t.Fatal(err)
+	}
+	want := torrentzipOf(t, &zr.Reader, readEntries(t, &zr.Reader))
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("torrentzip of %s differs from torrentzip of its contents", name)
+	}
+}
+
+func TestRezipBzip2(t *testing.T) {
+	testRezipMethod(t, bzip2Zip, czip.Bzip2)
+}
+
+// the Deflate64 zip was checked with Info-ZIP unzip
+func TestRezipDeflate64(t *testing.T) {
+	testRezipMethod(t, deflate64Zip, czip.Deflate64)
+}
+
+// the LZMA zip has entries with and without end marker
+func TestRezipLZMA(t *testing.T) {
+	testRezipMethod(t, lzmaZip, czip.LZMA)
+}
+
+// the XZ zip has entries with each of the checks xz supports
+func TestRezipXZ(t *testing.T) {
+	testRezipMethod(t, xzZip, czip.XZ)
+}
+
+// xorWriter and xorReader implement a made up compression method.
+type xorWriter struct {
+	w io.Writer
+}
+
+func (x xorWriter) Write(p []byte) (int, error) {
+	q := make([]byte, len(p))
+	for i, b := range p {
+		q[i] = b ^ 0x55
+	}
+	return x.w.Write(q)
+}
+
+func (x xorWriter) Close() error {
+	return nil
+}
+
+type xorReader struct {
+	r io.Reader
+}
+
+func (x xorReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	for i := range p[:n] {
+		p[i] ^= 0x55
+	}
+	return n, err
+}
+
+func (x xorReader) Close() error {
+	return nil
+}
+
+func TestRegisterDecompressor(t *testing.T) {
+	const xorMethod = 0xff55
+
+	var buf bytes.Buffer
+	zw := czip.NewWriter(&buf)
+	zw.RegisterCompressor(xorMethod, func(w io.Writer) (io.WriteCloser, error) {
+		return xorWriter{w}, nil
+	})
+	contents := [][]byte{[]byte("first file\n"), bytes.Repeat([]byte("second file\n"), 100)}
+	for i, data := range contents {
+		w, err := zw.CreateHeader(&czip.FileHeader{
+			Name:   []string{"a.txt", "b.txt"}[i],
+			Method: xorMethod,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := czip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zr.File[0].Open(); err != czip.ErrAlgorithm {
+		t.Fatalf("opening entry with unknown method gave %v", err)
+	}
+
+	zr.RegisterDecompressor(xorMethod, func(r io.Reader) (io.ReadCloser, error) {
+		return xorReader{r}, nil
+	})
+	got := readEntries(t, zr)
+	for i := range contents {
+		if !bytes.Equal(got[i], contents[i]) {
+			t.Errorf("%s: got %q", zr.File[i].Name, got[i])
+		}
+	}
+
+	var tz bytes.Buffer
+	if err := Rezip(&tz, zr, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tz.Bytes(), torrentzipOf(t, zr, contents)) {
+		t.Errorf("torrentzip of registered method zip differs from torrentzip of its contents")
+	}
+}
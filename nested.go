@@ -0,0 +1,324 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrentzip
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/uwedeportivo/torrentzip/czip"
+)
+
+// spoolEntry is an entry written while nested archives are rewritten. Its
+// first bytes are held back until they show whether the entry is a zip
+// archive. If it is, its content goes to a temp file to be torrentzipped
+// once complete, otherwise it is compressed right away.
+type spoolEntry struct {
+	w    *Writer
+	name string
+	head []byte
+	f    *os.File
+	bf   *bufio.Writer
+	cw   io.Writer
+}
+
+func (se *spoolEntry) Write(p []byte) (int, error) {
+	if se.f != nil || se.cw != nil {
+		return se.write(p)
+	}
+	need := 4 - len(se.head)
+	if len(p) < need {
+		se.head = append(se.head, p...)
+		return len(p), nil
+	}
+	se.head = append(se.head, p[:need]...)
+	if err := se.start(); err != nil {
+		return 0, err
+	}
+	n, err := se.write(p[need:])
+	return need + n, err
+}
+
+func (se *spoolEntry) write(p []byte) (int, error) {
+	if se.bf != nil {
+		return se.bf.Write(p)
+	}
+	return se.cw.Write(p)
+}
+
+// start decides from the first bytes of the entry where its content goes.
+func (se *spoolEntry) start() error {
+	if !hasZipMagic(se.head) {
+		cw, err := se.w.create(se.name)
+		if err != nil {
+			return err
+		}
+		se.cw = cw
+		_, err = cw.Write(se.head)
+		return err
+	}
+
+	f, err := ioutil.TempFile(se.w.tempDir, "torrentzip")
+	if err != nil {
+		return err
+	}
+	se.f = f
+	se.bf = bufio.NewWriter(f)
+	_, err = se.bf.Write(se.head)
+	return err
+}
+
+// NestedError reports an entry that looks like a zip archive but could
+// not be torrentzipped.
+type NestedError struct {
+	Name string
+	Err  error
+}
+
+func (e *NestedError) Error() string {
+	return fmt.Sprintf("torrentzip: nested archive %s: %v", e.Name, e.Err)
+}
+
+// SetNestedDepth makes w torrentzip zip archives that are added as entries,
+// so that the outer archive is deterministic even if the inner archives
+// were not. Nested archives are recognized by their magic bytes and are
+// rewritten up to depth levels deep. A depth of 0, the default, stores all
+// entries unchanged. Adding an entry that looks like a zip archive but
+// cannot be torrentzipped fails with a *NestedError, unless a handler set
+// with SetNestedErrorHandler decides otherwise.
+func (w *Writer) SetNestedDepth(depth int) {
+	w.depth = depth
+}
+
+// SetNestedErrorHandler makes w call h for entries that look like zip
+// archives but cannot be torrentzipped. If h returns nil the entry is
+// stored unchanged, otherwise adding it fails with the returned error.
+// The handler is used for archives nested deeper as well.
+func (w *Writer) SetNestedErrorHandler(h func(err *NestedError) error) {
+	w.nested = h
+}
+
+// Rezip writes a torrentzipped copy of the archive read by zr to w.
+// Zip archives stored inside zr are torrentzipped up to depth levels deep,
+// failing with a *NestedError for those that cannot be.
+func Rezip(w io.Writer, zr *czip.Reader, depth int) error {
+	return rezip(w, zr, "", depth, TorrentZip, nil)
+}
+
+// RezipProfile is like Rezip but writes the archive, and the nested
+// archives, in the format described by p.
+func RezipProfile(w io.Writer, zr *czip.Reader, depth int, p *Profile) error {
+	return rezip(w, zr, "", depth, p, nil)
+}
+
+func rezip(w io.Writer, zr *czip.Reader, tempDir string, depth int, p *Profile, nested func(*NestedError) error) error {
+	zw, err := NewWriterWithProfile(w, tempDir, p)
+	if err != nil {
+		return err
+	}
+	zw.SetNestedDepth(depth)
+	zw.SetNestedErrorHandler(nested)
+
+	err = copyEntries(zw, zr)
+	if err != nil {
+		zw.abort()
+		return err
+	}
+	return zw.Close()
+}
+
+func copyEntries(zw *Writer, zr *czip.Reader) error {
+	for _, fh := range zr.File {
+		cw, err := zw.Create(fh.Name)
+		if err != nil {
+			return err
+		}
+		cr, err := fh.Open()
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(cw, cr)
+		if err != nil {
+			cr.Close()
+			return err
+		}
+
+		err = cr.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abort removes the temp files of a Writer.
+func (w *Writer) abort() {
+	if w.spool != nil && w.spool.f != nil {
+		w.spool.f.Close()
+		os.Remove(w.spool.f.Name())
+	}
+	w.spool = nil
+	w.tf.Close()
+	os.Remove(w.tf.Name())
+}
+
+func (w *Writer) createSpool(name string) (io.Writer, error) {
+	w.spool = &spoolEntry{w: w, name: name}
+	return w.spool, nil
+}
+
+// flushSpool finishes the spooled entry, if any, replacing a nested zip
+// archive with its torrentzipped version.
+func (w *Writer) flushSpool() error {
+	se := w.spool
+	if se == nil {
+		return nil
+	}
+	w.spool = nil
+
+	if se.f == nil && se.cw == nil {
+		// too short to be a zip archive
+		if err := se.start(); err != nil {
+			return err
+		}
+	}
+	if se.f == nil {
+		return nil
+	}
+
+	err := se.bf.Flush()
+	if err == nil {
+		err = w.addSpooled(se)
+	}
+	if cerr := se.f.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(se.f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+func (w *Writer) addSpooled(se *spoolEntry) error {
+	fi, err := se.f.Stat()
+	if err != nil {
+		return err
+	}
+	src := io.NewSectionReader(se.f, 0, fi.Size())
+
+	nf, err := ioutil.TempFile(w.tempDir, "torrentzip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(nf.Name())
+	defer nf.Close()
+
+	n, handled, err := w.rezipNested(nf, se.f, fi.Size())
+	switch {
+	case err == nil:
+		src = io.NewSectionReader(nf, 0, n)
+	case handled:
+		// a deeper archive failed and was reported already
+		w.nestedFailed = true
+		return err
+	default:
+		if err = w.nestedError(se.name, err); err != nil {
+			return err
+		}
+	}
+
+	cw, err := w.create(se.name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(cw, src)
+	return err
+}
+
+// nestedError returns the error for the entry name that could not be
+// torrentzipped, nil if it is to be stored unchanged.
+func (w *Writer) nestedError(name string, err error) error {
+	ne := &NestedError{Name: name, Err: err}
+	if w.nested == nil {
+		w.nestedFailed = true
+		return ne
+	}
+	if err := w.nested(ne); err != nil {
+		w.nestedFailed = true
+		return err
+	}
+	return nil
+}
+
+// rezipNested torrentzips the archive in r into dst and returns the
+// number of bytes written. handled is set if the error is that of an
+// archive nested in r, which was passed to the handler already.
+func (w *Writer) rezipNested(dst io.Writer, r io.ReaderAt, size int64) (n int64, handled bool, err error) {
+	zr, err := czip.NewReader(r, size)
+	if err != nil {
+		return 0, false, err
+	}
+
+	bw := bufio.NewWriter(dst)
+	cw := &countWriter{w: bw}
+	zw, err := NewWriterWithProfile(cw, w.tempDir, w.profile)
+	if err != nil {
+		return 0, false, err
+	}
+	zw.SetNestedDepth(w.depth - 1)
+	zw.SetNestedErrorHandler(w.nested)
+
+	err = copyEntries(zw, zr)
+	if err != nil {
+		zw.abort()
+	} else {
+		err = zw.Close()
+	}
+	if err != nil {
+		return 0, zw.nestedFailed, err
+	}
+	return cw.count, false, bw.Flush()
+}
+
+// hasZipMagic reports whether head starts like a zip archive, with a
+// local file header or, for empty archives, the end of central directory.
+func hasZipMagic(head []byte) bool {
+	if len(head) < 4 {
+		return false
+	}
+	sig := binary.LittleEndian.Uint32(head)
+	return sig == fileHeaderSignature || sig == directoryEndSignature
+}
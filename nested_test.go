@@ -0,0 +1,334 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrentzip
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip/czip"
+)
+
+func nestedEntry(t *testing.T, inner []byte, depth int) []byte {
+	var buf bytes.Buffer
+
+	zw, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.SetNestedDepth(depth)
+	var failed []string
+	zw.SetNestedErrorHandler(func(err *NestedError) error {
+		failed = append(failed, err.Name)
+		return nil
+	})
+
+	cw, err := zw.Create("inner.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cw.Write(inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cw, err = zw.Create("notazip.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.WriteString(cw, "PK\x03\x04 but not really a zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth > 0 && (len(failed) != 1 || failed[0] != "notazip.bin") {
+		t.Errorf("entries reported as not torrentzipped: %v", failed)
+	}
+
+	zr, err := czip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 2 || zr.File[0].Name != "inner.zip" {
+		t.Fatalf("unexpected entries in outer zip")
+	}
+
+	cr, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.Close()
+
+	content, err := ioutil.ReadAll(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestNested(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*"+zipext))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range paths {
+		inner, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content := nestedEntry(t, inner, 0)
+		if !bytes.Equal(content, inner) {
+			t.Errorf("nested zip %s was modified with depth 0", path)
+		}
+
+		content = nestedEntry(t, inner, 1)
+		hh := sha1.Sum(content)
+		testsha1 := hex.EncodeToString(hh[:])
+		goldensha1 := strings.TrimSuffix(filepath.Base(path), zipext)
+		if testsha1 != strings.ToLower(goldensha1) {
+			t.Errorf("nested torrentzip for %s differs from golden", path)
+		}
+	}
+}
+
+func TestRezip(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*"+zipext))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range paths {
+		zr, err := czip.OpenReader(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hh := sha1.New()
+		err = Rezip(hh, &zr.Reader, 0)
+		zr.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testsha1 := hex.EncodeToString(hh.Sum(nil))
+		goldensha1 := strings.TrimSuffix(filepath.Base(path), zipext)
+		if testsha1 != strings.ToLower(goldensha1) {
+			t.Errorf("rezip of %s differs from golden", path)
+		}
+	}
+}
+
+func TestNestedError(t *testing.T) {
+	zw, err := NewWriter(ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.SetNestedDepth(1)
+	cw, err := zw.Create("notazip.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(cw, "PK\x03\x04 but not really a zip"); err != nil {
+		t.Fatal(err)
+	}
+	err = zw.Close()
+	if ne, ok := err.(*NestedError); !ok || ne.Name != "notazip.bin" {
+		t.Errorf("closing with a broken nested zip gave %v", err)
+	}
+}
+
+// TestNestedEmpty checks that empty zip archives, which start with the
+// end of central directory, are recognized as nested archives.
+func TestNestedEmpty(t *testing.T) {
+	var empty bytes.Buffer
+	if err := czip.NewWriter(&empty).Close(); err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	zw, err := NewWriter(&want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := nestedEntry(t, empty.Bytes(), 1); !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("nested empty zip was not torrentzipped")
+	}
+}
+
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrShortWrite
+}
+
+// TestCloseRemovesTemp checks that a failing Close leaves no temp files
+// behind.
+func TestCloseRemovesTemp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torrentzip_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zw, err := NewWriterWithTemp(failWriter{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.SetNestedDepth(1)
+	cw, err := zw.Create("a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(cw, "some content"); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err == nil {
+		t.Fatal("writing to a failing writer succeeded")
+	}
+
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("%d temp files left behind", len(names))
+	}
+}
+
+// TestNestedHandlerOnce checks that the error handler is called once for
+// an archive nested two levels deep, and that its error is returned as is.
+func TestNestedHandlerOnce(t *testing.T) {
+	var middle bytes.Buffer
+	mw := czip.NewWriter(&middle)
+	w, err := mw.Create("broken.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "PK\x03\x04 but not really a zip"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	errStop := errors.New("stop")
+	var failed []string
+	zw, err := NewWriter(ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.SetNestedDepth(2)
+	zw.SetNestedErrorHandler(func(err *NestedError) error {
+		failed = append(failed, err.Name)
+		return errStop
+	})
+	cw, err := zw.Create("middle.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cw.Write(middle.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != errStop {
+		t.Errorf("got error %v, want the one of the handler", err)
+	}
+	if len(failed) != 1 || failed[0] != "broken.zip" {
+		t.Errorf("handler called for %v", failed)
+	}
+}
+
+// TestSpoolArchivesOnly checks that only entries starting like a zip
+// archive are held in temp files.
+func TestSpoolArchivesOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torrentzip_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var empty bytes.Buffer
+	if err := czip.NewWriter(&empty).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zw, err := NewWriterWithTemp(ioutil.Discard, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.SetNestedDepth(1)
+	for _, e := range []struct {
+		name    string
+		content []byte
+		temps   int
+	}{
+		{"a.bin", []byte("some content"), 1},
+		{"b.bin", []byte("PK"), 1},
+		{"c.zip", empty.Bytes(), 2},
+	} {
+		cw, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// one byte at a time, so the first bytes arrive in pieces
+		for i := range e.content {
+			if _, err := cw.Write(e.content[i : i+1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		names, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != e.temps {
+			t.Errorf("%s: got %d temp files, want %d", e.name, len(names), e.temps)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrentzip
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/uwedeportivo/torrentzip/czip"
+)
+
+// Profile describes a canonical zip format: the compression method and
+// fixed header values of its entries and the prefix of its archive
+// comment, which is followed by the CRC32 of the central directory in
+// upper case hex. All profiles share the entry order and name
+// canonicalization of torrentzip.
+type Profile struct {
+	Name          string
+	Method        uint16 // compression method of every entry
+	ReaderVersion uint16 // version needed to extract, raised to 4.5 for zip64 entries
+	Flags         uint16 // general purpose bit flag
+	ModifiedTime  uint16
+	ModifiedDate  uint16
+	CommentPrefix string
+}
+
+var (
+	// TorrentZip is the classic torrentzip format, deflated with zlib at
+	// level 9.
+	TorrentZip = &Profile{
+		Name:          "torrentzip",
+		Method:        czip.Deflate,
+		ReaderVersion: zipVersion20,
+		Flags:         2,
+		ModifiedTime:  48128,
+		ModifiedDate:  8600,
+		CommentPrefix: "TORRENTZIPPED-",
+	}
+
+	// RVZSTD is RomVault's zstd variant. The entries are compressed with
+	// zstd at its best compression level. The compressed bytes depend on
+	// the zstd encoder, so archives written here are valid RVZSTD files
+	// but aren't guaranteed to be byte-identical to RomVault's.
+	RVZSTD = &Profile{
+		Name:          "rvzstd",
+		Method:        czip.Zstd,
+		ReaderVersion: zipVersion63,
+		Flags:         0,
+		ModifiedTime:  48128,
+		ModifiedDate:  8600,
+		CommentPrefix: "RVZSTD-",
+	}
+
+	// Profiles lists the known profiles.
+	Profiles = []*Profile{TorrentZip, RVZSTD}
+)
+
+// ProfileByName returns the profile with the given name, nil if there is
+// none.
+func ProfileByName(name string) *Profile {
+	for _, p := range Profiles {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (p *Profile) commentLen() int {
+	return len(p.CommentPrefix) + 8
+}
+
+func (p *Profile) comment(crc []byte) string {
+	return p.CommentPrefix + strings.ToUpper(hex.EncodeToString(crc))
+}
+
+// readerVersion returns the version needed to extract an entry.
+func (p *Profile) readerVersion(zip64 bool) uint16 {
+	if zip64 && p.ReaderVersion < zipVersion45 {
+		return zipVersion45
+	}
+	return p.ReaderVersion
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrentzip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip/czip"
+)
+
+func TestRVZSTD(t *testing.T) {
+	names, err := filepath.Glob(filepath.Join("testdata", "*.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := czip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := RezipProfile(&buf, zr, 0, RVZSTD); err != nil {
+			t.Fatal(err)
+		}
+		rv := append([]byte(nil), buf.Bytes()...)
+
+		p, err := DetectProfile(bytes.NewReader(rv), int64(len(rv)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p != RVZSTD {
+			t.Fatalf("%s: rvzstd archive detected as %v", name, p)
+		}
+		rr, err := czip.NewReader(bytes.NewReader(rv), int64(len(rv)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(rr.Comment, "RVZSTD-") {
+			t.Errorf("%s: got comment %s", name, rr.Comment)
+		}
+		for _, f := range rr.File {
+			if f.Method != czip.Zstd || f.ReaderVersion != zipVersion63 {
+				t.Errorf("%s: entry %s has method %d, version %d", name, f.Name, f.Method, f.ReaderVersion)
+			}
+		}
+
+		// converting back has to give the original torrentzip
+		buf.Reset()
+		if err := Rezip(&buf, rr, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("%s: torrentzip made from rvzstd differs from original", name)
+		}
+
+		// raw copies of zstd entries reproduce the rvzstd archive
+		buf.Reset()
+		zw, err := NewWriterWithProfile(&buf, "", RVZSTD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range rr.File {
+			if err := zw.CopyRaw(f.Name, f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), rv) {
+			t.Errorf("%s: raw copy of rvzstd archive differs", name)
+		}
+
+		ok, err := IsTorrentzipped(bytes.NewReader(rv), int64(len(rv)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Errorf("%s: rvzstd archive reported as torrentzip", name)
+		}
+	}
+}
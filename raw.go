@@ -0,0 +1,82 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrentzip
+
+import (
+	"io"
+
+	"github.com/uwedeportivo/torrentzip/czip"
+)
+
+// CopyRaw adds the entry f of another zip file under the given name. An
+// entry compressed with the method of the Writer's profile is copied
+// without decompressing and recompressing it, which only results in a
+// canonical archive if f comes from one or its stream was made with the
+// same compressor parameters. Entries stored with other methods, and
+// encrypted entries, are decompressed and compressed again.
+func (w *Writer) CopyRaw(name string, f *czip.File) error {
+	if f.Method != w.profile.Method || f.IsEncrypted() {
+		fr, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer fr.Close()
+
+		cw, err := w.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(cw, fr)
+		return err
+	}
+
+	if err := w.flushSpool(); err != nil {
+		return err
+	}
+
+	fr, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+
+	cw, err := w.uw.CreateRaw(&czip.FileHeader{
+		Name:               name,
+		Method:             f.Method,
+		CRC32:              f.CRC32,
+		UncompressedSize64: f.UncompressedSize64,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(cw, fr)
+	return err
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrentzip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip/czip"
+)
+
+func TestCopyRaw(t *testing.T) {
+	names, err := filepath.Glob(filepath.Join("testdata", "*.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := czip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		zw, err := NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			if err := zw.CopyRaw(f.Name, f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("%s: raw copy differs from original", name)
+		}
+	}
+}
+
+func TestCopyRawStored(t *testing.T) {
+	content := []byte("stored content, recompressed by CopyRaw")
+
+	var src bytes.Buffer
+	uw := czip.NewWriter(&src)
+	w, err := uw.CreateHeader(&czip.FileHeader{Name: "a.txt", Method: czip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(content)
+	if err := uw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := czip.NewReader(bytes.NewReader(src.Bytes()), int64(src.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var copied, created bytes.Buffer
+	zw, err := NewWriter(&copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.CopyRaw("a.txt", zr.File[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zw, err = NewWriter(&created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw, err := zw.Create("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw.Write(content)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(copied.Bytes(), created.Bytes()) {
+		t.Error("copy of stored entry differs from created entry")
+	}
+}
@@ -0,0 +1,622 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package rebuild builds torrentzipped sets described by a DAT from
+arbitrary source files.
+
+Every source file, and every entry of source zip files, is hashed and
+matched against the roms of the DAT by SHA1, or by CRC32 and size for roms
+without a SHA1. Each set with at least one matching rom is then written
+through torrentzip.Writer under the names the DAT gives it. Entries of an
+archive already in the output directory that match no rom of its set are
+kept when the archive is rewritten.
+*/
+package rebuild
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uwedeportivo/torrentzip"
+	"github.com/uwedeportivo/torrentzip/czip"
+	"github.com/uwedeportivo/torrentzip/dat"
+	"github.com/uwedeportivo/torrentzip/detector"
+	"github.com/uwedeportivo/torrentzip/scanner"
+)
+
+// Source is a candidate file for a rebuild: either a file on disk or,
+// if Entry is set, an entry of the zip file at Path.
+type Source struct {
+	Path  string
+	Entry string
+	Size  uint64
+	CRC   dat.Hash
+	MD5   dat.Hash
+	SHA1  dat.Hash
+
+	// Headerless holds the hashes of the content without its copier
+	// header, if the Detector of the Rebuilder found one.
+	Headerless *detector.Hashes
+
+	used   bool
+	output bool
+}
+
+func (s *Source) String() string {
+	if s.Entry == "" {
+		return s.Path
+	}
+	return s.Path + ":" + s.Entry
+}
+
+// SetResult describes a rebuilt set.
+type SetResult struct {
+	Name string
+	Path string
+
+	// Status is dat.SetComplete or dat.SetPartial.
+	Status string
+
+	// Unchanged is set if the archive was complete and torrentzipped
+	// already and was left alone.
+	Unchanged bool
+
+	Missing []*dat.Rom
+
+	// Kept lists the entries of the archive that was in the output dir
+	// already which match no rom of the set and were kept.
+	Kept []string
+
+	// Backup is where the archive that was in the output dir already was
+	// moved, if some of its entries match no rom and have the name of
+	// one. It is empty if the archive wasn't moved.
+	Backup string
+}
+
+// Report is the result of a rebuild.
+type Report struct {
+	Sets []*SetResult
+
+	// Unused lists the sources that didn't match any rom. This includes
+	// entries of archives in the output dir, which are kept if their
+	// archive was rewritten.
+	Unused []*Source
+
+	// Removed lists the source files deleted after a rebuild with Move.
+	Removed []string
+}
+
+// Rebuilder rebuilds the sets of a DAT into a directory.
+type Rebuilder struct {
+	Dat *dat.Dat
+
+	// OutDir is the directory the sets are written to. Archives already
+	// in OutDir are used as sources too, so sets can be completed over
+	// several runs.
+	OutDir string
+
+	// Move removes source files once their content has been rebuilt.
+	// Source zip files are only removed if all their entries were used.
+	Move bool
+
+	// TempDir is used for temporary files. If empty, the default
+	// directory for temporary files is used.
+	TempDir string
+
+	// Detector, if set, is used to match sources with copier headers by
+	// the hashes of their headerless content. Matching sources are
+	// written with their header.
+	Detector *detector.Detector
+
+	// BackupDir is where archives in OutDir are moved before they are
+	// replaced, if they hold entries that match no rom but have the name
+	// of one and so can't be kept. If empty, a dir named backup in OutDir
+	// is used.
+	BackupDir string
+
+	// Damaged lists source zip files known to be damaged. Entries of them
+	// that can't be read are skipped instead of failing the rebuild, and
+	// so is the whole archive if it can't be opened.
+	Damaged []string
+
+	damaged map[string]bool
+	sources []*Source
+	outputs map[string][]*Source
+	bySHA1  map[string]*Source
+	byMD5   map[string]*Source
+	byCRC   map[crcKey]*Source
+}
+
+type match struct {
+	name string
+	src  *Source
+}
+
+// pendingSet is a set written to a temp file, waiting to replace its
+// archive.
+type pendingSet struct {
+	sr     *SetResult
+	backup bool
+}
+
+type crcKey struct {
+	crc  string
+	size uint64
+}
+
+// Rebuild hashes the given source files and directories and writes every
+// set of the DAT that has at least one matching rom.
+func (rb *Rebuilder) Rebuild(sources ...string) (*Report, error) {
+	rb.sources = nil
+	rb.bySHA1 = make(map[string]*Source)
+	rb.byMD5 = make(map[string]*Source)
+	rb.byCRC = make(map[crcKey]*Source)
+	rb.outputs = make(map[string][]*Source)
+	rb.damaged = make(map[string]bool)
+	for _, path := range rb.Damaged {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		rb.damaged[abs] = true
+	}
+
+	outDir, err := filepath.Abs(rb.OutDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range rb.Dat.Games {
+		if _, err := dat.SetPath(outDir, g); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := rb.addDir(outDir, true); err != nil {
+		return nil, err
+	}
+	for _, src := range sources {
+		abs, err := filepath.Abs(src)
+		if err != nil {
+			return nil, err
+		}
+		if abs == outDir || strings.HasPrefix(abs, outDir+string(filepath.Separator)) {
+			continue
+		}
+		if err := rb.addDir(abs, false); err != nil {
+			return nil, err
+		}
+	}
+
+	// Sets are written to temp files first and only renamed once all of
+	// them are written, since archives in the output dir may be sources
+	// of other sets.
+	report := new(Report)
+	pending := make(map[string]*pendingSet)
+	defer func() {
+		for tmp := range pending {
+			os.Remove(tmp)
+		}
+	}()
+	for _, g := range rb.Dat.Games {
+		sr, tmp, backup, err := rb.rebuildSet(outDir, g)
+		if err != nil {
+			return nil, fmt.Errorf("rebuilding %s failed: %v", g.Name, err)
+		}
+		if sr == nil {
+			continue
+		}
+		report.Sets = append(report.Sets, sr)
+		if tmp != "" {
+			pending[tmp] = &pendingSet{sr: sr, backup: backup}
+		}
+	}
+	for tmp, ps := range pending {
+		if ps.backup {
+			if err := rb.backup(outDir, ps.sr); err != nil {
+				return nil, err
+			}
+		}
+		if err := os.Rename(tmp, ps.sr.Path); err != nil {
+			return nil, err
+		}
+		delete(pending, tmp)
+	}
+
+	for _, s := range rb.sources {
+		if !s.used {
+			report.Unused = append(report.Unused, s)
+		}
+	}
+
+	if rb.Move {
+		report.Removed, err = rb.removeUsed()
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func (rb *Rebuilder) addDir(root string, output bool) error {
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		zip, err := scanner.IsZip(path)
+		if err != nil {
+			return err
+		}
+		if zip {
+			return rb.addZip(path, output)
+		}
+		if output {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return rb.add(&Source{Path: path}, f, fi.Size())
+	})
+}
+
+func (rb *Rebuilder) addZip(path string, output bool) error {
+	zr, err := czip.OpenReader(path)
+	if err != nil {
+		if rb.damaged[path] {
+			return nil
+		}
+		return err
+	}
+	defer zr.Close()
+
+	for _, fh := range zr.File {
+		if strings.HasSuffix(fh.Name, "/") {
+			continue
+		}
+		fr, err := fh.Open()
+		if err != nil {
+			if rb.damaged[path] {
+				continue
+			}
+			return err
+		}
+		err = rb.add(&Source{Path: path, Entry: fh.Name, output: output}, fr, int64(fh.UncompressedSize64))
+		fr.Close()
+		if err != nil && rb.damaged[path] {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s in %s failed: %v", fh.Name, path, err)
+		}
+	}
+	return nil
+}
+
+func (rb *Rebuilder) add(s *Source, r io.Reader, size int64) error {
+	raw, headerless, err := detector.Hash(r, size, rb.Detector)
+	if err != nil {
+		return err
+	}
+	s.Size = raw.Size
+	s.CRC = dat.CRC(raw.CRC32)
+	s.MD5 = raw.MD5
+	s.SHA1 = raw.SHA1
+	s.Headerless = headerless
+
+	rb.sources = append(rb.sources, s)
+	if s.output {
+		rb.outputs[s.Path] = append(rb.outputs[s.Path], s)
+	}
+	rb.index(s, s.Size, s.CRC, s.MD5, s.SHA1)
+	if headerless != nil {
+		rb.index(s, headerless.Size, dat.CRC(headerless.CRC32), headerless.MD5, headerless.SHA1)
+	}
+	return nil
+}
+
+func (rb *Rebuilder) index(s *Source, size uint64, crc, md5, sha1 []byte) {
+	// prefer sources that are in the output dir already, they are read
+	// before all others
+	if rb.bySHA1[string(sha1)] == nil {
+		rb.bySHA1[string(sha1)] = s
+	}
+	if rb.byMD5[string(md5)] == nil {
+		rb.byMD5[string(md5)] = s
+	}
+	key := crcKey{string(crc), size}
+	if rb.byCRC[key] == nil {
+		rb.byCRC[key] = s
+	}
+}
+
+func (rb *Rebuilder) lookup(rom *dat.Rom) *Source {
+	switch {
+	case rom.SHA1 != nil:
+		return rb.bySHA1[string(rom.SHA1)]
+	case rom.MD5 != nil:
+		return rb.byMD5[string(rom.MD5)]
+	case rom.CRC != nil:
+		return rb.byCRC[crcKey{string(rom.CRC), rom.Size}]
+	}
+	return nil
+}
+
+// empty reports whether rom can be created without a source.
+func empty(rom *dat.Rom) bool {
+	return rom.Size == 0 && (rom.CRC == nil || rom.CRC.Equal(dat.CRC(0)))
+}
+
+// rebuildSet writes set g to a temp file next to its archive and returns
+// the temp file's name, and whether the archive needs a backup before it
+// is replaced. If the set has no matching roms, the returned result is
+// nil.
+func (rb *Rebuilder) rebuildSet(outDir string, g *dat.Game) (*SetResult, string, bool, error) {
+	path, err := dat.SetPath(outDir, g)
+	if err != nil {
+		return nil, "", false, err
+	}
+	sr := &SetResult{
+		Name:   g.Name,
+		Path:   path,
+		Status: dat.SetComplete,
+	}
+
+	var matches []match
+	found := 0
+	seen := make(map[string]bool)
+	for _, rom := range g.Roms {
+		if rom.Status == dat.StatusNoDump {
+			continue
+		}
+		name := strings.Replace(rom.Name, "\\", "/", -1)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		if empty(rom) {
+			matches = append(matches, match{name: name})
+			continue
+		}
+		src := rb.lookup(rom)
+		if src == nil {
+			sr.Missing = append(sr.Missing, rom)
+			sr.Status = dat.SetPartial
+			continue
+		}
+		matches = append(matches, match{name: name, src: src})
+		found++
+	}
+	if found == 0 {
+		return nil, "", false, nil
+	}
+	matched := make(map[string]bool)
+	for _, m := range matches {
+		if m.src != nil {
+			m.src.used = true
+			matched[string(m.src.SHA1)] = true
+		}
+	}
+
+	// keep the entries of the old archive whose content isn't in the set
+	// under another name
+	backup := false
+	for _, s := range rb.outputs[sr.Path] {
+		if matched[string(s.SHA1)] {
+			continue
+		}
+		if seen[s.Entry] {
+			backup = true
+			continue
+		}
+		seen[s.Entry] = true
+		matches = append(matches, match{name: s.Entry, src: s})
+		sr.Kept = append(sr.Kept, s.Entry)
+	}
+
+	if rb.upToDate(sr.Path, g) {
+		sr.Unchanged = true
+		return sr, "", false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(sr.Path), 0755); err != nil {
+		return nil, "", false, err
+	}
+	tf, err := ioutil.TempFile(filepath.Dir(sr.Path), "rebuild")
+	if err != nil {
+		return nil, "", false, err
+	}
+	err = writeSet(tf, matches, rb.TempDir)
+	if cerr := tf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tf.Name())
+		return nil, "", false, err
+	}
+	return sr, tf.Name(), backup, nil
+}
+
+// backup moves the archive of sr out of the way to BackupDir.
+func (rb *Rebuilder) backup(outDir string, sr *SetResult) error {
+	dir := rb.BackupDir
+	if dir == "" {
+		dir = filepath.Join(outDir, "backup")
+	}
+	rel, err := filepath.Rel(outDir, sr.Path)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		path = filepath.Join(dir, strings.TrimSuffix(rel, ".zip")+fmt.Sprintf(".%d.zip", i))
+	}
+	if err := os.Rename(sr.Path, path); err != nil {
+		return err
+	}
+	sr.Backup = path
+	return nil
+}
+
+func writeSet(w io.Writer, matches []match, tempDir string) error {
+	zw, err := torrentzip.NewWriterWithTemp(w, tempDir)
+	if err != nil {
+		return err
+	}
+	zs := &zipSources{files: make(map[string]map[string]*czip.File)}
+	defer zs.close()
+
+	for _, m := range matches {
+		cw, err := zw.Create(m.name)
+		if err == nil && m.src != nil {
+			err = zs.copy(cw, m.src)
+		}
+		if err != nil {
+			zw.Abort()
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// upToDate reports whether the archive at path holds all roms of g, those
+// shared with its parent too, and is torrentzipped. Other entries of the
+// archive would be kept anyway.
+func (rb *Rebuilder) upToDate(path string, g *dat.Game) bool {
+	res, err := scanner.ScanArchive(path, false, rb.Detector)
+	if err != nil || !res.Torrentzipped {
+		return false
+	}
+	s := dat.VerifySet(g, res)
+	return s.Status == dat.SetComplete && len(s.Merged) == 0
+}
+
+// zipSources keeps the source zip files of a set open while it is
+// written, so each is opened and indexed only once.
+type zipSources struct {
+	readers []*czip.ReadCloser
+	files   map[string]map[string]*czip.File
+}
+
+func (zs *zipSources) copy(w io.Writer, s *Source) error {
+	if s.Entry == "" {
+		f, err := os.Open(s.Path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	}
+
+	files, ok := zs.files[s.Path]
+	if !ok {
+		zr, err := czip.OpenReader(s.Path)
+		if err != nil {
+			return err
+		}
+		zs.readers = append(zs.readers, zr)
+		files = make(map[string]*czip.File)
+		for _, fh := range zr.File {
+			if files[fh.Name] == nil {
+				files[fh.Name] = fh
+			}
+		}
+		zs.files[s.Path] = files
+	}
+
+	fh := files[s.Entry]
+	if fh == nil {
+		return fmt.Errorf("%s not found in %s", s.Entry, s.Path)
+	}
+	fr, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	_, err = io.Copy(w, fr)
+	return err
+}
+
+func (zs *zipSources) close() {
+	for _, zr := range zs.readers {
+		zr.Close()
+	}
+}
+
+// removeUsed deletes source files whose content was used. Zip files are
+// only deleted if all their entries were used. Archives in the output dir
+// are never deleted.
+func (rb *Rebuilder) removeUsed() ([]string, error) {
+	keep := make(map[string]bool)
+	var paths []string
+	for _, s := range rb.sources {
+		if s.output {
+			continue
+		}
+		if !keep[s.Path] && !s.used {
+			keep[s.Path] = true
+		}
+		if len(paths) == 0 || paths[len(paths)-1] != s.Path {
+			paths = append(paths, s.Path)
+		}
+	}
+
+	var removed []string
+	for _, path := range paths {
+		if keep[path] {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
@@ -0,0 +1,379 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package rebuild
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip"
+	"github.com/uwedeportivo/torrentzip/czip"
+	"github.com/uwedeportivo/torrentzip/dat"
+	"github.com/uwedeportivo/torrentzip/detector"
+	"github.com/uwedeportivo/torrentzip/scanner"
+)
+
+func testRom(name string, content []byte, withSHA1 bool) *dat.Rom {
+	rom := &dat.Rom{
+		Name: name,
+		Size: uint64(len(content)),
+		CRC:  dat.CRC(crc32.ChecksumIEEE(content)),
+	}
+	if withSHA1 {
+		h := sha1.Sum(content)
+		rom.SHA1 = h[:]
+	}
+	return rom
+}
+
+func writeZip(t *testing.T, path string, files map[string][]byte) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zw := czip.NewWriter(f)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebuild")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := []byte("content of a")
+	b := []byte("content of b")
+	m := []byte("content of m")
+	junk := []byte("junk")
+
+	src := filepath.Join(dir, "src")
+	out := filepath.Join(dir, "out")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "whatever.bin"), a, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeZip(t, filepath.Join(src, "random.dat"), map[string][]byte{
+		"B.BIN":    b,
+		"junk.txt": junk,
+	})
+
+	d := &dat.Dat{
+		Games: []*dat.Game{
+			{
+				Name: "set1",
+				Roms: []*dat.Rom{
+					testRom("a.bin", a, false),
+					testRom("sub\\b.bin", b, true),
+					{Name: "empty/", CRC: dat.CRC(0)},
+				},
+			},
+			{
+				Name: "set2",
+				Roms: []*dat.Rom{
+					testRom("a.bin", a, true),
+					testRom("m.bin", m, true),
+				},
+			},
+			{
+				Name: "set3",
+				Roms: []*dat.Rom{testRom("n.bin", []byte("nowhere"), true)},
+			},
+		},
+	}
+
+	rb := &Rebuilder{Dat: d, OutDir: out}
+	report, err := rb.Rebuild(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Sets) != 2 {
+		t.Fatalf("got %d sets, want 2", len(report.Sets))
+	}
+	if s := report.Sets[0]; s.Name != "set1" || s.Status != dat.SetComplete || s.Unchanged {
+		t.Errorf("unexpected set1 result %+v", s)
+	}
+	if s := report.Sets[1]; s.Name != "set2" || s.Status != dat.SetPartial || len(s.Missing) != 1 {
+		t.Errorf("unexpected set2 result %+v", s)
+	}
+	if len(report.Unused) != 1 || report.Unused[0].Entry != "junk.txt" {
+		t.Errorf("unexpected unused %v", report.Unused)
+	}
+	if _, err := os.Stat(filepath.Join(out, "set3.zip")); !os.IsNotExist(err) {
+		t.Error("set without matches was written")
+	}
+
+	for _, name := range []string{"set1.zip", "set2.zip"} {
+		f, err := os.Open(filepath.Join(out, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, _ := f.Stat()
+		ok, err := torrentzip.IsTorrentzipped(f, fi.Size())
+		f.Close()
+		if err != nil || !ok {
+			t.Errorf("%s is not torrentzipped: %v", name, err)
+		}
+	}
+
+	vr, err := dat.VerifyDir(d, &scanner.Scanner{HashEntries: true}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vr.Sets[0].Status != dat.SetComplete || len(vr.Sets[0].Unneeded) != 0 {
+		t.Errorf("rebuilt set1 doesn't verify: %+v", vr.Sets[0])
+	}
+
+	// A second run leaves complete sets alone and completes set2 from a
+	// new source, which is moved.
+	src2 := filepath.Join(dir, "src2")
+	if err := os.MkdirAll(src2, 0755); err != nil {
+		t.Fatal(err)
+	}
+	mpath := filepath.Join(src2, "m")
+	if err := ioutil.WriteFile(mpath, m, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rb.Move = true
+	report, err = rb.Rebuild(src, src2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := report.Sets[0]; !s.Unchanged {
+		t.Errorf("complete set1 was rewritten")
+	}
+	if s := report.Sets[1]; s.Status != dat.SetComplete || s.Unchanged {
+		t.Errorf("unexpected set2 result %+v", s)
+	}
+	// a is read from set1.zip now, so its source file is unused
+	if len(report.Removed) != 1 || report.Removed[0] != mpath {
+		t.Errorf("got removed %v, want %s", report.Removed, mpath)
+	}
+	if _, err := os.Stat(mpath); !os.IsNotExist(err) {
+		t.Error("moved source still exists")
+	}
+	if _, err := os.Stat(filepath.Join(src, "random.dat")); err != nil {
+		t.Error("partly used source zip was removed")
+	}
+}
+
+func TestRebuildHeadered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebuild")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rom := bytes.Repeat([]byte("rom data"), 1000)
+	headered := append([]byte("NES\x1a\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), rom...)
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "dump.nes"), headered, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &dat.Dat{
+		Games: []*dat.Game{{Name: "game", Roms: []*dat.Rom{testRom("game.nes", rom, true)}}},
+	}
+	det, err := detector.Parse(strings.NewReader(`<detector><name>nes</name>
+		<rule start_offset="10"><data offset="0" value="4E45531A"/></rule></detector>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "out")
+	rb := &Rebuilder{Dat: d, OutDir: out}
+	report, err := rb.Rebuild(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Sets) != 0 {
+		t.Fatal("headered source matched without detector")
+	}
+
+	rb.Detector = det
+	report, err = rb.Rebuild(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Sets) != 1 || report.Sets[0].Status != dat.SetComplete {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	zr, err := czip.OpenReader(filepath.Join(out, "game.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	if len(zr.File) != 1 || zr.File[0].UncompressedSize64 != uint64(len(headered)) {
+		t.Error("rebuilt rom lost its header")
+	}
+
+	// the rebuilt set is recognized as complete on the next run
+	report, err = rb.Rebuild(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Sets[0].Unchanged {
+		t.Error("complete headered set was rewritten")
+	}
+}
+
+// TestRebuildKeep checks that rewriting an archive in the output dir keeps
+// its unknown entries, and backs it up if an unknown entry has the name of
+// a rom.
+func TestRebuildKeep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebuild")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := []byte("content of a")
+	b := []byte("content of b")
+	notes := []byte("notes")
+
+	src := filepath.Join(dir, "src")
+	out := filepath.Join(dir, "out")
+	for _, d := range []string{src, out} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "a"), a, 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := map[string][]byte{
+		"a.bin":     []byte("bad dump of a"),
+		"b.old":     b,
+		"notes.txt": notes,
+	}
+	writeZip(t, filepath.Join(out, "set1.zip"), old)
+
+	d := &dat.Dat{Games: []*dat.Game{{
+		Name: "set1",
+		Roms: []*dat.Rom{testRom("a.bin", a, true), testRom("b.bin", b, true)},
+	}}}
+	rb := &Rebuilder{Dat: d, OutDir: out}
+	report, err := rb.Rebuild(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := report.Sets[0]
+	backup := filepath.Join(out, "backup", "set1.zip")
+	if s.Status != dat.SetComplete || len(s.Kept) != 1 || s.Kept[0] != "notes.txt" || s.Backup != backup {
+		t.Errorf("unexpected set1 result %+v", s)
+	}
+
+	want := map[string][]byte{"a.bin": a, "b.bin": b, "notes.txt": notes}
+	for path, files := range map[string]map[string][]byte{filepath.Join(out, "set1.zip"): want, backup: old} {
+		zr, err := czip.OpenReader(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(zr.File) != len(files) {
+			t.Errorf("%s has %d entries, want %d", path, len(zr.File), len(files))
+		}
+		for _, fh := range zr.File {
+			fr, err := fh.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := ioutil.ReadAll(fr)
+			fr.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, files[fh.Name]) {
+				t.Errorf("%s in %s has content %q", fh.Name, path, content)
+			}
+		}
+		zr.Close()
+	}
+}
+
+func TestRebuildBadName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebuild")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := []byte("content of a")
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "a"), a, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../evil", "sub/../../evil", "/evil", ".."} {
+		d := &dat.Dat{Games: []*dat.Game{
+			{Name: "good", Roms: []*dat.Rom{testRom("a.bin", a, true)}},
+			{Name: name, Roms: []*dat.Rom{testRom("a.bin", a, true)}},
+		}}
+		rb := &Rebuilder{Dat: d, OutDir: filepath.Join(dir, "out")}
+		if _, err := rb.Rebuild(src); err == nil {
+			t.Errorf("rebuild of set %q succeeded", name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "out")); !os.IsNotExist(err) {
+			t.Errorf("rebuild of set %q created the output dir", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil.zip")); !os.IsNotExist(err) {
+		t.Error("set was written outside the output dir")
+	}
+}
@@ -0,0 +1,505 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package scanner walks collections of zip files and caches what it learns
+about every archive.
+
+Archives are recognized by their magic bytes, not by their extension. For
+every archive the scanner records the SHA1 of the whole file, whether it
+is a valid torrentzip, and CRC32, size and optionally MD5 and SHA1 of its
+entries. Results are cached by path, size and modification time, so a
+rescan only reads archives that were added or changed since the last scan.
+
+With a header detector, entries with a copier header also get the hashes
+of their headerless content, which is what DATs list for such roms.
+*/
+package scanner
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/uwedeportivo/torrentzip"
+	"github.com/uwedeportivo/torrentzip/czip"
+	"github.com/uwedeportivo/torrentzip/detector"
+)
+
+const (
+	fileHeaderSignature   = 0x04034b50
+	directoryEndSignature = 0x06054b50
+)
+
+// Entry is a file inside a scanned archive. MD5 and SHA1 are only set if
+// the archive was scanned with HashEntries or a Detector. Headerless is
+// set if a rule of the Detector applied to the entry.
+type Entry struct {
+	Name       string
+	Size       uint64
+	CRC32      uint32
+	MD5        []byte
+	SHA1       []byte
+	Headerless *detector.Hashes
+}
+
+// Result is what the scanner learned about an archive.
+type Result struct {
+	Path          string
+	Size          int64
+	ModTime       int64
+	SHA1          []byte
+	Torrentzipped bool
+	Hashed        bool
+
+	// Detector identifies the detector the archive was scanned with, if
+	// any, by a hash of its rules, so editing a detector file invalidates
+	// the results made with it.
+	Detector string
+
+	Entries []*Entry
+}
+
+// Cache holds scan results keyed by path. A Cache is safe for concurrent
+// use.
+type Cache struct {
+	mu      sync.Mutex
+	results map[string]*Result
+}
+
+// NewCache returns an empty cache.
+func NewCache() *Cache {
+	return &Cache{results: make(map[string]*Result)}
+}
+
+// LoadCache reads a cache saved by Save from the file at path. A missing
+// file results in an empty cache.
+func LoadCache(path string) (*Cache, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return NewCache(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := NewCache()
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&c.results); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Save writes the cache to the file at path. The cache is written to a
+// temp file first and renamed, so a crash never leaves a partial cache.
+func (c *Cache) Save(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	err = gob.NewEncoder(bw).Encode(c.results)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Get returns the cached result for the archive at path, or nil.
+func (c *Cache) Get(path string) *Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.results[path]
+}
+
+func (c *Cache) put(r *Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results[r.Path] = r
+}
+
+func (c *Cache) remove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.results, path)
+}
+
+func (c *Cache) paths() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ps := make([]string, 0, len(c.results))
+	for p := range c.results {
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// Report lists what changed since the last scan of the same roots.
+// All paths are absolute and sorted.
+type Report struct {
+	Added   []string
+	Changed []string
+	Removed []string
+
+	// Results holds the results of all archives found, cached or not,
+	// sorted by path.
+	Results []*Result
+
+	// Failed maps paths of archives that could not be read to the error.
+	Failed map[string]error
+}
+
+// Scanner scans collections of zip files.
+type Scanner struct {
+	// Cache holds the results of previous scans. If nil, every archive
+	// is read.
+	Cache *Cache
+
+	// Workers is the number of archives read concurrently. If 0, the
+	// number of CPUs is used.
+	Workers int
+
+	// HashEntries makes the scanner decompress all entries to compute
+	// their MD5 and SHA1.
+	HashEntries bool
+
+	// Detector, if set, is used to compute the headerless hashes of
+	// entries, which implies HashEntries.
+	Detector *detector.Detector
+}
+
+type scanned struct {
+	path   string
+	result *Result
+	status int
+	err    error
+}
+
+const (
+	statusUnchanged = iota
+	statusAdded
+	statusChanged
+	statusNotZip
+)
+
+// Scan walks the given roots and returns what it found. Cached archives
+// below the roots that are gone, or are no longer zip files, are removed
+// from the cache.
+func (s *Scanner) Scan(roots ...string) (*Report, error) {
+	if s.Cache == nil {
+		s.Cache = NewCache()
+	}
+	workers := s.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	var absRoots []string
+	for _, root := range roots {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		absRoots = append(absRoots, abs)
+	}
+
+	key := detectorKey(s.Detector)
+	paths := make(chan string)
+	out := make(chan *scanned)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				out <- s.scan(path, key)
+			}
+		}()
+	}
+
+	// paths that can't be walked are reported like archives that can't
+	// be read, and the walk goes on
+	walkFailed := make(map[string]error)
+	go func() {
+		defer close(paths)
+		for _, root := range absRoots {
+			filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+				if err != nil {
+					walkFailed[path] = err
+					return nil
+				}
+				if fi.Mode().IsRegular() {
+					paths <- path
+				}
+				return nil
+			})
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	report := &Report{Failed: make(map[string]error)}
+	seen := make(map[string]bool)
+	for sc := range out {
+		if sc.err != nil {
+			report.Failed[sc.path] = sc.err
+			continue
+		}
+		if sc.status == statusNotZip {
+			continue
+		}
+		seen[sc.path] = true
+		report.Results = append(report.Results, sc.result)
+		switch sc.status {
+		case statusAdded:
+			report.Added = append(report.Added, sc.path)
+		case statusChanged:
+			report.Changed = append(report.Changed, sc.path)
+		}
+	}
+	for path, err := range walkFailed {
+		report.Failed[path] = err
+	}
+
+	for _, path := range s.Cache.paths() {
+		if seen[path] || !below(path, absRoots) || failed(path, report.Failed) {
+			continue
+		}
+		s.Cache.remove(path)
+		report.Removed = append(report.Removed, path)
+	}
+
+	sort.Strings(report.Added)
+	sort.Strings(report.Changed)
+	sort.Strings(report.Removed)
+	sort.Slice(report.Results, func(i, j int) bool {
+		return report.Results[i].Path < report.Results[j].Path
+	})
+	return report, nil
+}
+
+// failed reports whether path or a directory above it could not be read,
+// in which case its cached result is kept as it may still be there.
+func failed(path string, failures map[string]error) bool {
+	for p := path; ; p = filepath.Dir(p) {
+		if _, ok := failures[p]; ok {
+			return true
+		}
+		if filepath.Dir(p) == p {
+			return false
+		}
+	}
+}
+
+func below(path string, roots []string) bool {
+	for _, root := range roots {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Scanner) scan(path string, key string) *scanned {
+	sc := &scanned{path: path}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		sc.err = err
+		return sc
+	}
+
+	cached := s.Cache.Get(path)
+	if cached != nil && cached.Size == fi.Size() && cached.ModTime == fi.ModTime().UnixNano() &&
+		(cached.Hashed || !s.HashEntries) && cached.Detector == key {
+		sc.result = cached
+		sc.status = statusUnchanged
+		return sc
+	}
+
+	zip, err := IsZip(path)
+	if err != nil {
+		sc.err = err
+		return sc
+	}
+	if !zip {
+		sc.status = statusNotZip
+		return sc
+	}
+
+	r, err := ScanArchive(path, s.HashEntries, s.Detector)
+	if err != nil {
+		s.Cache.remove(path)
+		sc.err = err
+		return sc
+	}
+	r.Size = fi.Size()
+	r.ModTime = fi.ModTime().UnixNano()
+
+	s.Cache.put(r)
+	sc.result = r
+	if cached == nil {
+		sc.status = statusAdded
+	} else {
+		sc.status = statusChanged
+	}
+	return sc
+}
+
+// IsZip reports whether the file at path starts like a zip file, either
+// with a local file header or, for empty archives, with the end of central
+// directory record.
+func IsZip(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var buf [4]byte
+	if _, err := io.ReadFull(f, buf[:]); err != nil {
+		return false, nil
+	}
+	sig := binary.LittleEndian.Uint32(buf[:])
+	return sig == fileHeaderSignature || sig == directoryEndSignature, nil
+}
+
+func detectorKey(d *detector.Detector) string {
+	if d == nil {
+		return ""
+	}
+	hh := sha1.New()
+	for _, r := range d.Rules {
+		fmt.Fprintf(hh, "rule %d %d %s\n", r.StartOffset, r.EndOffset, r.Operation)
+		for _, t := range r.Tests {
+			fmt.Fprintf(hh, "%+v\n", *t)
+		}
+	}
+	return hex.EncodeToString(hh.Sum(nil))
+}
+
+// ScanArchive reads the zip file at path and returns its result. Size and
+// ModTime of the result are not set. If d is not nil, entries are hashed
+// as with hashEntries and headerless hashes are computed too.
+func ScanArchive(path string, hashEntries bool, d *detector.Detector) (*Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	hh := sha1.New()
+	if _, err := io.Copy(hh, bufio.NewReader(f)); err != nil {
+		return nil, err
+	}
+
+	zr, err := czip.NewReader(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	tz, err := torrentzip.IsTorrentzipped(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Result{
+		Path:          path,
+		SHA1:          hh.Sum(nil),
+		Torrentzipped: tz,
+		Hashed:        hashEntries || d != nil,
+		Detector:      detectorKey(d),
+	}
+	for _, fh := range zr.File {
+		e := &Entry{
+			Name:  fh.Name,
+			Size:  fh.UncompressedSize64,
+			CRC32: fh.CRC32,
+		}
+		if r.Hashed {
+			if err := hashEntry(fh, e, d); err != nil {
+				return nil, err
+			}
+		}
+		r.Entries = append(r.Entries, e)
+	}
+	return r, nil
+}
+
+func hashEntry(fh *czip.File, e *Entry, d *detector.Detector) error {
+	fr, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+
+	raw, headerless, err := detector.Hash(fr, int64(fh.UncompressedSize64), d)
+	if err != nil {
+		return err
+	}
+	e.MD5 = raw.MD5
+	e.SHA1 = raw.SHA1
+	e.Headerless = headerless
+	return nil
+}
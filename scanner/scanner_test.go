@@ -0,0 +1,333 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package scanner
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uwedeportivo/torrentzip/czip"
+	"github.com/uwedeportivo/torrentzip/detector"
+)
+
+func copyTestdata(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join("..", "testdata", "*.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) == 0 {
+		t.Fatal("no testdata zips found")
+	}
+	var copied []string
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := filepath.Join(dir, strings.TrimSuffix(filepath.Base(name), ".zip")+".bin")
+		if err := ioutil.WriteFile(dst, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		copied = append(copied, dst)
+	}
+	return copied
+}
+
+func TestScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths := copyTestdata(t, dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Scanner{Workers: 3}
+	report, err := s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Added) != len(paths) || len(report.Results) != len(paths) {
+		t.Fatalf("got %d added, %d results, want %d", len(report.Added), len(report.Results), len(paths))
+	}
+	if len(report.Failed) != 0 {
+		t.Fatalf("unexpected failures %v", report.Failed)
+	}
+	for _, r := range report.Results {
+		want := strings.TrimSuffix(filepath.Base(r.Path), ".bin")
+		if got := hex.EncodeToString(r.SHA1); !strings.EqualFold(got, want) {
+			t.Errorf("%s: sha1 %s, want %s", r.Path, got, want)
+		}
+		if !r.Torrentzipped {
+			t.Errorf("%s: not reported as torrentzipped", r.Path)
+		}
+		if len(r.Entries) == 0 {
+			t.Errorf("%s: no entries", r.Path)
+		}
+	}
+
+	cacheFile := filepath.Join(dir, "cache")
+	if err := s.Cache.Save(cacheFile); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := LoadCache(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(cacheFile)
+
+	// Change one archive, remove another.
+	changed, removed := paths[0], paths[1]
+	data, err := ioutil.ReadFile(changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(changed, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(changed, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+
+	s = &Scanner{Cache: cache}
+	report, err = s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Added) != 0 {
+		t.Errorf("added %v, want none", report.Added)
+	}
+	if len(report.Changed) != 1 || report.Changed[0] != changed {
+		t.Errorf("changed %v, want %s", report.Changed, changed)
+	}
+	if len(report.Removed) != 1 || report.Removed[0] != removed {
+		t.Errorf("removed %v, want %s", report.Removed, removed)
+	}
+	if cache.Get(removed) != nil {
+		t.Errorf("removed archive %s still cached", removed)
+	}
+	if r := cache.Get(changed); r == nil || r.Torrentzipped {
+		t.Errorf("changed archive %s should no longer be torrentzipped", changed)
+	}
+}
+
+func TestScanHashEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths := copyTestdata(t, dir)
+
+	s := &Scanner{}
+	if _, err := s.Scan(dir); err != nil {
+		t.Fatal(err)
+	}
+	if r := s.Cache.Get(paths[0]); r.Hashed || r.Entries[0].SHA1 != nil {
+		t.Fatal("entries hashed without HashEntries")
+	}
+
+	// Asking for entry hashes rescans archives cached without them.
+	s.HashEntries = true
+	report, err := s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Changed) != len(paths) {
+		t.Fatalf("got %d changed, want %d", len(report.Changed), len(paths))
+	}
+	for _, r := range report.Results {
+		for _, e := range r.Entries {
+			if len(e.MD5) != 16 || len(e.SHA1) != 20 {
+				t.Errorf("%s: entry %s not hashed", r.Path, e.Name)
+			}
+		}
+	}
+
+	report, err = s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Changed) != 0 || len(report.Added) != 0 {
+		t.Errorf("rescan reported changes: %v %v", report.Added, report.Changed)
+	}
+	if !bytes.Equal(report.Results[0].SHA1, s.Cache.Get(report.Results[0].Path).SHA1) {
+		t.Error("cached result differs")
+	}
+}
+
+func TestScanDetector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rom := bytes.Repeat([]byte("rom data"), 1000)
+	headered := append([]byte("NES\x1a\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), rom...)
+
+	f, err := os.Create(filepath.Join(dir, "nes.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := czip.NewWriter(f)
+	for name, data := range map[string][]byte{"headered.nes": headered, "plain.nes": rom} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s := &Scanner{}
+	if _, err := s.Scan(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := detector.Parse(strings.NewReader(`<detector><name>nes</name>
+		<rule start_offset="10"><data offset="0" value="4E45531A"/></rule></detector>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Detector = d
+	report, err := s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Changed) != 1 {
+		t.Fatalf("archive scanned without detector not rescanned: %+v", report)
+	}
+
+	report, err = s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Changed) != 0 {
+		t.Errorf("archive rescanned with unchanged detector: %+v", report)
+	}
+
+	// same name, different rules
+	edited, err := detector.Parse(strings.NewReader(`<detector><name>nes</name>
+		<rule start_offset="10"><data offset="0" value="4E45531B"/></rule></detector>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Detector = edited
+	edReport, err := s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edReport.Changed) != 1 {
+		t.Errorf("archive not rescanned after detector rules changed: %+v", edReport)
+	}
+
+	sum := sha1.Sum(rom)
+	for _, e := range report.Results[0].Entries {
+		switch e.Name {
+		case "headered.nes":
+			if e.Headerless == nil || e.Headerless.Size != uint64(len(rom)) || !bytes.Equal(e.Headerless.SHA1, sum[:]) {
+				t.Errorf("unexpected headerless hashes %+v", e.Headerless)
+			}
+		case "plain.nes":
+			if e.Headerless != nil || !bytes.Equal(e.SHA1, sum[:]) {
+				t.Errorf("unexpected hashes for plain rom %+v", e)
+			}
+		}
+	}
+}
+
+func TestScanUnreadable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths := copyTestdata(t, dir)
+	missing := filepath.Join(dir, "missing")
+
+	s := &Scanner{}
+	report, err := s.Scan(missing, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Added) != len(paths) {
+		t.Errorf("scan found %d archives next to a missing root, want %d", len(report.Added), len(paths))
+	}
+	if report.Failed[missing] == nil {
+		t.Errorf("missing root not reported as failed: %v", report.Failed)
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can read files without read permission")
+	}
+	if err := os.Chmod(paths[0], 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(paths[0], 0644)
+	// make sure the cached result is not used
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(paths[0], later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Failed[paths[0]] == nil {
+		t.Errorf("unreadable archive not reported as failed: %v", report.Failed)
+	}
+	if len(report.Results) != len(paths)-1 || len(report.Removed) != 0 {
+		t.Errorf("scan with unreadable archive has %d results and %d removed, want %d and 0",
+			len(report.Results), len(report.Removed), len(paths)-1)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package sevenzip
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// bcjReader undoes the BCJ x86 filter, which turns the relative addresses
+// of call and jump instructions into absolute ones to make them compress
+// better. It follows the filter of xz and 7-Zip.
+type bcjReader struct {
+	r   io.Reader
+	buf [1 << 16]byte
+	err error
+
+	// buf[start:conv] is decoded, buf[conv:end] is waiting for more
+	// input to decide on instructions crossing its end.
+	start, conv, end int
+
+	pos      uint32 // stream position of buf[conv]
+	prevMask uint32
+	prevPos  uint32
+}
+
+func newBCJReader(r io.Reader, props []byte) (*bcjReader, error) {
+	br := &bcjReader{r: r, prevPos: ^uint32(0) - 4}
+	switch len(props) {
+	case 0:
+	case 4:
+		br.pos = binary.LittleEndian.Uint32(props)
+	default:
+		return nil, ErrFormat
+	}
+	return br, nil
+}
+
+func (r *bcjReader) Read(p []byte) (int, error) {
+	for r.start == r.conv {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.end = copy(r.buf[:], r.buf[r.conv:r.end])
+		r.start, r.conv = 0, 0
+
+		n, err := r.r.Read(r.buf[r.end:])
+		r.end += n
+		k := r.x86(r.buf[:r.end])
+		r.conv += k
+		r.pos += uint32(k)
+		if err != nil {
+			// the tail that is too short for an instruction is
+			// passed through unchanged
+			if err == io.EOF {
+				r.pos += uint32(r.end - r.conv)
+				r.conv = r.end
+			}
+			r.err = err
+		}
+	}
+	n := copy(p, r.buf[r.start:r.conv])
+	r.start += n
+	return n, nil
+}
+
+func test86MSByte(b byte) bool {
+	return b == 0 || b == 0xff
+}
+
+var (
+	maskToAllowed   = [8]bool{true, true, true, false, true, false, false, false}
+	maskToBitNumber = [8]uint32{0, 1, 2, 2, 3, 3, 3, 3}
+)
+
+// x86 decodes the instructions in buf, which starts at r.pos, and returns
+// the number of bytes done.
+func (r *bcjReader) x86(buf []byte) int {
+	if len(buf) < 5 {
+		return 0
+	}
+	now := r.pos
+	if now-r.prevPos > 5 {
+		r.prevPos = now - 5
+	}
+	limit := len(buf) - 5
+	i := 0
+	for i <= limit {
+		b := buf[i]
+		if b != 0xe8 && b != 0xe9 {
+			i++
+			continue
+		}
+		offset := now + uint32(i) - r.prevPos
+		r.prevPos = now + uint32(i)
+		if offset > 5 {
+			r.prevMask = 0
+		} else {
+			for j := uint32(0); j < offset; j++ {
+				r.prevMask &= 0x77
+				r.prevMask <<= 1
+			}
+		}
+
+		b = buf[i+4]
+		if test86MSByte(b) && maskToAllowed[(r.prevMask>>1)&7] && r.prevMask>>1 < 0x10 {
+			src := binary.LittleEndian.Uint32(buf[i+1:])
+			var dest uint32
+			for {
+				dest = src - (now + uint32(i) + 5)
+				if r.prevMask == 0 {
+					break
+				}
+				k := maskToBitNumber[r.prevMask>>1]
+				if !test86MSByte(byte(dest >> (24 - k*8))) {
+					break
+				}
+				src = dest ^ (1<<(32-k*8) - 1)
+			}
+			dest &= 0x01ffffff
+			if dest&0x01000000 != 0 {
+				dest |= 0xff000000
+			}
+			binary.LittleEndian.PutUint32(buf[i+1:], dest)
+			i += 5
+			r.prevMask = 0
+		} else {
+			i++
+			r.prevMask |= 1
+			if test86MSByte(b) {
+				r.prevMask |= 0x10
+			}
+		}
+	}
+	return i
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package sevenzip
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/uwedeportivo/torrentzip/lzma"
+)
+
+// coder method ids
+var (
+	methodCopy  = []byte{0x00}
+	methodLZMA  = []byte{0x03, 0x01, 0x01}
+	methodLZMA2 = []byte{0x21}
+	methodBCJ   = []byte{0x03, 0x03, 0x01, 0x03}
+	methodAES   = []byte{0x06, 0xf1, 0x07, 0x01}
+)
+
+// newFolderReader returns a reader decoding the output of folder i of si.
+func newFolderReader(ra io.ReaderAt, si *streamsInfo, i int) (io.Reader, error) {
+	f := si.folders[i]
+	if f.packStart+len(f.packed) > len(si.packSizes) {
+		return nil, ErrFormat
+	}
+
+	offset := int64(signatureHeaderLen + si.packPos)
+	for _, size := range si.packSizes[:f.packStart] {
+		offset += int64(size)
+	}
+	packed := make([]io.Reader, len(f.packed))
+	for j := range packed {
+		size := int64(si.packSizes[f.packStart+j])
+		packed[j] = bufio.NewReader(io.NewSectionReader(ra, offset, size))
+		offset += size
+	}
+
+	out := f.mainOut()
+	r, err := f.output(out, packed, 0)
+	if err != nil {
+		return nil, err
+	}
+	return io.LimitReader(r, int64(f.sizes[out])), nil
+}
+
+// output returns a reader for output stream out of the folder, building
+// the coders feeding it from the packed streams.
+func (f *folder) output(out int, packed []io.Reader, depth int) (io.Reader, error) {
+	if depth > len(f.coders) {
+		// the bind pairs form a cycle
+		return nil, ErrFormat
+	}
+
+	inBase, outBase := 0, 0
+	for _, c := range f.coders {
+		if out >= outBase+c.numOut {
+			inBase += c.numIn
+			outBase += c.numOut
+			continue
+		}
+		if c.numOut != 1 || c.numIn != 1 {
+			// BCJ2 is the only such coder in use
+			return nil, ErrAlgorithm
+		}
+
+		var in io.Reader
+		if bp := f.bindIn(inBase); bp >= 0 {
+			var err error
+			in, err = f.output(f.bindPairs[bp].out, packed, depth+1)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			for j, k := range f.packed {
+				if k == inBase {
+					in = packed[j]
+					break
+				}
+			}
+			if in == nil {
+				return nil, ErrFormat
+			}
+		}
+		return newCoder(c, in, f.sizes[out])
+	}
+	return nil, ErrFormat
+}
+
+func newCoder(c coder, in io.Reader, size uint64) (io.Reader, error) {
+	switch {
+	case bytes.Equal(c.id, methodCopy):
+		return in, nil
+	case bytes.Equal(c.id, methodLZMA):
+		p, err := lzma.DecodeProperties(c.props)
+		if err != nil {
+			return nil, ErrFormat
+		}
+		return lzma.NewRawReader(in, p, int64(size))
+	case bytes.Equal(c.id, methodLZMA2):
+		if len(c.props) != 1 {
+			return nil, ErrFormat
+		}
+		dictSize, err := lzma.DictSize2(c.props[0])
+		if err != nil {
+			return nil, ErrFormat
+		}
+		if uint64(dictSize) > size {
+			dictSize = uint32(size)
+		}
+		return lzma.NewReader2(in, dictSize), nil
+	case bytes.Equal(c.id, methodBCJ):
+		return newBCJReader(in, c.props)
+	case bytes.Equal(c.id, methodAES):
+		return nil, ErrEncrypted
+	}
+	return nil, ErrAlgorithm
+}
@@ -0,0 +1,687 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package sevenzip
+
+import (
+	"encoding/binary"
+	"time"
+	"unicode/utf16"
+)
+
+// property ids of the 7z header
+const (
+	idEnd = iota
+	idHeader
+	idArchiveProperties
+	idAdditionalStreamsInfo
+	idMainStreamsInfo
+	idFilesInfo
+	idPackInfo
+	idUnpackInfo
+	idSubStreamsInfo
+	idSize
+	idCRC
+	idFolder
+	idCodersUnpackSize
+	idNumUnpackStream
+	idEmptyStream
+	idEmptyFile
+	idAnti
+	idName
+	idCTime
+	idATime
+	idMTime
+	idWinAttributes
+	idComment
+	idEncodedHeader
+	idStartPos
+	idDummy
+)
+
+// maxCoderStreams limits the number of streams in a folder. 7-Zip itself
+// never uses more than four.
+const maxCoderStreams = 32
+
+type coder struct {
+	id     []byte
+	numIn  int
+	numOut int
+	props  []byte
+}
+
+type bindPair struct {
+	in, out int
+}
+
+// folder is a graph of coders decoding one or more packed streams into a
+// single output, which is the concatenation of the folder's substreams.
+type folder struct {
+	coders    []coder
+	bindPairs []bindPair
+	packed    []int    // coder input streams fed by packed streams
+	sizes     []uint64 // sizes of all coder output streams
+	crc       uint32
+	hasCRC    bool
+
+	packStart int // index of the folder's first packed stream
+}
+
+func (f *folder) numIn() int {
+	n := 0
+	for _, c := range f.coders {
+		n += c.numIn
+	}
+	return n
+}
+
+func (f *folder) numOut() int {
+	n := 0
+	for _, c := range f.coders {
+		n += c.numOut
+	}
+	return n
+}
+
+// mainOut returns the output stream that is not bound to a coder input.
+func (f *folder) mainOut() int {
+	for i := 0; i < f.numOut(); i++ {
+		bound := false
+		for _, bp := range f.bindPairs {
+			if bp.out == i {
+				bound = true
+				break
+			}
+		}
+		if !bound {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *folder) size() uint64 {
+	if i := f.mainOut(); i >= 0 {
+		return f.sizes[i]
+	}
+	return 0
+}
+
+type streamsInfo struct {
+	packPos   uint64
+	packSizes []uint64
+	folders   []*folder
+
+	// substreams, numStreams holds their number per folder
+	numStreams []int
+	sizes      []uint64
+	crcs       []uint32
+	hasCRC     []bool
+}
+
+type fileInfo struct {
+	name      string
+	hasStream bool
+	dir       bool
+	mtime     uint64
+	hasMTime  bool
+	attrib    uint32
+	hasAttrib bool
+}
+
+type header struct {
+	streams *streamsInfo
+	files   []fileInfo
+}
+
+// headerReader decodes the fields of a 7z header. Errors are sticky, once
+// the data is exhausted all reads return zero values.
+type headerReader struct {
+	b   []byte
+	err error
+}
+
+func (r *headerReader) fail() {
+	if r.err == nil {
+		r.err = ErrFormat
+	}
+	r.b = nil
+}
+
+func (r *headerReader) byte() byte {
+	if len(r.b) < 1 {
+		r.fail()
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *headerReader) bytes(n uint64) []byte {
+	if uint64(len(r.b)) < n {
+		r.fail()
+		return nil
+	}
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p
+}
+
+func (r *headerReader) uint32() uint32 {
+	p := r.bytes(4)
+	if p == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(p)
+}
+
+func (r *headerReader) uint64() uint64 {
+	p := r.bytes(8)
+	if p == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(p)
+}
+
+// number reads a variable length integer. The number of leading one bits
+// in the first byte gives the number of little endian bytes following it,
+// the remaining bits of the first byte are the most significant ones.
+func (r *headerReader) number() uint64 {
+	first := r.byte()
+	mask := byte(0x80)
+	var v uint64
+	for i := 0; i < 8; i++ {
+		if first&mask == 0 {
+			high := uint64(first & (mask - 1))
+			return v | high<<(8*uint(i))
+		}
+		v |= uint64(r.byte()) << (8 * uint(i))
+		mask >>= 1
+	}
+	return v
+}
+
+// count reads a number of items each taking at least one byte of the
+// header, which keeps corrupt headers from causing huge allocations.
+func (r *headerReader) count() int {
+	n := r.number()
+	if n > uint64(len(r.b)) {
+		r.fail()
+		return 0
+	}
+	return int(n)
+}
+
+func (r *headerReader) expect(id uint64) {
+	if r.number() != id {
+		r.fail()
+	}
+}
+
+func (r *headerReader) bitVector(n int) []bool {
+	v := make([]bool, n)
+	var b byte
+	for i := range v {
+		if i%8 == 0 {
+			b = r.byte()
+		}
+		v[i] = b&(0x80>>uint(i%8)) != 0
+	}
+	return v
+}
+
+// defined reads a vector telling which of n items are present, preceded
+// by a byte that is set if all of them are.
+func (r *headerReader) defined(n int) []bool {
+	if r.byte() == 0 {
+		return r.bitVector(n)
+	}
+	v := make([]bool, n)
+	for i := range v {
+		v[i] = true
+	}
+	return v
+}
+
+func (r *headerReader) digests(n int) ([]uint32, []bool) {
+	defined := r.defined(n)
+	crcs := make([]uint32, n)
+	for i, ok := range defined {
+		if ok {
+			crcs[i] = r.uint32()
+		}
+	}
+	return crcs, defined
+}
+
+func (r *headerReader) readPackInfo(si *streamsInfo) {
+	si.packPos = r.number()
+	n := r.count()
+	for {
+		id := r.number()
+		if id == idEnd || r.err != nil {
+			break
+		}
+		switch id {
+		case idSize:
+			si.packSizes = make([]uint64, n)
+			for i := range si.packSizes {
+				si.packSizes[i] = r.number()
+			}
+		case idCRC:
+			r.digests(n)
+		default:
+			r.skipProperty()
+		}
+	}
+	if len(si.packSizes) != n {
+		r.fail()
+	}
+}
+
+func (r *headerReader) readFolder() *folder {
+	f := new(folder)
+	n := r.count()
+	if n == 0 || n > maxCoderStreams {
+		r.fail()
+		return f
+	}
+	f.coders = make([]coder, n)
+	for i := range f.coders {
+		c := &f.coders[i]
+		flags := r.byte()
+		if flags&0x80 != 0 {
+			// alternative methods were never used by 7-Zip
+			r.fail()
+			return f
+		}
+		c.id = r.bytes(uint64(flags & 0x0f))
+		c.numIn, c.numOut = 1, 1
+		if flags&0x10 != 0 {
+			c.numIn = r.count()
+			c.numOut = r.count()
+		}
+		if flags&0x20 != 0 {
+			c.props = r.bytes(r.number())
+		}
+	}
+	numIn, numOut := f.numIn(), f.numOut()
+	if numOut == 0 || numIn > maxCoderStreams || numOut > maxCoderStreams {
+		r.fail()
+		return f
+	}
+
+	f.bindPairs = make([]bindPair, numOut-1)
+	for i := range f.bindPairs {
+		bp := &f.bindPairs[i]
+		bp.in = int(r.number())
+		bp.out = int(r.number())
+		if bp.in >= numIn || bp.out >= numOut {
+			r.fail()
+			return f
+		}
+	}
+
+	numPacked := numIn - len(f.bindPairs)
+	if numPacked < 1 {
+		r.fail()
+		return f
+	}
+	if numPacked == 1 {
+		for i := 0; i < numIn; i++ {
+			if f.bindIn(i) < 0 {
+				f.packed = []int{i}
+				break
+			}
+		}
+		if f.packed == nil {
+			r.fail()
+		}
+	} else {
+		f.packed = make([]int, numPacked)
+		for i := range f.packed {
+			f.packed[i] = int(r.number())
+			if f.packed[i] >= numIn {
+				r.fail()
+			}
+		}
+	}
+	return f
+}
+
+// bindIn returns the bind pair feeding the coder input stream in, or -1.
+func (f *folder) bindIn(in int) int {
+	for i, bp := range f.bindPairs {
+		if bp.in == in {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *headerReader) readUnpackInfo(si *streamsInfo) {
+	r.expect(idFolder)
+	n := r.count()
+	if r.byte() != 0 {
+		// folders stored in additional streams
+		r.fail()
+	}
+	si.folders = make([]*folder, n)
+	packStart := 0
+	for i := range si.folders {
+		if r.err != nil {
+			return
+		}
+		f := r.readFolder()
+		f.packStart = packStart
+		packStart += len(f.packed)
+		si.folders[i] = f
+	}
+
+	r.expect(idCodersUnpackSize)
+	for _, f := range si.folders {
+		if r.err != nil {
+			return
+		}
+		f.sizes = make([]uint64, f.numOut())
+		for j := range f.sizes {
+			f.sizes[j] = r.number()
+		}
+	}
+
+	for {
+		id := r.number()
+		if id == idEnd || r.err != nil {
+			break
+		}
+		switch id {
+		case idCRC:
+			crcs, defined := r.digests(n)
+			for i, f := range si.folders {
+				f.crc, f.hasCRC = crcs[i], defined[i]
+			}
+		default:
+			r.skipProperty()
+		}
+	}
+}
+
+func (r *headerReader) readSubStreamsInfo(si *streamsInfo) {
+	si.numStreams = make([]int, len(si.folders))
+	for i := range si.numStreams {
+		si.numStreams[i] = 1
+	}
+
+	id := r.number()
+	if id == idNumUnpackStream {
+		for i := range si.numStreams {
+			si.numStreams[i] = r.count()
+		}
+		id = r.number()
+	}
+
+	for i, f := range si.folders {
+		n := si.numStreams[i]
+		if n == 0 {
+			continue
+		}
+		total := f.size()
+		var sum uint64
+		if id == idSize {
+			for j := 1; j < n; j++ {
+				size := r.number()
+				si.sizes = append(si.sizes, size)
+				sum += size
+			}
+		} else if n > 1 {
+			r.fail()
+			return
+		}
+		if sum > total {
+			r.fail()
+			return
+		}
+		si.sizes = append(si.sizes, total-sum)
+	}
+	if id == idSize {
+		id = r.number()
+	}
+
+	si.crcs = make([]uint32, len(si.sizes))
+	si.hasCRC = make([]bool, len(si.sizes))
+	// folders holding a single stream with a known crc carry it
+	// themselves, digests follow for all other streams.
+	numDigests := 0
+	for i, f := range si.folders {
+		n := si.numStreams[i]
+		if n != 1 || !f.hasCRC {
+			numDigests += n
+		}
+	}
+	for id != idEnd && r.err == nil {
+		if id == idCRC {
+			crcs, defined := r.digests(numDigests)
+			k, j := 0, 0
+			for i, f := range si.folders {
+				n := si.numStreams[i]
+				if n == 1 && f.hasCRC {
+					k++
+					continue
+				}
+				for ; n > 0; n-- {
+					si.crcs[k], si.hasCRC[k] = crcs[j], defined[j]
+					k++
+					j++
+				}
+			}
+		} else {
+			r.skipProperty()
+		}
+		id = r.number()
+	}
+	k := 0
+	for i, f := range si.folders {
+		if si.numStreams[i] == 1 && f.hasCRC {
+			si.crcs[k], si.hasCRC[k] = f.crc, true
+		}
+		k += si.numStreams[i]
+	}
+}
+
+func (r *headerReader) readStreamsInfo() *streamsInfo {
+	si := new(streamsInfo)
+	for {
+		id := r.number()
+		if r.err != nil {
+			return si
+		}
+		switch id {
+		case idEnd:
+			if si.numStreams == nil {
+				r.readSubStreamsInfoDefault(si)
+			}
+			return si
+		case idPackInfo:
+			r.readPackInfo(si)
+		case idUnpackInfo:
+			r.readUnpackInfo(si)
+		case idSubStreamsInfo:
+			r.readSubStreamsInfo(si)
+		default:
+			r.fail()
+		}
+	}
+}
+
+// readSubStreamsInfoDefault sets up one stream per folder for archives
+// without substreams info.
+func (r *headerReader) readSubStreamsInfoDefault(si *streamsInfo) {
+	n := len(si.folders)
+	si.numStreams = make([]int, n)
+	si.sizes = make([]uint64, n)
+	si.crcs = make([]uint32, n)
+	si.hasCRC = make([]bool, n)
+	for i, f := range si.folders {
+		si.numStreams[i] = 1
+		si.sizes[i] = f.size()
+		si.crcs[i], si.hasCRC[i] = f.crc, f.hasCRC
+	}
+}
+
+// skipProperty skips a property whose data is preceded by its size.
+func (r *headerReader) skipProperty() {
+	r.bytes(r.number())
+}
+
+func (r *headerReader) readFilesInfo() []fileInfo {
+	files := make([]fileInfo, r.count())
+	for i := range files {
+		files[i].hasStream = true
+	}
+	var emptyStream, emptyFile []bool
+	numEmpty := 0
+
+	for {
+		id := r.number()
+		if id == idEnd || r.err != nil {
+			break
+		}
+		pr := &headerReader{b: r.bytes(r.number())}
+		switch id {
+		case idEmptyStream:
+			emptyStream = pr.bitVector(len(files))
+			numEmpty = 0
+			for _, e := range emptyStream {
+				if e {
+					numEmpty++
+				}
+			}
+		case idEmptyFile:
+			emptyFile = pr.bitVector(numEmpty)
+		case idName:
+			if pr.byte() != 0 {
+				r.fail()
+				break
+			}
+			for i := range files {
+				files[i].name = pr.name()
+			}
+		case idMTime:
+			defined := pr.defined(len(files))
+			if pr.byte() != 0 {
+				r.fail()
+				break
+			}
+			for i, ok := range defined {
+				if ok {
+					files[i].mtime, files[i].hasMTime = pr.uint64(), true
+				}
+			}
+		case idWinAttributes:
+			defined := pr.defined(len(files))
+			if pr.byte() != 0 {
+				r.fail()
+				break
+			}
+			for i, ok := range defined {
+				if ok {
+					files[i].attrib, files[i].hasAttrib = pr.uint32(), true
+				}
+			}
+		}
+		if pr.err != nil {
+			r.fail()
+		}
+	}
+
+	j := 0
+	for i, e := range emptyStream {
+		if !e {
+			continue
+		}
+		files[i].hasStream = false
+		files[i].dir = j >= len(emptyFile) || !emptyFile[j]
+		j++
+	}
+	return files
+}
+
+func (r *headerReader) name() string {
+	var u []uint16
+	for {
+		p := r.bytes(2)
+		if p == nil {
+			return ""
+		}
+		c := binary.LittleEndian.Uint16(p)
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+func (r *headerReader) readHeader() *header {
+	h := new(header)
+	id := r.number()
+	if id == idArchiveProperties {
+		for r.number() != idEnd && r.err == nil {
+			r.skipProperty()
+		}
+		id = r.number()
+	}
+	if id == idAdditionalStreamsInfo {
+		r.readStreamsInfo()
+		id = r.number()
+	}
+	if id == idMainStreamsInfo {
+		h.streams = r.readStreamsInfo()
+		id = r.number()
+	}
+	if id == idFilesInfo {
+		h.files = r.readFilesInfo()
+		id = r.number()
+	}
+	if id != idEnd {
+		r.fail()
+	}
+	return h
+}
+
+// filetime converts a Windows FILETIME, the number of 100ns intervals
+// since 1601, to a time.
+func filetime(ft uint64) time.Time {
+	const epochDiff = 11644473600 // seconds from 1601 to 1970
+	sec := int64(ft/1e7) - epochDiff
+	nsec := int64(ft%1e7) * 100
+	return time.Unix(sec, nsec).UTC()
+}
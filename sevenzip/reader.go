@@ -0,0 +1,422 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Package sevenzip implements reading of 7z archives.
+//
+// Supported are the Copy, LZMA, LZMA2 and BCJ (x86) coders, solid
+// folders and compressed headers. Encrypted archives and the BCJ2 and
+// other filters are not.
+package sevenzip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFormat    = errors.New("7z: not a valid 7z file")
+	ErrAlgorithm = errors.New("7z: unsupported compression method")
+	ErrEncrypted = errors.New("7z: encrypted archives are not supported")
+	ErrChecksum  = errors.New("7z: checksum error")
+
+	errClosed = errors.New("7z: read from closed file")
+)
+
+const (
+	signatureHeaderLen = 32
+
+	// maxHeaderSize limits the size of a compressed header.
+	maxHeaderSize = 1 << 28
+)
+
+var signature = []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}
+
+type Reader struct {
+	r       io.ReaderAt
+	File    []*File
+	streams *streamsInfo
+
+	// mu guards cache, the decoders of solid folders left positioned
+	// after the last file read from them.
+	mu    sync.Mutex
+	cache map[int]*folderReader
+}
+
+type ReadCloser struct {
+	f *os.File
+	Reader
+}
+
+// FileHeader describes a file within a 7z archive.
+type FileHeader struct {
+	// Name is the path of the file as stored in the archive.
+	Name string
+
+	Size       uint64
+	CRC32      uint32
+	HasCRC     bool
+	Modified   time.Time // zero if not stored
+	Attributes uint32    // Windows attributes, zero if not stored
+
+	dir bool
+}
+
+// IsDir reports whether the header describes a directory.
+func (h *FileHeader) IsDir() bool {
+	return h.dir
+}
+
+type File struct {
+	FileHeader
+	z      *Reader
+	folder int   // index of the folder holding the file, -1 if empty
+	offset int64 // offset of the file within the folder's output
+}
+
+// OpenReader will open the 7z file specified by name and return a ReadCloser.
+func OpenReader(name string) (*ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := new(ReadCloser)
+	if err := r.init(f, fi.Size()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.f = f
+	return r, nil
+}
+
+// NewReader returns a new Reader reading from r, which is assumed to
+// have the given size in bytes.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	zr := new(Reader)
+	if err := zr.init(r, size); err != nil {
+		return nil, err
+	}
+	return zr, nil
+}
+
+// Close closes the 7z file, rendering it unusable for I/O.
+func (rc *ReadCloser) Close() error {
+	return rc.f.Close()
+}
+
+func (z *Reader) init(r io.ReaderAt, size int64) error {
+	z.r = r
+	z.cache = make(map[int]*folderReader)
+
+	var buf [signatureHeaderLen]byte
+	if _, err := r.ReadAt(buf[:], 0); err != nil {
+		if err == io.EOF {
+			return ErrFormat
+		}
+		return err
+	}
+	if !bytes.Equal(buf[:6], signature) || buf[6] != 0 {
+		return ErrFormat
+	}
+	if crc32.ChecksumIEEE(buf[12:]) != binary.LittleEndian.Uint32(buf[8:]) {
+		return ErrFormat
+	}
+	offset := binary.LittleEndian.Uint64(buf[12:])
+	length := binary.LittleEndian.Uint64(buf[20:])
+	crc := binary.LittleEndian.Uint32(buf[28:])
+	if length == 0 {
+		return nil
+	}
+	if offset > uint64(size) || length > uint64(size)-offset ||
+		signatureHeaderLen+offset+length > uint64(size) {
+		return ErrFormat
+	}
+	data := make([]byte, length)
+	if _, err := r.ReadAt(data, int64(signatureHeaderLen+offset)); err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(data) != crc {
+		return ErrChecksum
+	}
+
+	hr := &headerReader{b: data}
+	id := hr.number()
+	for id == idEncodedHeader {
+		si := hr.readStreamsInfo()
+		if hr.err != nil {
+			return hr.err
+		}
+		var err error
+		if data, err = z.decodeHeader(si); err != nil {
+			return err
+		}
+		hr = &headerReader{b: data}
+		id = hr.number()
+	}
+	if id != idHeader {
+		return ErrFormat
+	}
+	h := hr.readHeader()
+	if hr.err != nil {
+		return hr.err
+	}
+	return z.initFiles(h)
+}
+
+// decodeHeader unpacks a header stored in the folders of si.
+func (z *Reader) decodeHeader(si *streamsInfo) ([]byte, error) {
+	if len(si.folders) == 0 {
+		return nil, ErrFormat
+	}
+	var data []byte
+	for i, f := range si.folders {
+		size := f.size()
+		if size > maxHeaderSize-uint64(len(data)) {
+			return nil, ErrFormat
+		}
+		r, err := newFolderReader(z.r, si, i)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if f.hasCRC && crc32.ChecksumIEEE(buf) != f.crc {
+			return nil, ErrChecksum
+		}
+		data = append(data, buf...)
+	}
+	return data, nil
+}
+
+func (z *Reader) initFiles(h *header) error {
+	si := h.streams
+	if si == nil {
+		si = new(streamsInfo)
+	}
+	z.streams = si
+	if err := si.check(); err != nil {
+		return err
+	}
+
+	// walk the substreams of all folders in order, handing them to the
+	// files that have data
+	folder, inFolder, stream := 0, 0, 0
+	var offset int64
+	z.File = make([]*File, 0, len(h.files))
+	for _, fi := range h.files {
+		f := &File{
+			FileHeader: FileHeader{
+				Name:       fi.name,
+				Attributes: fi.attrib,
+				dir:        fi.dir,
+			},
+			z:      z,
+			folder: -1,
+		}
+		if fi.hasMTime {
+			f.Modified = filetime(fi.mtime)
+		}
+		if fi.hasStream {
+			for folder < len(si.folders) && inFolder == si.numStreams[folder] {
+				folder++
+				inFolder = 0
+				offset = 0
+			}
+			if folder == len(si.folders) {
+				return ErrFormat
+			}
+			f.folder = folder
+			f.offset = offset
+			f.Size = si.sizes[stream]
+			f.CRC32, f.HasCRC = si.crcs[stream], si.hasCRC[stream]
+			offset += int64(f.Size)
+			inFolder++
+			stream++
+		}
+		z.File = append(z.File, f)
+	}
+	return nil
+}
+
+// check validates the sizes recorded in si against each other.
+func (si *streamsInfo) check() error {
+	numPacked := 0
+	for _, f := range si.folders {
+		numPacked += len(f.packed)
+	}
+	if numPacked > len(si.packSizes) || len(si.numStreams) != len(si.folders) {
+		return ErrFormat
+	}
+	end := si.packPos
+	for _, size := range si.packSizes {
+		end += size
+		if end < size || end > 1<<62 {
+			return ErrFormat
+		}
+	}
+	for _, f := range si.folders {
+		if f.mainOut() < 0 || f.size() > 1<<62 {
+			return ErrFormat
+		}
+	}
+	return nil
+}
+
+// Open returns a ReadCloser that provides access to the File's contents.
+// Multiple files may be read concurrently. Reading the files of a solid
+// folder in archive order decodes the folder only once.
+func (f *File) Open() (io.ReadCloser, error) {
+	if f.folder < 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	fr, err := f.z.folderReader(f.folder, f.offset)
+	if err != nil {
+		return nil, err
+	}
+	return &fileReader{
+		z:      f.z,
+		fr:     fr,
+		f:      f,
+		remain: int64(f.Size),
+		hash:   crc32.NewIEEE(),
+	}, nil
+}
+
+// folderReader is the decoded output of a folder positioned at pos.
+type folderReader struct {
+	folder int
+	r      io.Reader
+	pos    int64
+}
+
+// folderReader returns the output of folder i positioned at offset,
+// reusing a cached decoder that has not gone past it yet.
+func (z *Reader) folderReader(i int, offset int64) (*folderReader, error) {
+	z.mu.Lock()
+	fr := z.cache[i]
+	if fr != nil {
+		delete(z.cache, i)
+		if fr.pos > offset {
+			fr = nil
+		}
+	}
+	z.mu.Unlock()
+
+	if fr == nil {
+		r, err := newFolderReader(z.r, z.streams, i)
+		if err != nil {
+			return nil, err
+		}
+		fr = &folderReader{folder: i, r: r}
+	}
+	if fr.pos < offset {
+		n, err := io.CopyN(ioutil.Discard, fr.r, offset-fr.pos)
+		fr.pos += n
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return fr, nil
+}
+
+func (z *Reader) release(fr *folderReader) {
+	z.mu.Lock()
+	z.cache[fr.folder] = fr
+	z.mu.Unlock()
+}
+
+type fileReader struct {
+	z      *Reader
+	fr     *folderReader
+	f      *File
+	remain int64
+	hash   hash.Hash32
+	err    error // sticky error
+}
+
+func (r *fileReader) Read(b []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.remain == 0 {
+		r.err = io.EOF
+		if r.f.HasCRC && r.hash.Sum32() != r.f.CRC32 {
+			r.err = ErrChecksum
+		}
+		return 0, r.err
+	}
+	if int64(len(b)) > r.remain {
+		b = b[:r.remain]
+	}
+	n, err := r.fr.r.Read(b)
+	r.hash.Write(b[:n])
+	r.remain -= int64(n)
+	r.fr.pos += int64(n)
+	if err == io.EOF && r.remain > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, r.err
+}
+
+// Close hands the folder decoder back for reading the following files
+// unless reading failed.
+func (r *fileReader) Close() error {
+	if r.fr != nil && (r.err == nil || r.err == io.EOF) {
+		r.z.release(r.fr)
+	}
+	r.fr = nil
+	if r.err == nil {
+		r.err = errClosed
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package sevenzip
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type testEntry struct {
+	name string
+	sha1 string // empty for directories
+	dir  bool
+}
+
+// copy, lzma1 and lzma2 were written by bsdtar, bcj by a script putting
+// an x86 filtered and a second folder into an archive with a compressed
+// header.
+var (
+	bsdtarEntries = []testEntry{
+		{"set/a.bin", "a8540988f511c682d2af8392daa37742ba7a8258", false},
+		{"set/b.txt", "3b402cb23ef2177c82b0655df5d5338c7f5474c7", false},
+		{"set/sub/c.rom", "b9a6aeedd3162a6b42d7ab100b6685a5d99efcf8", false},
+		{"set/empty", "da39a3ee5e6b4b0d3255bfef95601890afd80709", false},
+		{"set/emptydir", "", true},
+		{"set/sub", "", true},
+		{"set", "", true},
+	}
+	bcjEntries = []testEntry{
+		{"prog.exe", "ceb04574485adc80155e69abd55dbd16e69cc8c3", false},
+		{"set/a.bin", "a8540988f511c682d2af8392daa37742ba7a8258", false},
+		{"set/b.txt", "3b402cb23ef2177c82b0655df5d5338c7f5474c7", false},
+		{"empty", "da39a3ee5e6b4b0d3255bfef95601890afd80709", false},
+		{"dir", "", true},
+	}
+	testArchives = map[string][]testEntry{
+		"copy.7z":  bsdtarEntries,
+		"lzma1.7z": bsdtarEntries,
+		"lzma2.7z": bsdtarEntries,
+		"bcj.7z":   bcjEntries,
+	}
+)
+
+func readAll(f *File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return "", err
+	}
+	if uint64(len(data)) != f.Size {
+		return "", io.ErrUnexpectedEOF
+	}
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func TestReader(t *testing.T) {
+	for name, entries := range testArchives {
+		zr, err := OpenReader(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(zr.File) != len(entries) {
+			t.Fatalf("%s: got %d files, want %d", name, len(zr.File), len(entries))
+		}
+		for i, f := range zr.File {
+			e := entries[i]
+			if f.Name != e.name || f.IsDir() != e.dir {
+				t.Errorf("%s: got file %s (dir %v), want %s (dir %v)", name, f.Name, f.IsDir(), e.name, e.dir)
+				continue
+			}
+			if e.dir {
+				continue
+			}
+			sum, err := readAll(f)
+			if err != nil {
+				t.Errorf("%s: reading %s failed: %v", name, f.Name, err)
+			} else if sum != e.sha1 {
+				t.Errorf("%s: %s has sha1 %s, want %s", name, f.Name, sum, e.sha1)
+			}
+		}
+		zr.Close()
+	}
+}
+
+func TestHeader(t *testing.T) {
+	zr, err := OpenReader(filepath.Join("testdata", "bcj.7z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	f := zr.File[1]
+	if !f.HasCRC || f.Size != 23159 {
+		t.Errorf("got size %d, crc %v for %s", f.Size, f.HasCRC, f.Name)
+	}
+	if got := f.Modified.Format("2006-01-02 15:04:05"); got != "2019-04-17 18:40:00" {
+		t.Errorf("got modification time %s for %s", got, f.Name)
+	}
+	if d := zr.File[4]; d.Attributes != 0x10 {
+		t.Errorf("got attributes %x for %s", d.Attributes, d.Name)
+	}
+}
+
+// TestSolid reads the files of solid folders out of order and
+// concurrently, which must not mix up the cached folder decoders.
+func TestSolid(t *testing.T) {
+	for name, entries := range testArchives {
+		zr, err := OpenReader(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for i := len(zr.File) - 1; i >= 0; i-- {
+			f := zr.File[i]
+			if f.IsDir() {
+				continue
+			}
+			sum, err := readAll(f)
+			if err != nil || sum != entries[i].sha1 {
+				t.Errorf("%s: reading %s backwards got %s, %v", name, f.Name, sum, err)
+			}
+		}
+
+		var wg sync.WaitGroup
+		for i, f := range zr.File {
+			if f.IsDir() {
+				continue
+			}
+			wg.Add(1)
+			go func(f *File, want string) {
+				defer wg.Done()
+				sum, err := readAll(f)
+				if err != nil || sum != want {
+					t.Errorf("%s: reading %s concurrently got %s, %v", name, f.Name, sum, err)
+				}
+			}(f, entries[i].sha1)
+		}
+		wg.Wait()
+		zr.Close()
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "copy.7z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewReader(bytes.NewReader(data[:20]), 20); err != ErrFormat {
+		t.Errorf("truncated signature header gave %v", err)
+	}
+
+	bad := append([]byte(nil), data...)
+	bad[len(bad)-5] ^= 1
+	if _, err := NewReader(bytes.NewReader(bad), int64(len(bad))); err != ErrChecksum {
+		t.Errorf("corrupt header gave %v", err)
+	}
+
+	bad = append([]byte(nil), data...)
+	bad[signatureHeaderLen+100] ^= 1
+	zr, err := NewReader(bytes.NewReader(bad), int64(len(bad)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAll(zr.File[0]); err != ErrChecksum {
+		t.Errorf("corrupt data gave %v", err)
+	}
+}
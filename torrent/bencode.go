@@ -0,0 +1,252 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+)
+
+var ErrBencode = errors.New("torrent: invalid bencoding")
+
+// maxNesting limits how deeply lists and dictionaries may nest, so that
+// decoding doesn't overflow the stack. v2 file trees nest a dictionary for
+// every directory level, which still leaves plenty of room.
+const maxNesting = 1000
+
+// Encode writes v bencoded to w. v may be an int, int64, uint64, string,
+// []byte, []interface{} or map[string]interface{}. Dictionary keys are
+// sorted by their raw bytes as bencoding requires.
+func Encode(w io.Writer, v interface{}) error {
+	bw := bufio.NewWriter(w)
+	if err := encode(bw, v); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Marshal returns the bencoding of v.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encode(bw *bufio.Writer, v interface{}) error {
+	switch v := v.(type) {
+	case int:
+		writeInt(bw, strconv.FormatInt(int64(v), 10))
+	case int64:
+		writeInt(bw, strconv.FormatInt(v, 10))
+	case uint64:
+		writeInt(bw, strconv.FormatUint(v, 10))
+	case string:
+		writeString(bw, v)
+	case []byte:
+		writeString(bw, string(v))
+	case []interface{}:
+		bw.WriteByte('l')
+		for _, e := range v {
+			if err := encode(bw, e); err != nil {
+				return err
+			}
+		}
+		bw.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		bw.WriteByte('d')
+		for _, k := range keys {
+			writeString(bw, k)
+			if err := encode(bw, v[k]); err != nil {
+				return err
+			}
+		}
+		bw.WriteByte('e')
+	default:
+		return fmt.Errorf("torrent: can't bencode %T", v)
+	}
+	return nil
+}
+
+func writeInt(bw *bufio.Writer, s string) {
+	bw.WriteByte('i')
+	bw.WriteString(s)
+	bw.WriteByte('e')
+}
+
+func writeString(bw *bufio.Writer, s string) {
+	bw.WriteString(strconv.Itoa(len(s)))
+	bw.WriteByte(':')
+	bw.WriteString(s)
+}
+
+// Decode reads a single bencoded value from r. Integers decode to int64,
+// strings to string, lists to []interface{} and dictionaries to
+// map[string]interface{}.
+func Decode(r io.Reader) (interface{}, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return Unmarshal(data)
+}
+
+// Unmarshal decodes the bencoded value in data, which must not be followed
+// by anything else.
+func Unmarshal(data []byte) (interface{}, error) {
+	d := &decoder{data: data}
+	v, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, ErrBencode
+	}
+	return v, nil
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+
+	// nesting counts the lists and dictionaries being decoded.
+	nesting int
+
+	// infoStart and infoEnd delimit the value of the "info" key of the
+	// outermost dictionary.
+	depth     int
+	infoStart int
+	infoEnd   int
+}
+
+func (d *decoder) value() (interface{}, error) {
+	if d.pos >= len(d.data) {
+		return nil, ErrBencode
+	}
+	if c := d.data[d.pos]; c == 'l' || c == 'd' {
+		if d.nesting == maxNesting {
+			return nil, ErrBencode
+		}
+		d.nesting++
+		defer func() { d.nesting-- }()
+	}
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		d.pos++
+		end := bytes.IndexByte(d.data[d.pos:], 'e')
+		if end < 0 {
+			return nil, ErrBencode
+		}
+		n, err := strconv.ParseInt(string(d.data[d.pos:d.pos+end]), 10, 64)
+		if err != nil {
+			return nil, ErrBencode
+		}
+		d.pos += end + 1
+		return n, nil
+	case c >= '0' && c <= '9':
+		return d.str()
+	case c == 'l':
+		d.pos++
+		list := []interface{}{}
+		for {
+			if d.pos >= len(d.data) {
+				return nil, ErrBencode
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return list, nil
+			}
+			v, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+	case c == 'd':
+		d.pos++
+		d.depth++
+		defer func() { d.depth-- }()
+		dict := map[string]interface{}{}
+		for {
+			if d.pos >= len(d.data) {
+				return nil, ErrBencode
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return dict, nil
+			}
+			k, err := d.str()
+			if err != nil {
+				return nil, err
+			}
+			start := d.pos
+			v, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			if d.depth == 1 && k == "info" {
+				d.infoStart, d.infoEnd = start, d.pos
+			}
+			dict[k] = v
+		}
+	}
+	return nil, ErrBencode
+}
+
+func (d *decoder) str() (string, error) {
+	colon := bytes.IndexByte(d.data[d.pos:], ':')
+	if colon < 0 {
+		return "", ErrBencode
+	}
+	n, err := strconv.Atoi(string(d.data[d.pos : d.pos+colon]))
+	if err != nil || n < 0 {
+		return "", ErrBencode
+	}
+	d.pos += colon + 1
+	if n > len(d.data)-d.pos {
+		return "", ErrBencode
+	}
+	s := string(d.data[d.pos : d.pos+n])
+	d.pos += n
+	return s, nil
+}
@@ -0,0 +1,604 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Package torrent creates BitTorrent metainfo files. It writes v1 torrents
+// (BEP 3) and optionally v2 or hybrid torrents (BEP 52) with per-file
+// merkle trees. Files are ordered by path so that the same tree always
+// produces the same torrent.
+package torrent
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Version selects the metainfo format to create.
+type Version int
+
+const (
+	V1     Version = iota // BEP 3 only
+	V2                    // BEP 52 only
+	Hybrid                // both, with the v1 files padded to piece boundaries
+)
+
+const (
+	blockSize      = 16 << 10
+	maxPieceLength = 16 << 20
+	targetPieces   = 1500
+
+	// pieceLengthLimit bounds the piece lengths of torrents that are
+	// created or loaded, since checking a piece holds it in memory.
+	pieceLengthLimit = 256 << 20
+)
+
+var ErrEmpty = errors.New("torrent: nothing to share")
+
+// Options controls how a torrent is created.
+type Options struct {
+	Version      Version
+	PieceLength  int64    // power of two from 16KB to 256MB, 0 picks one from the total size
+	Trackers     []string // the first one is the announce url, all of them form the announce-list
+	Comment      string
+	CreatedBy    string
+	CreationDate int64 // seconds since the epoch, 0 leaves it out
+	Private      bool
+	Workers      int // number of goroutines hashing pieces, 0 uses GOMAXPROCS
+}
+
+// File is a file shared by a torrent.
+type File struct {
+	Path       []string // path components relative to the torrent root
+	Length     int64
+	PiecesRoot []byte // v2 merkle root, nil for v1 torrents and empty files
+
+	disk string
+	pad  bool
+}
+
+// Torrent is a created torrent.
+type Torrent struct {
+	Name        string
+	PieceLength int64
+	Files       []*File
+	InfoHashV1  []byte // sha1 of the info dictionary, nil for v2 torrents
+	InfoHashV2  []byte // sha256 of the info dictionary, nil for v1 torrents
+
+	meta   map[string]interface{}
+	single bool              // the torrent shares a single file named Name
+	layout []*File           // v1 files including pad files, nil for v2 torrents
+	pieces []byte            // v1 piece hashes
+	layers map[string][]byte // v2 piece layers by pieces root
+}
+
+// Write writes the bencoded metainfo of t to w.
+func (t *Torrent) Write(w io.Writer) error {
+	return Encode(w, t.meta)
+}
+
+// Create hashes the file or directory tree at path and returns the
+// torrent sharing it. Only regular files are included.
+func Create(path string, opts *Options) (*Torrent, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	name, files, single, err := collect(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	for _, f := range files {
+		total += f.Length
+	}
+	if total == 0 {
+		return nil, ErrEmpty
+	}
+
+	pl := opts.PieceLength
+	if pl == 0 {
+		pl = pieceLength(total)
+	}
+	if !validPieceLength(pl) {
+		return nil, fmt.Errorf("torrent: piece length %d is not a power of two between %d and %d",
+			pl, blockSize, pieceLengthLimit)
+	}
+
+	t := &Torrent{
+		Name:        name,
+		PieceLength: pl,
+		Files:       files,
+		single:      single,
+	}
+
+	h := newHasher(files, pl, opts.Version)
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if err := h.run(workers); err != nil {
+		return nil, err
+	}
+
+	info := map[string]interface{}{
+		"name":         name,
+		"piece length": pl,
+	}
+	if opts.Private {
+		info["private"] = 1
+	}
+	t.meta = map[string]interface{}{}
+
+	if opts.Version != V2 {
+		for _, p := range h.v1 {
+			t.pieces = append(t.pieces, p...)
+		}
+		info["pieces"] = t.pieces
+		t.layout = v1Layout(files, pl, opts.Version == Hybrid)
+		if single {
+			info["length"] = files[0].Length
+		} else {
+			info["files"] = v1Files(t.layout)
+		}
+	}
+
+	if opts.Version != V1 {
+		t.layers = make(map[string][]byte)
+		layers := map[string]interface{}{}
+		tree := map[string]interface{}{}
+		for i, f := range files {
+			entry := map[string]interface{}{"length": f.Length}
+			if f.Length > 0 {
+				f.PiecesRoot = h.root(i)
+				entry["pieces root"] = f.PiecesRoot
+				if f.Length > pl {
+					var layer []byte
+					for _, p := range h.v2[i] {
+						layer = append(layer, p...)
+					}
+					layers[string(f.PiecesRoot)] = layer
+					t.layers[string(f.PiecesRoot)] = layer
+				}
+			}
+			addTree(tree, f.Path, entry)
+		}
+		info["meta version"] = 2
+		info["file tree"] = tree
+		t.meta["piece layers"] = layers
+	}
+
+	t.meta["info"] = info
+	if len(opts.Trackers) > 0 {
+		t.meta["announce"] = opts.Trackers[0]
+	}
+	if len(opts.Trackers) > 1 {
+		var tiers []interface{}
+		for _, tr := range opts.Trackers {
+			tiers = append(tiers, []interface{}{tr})
+		}
+		t.meta["announce-list"] = tiers
+	}
+	if opts.Comment != "" {
+		t.meta["comment"] = opts.Comment
+	}
+	if opts.CreatedBy != "" {
+		t.meta["created by"] = opts.CreatedBy
+	}
+	if opts.CreationDate != 0 {
+		t.meta["creation date"] = opts.CreationDate
+	}
+
+	bs, err := Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Version != V2 {
+		s := sha1.Sum(bs)
+		t.InfoHashV1 = s[:]
+	}
+	if opts.Version != V1 {
+		s := sha256.Sum256(bs)
+		t.InfoHashV2 = s[:]
+	}
+	return t, nil
+}
+
+// collect returns the torrent name and the regular files under root in
+// path order. single is true if root is a file itself.
+func collect(root string) (string, []*File, bool, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", nil, false, err
+	}
+	name := filepath.Base(abs)
+
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return "", nil, false, err
+	}
+	if !fi.IsDir() {
+		if !fi.Mode().IsRegular() {
+			return "", nil, false, fmt.Errorf("torrent: %s is not a regular file", root)
+		}
+		return name, []*File{{Path: []string{name}, Length: fi.Size(), disk: abs}}, true, nil
+	}
+
+	var files []*File
+	err = filepath.Walk(abs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(abs, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, &File{
+			Path:   strings.Split(filepath.ToSlash(rel), "/"),
+			Length: info.Size(),
+			disk:   path,
+		})
+		return nil
+	})
+	if err != nil {
+		return "", nil, false, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return lessPath(files[i].Path, files[j].Path)
+	})
+	return name, files, false, nil
+}
+
+// lessPath orders paths component by component, which is the order of the
+// keys in a v2 file tree.
+func lessPath(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// pieceLength picks the smallest power of two piece length that keeps the
+// number of pieces near targetPieces.
+func pieceLength(total int64) int64 {
+	pl := int64(blockSize)
+	for pl < maxPieceLength && total/pl > targetPieces {
+		pl *= 2
+	}
+	return pl
+}
+
+// validPieceLength reports whether pl is a power of two between blockSize
+// and pieceLengthLimit.
+func validPieceLength(pl int64) bool {
+	return pl >= blockSize && pl <= pieceLengthLimit && pl&(pl-1) == 0
+}
+
+// padLength returns the length of the pad file following file i in a
+// hybrid torrent, 0 if there is none.
+func padLength(files []*File, i int, pl int64) int64 {
+	if i == len(files)-1 || files[i].Length%pl == 0 {
+		return 0
+	}
+	return pl - files[i].Length%pl
+}
+
+// v1Layout returns the files of the v1 part of a torrent, with pad files
+// after each file that does not end on a piece boundary if pad is true.
+func v1Layout(files []*File, pl int64, pad bool) []*File {
+	var layout []*File
+	for i, f := range files {
+		layout = append(layout, f)
+		if !pad {
+			continue
+		}
+		if n := padLength(files, i, pl); n > 0 {
+			layout = append(layout, &File{
+				Path:   []string{".pad", strconv.FormatInt(n, 10)},
+				Length: n,
+				pad:    true,
+			})
+		}
+	}
+	return layout
+}
+
+func v1Files(layout []*File) []interface{} {
+	var list []interface{}
+	for _, f := range layout {
+		path := make([]interface{}, len(f.Path))
+		for j, c := range f.Path {
+			path[j] = c
+		}
+		e := map[string]interface{}{
+			"length": f.Length,
+			"path":   path,
+		}
+		if f.pad {
+			e["attr"] = "p"
+		}
+		list = append(list, e)
+	}
+	return list
+}
+
+func addTree(tree map[string]interface{}, path []string, entry map[string]interface{}) {
+	for _, c := range path[:len(path)-1] {
+		sub, ok := tree[c].(map[string]interface{})
+		if !ok {
+			sub = map[string]interface{}{}
+			tree[c] = sub
+		}
+		tree = sub
+	}
+	tree[path[len(path)-1]] = map[string]interface{}{"": entry}
+}
+
+// piece is a unit of work for the hashing goroutines.
+type piece struct {
+	v1    int   // index of the v1 piece, -1 if it has none
+	file  int   // index of the file for the v2 piece, -1 if it has none
+	index int   // index of the v2 piece within its file
+	pad   int64 // zero bytes to append for the v1 hash
+	data  []byte
+}
+
+type hasher struct {
+	files   []*File
+	pl      int64
+	version Version
+
+	v1     [][]byte   // v1 piece hashes
+	v2     [][][]byte // v2 piece layer of each file
+	leaves int        // v2 leaves per piece
+}
+
+// zeros pads the last piece of a file in hybrid torrents.
+var zeros [blockSize]byte
+
+func newHasher(files []*File, pl int64, version Version) *hasher {
+	h := &hasher{
+		files:   files,
+		pl:      pl,
+		version: version,
+		leaves:  int(pl / blockSize),
+	}
+
+	var n int64
+	if version == V1 {
+		var total int64
+		for _, f := range files {
+			total += f.Length
+		}
+		n = (total + pl - 1) / pl
+	} else {
+		h.v2 = make([][][]byte, len(files))
+		for i, f := range files {
+			np := (f.Length + pl - 1) / pl
+			h.v2[i] = make([][]byte, np)
+			n += np
+		}
+	}
+	if version != V2 {
+		h.v1 = make([][]byte, n)
+	}
+	return h
+}
+
+func (h *hasher) run(workers int) error {
+	jobs := make(chan *piece, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				h.hash(p)
+			}
+		}()
+	}
+
+	var err error
+	if h.version == V1 {
+		err = h.readStream(jobs)
+	} else {
+		err = h.readFiles(jobs)
+	}
+	close(jobs)
+	wg.Wait()
+	return err
+}
+
+// readStream cuts the concatenation of all files into pieces.
+func (h *hasher) readStream(jobs chan<- *piece) error {
+	buf := make([]byte, h.pl)
+	var n, index int
+	for _, f := range h.files {
+		fd, err := os.Open(f.disk)
+		if err != nil {
+			return err
+		}
+		var read int64
+		for read < f.Length {
+			want := int64(len(buf) - n)
+			if rest := f.Length - read; rest < want {
+				want = rest
+			}
+			m, err := io.ReadFull(fd, buf[n:n+int(want)])
+			read += int64(m)
+			n += m
+			if err != nil {
+				fd.Close()
+				return fmt.Errorf("torrent: reading %s failed: %v", f.disk, err)
+			}
+			if n == len(buf) {
+				jobs <- &piece{v1: index, file: -1, data: buf}
+				index++
+				buf = make([]byte, h.pl)
+				n = 0
+			}
+		}
+		fd.Close()
+	}
+	if n > 0 {
+		jobs <- &piece{v1: index, file: -1, data: buf[:n]}
+	}
+	return nil
+}
+
+// readFiles cuts every file into pieces of its own. In a hybrid torrent
+// the last piece of a file is followed by its pad file for the v1 hash.
+func (h *hasher) readFiles(jobs chan<- *piece) error {
+	index := 0
+	for i, f := range h.files {
+		if f.Length == 0 {
+			continue
+		}
+		fd, err := os.Open(f.disk)
+		if err != nil {
+			return err
+		}
+		for k := range h.v2[i] {
+			n := h.pl
+			if rest := f.Length - int64(k)*h.pl; rest < n {
+				n = rest
+			}
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(fd, buf); err != nil {
+				fd.Close()
+				return fmt.Errorf("torrent: reading %s failed: %v", f.disk, err)
+			}
+			p := &piece{v1: -1, file: i, index: k, data: buf}
+			if h.version == Hybrid {
+				p.v1 = index
+				index++
+				if k == len(h.v2[i])-1 {
+					p.pad = padLength(h.files, i, h.pl)
+				}
+			}
+			jobs <- p
+		}
+		fd.Close()
+	}
+	return nil
+}
+
+func (h *hasher) hash(p *piece) {
+	if p.v1 >= 0 {
+		s := sha1.New()
+		s.Write(p.data)
+		for n := p.pad; n > 0; n -= int64(len(zeros)) {
+			s.Write(zeros[:min(n, int64(len(zeros)))])
+		}
+		h.v1[p.v1] = s.Sum(nil)
+	}
+	if p.file >= 0 {
+		leaves := h.leaves
+		if len(h.v2[p.file]) == 1 {
+			leaves = nextPow2((len(p.data) + blockSize - 1) / blockSize)
+		}
+		h.v2[p.file][p.index] = blockRoot(p.data, leaves)
+	}
+}
+
+// root returns the v2 pieces root of file i.
+func (h *hasher) root(i int) []byte {
+	layer := h.v2[i]
+	if len(layer) == 1 {
+		return layer[0]
+	}
+	pad := blockRoot(nil, h.leaves)
+	nodes := make([][]byte, nextPow2(len(layer)))
+	for j := range nodes {
+		if j < len(layer) {
+			nodes[j] = layer[j]
+		} else {
+			nodes[j] = pad
+		}
+	}
+	return merkleRoot(nodes)
+}
+
+// blockRoot returns the root of the merkle tree over the 16KB blocks of
+// data, with zero hashes as leaves past its end.
+func blockRoot(data []byte, leaves int) []byte {
+	nodes := make([][]byte, leaves)
+	for i := range nodes {
+		off := i * blockSize
+		if off >= len(data) {
+			nodes[i] = make([]byte, sha256.Size)
+			continue
+		}
+		end := off + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		s := sha256.Sum256(data[off:end])
+		nodes[i] = s[:]
+	}
+	return merkleRoot(nodes)
+}
+
+// merkleRoot reduces nodes, whose number is a power of two, to their root.
+func merkleRoot(nodes [][]byte) []byte {
+	for len(nodes) > 1 {
+		next := make([][]byte, len(nodes)/2)
+		for i := range next {
+			s := sha256.New()
+			s.Write(nodes[2*i])
+			s.Write(nodes[2*i+1])
+			next[i] = s.Sum(nil)
+		}
+		nodes = next
+	}
+	return nodes[0]
+}
+
+func nextPow2(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrent
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// Load reads the .torrent file in r. It accepts v1, v2 and hybrid
+// torrents.
+func Load(r io.Reader) (*Torrent, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	d := &decoder{data: data}
+	v, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, ErrBencode
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("torrent: metainfo is not a dictionary")
+	}
+	info, ok := meta["info"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("torrent: metainfo has no info dictionary")
+	}
+	raw := data[d.infoStart:d.infoEnd]
+
+	name, _ := info["name"].(string)
+	if !validComponent(name) {
+		return nil, fmt.Errorf("torrent: invalid name %q", name)
+	}
+	pl, _ := info["piece length"].(int64)
+	if !validPieceLength(pl) {
+		return nil, fmt.Errorf("torrent: invalid piece length %d", pl)
+	}
+
+	t := &Torrent{
+		Name:        name,
+		PieceLength: pl,
+		meta:        meta,
+	}
+
+	pieces, v1 := info["pieces"].(string)
+	version, _ := info["meta version"].(int64)
+	v2 := version == 2
+	if !v1 && !v2 {
+		return nil, fmt.Errorf("torrent: info dictionary has neither pieces nor a v2 file tree")
+	}
+
+	if v1 {
+		if err := t.loadV1(info, pieces); err != nil {
+			return nil, err
+		}
+		s := sha1.Sum(raw)
+		t.InfoHashV1 = s[:]
+	}
+	if v2 {
+		if err := t.loadV2(meta, info, v1); err != nil {
+			return nil, err
+		}
+		s := sha256.Sum256(raw)
+		t.InfoHashV2 = s[:]
+	}
+	return t, nil
+}
+
+func (t *Torrent) loadV1(info map[string]interface{}, pieces string) error {
+	if len(pieces)%sha1.Size != 0 {
+		return fmt.Errorf("torrent: pieces length %d is not a multiple of %d", len(pieces), sha1.Size)
+	}
+	t.pieces = []byte(pieces)
+
+	if length, ok := info["length"].(int64); ok {
+		if length < 0 {
+			return fmt.Errorf("torrent: invalid length %d", length)
+		}
+		t.single = true
+		t.layout = []*File{{Path: []string{t.Name}, Length: length}}
+	} else {
+		list, ok := info["files"].([]interface{})
+		if !ok {
+			return fmt.Errorf("torrent: info dictionary has neither length nor files")
+		}
+		for _, e := range list {
+			f, err := loadFile(e)
+			if err != nil {
+				return err
+			}
+			t.layout = append(t.layout, f)
+		}
+	}
+
+	var total int64
+	for _, f := range t.layout {
+		total += f.Length
+		if !f.pad {
+			t.Files = append(t.Files, f)
+		}
+	}
+	if n := (total + t.PieceLength - 1) / t.PieceLength; n != int64(len(t.pieces)/sha1.Size) {
+		return fmt.Errorf("torrent: %d pieces for %d bytes", len(t.pieces)/sha1.Size, total)
+	}
+	return nil
+}
+
+func loadFile(e interface{}) (*File, error) {
+	m, ok := e.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("torrent: file entry is not a dictionary")
+	}
+	length, ok := m["length"].(int64)
+	if !ok || length < 0 {
+		return nil, fmt.Errorf("torrent: file entry has an invalid length")
+	}
+	list, _ := m["path"].([]interface{})
+	if len(list) == 0 {
+		return nil, fmt.Errorf("torrent: file entry has no path")
+	}
+	f := &File{Length: length}
+	for _, c := range list {
+		s, ok := c.(string)
+		if !ok || !validComponent(s) {
+			return nil, fmt.Errorf("torrent: invalid path component %v", c)
+		}
+		f.Path = append(f.Path, s)
+	}
+	attr, _ := m["attr"].(string)
+	f.pad = strings.IndexByte(attr, 'p') >= 0
+	return f, nil
+}
+
+func (t *Torrent) loadV2(meta, info map[string]interface{}, v1 bool) error {
+	tree, ok := info["file tree"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("torrent: v2 info dictionary has no file tree")
+	}
+	var files []*File
+	if err := walkTree(tree, nil, &files); err != nil {
+		return err
+	}
+
+	t.layers = make(map[string][]byte)
+	layers, _ := meta["piece layers"].(map[string]interface{})
+	for _, f := range files {
+		if f.Length <= t.PieceLength {
+			continue
+		}
+		layer, _ := layers[string(f.PiecesRoot)].(string)
+		n := (f.Length + t.PieceLength - 1) / t.PieceLength
+		if int64(len(layer)) != n*sha256.Size {
+			return fmt.Errorf("torrent: missing or invalid piece layer for %s", strings.Join(f.Path, "/"))
+		}
+		t.layers[string(f.PiecesRoot)] = []byte(layer)
+	}
+
+	if v1 {
+		if len(files) != len(t.Files) {
+			return fmt.Errorf("torrent: v1 and v2 file lists differ")
+		}
+		for i, f := range files {
+			if strings.Join(f.Path, "/") != strings.Join(t.Files[i].Path, "/") || f.Length != t.Files[i].Length {
+				return fmt.Errorf("torrent: v1 and v2 file lists differ at %s", strings.Join(f.Path, "/"))
+			}
+			t.Files[i].PiecesRoot = f.PiecesRoot
+		}
+		return nil
+	}
+
+	t.Files = files
+	t.single = len(files) == 1 && len(files[0].Path) == 1 && files[0].Path[0] == t.Name
+	return nil
+}
+
+// walkTree appends the files of a v2 file tree to files in key order.
+func walkTree(tree map[string]interface{}, path []string, files *[]*File) error {
+	keys := make([]string, 0, len(tree))
+	for k := range tree {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		node, ok := tree[k].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("torrent: invalid file tree node %q", k)
+		}
+		if k == "" {
+			return fmt.Errorf("torrent: empty name in file tree")
+		}
+		if !validComponent(k) {
+			return fmt.Errorf("torrent: invalid path component %q", k)
+		}
+		p := append(append([]string{}, path...), k)
+
+		if leaf, ok := node[""].(map[string]interface{}); ok {
+			length, ok := leaf["length"].(int64)
+			if !ok || length < 0 {
+				return fmt.Errorf("torrent: invalid length for %s", strings.Join(p, "/"))
+			}
+			f := &File{Path: p, Length: length}
+			if length > 0 {
+				root, _ := leaf["pieces root"].(string)
+				if len(root) != sha256.Size {
+					return fmt.Errorf("torrent: invalid pieces root for %s", strings.Join(p, "/"))
+				}
+				f.PiecesRoot = []byte(root)
+			}
+			*files = append(*files, f)
+			continue
+		}
+		if err := walkTree(node, p, files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validComponent reports whether s can safely be used as a file or
+// directory name.
+func validComponent(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, "/\\\x00")
+}
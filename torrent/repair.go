@@ -0,0 +1,225 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/uwedeportivo/torrentzip"
+	"github.com/uwedeportivo/torrentzip/czip"
+	"github.com/uwedeportivo/torrentzip/dat"
+	"github.com/uwedeportivo/torrentzip/rebuild"
+	"github.com/uwedeportivo/torrentzip/scanner"
+)
+
+// Repair methods.
+const (
+	MethodRezip   = "rezip"
+	MethodRebuild = "rebuild"
+)
+
+// RepairResult describes the attempt to repair a failing file.
+type RepairResult struct {
+	Path   string
+	Method string // method that fixed the file, empty if none did
+	Fixed  bool
+	Err    error
+}
+
+// Repairer fixes archives that fail the check of a torrent by
+// torrentzipping them again, or by rebuilding their set from a DAT if
+// that doesn't make their pieces pass.
+type Repairer struct {
+	Torrent *Torrent
+
+	// Dir holds the content of Torrent, as passed to Verify.
+	Dir string
+
+	// Dat is used to rebuild sets Rezip can't fix. It may be nil.
+	Dat *dat.Dat
+
+	// Sources are files and dirs used, next to the failing archive itself,
+	// to rebuild a set.
+	Sources []string
+
+	// NestedDepth is passed to torrentzip.Rezip.
+	NestedDepth int
+
+	// TempDir is the dir for temporary files of the rebuild. The
+	// repaired archives are written next to the ones they replace.
+	TempDir string
+
+	Workers int
+
+	games map[string]*dat.Game
+}
+
+// Repair tries to fix the files of report. A repaired file replaces the
+// failing one only if all pieces holding its data pass afterwards, which
+// can't happen for a piece shared with another failing file that isn't
+// fixed first.
+func (rp *Repairer) Repair(report *Report) []*RepairResult {
+	c := rp.Torrent.newChecker(rp.Dir)
+	if rp.Dat != nil {
+		rp.games = rp.Dat.GamesByName()
+	}
+
+	var results []*RepairResult
+	for _, fr := range report.Files {
+		res := &RepairResult{Path: fr.Path}
+		results = append(results, res)
+
+		var rezipErr error
+		if !fr.Missing {
+			ok, err := scanner.IsZip(fr.Path)
+			if err != nil {
+				res.Err = err
+				continue
+			}
+			if !ok {
+				res.Err = fmt.Errorf("not a zip archive")
+				continue
+			}
+			ok, rezipErr = rp.try(c, fr, rp.rezip)
+			if ok {
+				res.Fixed, res.Method = true, MethodRezip
+				continue
+			}
+		}
+
+		// a damaged archive makes Rezip fail, which is when a rebuild is
+		// needed most
+		res.Err = rezipErr
+		if rp.Dat != nil {
+			ok, err := rp.try(c, fr, rp.rebuild)
+			switch {
+			case ok:
+				res.Fixed, res.Method, res.Err = true, MethodRebuild, nil
+			case err != nil && rezipErr != nil:
+				res.Err = fmt.Errorf("rezip failed: %v; rebuild failed: %v", rezipErr, err)
+			case err != nil:
+				res.Err = err
+			}
+		}
+	}
+	return results
+}
+
+// try builds a candidate for fr with build and replaces fr with it if the
+// pieces of fr pass with the candidate in its place.
+func (rp *Repairer) try(c *checker, fr *FileReport, build func(*FileReport, string) (string, error)) (bool, error) {
+	dir := filepath.Dir(fr.Path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, err
+	}
+	tmpDir, err := ioutil.TempDir(dir, ".repair")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	candidate, err := build(fr, tmpDir)
+	if err != nil || candidate == "" {
+		return false, err
+	}
+	fi, err := os.Stat(candidate)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if fi.Size() != fr.File.Length {
+		return false, nil
+	}
+
+	orig := c.paths[fr.index]
+	c.paths[fr.index] = candidate
+	bad, err := c.check(c.piecesOf(fr.index), rp.Workers)
+	c.paths[fr.index] = orig
+	if err != nil || len(bad) > 0 {
+		return false, err
+	}
+	return true, os.Rename(candidate, fr.Path)
+}
+
+func (rp *Repairer) rezip(fr *FileReport, tmpDir string) (string, error) {
+	zr, err := czip.OpenReader(fr.Path)
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+
+	path := filepath.Join(tmpDir, filepath.Base(fr.Path))
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	err = torrentzip.Rezip(f, &zr.Reader, rp.NestedDepth)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// rebuild rebuilds the set named like fr from the readable entries of the
+// failing archive and the sources. It returns an empty path if the DAT has no such set.
+func (rp *Repairer) rebuild(fr *FileReport, tmpDir string) (string, error) {
+	g := rp.games[dat.SetName(fr.Path)]
+	if g == nil {
+		return "", nil
+	}
+
+	rb := &rebuild.Rebuilder{
+		Dat:     &dat.Dat{Header: rp.Dat.Header, Games: []*dat.Game{g}},
+		OutDir:  tmpDir,
+		TempDir: rp.TempDir,
+	}
+	sources := rp.Sources
+	if !fr.Missing {
+		sources = append([]string{fr.Path}, sources...)
+		rb.Damaged = []string{fr.Path}
+	}
+	report, err := rb.Rebuild(sources...)
+	if err != nil {
+		return "", err
+	}
+	if len(report.Sets) == 0 {
+		return "", nil
+	}
+	return report.Sets[0].Path, nil
+}
@@ -0,0 +1,306 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	v := map[string]interface{}{
+		"b": -3,
+		"a": []interface{}{"x", []byte("yz"), int64(42), uint64(7)},
+		"c": map[string]interface{}{},
+	}
+	bs, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "d1:al1:x2:yzi42ei7ee1:bi-3e1:cdee"
+	if string(bs) != want {
+		t.Fatalf("got %q, want %q", bs, want)
+	}
+
+	if _, err := Marshal(1.5); err == nil {
+		t.Fatalf("expected error encoding a float")
+	}
+}
+
+type testFile struct {
+	path string
+	size int
+}
+
+func writeTree(t *testing.T, files []testFile) (string, map[string][]byte) {
+	dir, err := ioutil.TempDir("", "torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "sets")
+
+	r := rand.New(rand.NewSource(1))
+	contents := make(map[string][]byte)
+	for _, tf := range files {
+		data := make([]byte, tf.size)
+		r.Read(data)
+		path := filepath.Join(root, filepath.FromSlash(tf.path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		contents[tf.path] = data
+	}
+	return dir, contents
+}
+
+func v1Pieces(data []byte, pl int) []byte {
+	var pieces []byte
+	for off := 0; off < len(data); off += pl {
+		end := off + pl
+		if end > len(data) {
+			end = len(data)
+		}
+		s := sha1.Sum(data[off:end])
+		pieces = append(pieces, s[:]...)
+	}
+	return pieces
+}
+
+// fullRoot computes the v2 pieces root straight from the blocks of data.
+func fullRoot(data []byte) []byte {
+	var nodes [][]byte
+	for off := 0; off < len(data); off += blockSize {
+		end := off + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		s := sha256.Sum256(data[off:end])
+		nodes = append(nodes, s[:])
+	}
+	for len(nodes)&(len(nodes)-1) != 0 {
+		nodes = append(nodes, make([]byte, sha256.Size))
+	}
+	for len(nodes) > 1 {
+		var next [][]byte
+		for i := 0; i < len(nodes); i += 2 {
+			s := sha256.Sum256(append(append([]byte{}, nodes[i]...), nodes[i+1]...))
+			next = append(next, s[:])
+		}
+		nodes = next
+	}
+	return nodes[0]
+}
+
+var treeFiles = []testFile{
+	{"sub/b.zip", 70000},
+	{"a.zip", 100000},
+	{"c.zip", 0},
+	{"sub.zip", 10000},
+	{"d.zip", 32768},
+}
+
+func TestCreateV1(t *testing.T) {
+	dir, contents := writeTree(t, treeFiles)
+	defer os.RemoveAll(dir)
+
+	tr, err := Create(filepath.Join(dir, "sets"), &Options{
+		PieceLength: 32 << 10,
+		Trackers:    []string{"http://a/announce", "http://b/announce"},
+		Comment:     "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	var stream []byte
+	for _, f := range tr.Files {
+		name := filepath.ToSlash(filepath.Join(f.Path...))
+		names = append(names, name)
+		stream = append(stream, contents[name]...)
+	}
+	want := []string{"a.zip", "c.zip", "d.zip", "sub/b.zip", "sub.zip"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("got files %v, want %v", names, want)
+	}
+
+	info := tr.meta["info"].(map[string]interface{})
+	if info["name"] != "sets" {
+		t.Fatalf("got name %v", info["name"])
+	}
+	if !bytes.Equal(info["pieces"].([]byte), v1Pieces(stream, 32<<10)) {
+		t.Fatalf("v1 pieces mismatch")
+	}
+	if _, ok := info["file tree"]; ok {
+		t.Fatalf("v1 torrent has a file tree")
+	}
+	if tr.meta["announce"] != "http://a/announce" || len(tr.meta["announce-list"].([]interface{})) != 2 {
+		t.Fatalf("trackers not set")
+	}
+
+	bs, err := Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sha1.Sum(bs)
+	if !bytes.Equal(tr.InfoHashV1, s[:]) || tr.InfoHashV2 != nil {
+		t.Fatalf("info hash mismatch")
+	}
+}
+
+func TestCreateHybrid(t *testing.T) {
+	dir, contents := writeTree(t, treeFiles)
+	defer os.RemoveAll(dir)
+
+	pl := 32 << 10
+	tr, err := Create(filepath.Join(dir, "sets"), &Options{
+		Version:     Hybrid,
+		PieceLength: int64(pl),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := tr.meta["info"].(map[string]interface{})
+	layers := tr.meta["piece layers"].(map[string]interface{})
+
+	var stream []byte
+	for i, f := range tr.Files {
+		name := filepath.ToSlash(filepath.Join(f.Path...))
+		data := contents[name]
+		stream = append(stream, data...)
+		if i < len(tr.Files)-1 && len(data)%pl != 0 {
+			stream = append(stream, make([]byte, pl-len(data)%pl)...)
+		}
+
+		if len(data) == 0 {
+			if f.PiecesRoot != nil {
+				t.Errorf("%s: empty file has a pieces root", name)
+			}
+			continue
+		}
+		if !bytes.Equal(f.PiecesRoot, fullRoot(data)) {
+			t.Errorf("%s: pieces root mismatch", name)
+		}
+		layer, ok := layers[string(f.PiecesRoot)]
+		if (len(data) > pl) != ok {
+			t.Errorf("%s: piece layer present %v", name, ok)
+		}
+		if ok && len(layer.([]byte)) != (len(data)+pl-1)/pl*sha256.Size {
+			t.Errorf("%s: piece layer has length %d", name, len(layer.([]byte)))
+		}
+	}
+	if !bytes.Equal(info["pieces"].([]byte), v1Pieces(stream, pl)) {
+		t.Fatalf("v1 pieces mismatch")
+	}
+
+	var pads int
+	for _, e := range info["files"].([]interface{}) {
+		if e.(map[string]interface{})["attr"] == "p" {
+			pads++
+		}
+	}
+	if pads != 2 {
+		t.Fatalf("got %d pad files, want 2", pads)
+	}
+
+	tree := info["file tree"].(map[string]interface{})
+	sub := tree["sub"].(map[string]interface{})
+	leaf := sub["b.zip"].(map[string]interface{})[""].(map[string]interface{})
+	if leaf["length"] != int64(70000) {
+		t.Fatalf("got file tree entry %v", leaf)
+	}
+	if info["meta version"] != 2 || tr.InfoHashV1 == nil || tr.InfoHashV2 == nil {
+		t.Fatalf("hybrid torrent is missing v2 fields")
+	}
+}
+
+func TestCreateDeterministic(t *testing.T) {
+	dir, _ := writeTree(t, treeFiles)
+	defer os.RemoveAll(dir)
+
+	var outs [][]byte
+	for _, workers := range []int{1, 4} {
+		for _, v := range []Version{V1, V2} {
+			tr, err := Create(filepath.Join(dir, "sets"), &Options{
+				Version:     v,
+				PieceLength: 16 << 10,
+				Workers:     workers,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := tr.Write(&buf); err != nil {
+				t.Fatal(err)
+			}
+			outs = append(outs, buf.Bytes())
+		}
+	}
+	if !bytes.Equal(outs[0], outs[2]) || !bytes.Equal(outs[1], outs[3]) {
+		t.Fatalf("output depends on the number of workers")
+	}
+}
+
+func TestCreateSingleFile(t *testing.T) {
+	dir, contents := writeTree(t, []testFile{{"a.zip", 50000}})
+	defer os.RemoveAll(dir)
+
+	tr, err := Create(filepath.Join(dir, "sets", "a.zip"), &Options{Version: Hybrid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := tr.meta["info"].(map[string]interface{})
+	if info["name"] != "a.zip" || info["length"] != int64(50000) {
+		t.Fatalf("got info %v", info)
+	}
+	tree := info["file tree"].(map[string]interface{})
+	if _, ok := tree["a.zip"]; !ok {
+		t.Fatalf("file tree missing a.zip")
+	}
+	if !bytes.Equal(tr.Files[0].PiecesRoot, fullRoot(contents["a.zip"])) {
+		t.Fatalf("pieces root mismatch")
+	}
+
+	if _, err := Create(filepath.Join(dir, "sets"), &Options{PieceLength: 1000}); err == nil {
+		t.Fatalf("expected error for piece length 1000")
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// FileReport describes a file that fails the check of a torrent.
+type FileReport struct {
+	File    *File
+	Path    string // path of the file on disk
+	Missing bool
+	Size    int64 // size of the file on disk
+	Bad     []int // failing pieces holding data of the file
+
+	index int
+}
+
+// Report is the result of checking files against a torrent.
+type Report struct {
+	Pieces int           // number of pieces checked
+	Bad    []int         // failing pieces in ascending order
+	Files  []*FileReport // failing files in torrent order
+}
+
+// Verify checks the pieces of t against the files in dir, which holds
+// the file of a single file torrent or the directory named t.Name of a
+// multi file torrent. The pieces of v1 and hybrid torrents are checked
+// with their v1 hashes, those of v2 torrents with their piece layers.
+// Missing and short files read as zeros. A file fails if it is missing,
+// has the wrong size or holds data of a failing piece.
+func (t *Torrent) Verify(dir string, workers int) (*Report, error) {
+	c := t.newChecker(dir)
+
+	all := make([]int, c.n)
+	for i := range all {
+		all[i] = i
+	}
+	bad, err := c.check(all, workers)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Report{
+		Pieces: c.n,
+		Bad:    bad,
+	}
+	byFile := make(map[int][]int)
+	for _, p := range bad {
+		for _, s := range c.segments(p) {
+			byFile[s.file] = append(byFile[s.file], p)
+		}
+	}
+	for i, f := range c.files {
+		if f.pad {
+			continue
+		}
+		fr := &FileReport{
+			File:  f,
+			Path:  c.paths[i],
+			Size:  -1,
+			Bad:   byFile[i],
+			index: i,
+		}
+		fi, err := os.Stat(fr.Path)
+		switch {
+		case os.IsNotExist(err):
+			fr.Missing = true
+		case err != nil:
+			return nil, err
+		default:
+			fr.Size = fi.Size()
+		}
+		if fr.Missing || fr.Size != f.Length || len(fr.Bad) > 0 {
+			r.Files = append(r.Files, fr)
+		}
+	}
+	return r, nil
+}
+
+// segment is the part of a file that belongs to a piece.
+type segment struct {
+	file   int
+	off, n int64
+}
+
+// checker hashes pieces from files on disk.
+type checker struct {
+	t     *Torrent
+	v1    bool
+	files []*File  // t.layout for v1 hashes, t.Files for v2 hashes
+	paths []string // paths on disk of files
+	n     int      // number of pieces
+
+	offsets []int64 // v1: offset of each file in the concatenation of all files
+	first   []int   // v2: index of the first piece of each file
+}
+
+func (t *Torrent) newChecker(dir string) *checker {
+	c := &checker{t: t, v1: t.pieces != nil}
+	if c.v1 {
+		c.files = t.layout
+		c.n = len(t.pieces) / sha1.Size
+	} else {
+		c.files = t.Files
+	}
+
+	root := filepath.Join(dir, t.Name)
+	if t.single {
+		root = dir
+	}
+	c.paths = make([]string, len(c.files))
+	var off int64
+	for i, f := range c.files {
+		if !f.pad {
+			c.paths[i] = filepath.Join(root, filepath.Join(f.Path...))
+		}
+		if c.v1 {
+			c.offsets = append(c.offsets, off)
+			off += f.Length
+		} else {
+			c.first = append(c.first, c.n)
+			c.n += int((f.Length + t.PieceLength - 1) / t.PieceLength)
+		}
+	}
+	return c
+}
+
+// segments returns the parts of files that make up piece p.
+func (c *checker) segments(p int) []segment {
+	pl := c.t.PieceLength
+	if !c.v1 {
+		i := sort.Search(len(c.first), func(i int) bool { return c.first[i] > p }) - 1
+		off := int64(p-c.first[i]) * pl
+		n := c.files[i].Length - off
+		if n > pl {
+			n = pl
+		}
+		return []segment{{file: i, off: off, n: n}}
+	}
+
+	start := int64(p) * pl
+	end := start + pl
+	var segs []segment
+	i := sort.Search(len(c.offsets), func(i int) bool { return c.offsets[i] > start }) - 1
+	for ; i < len(c.files) && c.offsets[i] < end; i++ {
+		fstart, fend := c.offsets[i], c.offsets[i]+c.files[i].Length
+		if fend <= start {
+			continue
+		}
+		s, e := start, end
+		if fstart > s {
+			s = fstart
+		}
+		if fend < e {
+			e = fend
+		}
+		segs = append(segs, segment{file: i, off: s - fstart, n: e - s})
+	}
+	return segs
+}
+
+// piecesOf returns the pieces holding data of file i.
+func (c *checker) piecesOf(i int) []int {
+	f := c.files[i]
+	if f.Length == 0 {
+		return nil
+	}
+	pl := c.t.PieceLength
+	if !c.v1 {
+		var ps []int
+		for p := c.first[i]; int64(p-c.first[i])*pl < f.Length; p++ {
+			ps = append(ps, p)
+		}
+		return ps
+	}
+	var ps []int
+	for p := c.offsets[i] / pl; p*pl < c.offsets[i]+f.Length; p++ {
+		ps = append(ps, int(p))
+	}
+	return ps
+}
+
+// check hashes the given pieces and returns the failing ones in
+// ascending order.
+func (c *checker) check(pieces []int, workers int) ([]int, error) {
+	if workers <= 0 {
+		workers = 1
+	}
+	jobs := make(chan int)
+	results := make([]bool, len(pieces))
+	var firstErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				ok, err := c.checkPiece(pieces[j])
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+				results[j] = ok
+			}
+		}()
+	}
+	for j := range pieces {
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	var bad []int
+	for j, ok := range results {
+		if !ok {
+			bad = append(bad, pieces[j])
+		}
+	}
+	sort.Ints(bad)
+	return bad, nil
+}
+
+func (c *checker) checkPiece(p int) (bool, error) {
+	segs := c.segments(p)
+	var size int64
+	for _, s := range segs {
+		size += s.n
+	}
+	data := make([]byte, size)
+	var pos int64
+	for _, s := range segs {
+		if err := c.read(s, data[pos:pos+s.n]); err != nil {
+			return false, err
+		}
+		pos += s.n
+	}
+
+	if c.v1 {
+		sum := sha1.Sum(data)
+		return bytes.Equal(sum[:], c.t.pieces[p*sha1.Size:(p+1)*sha1.Size]), nil
+	}
+
+	f := c.files[segs[0].file]
+	if f.Length <= c.t.PieceLength {
+		leaves := nextPow2(int((f.Length + blockSize - 1) / blockSize))
+		return bytes.Equal(blockRoot(data, leaves), f.PiecesRoot), nil
+	}
+	k := p - c.first[segs[0].file]
+	layer := c.t.layers[string(f.PiecesRoot)]
+	want := layer[k*sha256.Size : (k+1)*sha256.Size]
+	return bytes.Equal(blockRoot(data, int(c.t.PieceLength/blockSize)), want), nil
+}
+
+// read fills buf with the data of s. Pad files, missing files and the
+// part of s past the end of a short file read as zeros.
+func (c *checker) read(s segment, buf []byte) error {
+	path := c.paths[s.file]
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.ReadAt(buf, s.off)
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
@@ -0,0 +1,323 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrent
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip"
+	"github.com/uwedeportivo/torrentzip/dat"
+)
+
+func TestUnmarshal(t *testing.T) {
+	v, err := Unmarshal([]byte("d1:al1:x2:yzi42ee1:bi-3e1:cdee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"a": []interface{}{"x", "yz", int64(42)},
+		"b": int64(-3),
+		"c": map[string]interface{}{},
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Fatalf("got %v, want %v", v, want)
+	}
+
+	for _, s := range []string{"", "i12", "5:abc", "l", "d1:a", "di1ei2ee", "ie", "1:ab", "-1:"} {
+		if _, err := Unmarshal([]byte(s)); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+	nested := strings.Repeat("l", maxNesting) + strings.Repeat("e", maxNesting)
+	if _, err := Unmarshal([]byte(nested)); err != nil {
+		t.Errorf("lists nested %d deep: %v", maxNesting, err)
+	}
+	nested = strings.Repeat("l", maxNesting+1) + strings.Repeat("e", maxNesting+1)
+	if _, err := Unmarshal([]byte(nested)); err != ErrBencode {
+		t.Errorf("lists nested %d deep returned %v, want %v", maxNesting+1, err, ErrBencode)
+	}
+	if _, err := Unmarshal([]byte(strings.Repeat("d1:a", 1<<20))); err != ErrBencode {
+		t.Errorf("deeply nested dictionaries returned %v, want %v", err, ErrBencode)
+	}
+}
+
+func createLoad(t *testing.T, path string, opts *Options) (*Torrent, *Torrent) {
+	tr, err := Create(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := tr.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lt, err := Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr, lt
+}
+
+func TestLoad(t *testing.T) {
+	dir, _ := writeTree(t, treeFiles)
+	defer os.RemoveAll(dir)
+
+	for _, v := range []Version{V1, V2, Hybrid} {
+		tr, lt := createLoad(t, filepath.Join(dir, "sets"), &Options{Version: v, PieceLength: 32 << 10})
+		if !bytes.Equal(tr.InfoHashV1, lt.InfoHashV1) || !bytes.Equal(tr.InfoHashV2, lt.InfoHashV2) {
+			t.Errorf("version %d: info hashes differ after loading", v)
+		}
+		if lt.Name != "sets" || lt.PieceLength != 32<<10 || lt.single {
+			t.Errorf("version %d: got name %s, piece length %d", v, lt.Name, lt.PieceLength)
+		}
+		if len(lt.Files) != len(tr.Files) {
+			t.Fatalf("version %d: got %d files, want %d", v, len(lt.Files), len(tr.Files))
+		}
+		for i, f := range lt.Files {
+			g := tr.Files[i]
+			if !reflect.DeepEqual(f.Path, g.Path) || f.Length != g.Length || !bytes.Equal(f.PiecesRoot, g.PiecesRoot) {
+				t.Errorf("version %d: file %d is %v, want %v", v, i, f, g)
+			}
+		}
+		if !bytes.Equal(lt.pieces, tr.pieces) || len(lt.layout) != len(tr.layout) || len(lt.layers) != len(tr.layers) {
+			t.Errorf("version %d: hashes differ after loading", v)
+		}
+	}
+
+	_, lt := createLoad(t, filepath.Join(dir, "sets", "a.zip"), &Options{Version: V2})
+	if !lt.single || lt.Files[0].Path[0] != "a.zip" {
+		t.Errorf("single file v2 torrent not recognized")
+	}
+
+	if _, err := Load(bytes.NewReader([]byte("d4:infod4:name2:..12:piece lengthi16384e6:pieces0:6:lengthi0eee"))); err == nil {
+		t.Errorf("expected error for name ..")
+	}
+
+	for _, pl := range []int64{0, -16384, 1000, 8192, 3 << 14, 1 << 30} {
+		info := fmt.Sprintf("d4:infod4:name1:a12:piece lengthi%de6:pieces0:6:lengthi0eee", pl)
+		if _, err := Load(strings.NewReader(info)); err == nil {
+			t.Errorf("expected error for piece length %d", pl)
+		}
+	}
+	if _, err := Load(strings.NewReader("d4:infod4:name1:a12:piece lengthi16384e6:pieces0:6:lengthi0eee")); err != nil {
+		t.Errorf("piece length 16384: %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, v := range []Version{V1, V2, Hybrid} {
+		dir, contents := writeTree(t, treeFiles)
+
+		_, lt := createLoad(t, filepath.Join(dir, "sets"), &Options{Version: v, PieceLength: 16 << 10})
+		r, err := lt.Verify(dir, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Bad) != 0 || len(r.Files) != 0 {
+			t.Fatalf("version %d: got %d bad pieces and %d bad files on intact tree", v, len(r.Bad), len(r.Files))
+		}
+
+		data := contents["sub/b.zip"]
+		data[40000] ^= 0xff
+		if err := ioutil.WriteFile(filepath.Join(dir, "sets", "sub", "b.zip"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(filepath.Join(dir, "sets", "d.zip")); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err = lt.Verify(dir, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// v1 pieces span file boundaries, so the neighbours of the
+		// failing files fail as well.
+		byPath := make(map[string]*FileReport)
+		for _, fr := range r.Files {
+			byPath[filepath.ToSlash(filepath.Join(fr.File.Path...))] = fr
+		}
+		if v != V1 && len(r.Files) != 2 {
+			t.Fatalf("version %d: got %d bad files, want 2", v, len(r.Files))
+		}
+		if d := byPath["d.zip"]; d == nil || !d.Missing || len(d.Bad) < 2 {
+			t.Errorf("version %d: got report %+v for d.zip", v, d)
+		}
+		if b := byPath["sub/b.zip"]; b == nil || b.Missing || b.Size != 70000 || len(b.Bad) == 0 {
+			t.Errorf("version %d: got report %+v for sub/b.zip", v, b)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+type testEntry struct {
+	name    string
+	content []byte
+}
+
+var setEntries = []testEntry{
+	{"a.bin", bytes.Repeat([]byte("torrentzip repair "), 3000)},
+	{"b.bin", []byte("second entry")},
+}
+
+func writeTorrentzip(t *testing.T, path string, entries []testEntry) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw, err := torrentzip.NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writePlainZip(t *testing.T, path string, entries []testEntry) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "sets")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTorrentzip(t, filepath.Join(root, "game1.zip"), setEntries)
+	writeTorrentzip(t, filepath.Join(root, "game2.zip"), setEntries[1:])
+	writeTorrentzip(t, filepath.Join(root, "game3.zip"), setEntries)
+
+	_, lt := createLoad(t, root, &Options{Version: Hybrid})
+
+	// flip a byte in the compressed data of a.bin, the first entry
+	game3, err := ioutil.ReadFile(filepath.Join(root, "game3.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	game3[40] ^= 0xff
+	if err := ioutil.WriteFile(filepath.Join(root, "game3.zip"), game3, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	writePlainZip(t, filepath.Join(root, "game1.zip"), setEntries)
+	if err := os.Remove(filepath.Join(root, "game2.zip")); err != nil {
+		t.Fatal(err)
+	}
+	srcDir := filepath.Join(dir, "src")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range setEntries {
+		if err := ioutil.WriteFile(filepath.Join(srcDir, fmt.Sprint("loose", i)), e.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := lt.Verify(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Files) != 3 {
+		t.Fatalf("got %d bad files, want 3", len(r.Files))
+	}
+
+	var roms []*dat.Rom
+	for _, e := range setEntries {
+		roms = append(roms, &dat.Rom{
+			Name: e.name,
+			Size: uint64(len(e.content)),
+			CRC:  dat.CRC(crc32.ChecksumIEEE(e.content)),
+		})
+	}
+	rp := &Repairer{
+		Torrent: lt,
+		Dir:     dir,
+		Dat: &dat.Dat{Games: []*dat.Game{
+			{Name: "game2", Roms: roms[1:]},
+			{Name: "game3", Roms: roms},
+		}},
+		Sources: []string{srcDir},
+		Workers: 2,
+	}
+	results := rp.Repair(r)
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	for i, want := range []string{MethodRezip, MethodRebuild, MethodRebuild} {
+		if res := results[i]; !res.Fixed || res.Method != want || res.Err != nil {
+			t.Errorf("got result %+v, want fixed by %s", res, want)
+		}
+	}
+
+	r, err = lt.Verify(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Bad) != 0 || len(r.Files) != 0 {
+		t.Fatalf("got %d bad pieces and %d bad files after repair", len(r.Bad), len(r.Files))
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package torrentgz reads and writes TorrentGZ files, the gzip files
+RomVault and romba keep in their depots.
+
+A TorrentGZ file is a single member gzip file with a fixed header whose
+FEXTRA field holds the MD5, CRC32 and uncompressed size of the content, so
+that the metadata can be read without decompressing anything. The deflate
+stream is made by zlib with the same parameters torrentzip uses, which
+makes the output deterministic:
+
+	ID1 ID2 CM FLG     0x1f 0x8b 0x08 0x04 (FEXTRA)
+	MTIME              0x00000000
+	XFL OS             0x00 0xff
+	XLEN               28
+	MD5                16 bytes
+	CRC32              4 bytes, big endian
+	size               8 bytes, little endian
+	deflate stream
+	CRC32 ISIZE        gzip trailer
+
+The header is written by hand rather than with cgzip's SetExtraHeader,
+since zlib then writes XFL 2 for level 9 and an OS byte cgzip has no way
+to set, neither of which matches RomVault. For the same reason the header
+is read with torrentzip.ReadGzipHeader: cgzip's GetExtraHeader only has
+the extra field once decompression has started, and it can't tell
+whether the rest of the header is the fixed one.
+*/
+package torrentgz
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/uwedeportivo/torrentzip"
+	"github.com/uwedeportivo/torrentzip/cgzip"
+	"github.com/uwedeportivo/torrentzip/zlib"
+)
+
+const (
+	extraLen  = md5.Size + crc32.Size + 8
+	osUnknown = 0xff
+)
+
+var (
+	ErrFormat   = errors.New("torrentgz: not a valid torrentgz file")
+	ErrChecksum = errors.New("torrentgz: checksum error")
+)
+
+// Info is the metadata of the content of a TorrentGZ file.
+type Info struct {
+	MD5   []byte
+	CRC32 uint32
+	Size  uint64
+
+	// SHA1 is not part of the header. It is only set by Write and Verify,
+	// which see all of the content.
+	SHA1 []byte
+}
+
+func (info *Info) extra() []byte {
+	buf := make([]byte, extraLen)
+	copy(buf, info.MD5)
+	binary.BigEndian.PutUint32(buf[md5.Size:], info.CRC32)
+	binary.LittleEndian.PutUint64(buf[md5.Size+crc32.Size:], info.Size)
+	return buf
+}
+
+func parseExtra(extra []byte) (*Info, error) {
+	if len(extra) != extraLen {
+		return nil, ErrFormat
+	}
+	return &Info{
+		MD5:   append([]byte(nil), extra[:md5.Size]...),
+		CRC32: binary.BigEndian.Uint32(extra[md5.Size:]),
+		Size:  binary.LittleEndian.Uint64(extra[md5.Size+crc32.Size:]),
+	}, nil
+}
+
+type countWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+// Write compresses the content read from r and writes it to w as a
+// TorrentGZ file. Since the header precedes the compressed data, the
+// compressed data is staged in a temp file in tempDir (or the default
+// directory for temp files if tempDir is empty).
+func Write(w io.Writer, r io.Reader, tempDir string) (*Info, error) {
+	tf, err := ioutil.TempFile(tempDir, "torrentgz")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tf.Name())
+	defer tf.Close()
+
+	bf := bufio.NewWriter(tf)
+	cw := &countWriter{w: bf}
+	zw, err := zlib.NewWriterLevel(cw, zlib.Z_BEST_COMPRESSION)
+	if err != nil {
+		return nil, err
+	}
+
+	md5h := md5.New()
+	sha1h := sha1.New()
+	crch := crc32.NewIEEE()
+	size, err := io.Copy(io.MultiWriter(zw, md5h, sha1h, crch), r)
+	if err != nil {
+		zw.Close()
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if err := bf.Flush(); err != nil {
+		return nil, err
+	}
+
+	info := &Info{
+		MD5:   md5h.Sum(nil),
+		CRC32: crch.Sum32(),
+		Size:  uint64(size),
+		SHA1:  sha1h.Sum(nil),
+	}
+
+	h := &torrentzip.GzipHeader{
+		OS:    osUnknown,
+		Extra: info.extra(),
+	}
+	if err := torrentzip.WriteGzipHeader(w, h); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, io.NewSectionReader(tf, 0, cw.count)); err != nil {
+		return nil, err
+	}
+
+	var buf [8]byte
+	binary.LittleEndian.PutUint32(buf[:4], info.CRC32)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(info.Size))
+	if _, err := w.Write(buf[:]); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ReadInfo reads the metadata from the header of the TorrentGZ file read
+// by r without decompressing anything.
+func ReadInfo(r io.Reader) (*Info, error) {
+	h, _, err := torrentzip.ReadGzipHeader(r)
+	if err == torrentzip.ErrGzipFormat || err == io.ErrUnexpectedEOF {
+		return nil, ErrFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	if h.Name != "" || h.Comment != "" || h.MTime != 0 {
+		return nil, ErrFormat
+	}
+	return parseExtra(h.Extra)
+}
+
+// Verify decompresses the TorrentGZ file read by r and checks its content
+// against the metadata in its header. It returns the metadata including
+// the SHA1 of the content, and ErrChecksum if the content does not match.
+func Verify(r io.Reader) (*Info, error) {
+	var hbuf bytes.Buffer
+	info, err := ReadInfo(io.TeeReader(r, &hbuf))
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := cgzip.NewReader(io.MultiReader(&hbuf, r))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	md5h := md5.New()
+	sha1h := sha1.New()
+	crch := crc32.NewIEEE()
+	size, err := io.Copy(io.MultiWriter(md5h, sha1h, crch), zr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(md5h.Sum(nil), info.MD5) || crch.Sum32() != info.CRC32 || uint64(size) != info.Size {
+		return nil, ErrChecksum
+	}
+	info.SHA1 = sha1h.Sum(nil)
+	return info, nil
+}
+
+// Open returns a ReadCloser that provides access to the decompressed
+// content of the TorrentGZ file read by r, along with the metadata from
+// its header.
+func Open(r io.Reader) (io.ReadCloser, *Info, error) {
+	var hbuf bytes.Buffer
+	info, err := ReadInfo(io.TeeReader(r, &hbuf))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	zr, err := cgzip.NewReader(io.MultiReader(&hbuf, r))
+	if err != nil {
+		return nil, nil, err
+	}
+	return zr, info, nil
+}
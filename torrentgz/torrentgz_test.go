@@ -0,0 +1,172 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package torrentgz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	where := 0
+	for where < size {
+		toFill := rand.Intn(16)
+		filler := 0x61 + rand.Intn(24)
+		for i := 0; i < toFill && where < size; i++ {
+			content[where] = byte(filler)
+			where++
+		}
+	}
+	return content
+}
+
+func TestWriteVerify(t *testing.T) {
+	content := testContent(256 * 1024)
+
+	var buf bytes.Buffer
+	info, err := Write(&buf, bytes.NewReader(content), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	md5sum := md5.Sum(content)
+	sha1sum := sha1.Sum(content)
+	crc := crc32.ChecksumIEEE(content)
+
+	header := []byte{0x1f, 0x8b, 0x08, 0x04, 0, 0, 0, 0, 0x00, 0xff, 28, 0}
+	header = append(header, md5sum[:]...)
+	header = append(header, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(content)))
+	header = append(header, size[:]...)
+
+	if !bytes.HasPrefix(buf.Bytes(), header) {
+		t.Fatalf("torrentgz header differs: got % x, want % x", buf.Bytes()[:len(header)], header)
+	}
+	if !bytes.Equal(info.SHA1, sha1sum[:]) {
+		t.Errorf("Write returned wrong sha1")
+	}
+
+	gr, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, content) {
+		t.Fatalf("decompressed torrentgz differs from content")
+	}
+
+	hinfo, err := ReadInfo(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hinfo.MD5, md5sum[:]) || hinfo.CRC32 != crc || hinfo.Size != uint64(len(content)) {
+		t.Errorf("ReadInfo returned wrong metadata")
+	}
+
+	vinfo, err := Verify(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(vinfo.SHA1, sha1sum[:]) {
+		t.Errorf("Verify returned wrong sha1")
+	}
+
+	corrupt := append([]byte(nil), buf.Bytes()...)
+	corrupt[12] ^= 0xff
+	if _, err := Verify(bytes.NewReader(corrupt)); err != ErrChecksum {
+		t.Errorf("Verify of corrupt header returned %v, want %v", err, ErrChecksum)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	content := testContent(64 * 1024)
+
+	var b1, b2 bytes.Buffer
+	if _, err := Write(&b1, bytes.NewReader(content), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Write(&b2, bytes.NewReader(content), ""); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b1.Bytes(), b2.Bytes()) {
+		t.Errorf("torrentgz output is not deterministic")
+	}
+
+	if _, err := ReadInfo(bytes.NewReader([]byte("not a gzip file"))); err != ErrFormat {
+		t.Errorf("ReadInfo of garbage returned %v, want %v", err, ErrFormat)
+	}
+}
+
+// testdata/bottles.gz was written by a script calling zlib directly with
+// the header layout of RomVault's TorrentGZ files, independently of this
+// package.
+func TestGolden(t *testing.T) {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", "bottles.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden, err := ioutil.ReadFile(filepath.Join("testdata", "bottles.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := Write(&buf, bytes.NewReader(content), ""); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), golden) {
+		t.Errorf("torrentgz of bottles.txt differs from golden")
+	}
+
+	info, err := Verify(bytes.NewReader(golden))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md5sum := md5.Sum(content)
+	sha1sum := sha1.Sum(content)
+	if !bytes.Equal(info.MD5, md5sum[:]) || !bytes.Equal(info.SHA1, sha1sum[:]) ||
+		info.CRC32 != crc32.ChecksumIEEE(content) || info.Size != uint64(len(content)) {
+		t.Errorf("Verify of golden returned wrong metadata")
+	}
+}
@@ -33,7 +33,6 @@ package torrentzip
 import (
 	"bufio"
 	"encoding/binary"
-	"encoding/hex"
 	"hash/crc32"
 	"io"
 	"io/ioutil"
@@ -57,6 +56,7 @@ const (
 
 	zipVersion20 = 20 // 2.0
 	zipVersion45 = 45 // 4.5 (reads and writes zip64 archives)
+	zipVersion63 = 63 // 6.3 (zstd, lzma and other newer compression methods)
 
 	directory64LocSignature = 0x07064b50
 	directory64EndSignature = 0x06064b50
@@ -72,10 +72,19 @@ const (
 )
 
 type Writer struct {
-	uw   *czip.Writer
-	sink io.Writer
-	tf   *os.File
-	bf   *bufio.Writer
+	uw      *czip.Writer
+	sink    io.Writer
+	tf      *os.File
+	bf      *bufio.Writer
+	tempDir string
+	depth   int
+	nested  func(err *NestedError) error
+	spool   *spoolEntry
+	profile *Profile
+
+	// nestedFailed is set once a nested archive failed with an error
+	// that is returned rather than stored.
+	nestedFailed bool
 }
 
 func NewWriter(w io.Writer) (*Writer, error) {
@@ -83,7 +92,13 @@ func NewWriter(w io.Writer) (*Writer, error) {
 }
 
 func NewWriterWithTemp(w io.Writer, tempDir string) (*Writer, error) {
-	r := new(Writer)
+	return NewWriterWithProfile(w, tempDir, TorrentZip)
+}
+
+// NewWriterWithProfile returns a Writer that writes a zip file in the
+// format described by p to w.
+func NewWriterWithProfile(w io.Writer, tempDir string, p *Profile) (*Writer, error) {
+	r := &Writer{profile: p}
 
 	tf, err := ioutil.TempFile(tempDir, "torrentzip")
 	if err != nil {
@@ -93,6 +108,7 @@ func NewWriterWithTemp(w io.Writer, tempDir string) (*Writer, error) {
 	r.bf = bufio.NewWriter(r.tf)
 
 	r.sink = w
+	r.tempDir = tempDir
 	r.uw = czip.NewWriter(r.bf)
 	return r, nil
 }
@@ -124,8 +140,27 @@ func torrentCanonicalName(name string) string {
 	return name
 }
 
+// Close finishes the zip file and writes it out. The temp files of w are
+// removed whether it succeeds or not.
 func (w *Writer) Close() error {
-	err := w.uw.Close()
+	err := w.close()
+	w.abort()
+	return err
+}
+
+// Abort discards the zip file and removes the temp files of w. Nothing is
+// written to the underlying writer.
+func (w *Writer) Abort() {
+	w.abort()
+}
+
+func (w *Writer) close() error {
+	err := w.flushSpool()
+	if err != nil {
+		return err
+	}
+
+	err = w.uw.Close()
 	if err != nil {
 		return err
 	}
@@ -144,6 +179,7 @@ func (w *Writer) Close() error {
 	if err != nil {
 		return err
 	}
+	defer r.Close()
 
 	fis := make(fileIndices, len(r.File))
 
@@ -164,7 +200,7 @@ func (w *Writer) Close() error {
 		fh := r.File[fi.index]
 		fh.Extra = nil
 		fi.offset = cw.count
-		err = writeHeader(cw, fh, fi.name)
+		err = writeHeader(cw, fh, fi.name, w.profile)
 		if err != nil {
 			return err
 		}
@@ -186,7 +222,7 @@ func (w *Writer) Close() error {
 	for _, fi := range fis {
 		fh := r.File[fi.index]
 		fh.Extra = nil
-		err = writeCentralHeader(mw, fh, fi.name, fi.offset)
+		err = writeCentralHeader(mw, fh, fi.name, fi.offset, w.profile)
 		if err != nil {
 			return err
 		}
@@ -245,41 +281,26 @@ func (w *Writer) Close() error {
 	b.uint16(uint16(records))
 	b.uint32(uint32(size))
 	b.uint32(uint32(offset))
-	b.uint16(22)
+	b.uint16(uint16(w.profile.commentLen()))
 
-	zipcomment := "TORRENTZIPPED-" + strings.ToUpper(hex.EncodeToString(dircrc.Sum(nil)))
+	zipcomment := w.profile.comment(dircrc.Sum(nil))
 
 	if _, err := cw.Write(buf[:]); err != nil {
 		return err
 	}
-	if _, err := io.WriteString(cw, zipcomment); err != nil {
-		return err
-	}
-
-	if err := r.Close(); err != nil {
-		return err
-	}
-
-	if err := os.Remove(w.tf.Name()); err != nil {
-		return err
-	}
-
-	return nil
+	_, err = io.WriteString(cw, zipcomment)
+	return err
 }
 
-func writeHeader(w io.Writer, h *czip.File, canonicalName string) error {
+func writeHeader(w io.Writer, h *czip.File, canonicalName string, p *Profile) error {
 	var buf [fileHeaderLen]byte
 	b := writeBuf(buf[:])
 	b.uint32(uint32(fileHeaderSignature))
-	if isZip64(h) {
-		b.uint16(zipVersion45)
-	} else {
-		b.uint16(zipVersion20)
-	}
-	b.uint16(2)
-	b.uint16(8)
-	b.uint16(48128)
-	b.uint16(8600)
+	b.uint16(p.readerVersion(isZip64(h)))
+	b.uint16(p.Flags)
+	b.uint16(p.Method)
+	b.uint16(p.ModifiedTime)
+	b.uint16(p.ModifiedDate)
 	b.uint32(h.CRC32)
 	if isZip64(h) {
 		// the file needs a zip64 header. store maxint in both
@@ -312,20 +333,16 @@ func writeHeader(w io.Writer, h *czip.File, canonicalName string) error {
 	return err
 }
 
-func writeCentralHeader(w io.Writer, h *czip.File, canonicalName string, offset int64) error {
+func writeCentralHeader(w io.Writer, h *czip.File, canonicalName string, offset int64, p *Profile) error {
 	var buf [directoryHeaderLen]byte
 	b := writeBuf(buf[:])
 	b.uint32(uint32(directoryHeaderSignature))
 	b.uint16(creatorFAT)
-	if isZip64(h) || offset > uint32max {
-		b.uint16(zipVersion45)
-	} else {
-		b.uint16(zipVersion20)
-	}
-	b.uint16(2)
-	b.uint16(8)
-	b.uint16(48128)
-	b.uint16(8600)
+	b.uint16(p.readerVersion(isZip64(h) || offset > uint32max))
+	b.uint16(p.Flags)
+	b.uint16(p.Method)
+	b.uint16(p.ModifiedTime)
+	b.uint16(p.ModifiedDate)
 	b.uint32(h.CRC32)
 
 	if h.CompressedSize64 > uint32max {
@@ -409,7 +426,20 @@ func isZip64(h *czip.File) bool {
 }
 
 func (w *Writer) Create(name string) (io.Writer, error) {
-	return w.uw.Create(name)
+	if err := w.flushSpool(); err != nil {
+		return nil, err
+	}
+	if w.depth > 0 {
+		return w.createSpool(name)
+	}
+	return w.create(name)
+}
+
+func (w *Writer) create(name string) (io.Writer, error) {
+	return w.uw.CreateHeader(&czip.FileHeader{
+		Name:   name,
+		Method: w.profile.Method,
+	})
 }
 
 type writeBuf []byte